@@ -4,8 +4,6 @@ import (
 	"context"
 	"flag"
 	"fmt"
-
-	"github.com/sourcegraph/src-cli/internal/cmderrors"
 )
 
 func init() {
@@ -13,6 +11,11 @@ func init() {
 'src batch apply' is used to apply a batch spec on a Sourcegraph instance,
 creating or updating the described batch change if necessary.
 
+The title, body, branch and commit message of the changesetTemplate can
+reference environment variables as ${env:NAME}, such as ${env:CI_PIPELINE_ID}.
+They're expanded before the steps are executed, and referencing a variable
+that isn't set is an error.
+
 Usage:
 
     src batch apply [command options] [-f FILE]
@@ -51,7 +54,7 @@ Examples:
 
 			applyBatchSpec: true,
 		}); err != nil {
-			return cmderrors.ExitCode(1, nil)
+			return batchExitCode(err)
 		}
 
 		return nil
@@ -63,7 +66,7 @@ Examples:
 		usageFunc: func() {
 			fmt.Fprintf(flag.CommandLine.Output(), "Usage of 'src batch %s':\n", flagSet.Name())
 			flagSet.PrintDefaults()
-			fmt.Println(usage)
+			fmt.Println(usage + batchExitCodesUsage)
 		},
 	})
 }
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -12,11 +14,14 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/mattn/go-isatty"
+	"github.com/pkg/browser"
 
 	"github.com/sourcegraph/sourcegraph/lib/errors"
 	"github.com/sourcegraph/sourcegraph/lib/output"
@@ -63,7 +68,7 @@ func newBatchExecutionFlags(flagSet *flag.FlagSet) *batchExecutionFlags {
 	)
 	flagSet.BoolVar(
 		&bef.clearCache, "clear-cache", false,
-		"If true, clears the execution cache and executes all steps anew.",
+		"If true, clears all cached results of the batch change and executes all steps anew. The cached results of other batch changes in the same cache directory are kept.",
 	)
 	flagSet.BoolVar(
 		&bef.skipErrors, "skip-errors", false,
@@ -86,21 +91,152 @@ func newBatchExecutionFlags(flagSet *flag.FlagSet) *batchExecutionFlags {
 type batchExecuteFlags struct {
 	*batchExecutionFlags
 
-	apply         bool
-	cacheDir      string
-	tempDir       string
-	file          string
-	keepLogs      bool
-	parallelism   int
-	timeout       time.Duration
-	workspace     string
-	cleanArchives bool
-	skipErrors    bool
-	runAsRoot     bool
+	apply          bool
+	cacheDir       string
+	tempDir        string
+	file           string
+	keepLogs       bool
+	keepWorkspaces string
+	parallelism    int
+	timeout        time.Duration
+	workspace      string
+	cleanArchives  bool
+	skipErrors     bool
+	runAsRoot      bool
+
+	// Maximum number of attempts to download a repository archive.
+	archiveFetchAttempts int
 
 	// If true, fail fast on first error instead of continuing execution
 	failFast bool
 
+	// Comma-separated list of repository names to limit execution to.
+	onlyRepos string
+	// File with the repository names to limit execution to, one per line.
+	repoList string
+
+	// Maximum number of workspaces that are executed.
+	maxWorkspaces int
+
+	// If true, cached results that can't be read are treated as misses.
+	ignoreCacheReadErrors bool
+
+	// If true, step output is also written to stdout.
+	streamLogs bool
+
+	// Format of the log files, "text" or "json".
+	logFormat string
+
+	// If true, the phases of every workspace are timed.
+	verboseTimings bool
+
+	// If true, consecutive steps share a container.
+	reuseContainers bool
+
+	// If true, the diffs of the changeset specs are checked to apply before
+	// they're uploaded.
+	verifySpecs bool
+
+	// If true, the images of the steps are pinned to their digests before
+	// the steps are executed.
+	pinImages bool
+
+	// What to do about changeset specs with the same title: "ignore",
+	// "warn" or "error".
+	duplicateTitles string
+
+	// Waves to split the workspaces into, and the wave to execute.
+	waves string
+	wave  string
+
+	// Comma-separated list of directories to spread workspaces across.
+	tempDirs string
+
+	// If true, changeset specs are uploaded as soon as their task finished.
+	uploadConcurrently bool
+	// Minimum time between the starts of two changeset spec uploads.
+	uploadInterval time.Duration
+
+	// How the steps are executed, "docker" or "local".
+	runner string
+
+	// Maximum random delay of the start of the first workspaces.
+	startJitter time.Duration
+
+	// File the changeset specs are written to as soon as they're built.
+	writeSpecs string
+
+	// File the events of the run are appended to as lines of JSON.
+	eventLog string
+
+	// Directory the current status of every workspace is kept in.
+	statusDir string
+
+	// File the steps are read from instead of the batch spec, "-" for stdin.
+	steps string
+
+	// File a summary of the run is written to.
+	writeSummary string
+
+	// File the cache keys of the run are compared to and recorded in.
+	cacheKeys string
+
+	// Comma-separated key=value metadata of the run.
+	annotations string
+	// ID that ties the run to the system that started it.
+	correlationID string
+
+	// Template appended to the body of every changeset.
+	bodyFooter string
+
+	// CODEOWNERS-style file that maps changed files to commit authors.
+	authorOwners string
+
+	// Labels derived from the changed files, as a list of key=label pairs.
+	fileLabels string
+
+	// Commit author, as "Name <email>", if the template doesn't specify one.
+	defaultAuthor string
+
+	// Workspaces whose diff changes fewer lines are treated as unchanged.
+	minChangedLines int
+
+	// If true, workspaces whose steps don't change anything fail.
+	requireChanges bool
+
+	// Number of git processes that compute the diff of a workspace.
+	diffParallelism int
+
+	// Options of the diffs of the workspaces.
+	diffContextLines int
+	diffNoRenames    bool
+	diffNoBinary     bool
+
+	// Limit of the disk space used by all workspaces, such as "50GB".
+	maxWorkspaceDisk string
+
+	// Size of the diffs of a workspace above which they're kept on disk
+	// instead of in memory, such as "10MB".
+	spillDiffsOver string
+
+	// Directory the diffs of the workspaces are written to as patches.
+	writePatches string
+
+	// File an HTML report of the workspaces and their changesets is written
+	// to, and whether to open it in the browser.
+	htmlReport     string
+	openHTMLReport bool
+
+	// If true, diffs are normalized before they're cached and used.
+	normalizeDiffs bool
+
+	// Shell command run whenever a workspace completed.
+	onTaskComplete string
+	// If true, a failing onTaskComplete command fails the workspace.
+	failOnTaskCompleteError bool
+
+	lintSteps lintStepsFlags
+
 	// EXPERIMENTAL
 	textOnly bool
 }
@@ -125,9 +261,18 @@ func newBatchExecuteFlags(flagSet *flag.FlagSet, cacheDir, tempDir string) *batc
 		"Retain logs after executing steps.",
 	)
 
+	flagSet.StringVar(
+		&caf.keepWorkspaces, "keep-workspaces", string(executor.KeepWorkspacesNone),
+		"Retain the workspaces of executed steps for inspection: none, on-failure or all. Only supported with -workspace bind.",
+	)
+
 	flagSet.StringVar(
 		&caf.cacheDir, "cache", cacheDir,
-		"Directory for caching results and repository archives.",
+		"Directory for caching results and repository archives. Defaults to $SRC_BATCH_CACHE_DIR if it's set.",
+	)
+	flagSet.StringVar(
+		&caf.cacheDir, "cache-dir", cacheDir,
+		"Alias for -cache.",
 	)
 
 	flagSet.StringVar(
@@ -154,12 +299,22 @@ func newBatchExecuteFlags(flagSet *flag.FlagSet, cacheDir, tempDir string) *batc
 		&caf.cleanArchives, "clean-archives", true,
 		"If true, deletes downloaded repository archives after executing batch spec steps. Note that only the archives related to the actual repositories matched by the batch spec will be cleaned up, and clean up will not occur if src exits unexpectedly.",
 	)
+	flagSet.IntVar(
+		&caf.archiveFetchAttempts, "archive-fetch-attempts", repozip.DefaultFetchAttempts,
+		"The maximum number of attempts to download a repository archive. Downloads that fail with a network error, a server error or an incomplete archive are retried with an exponential backoff; other errors, like a missing repository or an invalid access token, fail the workspace right away.",
+	)
 
 	flagSet.StringVar(
 		&caf.workspace, "workspace", "auto",
 		`Workspace mode to use ("auto", "bind", or "volume")`,
 	)
 
+	flagSet.StringVar(
+		&caf.runner, "runner", string(executor.RunnerDocker),
+		`How to execute the steps: "docker" executes each step in a container of its image. "local" executes the steps directly on this machine, in the workspace directory, and ignores their containers. `+
+			`WARNING: with "local", steps aren't isolated in any way: they can read and change all files and use all credentials of your user. Only use it with batch specs you trust.`,
+	)
+
 	flagSet.BoolVar(verbose, "v", false, "print verbose output")
 
 	flagSet.BoolVar(
@@ -172,11 +327,252 @@ func newBatchExecuteFlags(flagSet *flag.FlagSet, cacheDir, tempDir string) *batc
 		"Halts execution immediately upon first error instead of continuing with other tasks.",
 	)
 
+	flagSet.StringVar(
+		&caf.onlyRepos, "only-repos", "",
+		"Comma-separated list of repository names. If set, only workspaces in these repositories are executed. Repositories that are ignored or unsupported are still skipped. Listed repositories without workspaces, such as misspelled ones, are reported.",
+	)
+	flagSet.StringVar(
+		&caf.repoList, "repo-list", "",
+		"If set, only workspaces in the repositories listed in this file are executed, in addition to the limits of -only-repos and -wave. The file lists one repository name per line, and lines or the rest of lines starting with # are comments. Listed repositories without workspaces, such as misspelled ones, are reported.",
+	)
+
+	flagSet.IntVar(
+		&caf.maxWorkspaces, "max-workspaces", 0,
+		"If set, only the first workspaces up to this number are executed, such as 5, to try out a batch spec with a broad query on a few repositories. Unlike -j, it limits the total number of workspaces, not the ones executed at once.",
+	)
+
+	flagSet.BoolVar(
+		&caf.ignoreCacheReadErrors, "ignore-cache-read-errors", false,
+		"If true, cached results that can't be read, for example because they're corrupt, are ignored and the steps are executed again, instead of failing the workspace.",
+	)
+
+	flagSet.StringVar(
+		&caf.waves, "waves", "",
+		"Comma-separated list of waves to split the workspaces into, in the form name=size, for example \"canary=10,rest\". The last wave can omit the size to contain all remaining workspaces. "+
+			"Workspaces are assigned to waves in the order of their repository names and paths, so the same workspaces end up in the same waves every time.",
+	)
+
+	flagSet.StringVar(
+		&caf.wave, "wave", "",
+		"If set, only the workspaces in the wave with this name, as defined by -waves, are executed. Results are cached as usual, so workspaces of earlier waves aren't executed again.",
+	)
+
+	flagSet.StringVar(
+		&caf.tempDirs, "tmp-dirs", "",
+		"Comma-separated list of directories, for example on different disks, to spread the workspaces and temporary files of the executed steps across. If set, used instead of -tmp for those files.",
+	)
+
+	flagSet.BoolVar(
+		&caf.streamLogs, "stream-logs", false,
+		"If true, also writes the output of all steps to standard output, each line prefixed with the repository name. Ignored with -text-only.",
+	)
+
+	flagSet.StringVar(
+		&caf.logFormat, "log-format", "text",
+		"The format of the log files of the workspaces. \"text\" writes the lines of output with their time, \"json\" writes a header with the repository, revision and steps of the workspace, followed by every line of output, as JSON objects on lines of their own. Doesn't affect -stream-logs.",
+	)
+
+	flagSet.BoolVar(
+		&caf.verboseTimings, "verbose-timings", false,
+		"If true, logs when the download of the repository archive, the creation of the workspace, every step and the diff of every step start and end, relative to the start of the workspace, to the log file of the workspace, and prints the total time every workspace spent in each of these phases and in caching its results.",
+	)
+
+	flagSet.BoolVar(
+		&caf.reuseContainers, "reuse-containers", false,
+		"If true, consecutive steps of a workspace that use the same image, network, CPU and memory settings, and don't mount files, are executed in one container with `docker exec`, rather than in a new container each. Files that a step creates outside of the workspace are then visible to the later steps, but not when execution resumes from the cached results of a step.",
+	)
+
+	flagSet.BoolVar(
+		&caf.verifySpecs, "verify-specs", false,
+		"If true, checks that the commits of every changeset spec apply cleanly to the revision it's based on, in a new workspace of that revision, before the changeset specs are uploaded, and fails with a list of the repositories whose changes don't apply. Can't be combined with -upload-concurrently.",
+	)
+	flagSet.BoolVar(
+		&caf.pinImages, "pin-images", false,
+		"If true, resolves the tag of every step image to the digest of the image it refers to after pulling it, and executes all steps with the image by digest, so that the run is reproducible even if a tag such as latest is moved during it. Cached results of other images aren't used, and the digests are written to the -write-summary file. Images that weren't pulled from a registry aren't pinned.",
+	)
+	flagSet.StringVar(
+		&caf.duplicateTitles, "duplicate-titles", "ignore",
+		`What to do if changeset specs in different repositories, or on different branches, have the same title, which usually means that the title template of the batch spec is too generic: "ignore", "warn" to list them, or "error" to fail before uploading the changeset specs.`,
+	)
+
+	flagSet.BoolVar(
+		&caf.uploadConcurrently, "upload-concurrently", false,
+		"If true, uploads the changeset specs of each workspace as soon as its execution finished, while the other workspaces are still being executed.",
+	)
+	flagSet.DurationVar(
+		&caf.uploadInterval, "upload-interval", 0,
+		"If set, waits at least this long between the starts of two changeset spec uploads, including retries and the uploads of -upload-concurrently, so that the Sourcegraph instance and the code hosts aren't flooded with changesets. For batch changes with more than 1000 workspaces, 100ms to 250ms is recommended.",
+	)
+
+	flagSet.StringVar(
+		&caf.writeSpecs, "write-specs", "",
+		"If set, writes every changeset spec to this file as a line of JSON as soon as it's built, so that the file contains the specs of all finished workspaces even if the execution is aborted.",
+	)
+	flagSet.StringVar(
+		&caf.eventLog, "event-log", "",
+		"If set, appends an event to this file as a line of JSON for every state transition of every workspace: enqueued, started, served from the cache, each step started, skipped, finished or failed, and completed or failed, with a timestamp and the repository.",
+	)
+	flagSet.StringVar(
+		&caf.statusDir, "status-dir", "",
+		"If set, keeps the current status of every workspace in this directory as a JSON file, which is replaced atomically on every state transition, so that other processes can follow the run.",
+	)
+
+	flagSet.StringVar(
+		&caf.writeSummary, "write-summary", "",
+		"If set, writes a JSON summary of the run to this file after the batch spec was created: the Sourcegraph instance, the version of src, and the IDs and URLs of the batch spec, its changeset specs and the batch change, so that the changesets can be traced back to the run later.",
+	)
+	flagSet.StringVar(
+		&caf.cacheKeys, "cache-keys", "",
+		"If set, records the inputs of the cache key of every workspace in this file, such as the revision and the run script and image of every step. If the file was written by an earlier run, the workspaces that aren't served from the cache are listed with the inputs that changed since, such as \"step 2 run\".",
+	)
+
+	flagSet.StringVar(
+		&caf.annotations, "annotations", "",
+		"Comma-separated list of key=value pairs that describe the run, such as \"team=platform,ticket=PLAT-123\". They're written to the start of the log file of every workspace and to the -write-summary file, and don't affect the execution or the cache.",
+	)
+
+	flagSet.StringVar(
+		&caf.correlationID, "correlation-id", "",
+		"If set, passes this ID, such as the trace ID of a CI job, to every step in the SRC_CORRELATION_ID environment variable, and writes it to the start of the log file of every workspace, to every event of -event-log and to the -write-summary file. It doesn't affect the cache.",
+	)
+
+	flagSet.StringVar(
+		&caf.steps, "steps", "",
+		"If set, reads the steps from this file instead of the batch spec, or from standard input if it's -. The file contains a list of steps, or an object with steps and a changesetTemplate that replaces the one of the batch spec, so that the steps can be generated by another program.",
+	)
+
+	flagSet.DurationVar(
+		&caf.startJitter, "start-jitter", 0,
+		"If set, delays the start of each of the first -j workspaces by a random duration up to this, such as 2s, so that they don't all start at the same time.",
+	)
+
+	flagSet.StringVar(
+		&caf.bodyFooter, "body-footer", "",
+		"Text appended to the body of every changeset, such as a disclaimer. Supports the same templating variables as changesetTemplate.body, including ${{ batch_change_link }}.",
+	)
+
+	flagSet.StringVar(
+		&caf.authorOwners, "author-owners", "",
+		"If set, the commit author of changesets whose changesetTemplate doesn't specify one is read from this CODEOWNERS-style file, whose owners are authors in the form \"Name <email>\". If the changed files have different or no owners, -default-author is used.",
+	)
+	flagSet.StringVar(
+		&caf.fileLabels, "file-labels", "",
+		"If set, every workspace that produces changeset specs is labeled by the files it changes, and the labels are written to the -write-summary file, so that the changesets can be filtered by language. Comma-separated list of extension=label or filename=label pairs, such as \".go=lang:go,Dockerfile=docker\". \"default\" adds labels for common languages, which later pairs can override, or remove with an empty label.",
+	)
+
+	flagSet.StringVar(
+		&caf.defaultAuthor, "default-author", "",
+		"If set, the commit author, in the form \"Name <email>\", of changesets whose changesetTemplate doesn't specify one and that have no single owner in -author-owners. Otherwise the Sourcegraph default author is used.",
+	)
+
+	flagSet.IntVar(
+		&caf.minChangedLines, "min-changed-lines", 0,
+		"If set, no changeset specs are created for workspaces whose changes add and remove fewer lines than this in total, for example if they only touch whitespace. Changes to binary files or renames are never filtered.",
+	)
+
+	flagSet.BoolVar(
+		&caf.requireChanges, "require-changes", false,
+		"If true, workspaces whose steps produce no changes fail instead of being skipped, including ones whose empty result is cached. Use it for batch changes that must change every repository, to find the ones the steps missed.",
+	)
+
+	flagSet.StringVar(
+		&caf.maxWorkspaceDisk, "max-workspace-disk", "",
+		"If set, limits the estimated disk space used by all workspaces at the same time, such as 50GB. Workspaces wait to be created while the limit is reached, so fewer than -j workspaces may be executed at once.",
+	)
+
+	flagSet.StringVar(
+		&caf.spillDiffsOver, "spill-diffs-over", "",
+		"If set, the diffs of a finished workspace that are larger than this size, such as 10MB, are kept in files in -tmp until its changeset specs are uploaded, instead of in memory. Use it to bound the memory used by many workspaces with large diffs.",
+	)
+
+	flagSet.StringVar(
+		&caf.writePatches, "write-patches", "",
+		"If set, writes the diff of every workspace that changeset specs are created for to this directory as a .patch file, including cached ones, next to a .json file with the repository and base revision it applies to. The patches can be reviewed and applied with git apply without Sourcegraph.",
+	)
+	flagSet.StringVar(
+		&caf.htmlReport, "html-report", "",
+		"If set, writes an HTML page to this file after execution that lists every workspace with its outcome and the repository, title, published state and diff of its changesets, for a quick review. Long diffs are truncated, with a link to the full patch if -write-patches is set.",
+	)
+	flagSet.BoolVar(
+		&caf.openHTMLReport, "open-html-report", false,
+		"If true, opens the -html-report file in the browser once it's written.",
+	)
+
+	flagSet.IntVar(
+		&caf.diffParallelism, "diff-parallelism", 1,
+		"The number of git processes that compute the diff of a workspace after each step, split by directory. Speeds up steps that change thousands of files in large repositories. Only used with -workspace bind.",
+	)
+
+	flagSet.IntVar(
+		&caf.diffContextLines, "diff-context-lines", workspace.DefaultDiffContextLines,
+		"The number of lines of context around the changes in the diffs of the workspaces. Results that were cached with a different number are not used.",
+	)
+	flagSet.BoolVar(
+		&caf.diffNoRenames, "diff-no-renames", false,
+		"If true, renamed files are diffed as a deleted and an added file. Results that were cached without it are not used.",
+	)
+	flagSet.BoolVar(
+		&caf.diffNoBinary, "diff-no-binary", false,
+		"If true, the diffs of the workspaces only say that binary files differ, rather than containing their contents, so that changesets can't change binary files. Only cached results of complete executions are used, since such diffs can't be applied to resume the execution after a cached step.",
+	)
+
+	flagSet.BoolVar(
+		&caf.normalizeDiffs, "normalize-diffs", false,
+		"If true, the diffs of workspaces are normalized before they're cached and used to create changeset specs: files are sorted by path, and hunks get at most 3 lines of context. This avoids changeset updates when steps produce the same changes in a different form.",
+	)
+
+	flagSet.StringVar(
+		&caf.onTaskComplete, "on-task-complete", "",
+		"Shell command to run whenever a workspace completed, including workspaces served from the cache. It's run with sh -c, one at a time, and receives the diff on standard input and "+
+			"SRC_TASK_REPOSITORY, SRC_TASK_PATH, SRC_TASK_STATUS (succeeded, failed or cached) and SRC_TASK_ERROR in its environment.",
+	)
+	flagSet.BoolVar(
+		&caf.failOnTaskCompleteError, "fail-on-task-complete-error", false,
+		"If true, a failing -on-task-complete command fails the workspace. Otherwise, its error is only written to the log of the workspace.",
+	)
+
+	caf.lintSteps.register(flagSet)
+
 	return caf
 }
 
 var errAdditionalArguments = cmderrors.Usage("additional arguments not allowed")
 
+// lintStepsFlags are the flags of the commands that can lint the run scripts of
+// the steps in a batch spec before executing them.
+type lintStepsFlags struct {
+	enabled bool
+	linter  string
+}
+
+func (f *lintStepsFlags) register(flagSet *flag.FlagSet) {
+	flagSet.BoolVar(
+		&f.enabled, "lint-steps", false,
+		"If true, checks the run scripts of the steps for common shell mistakes, such as unquoted variables, and prints warnings.",
+	)
+	flagSet.StringVar(
+		&f.linter, "step-linter", "",
+		"Shell command, such as 'shellcheck -s bash -', that's run with every step script on standard input when -lint-steps is set. Its output is printed as warnings if it exits with a non-zero exit code.",
+	)
+}
+
+// lint prints warnings for the findings of executor.LintSteps if linting is
+// enabled. Findings don't fail the command.
+func (f *lintStepsFlags) lint(ctx context.Context, spec *batcheslib.BatchSpec, execUI ui.ExecUI) error {
+	if !f.enabled {
+		return nil
+	}
+
+	findings, err := executor.LintSteps(ctx, spec.Steps, f.linter)
+	if err != nil {
+		return err
+	}
+	if len(findings) > 0 {
+		execUI.StepLintFindings(findings)
+	}
+	return nil
+}
+
 func getBatchSpecFile(flagSet *flag.FlagSet, fileFlag *string) (string, error) {
 	if fileFlag == nil || *fileFlag != "" {
 		if flagSet.NArg() != 0 {
@@ -192,14 +588,29 @@ func getBatchSpecFile(flagSet *flag.FlagSet, fileFlag *string) (string, error) {
 	return flagSet.Arg(0), nil
 }
 
+// batchDefaultCacheDir returns the directory in which results and repository
+// archives are cached, unless -cache is set. If the environment variable
+// SRC_BATCH_CACHE_DIR is set, that is used. Otherwise it's sourcegraph/batch in
+// $XDG_CACHE_HOME, or in the user cache directory of the OS if $XDG_CACHE_HOME
+// isn't set.
 func batchDefaultCacheDir() string {
-	uc, err := os.UserCacheDir()
-	if err != nil {
-		return ""
+	if p := os.Getenv("SRC_BATCH_CACHE_DIR"); p != "" {
+		return p
+	}
+
+	// Relative paths in $XDG_CACHE_HOME are invalid and must be ignored,
+	// according to the XDG Base Directory Specification.
+	base := os.Getenv("XDG_CACHE_HOME")
+	if !filepath.IsAbs(base) {
+		var err error
+		if base, err = os.UserCacheDir(); err != nil {
+			// Without a home directory, the cache at least outlives the
+			// command in the temporary directory.
+			return filepath.Join(os.TempDir(), "sourcegraph-batch-cache")
+		}
 	}
-	dir := path.Join(uc, "sourcegraph", "batch")
 
-	return dir
+	return filepath.Join(base, "sourcegraph", "batch")
 }
 
 // batchDefaultTempDirPrefix returns the prefix to be passed to ioutil.TempFile.
@@ -273,10 +684,57 @@ func createDockerWatchdog(ctx context.Context, execUI ui.ExecUI) *watchdog.Watch
 	})
 }
 
+// batchExitCodes are the exit codes of 'src batch apply' and 'src batch
+// preview' if all Tasks that failed failed for the same reason.
+var batchExitCodes = map[executor.TaskErrorKind]int{
+	executor.TaskErrorStep:      3,
+	executor.TaskErrorTimeout:   4,
+	executor.TaskErrorWorkspace: 5,
+	executor.TaskErrorCancelled: 6,
+	executor.TaskErrorNoChanges: 7,
+}
+
+// batchExitCodesUsage documents the exit codes in the usage of the commands
+// that execute batch specs.
+const batchExitCodesUsage = `Exit codes:
+
+    1  the batch spec couldn't be executed, or tasks failed for different reasons
+    2  the batch spec is invalid
+    3  steps failed
+    4  tasks timed out
+    5  workspaces couldn't be created
+    6  tasks were cancelled
+    7  tasks didn't produce changes, with -require-changes
+`
+
+// batchExitCode returns the error with the exit code of the failed execution
+// of a batch spec, which is described by batchExitCodesUsage. The error itself
+// has already been printed by executeBatchSpec.
+func batchExitCode(err error) *cmderrors.ExitCodeError {
+	var exitErr *cmderrors.ExitCodeError
+	if errors.As(err, &exitErr) {
+		return cmderrors.ExitCode(exitErr.Code(), nil)
+	}
+
+	var runErrs *executor.RunErrors
+	if errors.As(err, &runErrs) && len(runErrs.Other) == 0 {
+		if kinds := runErrs.ByKind(); len(kinds) == 1 {
+			for kind := range kinds {
+				if code, ok := batchExitCodes[kind]; ok {
+					return cmderrors.ExitCode(code, nil)
+				}
+			}
+		}
+	}
+	return cmderrors.ExitCode(1, nil)
+}
+
 // executeBatchSpec performs all the steps required to upload the batch spec to
 // Sourcegraph, including execution as needed and applying the resulting batch
 // spec if specified.
 func executeBatchSpec(ctx context.Context, opts executeBatchSpecOpts) (err error) {
+	startedAt := time.Now()
+
 	var execUI ui.ExecUI
 	if opts.flags.textOnly {
 		execUI = &ui.JSONLines{}
@@ -285,11 +743,25 @@ func executeBatchSpec(ctx context.Context, opts executeBatchSpecOpts) (err error
 		execUI = &ui.TUI{Out: out}
 	}
 
-	w := createDockerWatchdog(ctx, execUI)
-	go w.Start()
+	runner, err := executor.ParseRunner(opts.flags.runner)
+	if err != nil {
+		return cmderrors.Usagef("invalid -runner: %s", err)
+	}
+	local := runner == executor.RunnerLocal
+	if local && opts.flags.workspace == "volume" {
+		return cmderrors.Usage("-runner local can't be used with -workspace volume")
+	}
+	if local && opts.flags.pinImages {
+		return cmderrors.Usage("-runner local can't be used with -pin-images, since the local runner doesn't use images")
+	}
+
+	if !local {
+		w := createDockerWatchdog(ctx, execUI)
+		go w.Start()
+		defer w.Stop()
+	}
 
 	defer func() {
-		w.Stop()
 		if err != nil {
 			execUI.ExecutionError(err)
 		}
@@ -308,6 +780,7 @@ func executeBatchSpec(ctx context.Context, opts executeBatchSpecOpts) (err error
 	if opts.flags.textOnly && ffs.BinaryDiffs {
 		execUI = &ui.JSONLines{BinaryDiffs: true}
 	}
+	execUI.FeatureFlags(ffs)
 
 	imageCache := docker.NewImageCache()
 
@@ -326,13 +799,23 @@ func executeBatchSpec(ctx context.Context, opts executeBatchSpecOpts) (err error
 	// In the past, we relied on `getBatchParallelism` to ascertain if docker is running,
 	// however, we don't always check for the number of CPUs (especially when the -j parallelis)
 	// flag is passed. This is a more explicit check to confirm docker is working.
-	if err := docker.CheckVersion(ctx); err != nil {
-		return err
-	}
+	// Steps executed on the host don't need Docker at all.
+	var parallelism int
+	if local {
+		parallelism = opts.flags.parallelism
+		if parallelism <= 0 {
+			parallelism = executor.AutoParallelism(runtime.NumCPU(), 0)
+		}
+	} else {
+		if err := docker.CheckVersion(ctx); err != nil {
+			return err
+		}
 
-	parallelism, err := getBatchParallelism(ctx, opts.flags.parallelism)
-	if err != nil {
-		return err
+		parallelism, err = getBatchParallelism(ctx, opts.flags.parallelism)
+		if err != nil {
+			return err
+		}
+		warnOnExcessiveParallelism(ctx, execUI, parallelism)
 	}
 
 	// On Linux only, we also need to figure out if we need to override the
@@ -343,7 +826,7 @@ func executeBatchSpec(ctx context.Context, opts executeBatchSpecOpts) (err error
 	// points here, but that feels like overkill. Basically, if it's
 	// desktop-linux, we'll just assume the user has the default /home mount
 	// available and go from there.
-	if runtime.GOOS == "linux" && opts.flags.tempDir == batchDefaultTempDirPrefix() {
+	if !local && runtime.GOOS == "linux" && opts.flags.tempDir == batchDefaultTempDirPrefix() {
 		context, err := docker.CurrentContext(ctx)
 		if err != nil {
 			return err
@@ -357,9 +840,139 @@ func executeBatchSpec(ctx context.Context, opts executeBatchSpecOpts) (err error
 		}
 	}
 
+	if err := template.ValidateChangesetTemplateField("body footer", opts.flags.bodyFooter); err != nil {
+		return cmderrors.Usage(err.Error())
+	}
+
+	var defaultAuthor *batcheslib.ChangesetSpecAuthor
+	if opts.flags.defaultAuthor != "" {
+		if defaultAuthor, err = executor.ParseAuthor(opts.flags.defaultAuthor); err != nil {
+			return cmderrors.Usagef("invalid -default-author: %s", err)
+		}
+	}
+	fileLabels, err := executor.ParseFileLabels(opts.flags.fileLabels)
+	if err != nil {
+		return cmderrors.Usagef("invalid -file-labels: %s", err)
+	}
+	var authorOwners *executor.AuthorOwners
+	if opts.flags.authorOwners != "" {
+		if authorOwners, err = readAuthorOwners(opts.flags.authorOwners); err != nil {
+			return cmderrors.Usagef("invalid -author-owners: %s", err)
+		}
+	}
+	var repoList []string
+	if opts.flags.repoList != "" {
+		if repoList, err = readRepoList(opts.flags.repoList); err != nil {
+			return cmderrors.Usagef("invalid -repo-list: %s", err)
+		}
+		if len(repoList) == 0 {
+			return cmderrors.Usagef("-repo-list %s doesn't list any repositories", opts.flags.repoList)
+		}
+	}
+
+	if opts.flags.minChangedLines < 0 {
+		return cmderrors.Usage("-min-changed-lines must not be negative")
+	}
+	var maxWorkspaceDisk uint64
+	if opts.flags.maxWorkspaceDisk != "" {
+		if maxWorkspaceDisk, err = humanize.ParseBytes(opts.flags.maxWorkspaceDisk); err != nil || maxWorkspaceDisk == 0 {
+			return cmderrors.Usagef("invalid -max-workspace-disk %q: must be a size such as 50GB", opts.flags.maxWorkspaceDisk)
+		}
+	}
+	var spillDiffsOver uint64
+	if opts.flags.spillDiffsOver != "" {
+		if spillDiffsOver, err = humanize.ParseBytes(opts.flags.spillDiffsOver); err != nil || spillDiffsOver == 0 {
+			return cmderrors.Usagef("invalid -spill-diffs-over %q: must be a size such as 10MB", opts.flags.spillDiffsOver)
+		}
+	}
+	annotations, err := parseAnnotations(opts.flags.annotations)
+	if err != nil {
+		return err
+	}
+	if opts.flags.diffParallelism < 1 {
+		return cmderrors.Usage("-diff-parallelism must be at least 1")
+	}
+	switch opts.flags.duplicateTitles {
+	case "ignore", "warn", "error":
+	default:
+		return cmderrors.Usagef(`-duplicate-titles must be "ignore", "warn" or "error", not %q`, opts.flags.duplicateTitles)
+	}
+	if opts.flags.verifySpecs && opts.flags.uploadConcurrently {
+		return cmderrors.Usage("-verify-specs can't be combined with -upload-concurrently, which uploads the changeset specs before they can be verified")
+	}
+	if opts.flags.diffContextLines < 1 {
+		return cmderrors.Usage("-diff-context-lines must be at least 1")
+	}
+	if opts.flags.archiveFetchAttempts < 1 {
+		return cmderrors.Usage("-archive-fetch-attempts must be at least 1")
+	}
+	var logFormatter log.Formatter
+	switch opts.flags.logFormat {
+	case "text":
+	case "json":
+		logFormatter = log.JSONFormatter{}
+	default:
+		return cmderrors.Usagef("invalid -log-format %q: must be text or json", opts.flags.logFormat)
+	}
+	if opts.flags.maxWorkspaces < 0 {
+		return cmderrors.Usage("-max-workspaces must not be negative")
+	}
+	if opts.flags.startJitter < 0 {
+		return cmderrors.Usage("-start-jitter must not be negative")
+	}
+	if opts.flags.uploadInterval < 0 {
+		return cmderrors.Usage("-upload-interval must not be negative")
+	}
+	if opts.flags.openHTMLReport && opts.flags.htmlReport == "" {
+		return cmderrors.Usage("-open-html-report requires -html-report")
+	}
+	uploadSpec := executor.PaceUploads(svc.CreateChangesetSpec, opts.flags.uploadInterval)
+	if opts.flags.steps == "-" && (opts.file == "" || opts.file == "-") {
+		return cmderrors.Usage("the batch spec and -steps can't both be read from standard input")
+	}
+
+	keepWorkspaces, err := executor.ParseKeepWorkspaces(opts.flags.keepWorkspaces)
+	if err != nil {
+		return cmderrors.Usagef("invalid -keep-workspaces: %s", err)
+	}
+
+	waves, err := executor.ParseWaves(opts.flags.waves)
+	if err != nil {
+		return cmderrors.Usagef("invalid -waves: %s", err)
+	}
+	if opts.flags.wave != "" && !slices.ContainsFunc(waves, func(w executor.Wave) bool { return w.Name == opts.flags.wave }) {
+		return cmderrors.Usagef("-wave %q is not defined by -waves", opts.flags.wave)
+	}
+
+	cacheDir, err := filepath.Abs(opts.flags.cacheDir)
+	if err != nil {
+		return errors.Wrapf(err, "resolving cache directory %s", opts.flags.cacheDir)
+	}
+	if err := os.MkdirAll(cacheDir, 0o700); err != nil {
+		return errors.Wrapf(err, "creating cache directory %s", cacheDir)
+	}
+	opts.flags.cacheDir = cacheDir
+	execUI.CacheDirectory(cacheDir)
+
+	tempDirs := splitFlagList(opts.flags.tempDirs)
+	for _, dir := range tempDirs {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return errors.Wrapf(err, "creating temporary directory %s", dir)
+		}
+	}
+
 	// Parse flags and build up our service and executor options.
 	execUI.ParsingBatchSpec()
 	batchSpec, batchSpecDir, rawSpec, err := parseBatchSpec(ctx, opts.file, svc)
+	if err == nil && opts.flags.steps != "" {
+		rawSpec, err = replaceBatchSpecSteps(ctx, batchSpec, batchSpecDir, opts.flags.steps, svc)
+	}
+	if err == nil {
+		err = service.ExpandChangesetTemplateEnv(batchSpec.ChangesetTemplate, os.LookupEnv)
+	}
+	if err == nil && !local {
+		err = service.ValidateStepImages(batchSpec)
+	}
 	if err != nil {
 		var multiErr errors.MultiError
 		if errors.As(err, &multiErr) {
@@ -373,6 +986,10 @@ func executeBatchSpec(ctx context.Context, opts executeBatchSpecOpts) (err error
 	}
 	execUI.ParsingBatchSpecSuccess()
 
+	if err := opts.flags.lintSteps.lint(ctx, batchSpec, execUI); err != nil {
+		return err
+	}
+
 	if batchSpec.Version == 3 {
 		return errors.New("batch spec version 3 is not supported for local execution, please run server-side")
 	}
@@ -385,24 +1002,54 @@ func executeBatchSpec(ctx context.Context, opts executeBatchSpecOpts) (err error
 	execUI.ResolvingNamespaceSuccess(namespace.ID)
 
 	var workspaceCreator workspace.Creator
-
-	if len(batchSpec.Steps) > 0 {
+	var pinnedImages []service.PinnedImage
+
+	if len(batchSpec.Steps) > 0 && local {
+		// The local runner doesn't use images, and executes the steps in
+		// workspaces on the host.
+		execUI.LocalRunnerWarning()
+		workspaceCreator, _ = workspace.NewCreator(ctx, "bind", opts.flags.cacheDir, opts.flags.tempDir, nil)
+	} else if len(batchSpec.Steps) > 0 {
 		execUI.PreparingContainerImages()
 		images, err := svc.EnsureDockerImages(
 			ctx,
 			imageCache,
-			batchSpec.Steps,
+			append(slices.Clone(batchSpec.Steps), batchSpec.Finally...),
 			parallelism,
 			execUI.PreparingContainerImagesProgress,
 		)
 		if err != nil {
 			return err
 		}
+		if opts.flags.pinImages {
+			if pinnedImages, err = service.PinStepImages(ctx, batchSpec); err != nil {
+				return err
+			}
+			// The pinned references refer to the images that were just
+			// pulled, so this only looks them up.
+			if images, err = svc.EnsureDockerImages(
+				ctx,
+				imageCache,
+				append(slices.Clone(batchSpec.Steps), batchSpec.Finally...),
+				parallelism,
+				func(done, total int) {},
+			); err != nil {
+				return err
+			}
+		}
 		execUI.PreparingContainerImagesSuccess()
 
 		execUI.DeterminingWorkspaceCreatorType()
+		preference := opts.flags.workspace
+		if batchSpec.Checkout != nil {
+			// Only workspaces on the host can be cloned into.
+			if preference == "volume" {
+				return cmderrors.Usage("-workspace volume can't be used with a batch spec that sets checkout")
+			}
+			preference = "bind"
+		}
 		var typ workspace.CreatorType
-		workspaceCreator, typ = workspace.NewCreator(ctx, opts.flags.workspace, opts.flags.cacheDir, opts.flags.tempDir, images)
+		workspaceCreator, typ = workspace.NewCreator(ctx, preference, opts.flags.cacheDir, opts.flags.tempDir, images)
 		if typ == workspace.CreatorTypeVolume {
 			// This creator type requires an additional image, so let's ensure it exists.
 			_, err = imageCache.Ensure(ctx, workspace.DockerVolumeWorkspaceImage)
@@ -427,30 +1074,109 @@ func executeBatchSpec(ctx context.Context, opts executeBatchSpecOpts) (err error
 		execUI.DeterminingWorkspacesSuccess(len(workspaces), len(repos), nil, nil)
 	}
 
-	archiveRegistry := repozip.NewArchiveRegistry(opts.client, opts.flags.cacheDir, opts.flags.cleanArchives)
+	archiveRegistry := repozip.NewArchiveRegistryWithAttempts(opts.client, opts.flags.cacheDir, opts.flags.cleanArchives, opts.flags.archiveFetchAttempts)
 	logManager := log.NewDiskManager(opts.flags.tempDir, opts.flags.keepLogs)
+	var logStream *log.Stream
+	if opts.flags.streamLogs && !opts.flags.textOnly {
+		logStream = log.NewStream(os.Stdout)
+	}
+	var specsWriter io.Writer
+	if opts.flags.writeSpecs != "" {
+		f, err := os.Create(opts.flags.writeSpecs)
+		if err != nil {
+			return errors.Wrap(err, "creating changeset specs file")
+		}
+		defer f.Close()
+		specsWriter = f
+	}
+	var eventWriter io.Writer
+	if opts.flags.eventLog != "" {
+		f, err := os.OpenFile(opts.flags.eventLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return errors.Wrap(err, "opening event log")
+		}
+		defer f.Close()
+		eventWriter = f
+	}
+	var statusStore executor.StatusStore
+	if opts.flags.statusDir != "" {
+		if statusStore, err = executor.NewFileStatusStore(opts.flags.statusDir); err != nil {
+			return err
+		}
+	} else if opts.flags.htmlReport != "" {
+		// The HTML report shows the final status of every workspace.
+		statusStore = executor.NewMemoryStatusStore()
+	}
 	coord := executor.NewCoordinator(
 		executor.NewCoordinatorOpts{
 			ExecOpts: executor.NewExecutorOpts{
-				Logger:              logManager,
-				RepoArchiveRegistry: archiveRegistry,
-				Creator:             workspaceCreator,
-				EnsureImage:         imageCache.Ensure,
-				Parallelism:         parallelism,
-				WorkingDirectory:    batchSpecDir,
-				Timeout:             opts.flags.timeout,
-				TempDir:             opts.flags.tempDir,
-				GlobalEnv:           os.Environ(),
-				ForceRoot:           opts.flags.runAsRoot,
-				FailFast:            opts.flags.failFast,
-				BinaryDiffs:         ffs.BinaryDiffs,
+				Logger:                     logManager,
+				RepoArchiveRegistry:        archiveRegistry,
+				Creator:                    workspaceCreator,
+				EnsureImage:                imageCache.Ensure,
+				Parallelism:                parallelism,
+				WorkingDirectory:           batchSpecDir,
+				Timeout:                    opts.flags.timeout,
+				TempDir:                    opts.flags.tempDir,
+				TempDirs:                   tempDirs,
+				GlobalEnv:                  os.Environ(),
+				ForceRoot:                  opts.flags.runAsRoot,
+				FailFast:                   opts.flags.failFast,
+				MaxTasks:                   opts.flags.maxWorkspaces,
+				CacheReadFailuresAreMisses: opts.flags.ignoreCacheReadErrors,
+				Waves:                      waves,
+				Wave:                       opts.flags.wave,
+				LogStream:                  logStream,
+				EventWriter:                eventWriter,
+				StatusStore:                statusStore,
+				LogFormatter:               logFormatter,
+				Annotations:                annotations,
+				CorrelationID:              opts.flags.correlationID,
+				VerboseTimings:             opts.flags.verboseTimings,
+				MinChangedLines:            opts.flags.minChangedLines,
+				RequireChanges:             opts.flags.requireChanges,
+				DiffParallelism:            opts.flags.diffParallelism,
+				DiffOptions: workspace.DiffOptions{
+					ContextLines: opts.flags.diffContextLines,
+					NoRenames:    opts.flags.diffNoRenames,
+					NoBinary:     opts.flags.diffNoBinary,
+				},
+				ReuseContainers:       opts.flags.reuseContainers,
+				MaxWorkspaceDiskBytes: int64(maxWorkspaceDisk),
+				PatchOutputDir:        opts.flags.writePatches,
+				SpillDiffsOver:        int64(spillDiffsOver),
+				NormalizeDiff:         opts.flags.normalizeDiffs,
+				OnTaskComplete:        taskCompleteCommand(opts.flags.onTaskComplete),
+				FailOnTaskCompleteErr: opts.flags.failOnTaskCompleteError,
+				SecretResolver:        secretFromEnv,
+				KeepWorkspaces:        keepWorkspaces,
+				StartJitter:           opts.flags.startJitter,
+				BinaryDiffs:           ffs.BinaryDiffs,
 			},
 			Logger:      logManager,
 			Cache:       executor.NewDiskCache(opts.flags.cacheDir),
 			BinaryDiffs: ffs.BinaryDiffs,
 			GlobalEnv:   os.Environ(),
+			BodyFooter:  opts.flags.bodyFooter,
+
+			OnlyRepos: splitFlagList(opts.flags.onlyRepos),
+			RepoList:  repoList,
+
+			DefaultAuthor: defaultAuthor,
+			AuthorOwners:  authorOwners,
+			FileLabels:    fileLabels,
+
+			ResolveRepository: svc.ResolveRepository,
+
+			UploadConcurrently: opts.flags.uploadConcurrently,
+			UploadSpec:         uploadSpec,
+			SpecsWriter:        specsWriter,
+			OnCacheHit: func(task *executor.Task, specs []*batcheslib.ChangesetSpec) {
+				execUI.TaskCached(task, len(specs))
+			},
 		},
 	)
+	defer coord.RemoveSpilledDiffs()
 
 	execUI.CheckingCache()
 	tasks := svc.BuildTasks(
@@ -461,6 +1187,31 @@ func executeBatchSpec(ctx context.Context, opts executeBatchSpecOpts) (err error
 		batchSpec.Steps,
 		workspaces,
 	)
+	for _, t := range tasks {
+		t.Runner = runner
+		t.Precondition = batchSpec.Precondition
+		t.Finally = batchSpec.Finally
+		t.Checkout = batchSpec.Checkout
+	}
+	if len(opts.flags.onlyRepos) > 0 || len(repoList) > 0 || opts.flags.wave != "" {
+		var skipped int
+		tasks, skipped = coord.FilterTasks(tasks)
+		execUI.FilteringTasksSuccess(len(tasks), skipped)
+		if missing := coord.MissingListedRepos(); len(missing) > 0 {
+			execUI.ListedReposNotFound(missing)
+		}
+	}
+	if opts.flags.maxWorkspaces > 0 {
+		var dropped int
+		if tasks, dropped = coord.LimitTasks(tasks); dropped > 0 {
+			execUI.TasksLimited(opts.flags.maxWorkspaces, dropped)
+		}
+	}
+	if batchSpec.ChangesetTemplate != nil && batchSpec.ChangesetTemplate.UpdateBranch {
+		if err := svc.ResolveHeadBranches(ctx, batchSpec.ChangesetTemplate, tasks); err != nil {
+			return err
+		}
+	}
 	var (
 		specs         []*batcheslib.ChangesetSpec
 		uncachedTasks []*executor.Task
@@ -477,10 +1228,36 @@ func executeBatchSpec(ctx context.Context, opts executeBatchSpecOpts) (err error
 			return err
 		}
 	}
+	if opts.flags.cacheKeys != "" {
+		if err := recordCacheKeys(opts.flags.cacheKeys, coord, tasks, uncachedTasks, execUI, !opts.flags.clearCache); err != nil {
+			return err
+		}
+	}
 	execUI.CheckingCacheSuccess(len(specs), len(uncachedTasks))
+	execUI.CacheStats(coord.CacheStats())
 
 	taskExecUI := execUI.ExecutingTasks(*verbose, parallelism)
+	if dumper, ok := taskExecUI.(ui.StatusDumper); ok {
+		stop := dumpStatusOnSignal(dumper, coord.InFlight)
+		defer stop()
+	}
+	stopPausing := pauseOnSignal(coord)
+	defer stopPausing()
 	freshSpecs, logFiles, execErr := coord.ExecuteAndBuildSpecs(ctx, batchSpec, uncachedTasks, taskExecUI)
+	execUI.RunReport(coord.Report())
+	// The report is written even if the execution failed, so that the
+	// failures can be reviewed too.
+	if opts.flags.htmlReport != "" {
+		if err := writeHTMLReport(opts.flags.htmlReport, coord); err != nil {
+			return err
+		}
+		execUI.HTMLReportWritten(opts.flags.htmlReport)
+		if opts.flags.openHTMLReport {
+			// The path of the report was printed, so it can still be opened
+			// by hand if there's no browser.
+			_ = browser.OpenFile(opts.flags.htmlReport)
+		}
+	}
 	// Add external changeset specs.
 	importedSpecs, importErr := svc.CreateImportChangesetSpecs(ctx, batchSpec)
 	if execErr != nil {
@@ -489,43 +1266,87 @@ func executeBatchSpec(ctx context.Context, opts executeBatchSpecOpts) (err error
 	if importErr != nil {
 		err = errors.Append(err, importErr)
 	}
-	if err != nil && !opts.flags.skipErrors {
-		return err
-	}
-	if err == nil || opts.flags.skipErrors {
-		if err == nil {
-			taskExecUI.Success()
-		} else {
-			execUI.ExecutingTasksSkippingErrors(err)
-		}
-	} else {
-		if err != nil {
-			taskExecUI.Failed(err)
+	// Both stop the status updates of the TUI.
+	if err != nil {
+		taskExecUI.Failed(err)
+		if !opts.flags.skipErrors {
+			printKeptWorkspaces(execUI, uncachedTasks)
+			printCleanupErrors(execUI, uncachedTasks)
 			return err
 		}
+		execUI.ExecutingTasksSkippingErrors(err)
+	} else {
+		taskExecUI.Success()
+	}
+
+	if filtered := coord.FilteredTasks(); filtered > 0 {
+		execUI.TasksBelowMinChangedLines(filtered, opts.flags.minChangedLines)
 	}
 
 	if len(logFiles) > 0 && opts.flags.keepLogs {
 		execUI.LogFilesKept(logFiles)
 	}
+	printKeptWorkspaces(execUI, uncachedTasks)
+	printCleanupErrors(execUI, uncachedTasks)
 
 	specs = append(specs, freshSpecs...)
 	specs = append(specs, importedSpecs...)
 
+	// The changesets declared by the outputs of steps can be in repositories
+	// no workspace is in.
+	repos = append(repos, coord.AdditionalRepositories()...)
+
 	err = svc.ValidateChangesetSpecs(repos, specs)
 	if err != nil {
 		return err
 	}
+	if opts.flags.duplicateTitles != "ignore" {
+		var dupErr *service.DuplicateTitlesErr
+		if err := svc.CheckChangesetTitles(repos, specs); errors.As(err, &dupErr) {
+			if opts.flags.duplicateTitles == "error" {
+				return err
+			}
+			execUI.DuplicateChangesetTitles(dupErr.Duplicates)
+		}
+	}
+
+	if opts.flags.verifySpecs && len(specs) > 0 {
+		execUI.VerifyingChangesetSpecs(len(specs))
+		if err := coord.VerifySpecs(ctx, tasks, specs); err != nil {
+			execUI.VerifyingChangesetSpecsFailure(err)
+			return err
+		}
+		execUI.VerifyingChangesetSpecsSuccess()
+	}
 
 	ids := make([]graphql.ChangesetSpecID, len(specs))
+	// The content hashes of the changeset specs are only recorded in the
+	// summary.
+	var hashes map[graphql.ChangesetSpecID]string
+	if opts.flags.writeSummary != "" {
+		hashes = make(map[graphql.ChangesetSpecID]string, len(specs))
+	}
 
 	if len(specs) > 0 {
 		execUI.UploadingChangesetSpecs(len(specs))
 
 		for i, spec := range specs {
-			id, err := svc.CreateChangesetSpec(ctx, spec)
-			if err != nil {
-				return err
+			id, ok := coord.UploadedChangesetSpecID(spec)
+			if !ok || hashes != nil {
+				spec, err := coord.LoadChangesetSpec(spec)
+				if err != nil {
+					return err
+				}
+				if !ok {
+					if id, err = executor.UploadChangesetSpec(ctx, uploadSpec, spec); err != nil {
+						return err
+					}
+				}
+				if hashes != nil {
+					if hashes[id], err = spec.ContentHash(); err != nil {
+						return errors.Wrapf(err, "hashing changeset spec %s", id)
+					}
+				}
 			}
 			ids[i] = id
 			execUI.UploadingChangesetSpecsProgress(i+1, len(specs))
@@ -544,6 +1365,17 @@ func executeBatchSpec(ctx context.Context, opts executeBatchSpecOpts) (err error
 	previewURL := cfg.endpointURL.JoinPath(url).String()
 	execUI.CreatingBatchSpecSuccess(previewURL)
 
+	summary := newBatchRunSummary(cfg.endpointURL.String(), startedAt)
+	summary.BatchSpecName = batchSpec.Name
+	summary.BatchSpecID = id
+	summary.ChangesetSpecIDs = ids
+	summary.ChangesetSpecHashes = hashes
+	summary.PreviewURL = previewURL
+	summary.Workspaces = coord.Report()
+	summary.Annotations = summary.Workspaces.Annotations
+	summary.CorrelationID = opts.flags.correlationID
+	summary.Images = pinnedImages
+
 	hasWorkspaceFiles := false
 	for _, step := range batchSpec.Steps {
 		if len(step.Mount) > 0 {
@@ -563,6 +1395,9 @@ func executeBatchSpec(ctx context.Context, opts executeBatchSpecOpts) (err error
 
 	if !opts.applyBatchSpec {
 		execUI.PreviewBatchSpec(previewURL)
+		if opts.flags.writeSummary != "" {
+			return summary.write(opts.flags.writeSummary)
+		}
 		return
 	}
 
@@ -571,8 +1406,13 @@ func executeBatchSpec(ctx context.Context, opts executeBatchSpecOpts) (err error
 	if err != nil {
 		return err
 	}
-	execUI.ApplyingBatchSpecSuccess(cfg.endpointURL.JoinPath(batch.URL).String())
+	batchChangeURL := cfg.endpointURL.JoinPath(batch.URL).String()
+	execUI.ApplyingBatchSpecSuccess(batchChangeURL)
 
+	if opts.flags.writeSummary != "" {
+		summary.BatchChangeURL = batchChangeURL
+		return summary.write(opts.flags.writeSummary)
+	}
 	return nil
 }
 
@@ -614,6 +1454,40 @@ func parseBatchSpec(ctx context.Context, file string, svc *service.Service) (*ba
 	return spec, dir, string(data), err
 }
 
+// replaceBatchSpecSteps replaces the steps of spec, and its changesetTemplate if
+// one is given, with the ones read from file. It returns the raw batch spec
+// with the new steps, since the original one doesn't match the changeset specs
+// anymore.
+func replaceBatchSpecSteps(ctx context.Context, spec *batcheslib.BatchSpec, dir, file string, svc *service.Service) (string, error) {
+	f, err := batchOpenFileFlag(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	setReadDeadlineOnCancel(ctx, f)
+
+	steps, changesetTemplate, err := svc.ParseSteps(dir, f)
+	if err != nil {
+		return "", err
+	}
+	spec.Steps = steps
+	if changesetTemplate != nil {
+		spec.ChangesetTemplate = changesetTemplate
+	}
+	if len(spec.Steps) > 0 && spec.ChangesetTemplate == nil {
+		return "", batcheslib.NewValidationError(errors.New("batch spec includes steps but no changesetTemplate"))
+	}
+
+	raw, err := json.Marshal(spec)
+	if err != nil {
+		return "", errors.Wrap(err, "marshalling batch spec")
+	}
+	return string(raw), nil
+}
+
 func getBatchSpecDirectory(file string) (string, error) {
 	var workingDirectory string
 	var err error
@@ -649,7 +1523,9 @@ func checkExecutable(cmd string, args ...string) error {
 func contextCancelOnInterrupt(parent context.Context) (context.Context, func()) {
 	ctx, ctxCancel := context.WithCancel(parent)
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	// SIGTERM is what CI runners and process managers send when they stop
+	// a job, so we treat it like an interrupt to clean up after ourselves.
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
 	go func() {
 		select {
@@ -665,12 +1541,95 @@ func contextCancelOnInterrupt(parent context.Context) (context.Context, func())
 	}
 }
 
+// taskCompleteCommand returns a NewExecutorOpts.OnTaskComplete hook that runs
+// the given shell command, or nil if command is empty.
+func taskCompleteCommand(command string) func(executor.TaskCompletion) error {
+	if command == "" {
+		return nil
+	}
+
+	return func(c executor.TaskCompletion) error {
+		status, errText := "succeeded", ""
+		if c.Err != nil {
+			status, errText = "failed", c.Err.Error()
+		} else if c.Cached {
+			status = "cached"
+		}
+
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Env = append(os.Environ(),
+			"SRC_TASK_REPOSITORY="+c.Task.Repository.Name,
+			"SRC_TASK_PATH="+c.Task.Path,
+			"SRC_TASK_STATUS="+status,
+			"SRC_TASK_ERROR="+errText,
+		)
+		cmd.Stdin = bytes.NewReader(c.Diff)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return errors.Wrapf(err, "running %q:\n%s", command, out)
+		}
+		return nil
+	}
+}
+
+// printKeptWorkspaces points the user at the workspaces of the given tasks
+// that were kept because of -keep-workspaces.
+func printKeptWorkspaces(execUI ui.ExecUI, tasks []*executor.Task) {
+	var kept []*executor.Task
+	for _, task := range tasks {
+		if task.KeptWorkspace != "" {
+			kept = append(kept, task)
+		}
+	}
+	if len(kept) > 0 {
+		execUI.WorkspacesKept(kept)
+	}
+}
+
+// secretFromEnv is the NewExecutorOpts.SecretResolver of src, which reads the
+// secrets that steps reference from the environment src is running in.
+func secretFromEnv(name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", errors.Newf("environment variable %s is not set", name)
+	}
+	return value, nil
+}
+
+// splitFlagList parses the value of a flag that takes a comma-separated list,
+// such as -only-repos.
+func splitFlagList(flag string) []string {
+	var values []string
+	for value := range strings.SplitSeq(flag, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
 func getBatchParallelism(ctx context.Context, flag int) (int, error) {
 	if flag > 0 {
 		return flag, nil
 	}
 
-	return docker.NCPU(ctx)
+	info, err := docker.GetInfo(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return executor.AutoParallelism(info.CPUs(), info.Memory()), nil
+}
+
+// warnOnExcessiveParallelism shows a warning if the given parallelism is
+// likely too high for the CPUs and memory available to Docker. Failing to
+// determine those isn't fatal, since the warning is only advisory.
+func warnOnExcessiveParallelism(ctx context.Context, execUI ui.ExecUI, parallelism int) {
+	info, err := docker.GetInfo(ctx)
+	if err != nil {
+		return
+	}
+	if err := executor.CheckParallelism(parallelism, info.CPUs(), info.Memory()); err != nil {
+		execUI.ParallelismWarning(err)
+	}
 }
 
 func validateSourcegraphVersionConstraint(ffs *batches.FeatureFlags) error {
@@ -679,3 +1638,97 @@ func validateSourcegraphVersionConstraint(ffs *batches.FeatureFlags) error {
 	}
 	return errors.Newf("\n\n * Warning:\n This version of src-cli requires Sourcegraph version 4.0 or newer. If you're not on Sourcegraph 4.0 or newer, please use the 3.x release of src-cli that corresponds to your Sourcegraph version.\n\n")
 }
+
+// parseAnnotations parses the value of -annotations.
+func parseAnnotations(flag string) (map[string]string, error) {
+	var annotations map[string]string
+	for _, pair := range splitFlagList(flag) {
+		key, value, ok := strings.Cut(pair, "=")
+		if key = strings.TrimSpace(key); !ok || key == "" {
+			return nil, cmderrors.Usagef("invalid -annotations entry %q: must be key=value", pair)
+		}
+		if annotations == nil {
+			annotations = make(map[string]string)
+		}
+		annotations[key] = strings.TrimSpace(value)
+	}
+	return annotations, nil
+}
+
+// recordCacheKeys writes the cache keys of tasks to path. If explain is set
+// and path holds the cache keys of an earlier run, the uncached Tasks are
+// compared to it first.
+func recordCacheKeys(path string, coord *executor.Coordinator, tasks, uncached []*executor.Task, execUI ui.ExecUI, explain bool) error {
+	record, err := coord.CacheKeyRecord(tasks)
+	if err != nil {
+		return err
+	}
+
+	if explain {
+		data, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "reading cache keys")
+		}
+		if err == nil {
+			var prev executor.CacheKeyRecord
+			if err := json.Unmarshal(data, &prev); err != nil {
+				return errors.Wrapf(err, "reading cache keys from %s", path)
+			}
+			execUI.CacheMisses(record.ExplainMisses(prev, uncached))
+		}
+	}
+
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshalling cache keys")
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return errors.Wrap(err, "writing cache keys")
+	}
+	return nil
+}
+
+// readAuthorOwners parses the CODEOWNERS-style file at path.
+func readAuthorOwners(path string) (*executor.AuthorOwners, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return executor.ParseAuthorOwners(f)
+}
+
+func writeHTMLReport(path string, coord *executor.Coordinator) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Wrap(err, "creating HTML report")
+	}
+	if err := coord.WriteHTMLReport(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readRepoList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return executor.ParseRepoList(f)
+}
+
+// printCleanupErrors warns the user about the tasks whose workspace couldn't
+// be deleted.
+func printCleanupErrors(execUI ui.ExecUI, tasks []*executor.Task) {
+	var failed []*executor.Task
+	for _, task := range tasks {
+		if task.CleanupErr != nil {
+			failed = append(failed, task)
+		}
+	}
+	if len(failed) > 0 {
+		execUI.WorkspaceCleanupFailed(failed)
+	}
+}
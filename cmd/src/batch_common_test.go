@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+
+	"github.com/sourcegraph/src-cli/internal/batches/executor"
+	"github.com/sourcegraph/src-cli/internal/cmderrors"
+)
+
+func TestBatchExitCode(t *testing.T) {
+	taskErr := func(repo string, err error) executor.TaskExecutionErr {
+		return executor.TaskExecutionErr{Repository: repo, Err: err}
+	}
+	workspaceErr := executor.WorkspaceCreationErr{Err: errors.New("fetching repo")}
+
+	tests := map[string]struct {
+		err  error
+		want int
+	}{
+		"other error": {
+			err:  errors.New("uploading changeset specs"),
+			want: 1,
+		},
+		"invalid batch spec": {
+			err:  cmderrors.ExitCode(2, nil),
+			want: 2,
+		},
+		"workspace errors": {
+			err:  &executor.RunErrors{Tasks: []executor.TaskExecutionErr{taskErr("a", workspaceErr), taskErr("b", workspaceErr)}},
+			want: 5,
+		},
+		"cancellation": {
+			err:  &executor.RunErrors{Tasks: []executor.TaskExecutionErr{taskErr("a", executor.ErrTaskCancelled)}},
+			want: 6,
+		},
+		"no changes": {
+			err:  errors.Wrap(&executor.RunErrors{Tasks: []executor.TaskExecutionErr{taskErr("a", executor.ErrNoChanges)}}, "executing"),
+			want: 7,
+		},
+		"different kinds": {
+			err:  &executor.RunErrors{Tasks: []executor.TaskExecutionErr{taskErr("a", workspaceErr), taskErr("b", executor.ErrNoChanges)}},
+			want: 1,
+		},
+		"unknown kind": {
+			err:  &executor.RunErrors{Tasks: []executor.TaskExecutionErr{taskErr("a", errors.New("unknown"))}},
+			want: 1,
+		},
+		"other errors of the run": {
+			err:  &executor.RunErrors{Tasks: []executor.TaskExecutionErr{taskErr("a", workspaceErr)}, Other: []error{context.Canceled}},
+			want: 1,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := batchExitCode(tc.err)
+			if have := err.Code(); have != tc.want {
+				t.Errorf("wrong exit code. want=%d, have=%d", tc.want, have)
+			}
+			if err.HasError() {
+				t.Errorf("error wasn't dropped: %s", err)
+			}
+		})
+	}
+}
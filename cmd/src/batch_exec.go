@@ -213,6 +213,7 @@ func executeBatchSpecInWorkspaces(ctx context.Context, flags *executorModeFlags)
 		RepoArchive:      &repozip.NoopArchive{},
 		UI:               taskExecUI.StepsExecutionUI(task),
 		ForceRoot:        !flags.runAsImageUser,
+		SecretResolver:   secretFromEnv,
 		BinaryDiffs:      flags.binaryDiffs,
 	}
 	results, err := executor.RunSteps(ctx, opts)
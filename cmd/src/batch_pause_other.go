@@ -0,0 +1,10 @@
+//go:build !(aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris)
+
+package main
+
+import "github.com/sourcegraph/src-cli/internal/batches/executor"
+
+// pauseOnSignal is a no-op on platforms without SIGUSR2.
+func pauseOnSignal(coord *executor.Coordinator) func() {
+	return func() {}
+}
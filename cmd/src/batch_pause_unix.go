@@ -0,0 +1,44 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/sourcegraph/src-cli/internal/batches/executor"
+)
+
+// pauseOnSignal pauses the execution of new workspaces whenever the process
+// receives SIGUSR2, and resumes it when it receives SIGUSR2 again. Running
+// workspaces aren't affected. The returned function stops listening for the
+// signal.
+func pauseOnSignal(coord *executor.Coordinator) func() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR2)
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-c:
+				if coord.Paused() {
+					coord.Resume()
+					fmt.Fprintln(os.Stderr, "Resumed: starting new workspaces again.")
+				} else {
+					coord.Pause()
+					fmt.Fprintln(os.Stderr, "Paused: no new workspaces are started until SIGUSR2 is received again.")
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(c)
+		close(done)
+	}
+}
@@ -4,8 +4,6 @@ import (
 	"context"
 	"flag"
 	"fmt"
-
-	"github.com/sourcegraph/src-cli/internal/cmderrors"
 )
 
 func init() {
@@ -13,6 +11,11 @@ func init() {
 'src batch preview' executes the steps in a batch spec and uploads it to a
 Sourcegraph instance, ready to be previewed and applied.
 
+The title, body, branch and commit message of the changesetTemplate can
+reference environment variables as ${env:NAME}, such as ${env:CI_PIPELINE_ID}.
+They're expanded before the steps are executed, and referencing a variable
+that isn't set is an error.
+
 Usage:
 
     src batch preview [command options] [-f FILE]
@@ -50,7 +53,7 @@ Examples:
 			// Do not apply the uploaded batch spec
 			applyBatchSpec: false,
 		}); err != nil {
-			return cmderrors.ExitCode(1, nil)
+			return batchExitCode(err)
 		}
 
 		return nil
@@ -62,7 +65,7 @@ Examples:
 		usageFunc: func() {
 			fmt.Fprintf(flag.CommandLine.Output(), "Usage of 'src batch %s':\n", flagSet.Name())
 			flagSet.PrintDefaults()
-			fmt.Println(usage)
+			fmt.Println(usage + batchExitCodesUsage)
 		},
 	})
 }
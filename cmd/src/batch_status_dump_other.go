@@ -0,0 +1,13 @@
+//go:build !(aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris)
+
+package main
+
+import (
+	"github.com/sourcegraph/src-cli/internal/batches/executor"
+	"github.com/sourcegraph/src-cli/internal/batches/ui"
+)
+
+// dumpStatusOnSignal is a no-op on platforms without SIGUSR1.
+func dumpStatusOnSignal(dumper ui.StatusDumper, inFlight func() []executor.TaskStatus) func() {
+	return func() {}
+}
@@ -0,0 +1,37 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/sourcegraph/src-cli/internal/batches/executor"
+	"github.com/sourcegraph/src-cli/internal/batches/ui"
+)
+
+// dumpStatusOnSignal renders the status of the tasks returned by inFlight to
+// stderr whenever the process receives SIGUSR1. The returned function stops
+// listening for the signal.
+func dumpStatusOnSignal(dumper ui.StatusDumper, inFlight func() []executor.TaskStatus) func() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-c:
+				dumper.DumpStatus(os.Stderr, inFlight())
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(c)
+		close(done)
+	}
+}
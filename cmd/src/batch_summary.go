@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+
+	"github.com/sourcegraph/src-cli/internal/batches/executor"
+	"github.com/sourcegraph/src-cli/internal/batches/graphql"
+	"github.com/sourcegraph/src-cli/internal/batches/service"
+	"github.com/sourcegraph/src-cli/internal/version"
+)
+
+// batchRunSummary records what a run of src batch preview or src batch apply
+// created, and which Sourcegraph instance and version of src created it, so
+// that changesets can still be traced back to them months later, when the
+// behavior of either may have changed.
+type batchRunSummary struct {
+	Instance   string `json:"instance"`
+	SrcVersion string `json:"srcVersion"`
+
+	BatchSpecName    string                    `json:"batchSpecName"`
+	BatchSpecID      graphql.BatchSpecID       `json:"batchSpecID"`
+	ChangesetSpecIDs []graphql.ChangesetSpecID `json:"changesetSpecIDs"`
+	// ChangesetSpecHashes are the content hashes of the changeset specs, by
+	// their ID, which are the same for changeset specs with the same content
+	// in any run.
+	ChangesetSpecHashes map[graphql.ChangesetSpecID]string `json:"changesetSpecHashes,omitempty"`
+	PreviewURL          string                             `json:"previewURL"`
+	// BatchChangeURL is only set if the batch spec was applied.
+	BatchChangeURL string `json:"batchChangeURL,omitempty"`
+	// Annotations are the ones passed with -annotations.
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// CorrelationID is the one passed with -correlation-id.
+	CorrelationID string `json:"correlationID,omitempty"`
+	// Images are the step images and the digests they were pinned to, if
+	// -pin-images was set.
+	Images []service.PinnedImage `json:"images,omitempty"`
+	// Workspaces are the outcomes of the workspaces of the run.
+	Workspaces executor.RunReport `json:"workspaces"`
+
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+}
+
+// newBatchRunSummary returns a batchRunSummary of a run against the given
+// instance by this version of src.
+func newBatchRunSummary(instance string, startedAt time.Time) *batchRunSummary {
+	return &batchRunSummary{
+		Instance:   instance,
+		SrcVersion: version.BuildTag,
+		StartedAt:  startedAt,
+	}
+}
+
+// write finishes s and writes it to the file at path as JSON.
+func (s *batchRunSummary) write(path string) error {
+	s.FinishedAt = time.Now()
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshalling run summary")
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return errors.Wrap(err, "writing run summary")
+	}
+	return nil
+}
@@ -38,6 +38,7 @@ Examples:
 		allowUnsupported bool
 		allowIgnored     bool
 		skipErrors       bool
+		lintSteps        lintStepsFlags
 	)
 	flagSet.BoolVar(
 		&allowUnsupported, "allow-unsupported", false,
@@ -51,6 +52,7 @@ Examples:
 		&skipErrors, "skip-errors", false,
 		"If true, errors encountered won't stop the program, but only log them.",
 	)
+	lintSteps.register(flagSet)
 
 	handler := func(args []string) error {
 		ctx := context.Background()
@@ -88,11 +90,16 @@ Examples:
 			return err
 		}
 
-		if _, _, _, err := parseBatchSpec(ctx, file, svc); err != nil {
+		spec, _, _, err := parseBatchSpec(ctx, file, svc)
+		if err != nil {
 			ui.ParsingBatchSpecFailure(err)
 			return err
 		}
 
+		if err := lintSteps.lint(ctx, spec, ui); err != nil {
+			return err
+		}
+
 		out.WriteLine(output.Line("\u2705", output.StyleSuccess, "Batch spec successfully validated."))
 		return nil
 	}
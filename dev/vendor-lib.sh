@@ -37,6 +37,10 @@ echo "  Date:   $COMMIT_DATE"
 
 cd "$ROOT_DIR"
 
+echo ""
+echo "Note: the vendored batch spec schema has local changes that are overwritten."
+echo "      See dev/lib-schema-changes.md for the properties to reapply."
+
 echo ""
 echo "Discovering packages to vendor..."
 
@@ -90,6 +90,13 @@ type ClientOpts struct {
 	ProxyPath string
 
 	OAuthToken *oauth.Token
+
+	// HTTPClient, if set, sends all requests of the client, such as a client
+	// with a custom CA bundle or client certificates. This includes the
+	// GraphQL requests and the requests built with NewHTTPRequest, which
+	// src batch uses to download repository archives. The -insecure-skip-verify
+	// flag, ProxyURL and ProxyPath don't apply to it.
+	HTTPClient *http.Client
 }
 
 // ErrCIAccessTokenRequired indicates SRC_ACCESS_TOKEN must be set when CI=true.
@@ -97,7 +104,12 @@ var ErrCIAccessTokenRequired = errors.New("SRC_ACCESS_TOKEN must be set when CI=
 
 func buildTransport(opts ClientOpts, flags *Flags) http.RoundTripper {
 	var transport http.RoundTripper
-	{
+	if opts.HTTPClient != nil {
+		transport = opts.HTTPClient.Transport
+		if transport == nil {
+			transport = http.DefaultTransport
+		}
+	} else {
 		tp := http.DefaultTransport.(*http.Transport).Clone()
 
 		if flags.insecureSkipVerify != nil && *flags.insecureSkipVerify {
@@ -141,6 +153,13 @@ func NewClient(opts ClientOpts) Client {
 	httpClient := &http.Client{
 		Transport: transport,
 	}
+	if opts.HTTPClient != nil {
+		// Copy the client, so that its other settings, such as its timeout,
+		// are kept without changing the transport of the caller's client.
+		c := *opts.HTTPClient
+		c.Transport = transport
+		httpClient = &c
+	}
 
 	return &client{
 		opts: ClientOpts{
@@ -307,7 +326,7 @@ func (r *request) do(ctx context.Context, result any) (bool, error) {
 		if err != nil {
 			return false, err
 		}
-		return false, fmt.Errorf("error: %s\n\n%s", resp.Status, body)
+		return false, &HTTPError{StatusCode: resp.StatusCode, Status: resp.Status, Body: body}
 	}
 
 	body := resp.Body
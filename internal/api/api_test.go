@@ -0,0 +1,72 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestNewClient_HTTPClient(t *testing.T) {
+	srv := startTargetServer(t)
+	endpoint, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(t *testing.T, c Client) (string, error) {
+		t.Helper()
+		req, err := c.NewHTTPRequest(context.Background(), "GET", "archive.zip", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	t.Run("default client doesn't trust the server", func(t *testing.T) {
+		c := NewClient(ClientOpts{EndpointURL: endpoint, Out: &bytes.Buffer{}})
+		if _, err := get(t, c); err == nil {
+			t.Fatal("no error for untrusted certificate")
+		}
+	})
+
+	t.Run("injected client", func(t *testing.T) {
+		// The client of the test server trusts its certificate, like a
+		// client configured with a custom CA bundle.
+		httpClient := srv.Client()
+		httpClient.Timeout = 10 * time.Second
+		transport := httpClient.Transport
+
+		c := NewClient(ClientOpts{EndpointURL: endpoint, Out: &bytes.Buffer{}, HTTPClient: httpClient})
+		body, err := get(t, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body != "ok\n" {
+			t.Errorf("wrong body: %q", body)
+		}
+
+		if httpClient.Transport != transport {
+			t.Error("transport of the injected client was changed")
+		}
+		if have := c.(*client).httpClient.Timeout; have != httpClient.Timeout {
+			t.Errorf("timeout of the injected client not kept: %s", have)
+		}
+	})
+
+	t.Run("injected client without transport", func(t *testing.T) {
+		c := NewClient(ClientOpts{EndpointURL: endpoint, Out: &bytes.Buffer{}, HTTPClient: &http.Client{}})
+		if have := c.(*client).httpClient.Transport; have != http.DefaultTransport {
+			t.Errorf("wrong transport: %T", have)
+		}
+	})
+}
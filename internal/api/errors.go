@@ -2,6 +2,8 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
+	"net/http"
 
 	"github.com/sourcegraph/sourcegraph/lib/errors"
 )
@@ -116,7 +118,26 @@ func (g *GraphQlError) Extensions() (map[string]any, error) {
 	return nil, errors.Errorf("unexpected extensions of type %T", e["extensions"])
 }
 
+// HTTPError is returned when the API responds with a status code other than
+// 200 OK, before the request reached the GraphQL endpoint.
+type HTTPError struct {
+	StatusCode int
+	Status     string
+	Body       []byte
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("error: %s\n\n%s", e.Status, e.Body)
+}
+
+// Temporary returns true if the same request might succeed when retried,
+// which is the case for rate limiting and server errors.
+func (e *HTTPError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
 var (
+	_ error = &HTTPError{}
 	_ error = &GraphQlError{}
 	_ error = GraphQlErrors{}
 )
@@ -37,33 +37,58 @@ func CurrentContext(ctx context.Context) (string, error) {
 
 type Info struct {
 	Host struct {
-		CPUs int `json:"cpus"`
+		CPUs     int   `json:"cpus"`
+		MemTotal int64 `json:"memTotal"`
 	} `json:"host"` // Podman engine
-	NCPU int `json:"NCPU"` // Docker Engine
+	NCPU     int   `json:"NCPU"`     // Docker Engine
+	MemTotal int64 `json:"MemTotal"` // Docker Engine
 }
 
-// NCPU returns the number of CPU cores available to Docker.
-func NCPU(ctx context.Context) (int, error) {
+// CPUs returns the number of CPU cores reported by the engine.
+func (i *Info) CPUs() int {
+	if i.NCPU > 0 {
+		return i.NCPU
+	}
+	return i.Host.CPUs
+}
+
+// Memory returns the total memory in bytes reported by the engine, or 0 if
+// it is unknown.
+func (i *Info) Memory() int64 {
+	if i.MemTotal > 0 {
+		return i.MemTotal
+	}
+	return i.Host.MemTotal
+}
+
+// GetInfo returns the output of `docker info`.
+func GetInfo(ctx context.Context) (*Info, error) {
 	dctx, cancel, err := withFastCommandContext(ctx)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	defer cancel()
 
 	args := []string{"info", "--format", "{{ json .}}"}
 	out, err := exec.CommandContext(dctx, "docker", args...).CombinedOutput()
 	if errors.IsDeadlineExceeded(err) || errors.IsDeadlineExceeded(dctx.Err()) {
-		return 0, newFastCommandTimeoutError(dctx, args...)
+		return nil, newFastCommandTimeoutError(dctx, args...)
 	} else if err != nil {
-		return 0, err
+		return nil, err
 	}
 
 	var info Info
 	if err := json.Unmarshal(out, &info); err != nil {
-		return 0, err
+		return nil, err
 	}
-	if info.NCPU > 0 {
-		return info.NCPU, nil
+	return &info, nil
+}
+
+// NCPU returns the number of CPU cores available to Docker.
+func NCPU(ctx context.Context) (int, error) {
+	info, err := GetInfo(ctx)
+	if err != nil {
+		return 0, err
 	}
-	return info.Host.CPUs, nil
+	return info.CPUs(), nil
 }
@@ -0,0 +1,122 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+
+	"github.com/sourcegraph/src-cli/internal/exec"
+)
+
+// referencePattern matches image references as Docker accepts them:
+// [domain[:port]/]path[:tag][@digest]. It follows the grammar of
+// github.com/distribution/reference, without IPv6 addresses as domains.
+var referencePattern = func() *regexp.Regexp {
+	const (
+		domainComponent = `(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])`
+		domain          = domainComponent + `(?:\.` + domainComponent + `)*(?::[0-9]+)?`
+		pathComponent   = `[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*`
+		path            = pathComponent + `(?:/` + pathComponent + `)*`
+		tag             = `[\w][\w.-]{0,127}`
+		digest          = `[A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*:[0-9a-fA-F]{32,}`
+	)
+	return regexp.MustCompile(`^(?:` + domain + `/)?(` + path + `)(?::` + tag + `)?(?:@` + digest + `)?$`)
+}()
+
+// maxNameLength is the maximum length of the name of an image, without its
+// tag and digest.
+const maxNameLength = 255
+
+// ValidateReference returns an error if ref isn't a well-formed image
+// reference, so that typos are caught before any image is pulled.
+func ValidateReference(ref string) error {
+	if ref == "" {
+		return errors.New("no image given")
+	}
+	if !referencePattern.MatchString(ref) {
+		if referencePattern.MatchString(strings.ToLower(ref)) {
+			return errors.Newf("invalid image reference %q: repository names must be lowercase", ref)
+		}
+		return errors.Newf("invalid image reference %q", ref)
+	}
+	if name := referenceName(ref); len(name) > maxNameLength {
+		return errors.Newf("invalid image reference %q: name is longer than %d characters", ref, maxNameLength)
+	}
+	return nil
+}
+
+// referenceName returns ref without its tag and digest.
+func referenceName(ref string) string {
+	if i := strings.IndexByte(ref, '@'); i >= 0 {
+		ref = ref[:i]
+	}
+	// A colon after the last slash separates the tag, any other one the port
+	// of the domain.
+	if i := strings.LastIndexByte(ref, ':'); i > strings.LastIndexByte(ref, '/') {
+		ref = ref[:i]
+	}
+	return ref
+}
+
+// familiarName returns name the way Docker shows images of Docker Hub, without
+// the default domain and the library/ namespace.
+func familiarName(name string) string {
+	for _, prefix := range []string{"docker.io/", "index.docker.io/"} {
+		if rest, ok := strings.CutPrefix(name, prefix); ok {
+			name = rest
+			break
+		}
+	}
+	if rest, ok := strings.CutPrefix(name, "library/"); ok && !strings.Contains(rest, "/") {
+		name = rest
+	}
+	return name
+}
+
+// PinnedReference returns ref pinned to the repository digest of the image it
+// currently refers to locally, such as alpine@sha256:..., which refers to the
+// same image even if the tag is moved to another one later. References that
+// already contain a digest are returned as they are.
+//
+// Only images that were pulled from or pushed to a registry have a
+// repository digest. For other images, such as ones that were built locally,
+// an empty string is returned.
+func PinnedReference(ctx context.Context, ref string) (string, error) {
+	if strings.Contains(ref, "@") {
+		return ref, nil
+	}
+
+	dctx, cancel, err := withFastCommandContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer cancel()
+
+	args := []string{"image", "inspect", "--format", "{{ json .RepoDigests }}", ref}
+	out, err := exec.CommandContext(dctx, "docker", args...).Output()
+	if errors.IsDeadlineExceeded(err) || errors.IsDeadlineExceeded(dctx.Err()) {
+		return "", newFastCommandTimeoutError(dctx, args...)
+	} else if err != nil {
+		return "", errors.Wrapf(err, "inspecting image %s", ref)
+	}
+
+	var repoDigests []string
+	if err := json.Unmarshal(bytes.TrimSpace(out), &repoDigests); err != nil {
+		return "", errors.Wrapf(err, "parsing repository digests of image %s", ref)
+	}
+
+	// An image can have been pulled from several repositories. Only the
+	// digest of the repository of ref pins it.
+	name := referenceName(ref)
+	for _, repoDigest := range repoDigests {
+		repo, digest, ok := strings.Cut(repoDigest, "@")
+		if ok && familiarName(repo) == familiarName(name) {
+			return name + "@" + digest, nil
+		}
+	}
+	return "", nil
+}
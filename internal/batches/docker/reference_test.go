@@ -0,0 +1,111 @@
+package docker
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sourcegraph/src-cli/internal/exec/expect"
+)
+
+func TestValidateReference(t *testing.T) {
+	const digest = "sha256:6e8b6f1b5e3ce4c4b9ba8c2d1bfa4b4a8d7bb9a2d1d54a9e8f1c6b0e0c7f9a12"
+
+	for _, ref := range []string{
+		"alpine",
+		"alpine:3.19",
+		"library/alpine:latest",
+		"docker.io/library/alpine",
+		"ghcr.io/sourcegraph/comby:1.8.1",
+		"localhost:5000/tools/go_fmt",
+		"registry.example.com:443/team/my-image:v1.0-rc.1",
+		"alpine@" + digest,
+		"alpine:3@" + digest,
+		"Registry.Example.com/tools/fmt",
+	} {
+		assert.NoError(t, ValidateReference(ref), ref)
+	}
+
+	for ref, want := range map[string]string{
+		"":                                   "no image given",
+		"alpine:":                            `invalid image reference "alpine:"`,
+		"alpine 3":                           `invalid image reference "alpine 3"`,
+		"alpine:3:4":                         `invalid image reference "alpine:3:4"`,
+		"alpine@sha256:abc":                  `invalid image reference "alpine@sha256:abc"`,
+		"-alpine":                            `invalid image reference "-alpine"`,
+		"sourcegraph/Comby":                  `invalid image reference "sourcegraph/Comby": repository names must be lowercase`,
+		"alpine:" + strings.Repeat("a", 129): "invalid image reference",
+		strings.Repeat("a/", 128) + "a":      "name is longer than 255 characters",
+	} {
+		assert.ErrorContains(t, ValidateReference(ref), want, ref)
+	}
+}
+
+func TestPinnedReference(t *testing.T) {
+	ctx := context.Background()
+	const digest = "sha256:6e8b6f1b5e3ce4c4b9ba8c2d1bfa4b4a8d7bb9a2d1d54a9e8f1c6b0e0c7f9a12"
+
+	for name, tc := range map[string]struct {
+		ref          string
+		expectations []*expect.Expectation
+		want         string
+		wantErr      bool
+	}{
+		"tag": {
+			ref:          "ghcr.io/sourcegraph/comby:1.8.1",
+			expectations: []*expect.Expectation{inspectRepoDigests("ghcr.io/sourcegraph/comby:1.8.1", `["ghcr.io/sourcegraph/comby@`+digest+`"]`)},
+			want:         "ghcr.io/sourcegraph/comby@" + digest,
+		},
+		"docker hub": {
+			ref:          "docker.io/library/alpine:3",
+			expectations: []*expect.Expectation{inspectRepoDigests("docker.io/library/alpine:3", `["alpine@`+digest+`"]`)},
+			want:         "docker.io/library/alpine@" + digest,
+		},
+		"several repositories": {
+			ref: "localhost:5000/alpine",
+			expectations: []*expect.Expectation{inspectRepoDigests(
+				"localhost:5000/alpine",
+				`["alpine@sha256:0000000000000000000000000000000000000000000000000000000000000000","localhost:5000/alpine@`+digest+`"]`,
+			)},
+			want: "localhost:5000/alpine@" + digest,
+		},
+		"built locally": {
+			ref:          "my-tool:dev",
+			expectations: []*expect.Expectation{inspectRepoDigests("my-tool:dev", `[]`)},
+			want:         "",
+		},
+		"digest": {
+			ref:  "alpine@" + digest,
+			want: "alpine@" + digest,
+		},
+		"inspect failure": {
+			ref: "alpine",
+			expectations: []*expect.Expectation{expect.NewGlob(
+				expect.Behaviour{ExitCode: 1},
+				"docker", "image", "inspect", "--format", `\{\{ json .RepoDigests }}`, "alpine",
+			)},
+			wantErr: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			expect.Commands(t, tc.expectations...)
+
+			have, err := PinnedReference(ctx, tc.ref)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, have)
+		})
+	}
+}
+
+func inspectRepoDigests(name, repoDigests string) *expect.Expectation {
+	return expect.NewGlob(
+		expect.Behaviour{Stdout: []byte(repoDigests + "\n")},
+		"docker", "image", "inspect", "--format", `\{\{ json .RepoDigests }}`, name,
+	)
+}
@@ -0,0 +1,192 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"slices"
+	"sync"
+
+	batcheslib "github.com/sourcegraph/sourcegraph/lib/batches"
+	"github.com/sourcegraph/sourcegraph/lib/batches/git"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+
+	"github.com/sourcegraph/src-cli/internal/batches/graphql"
+)
+
+const (
+	// maxAdditionalChangesets is the maximum number of additional changesets
+	// the outputs of a Task can declare.
+	maxAdditionalChangesets = 10
+	// maxAdditionalChangesetDiffBytes is the maximum size of the diff of an
+	// additional changeset.
+	maxAdditionalChangesetDiffBytes = 1 << 20
+)
+
+// AdditionalChangeset is a changeset in another repository than the one of
+// the workspace, declared by an output with Changesets set, such as a
+// companion change in a shared configuration repository.
+type AdditionalChangeset struct {
+	Repository string `json:"repository"`
+	Branch     string `json:"branch"`
+	Title      string `json:"title"`
+	Body       string `json:"body,omitempty"`
+	Message    string `json:"message"`
+	Diff       string `json:"diff"`
+}
+
+// RepositoryResolver resolves the name of a repository on the Sourcegraph
+// instance. It returns an error if the repository doesn't exist.
+type RepositoryResolver func(ctx context.Context, name string) (*graphql.Repository, error)
+
+// additionalChangesets returns the AdditionalChangesets declared in outputs
+// by the outputs of the Task's steps with Changesets set.
+func (t *Task) additionalChangesets(outputs map[string]any) ([]AdditionalChangeset, error) {
+	var changesets []AdditionalChangeset
+	for _, step := range t.Steps {
+		for _, name := range slices.Sorted(maps.Keys(step.Outputs)) {
+			value, ok := outputs[name]
+			if !ok || !step.Outputs[name].Changesets || value == nil {
+				continue
+			}
+
+			// The value was already parsed in the format of the output, so
+			// it's converted to AdditionalChangesets through JSON.
+			raw, err := json.Marshal(value)
+			if err != nil {
+				return nil, errors.Wrapf(err, "output %q", name)
+			}
+			var declared []AdditionalChangeset
+			if err := json.Unmarshal(raw, &declared); err != nil {
+				return nil, errors.Wrapf(err, "output %q is not a list of changesets", name)
+			}
+			for i, cs := range declared {
+				if err := cs.validate(); err != nil {
+					return nil, errors.Wrapf(err, "changeset %d of output %q", i+1, name)
+				}
+			}
+			changesets = append(changesets, declared...)
+		}
+	}
+	if len(changesets) > maxAdditionalChangesets {
+		return nil, errors.Newf("outputs declare %d additional changesets, more than the maximum of %d", len(changesets), maxAdditionalChangesets)
+	}
+	return changesets, nil
+}
+
+func (cs AdditionalChangeset) validate() error {
+	var errs error
+	for _, field := range []struct{ name, value string }{
+		{"repository", cs.Repository},
+		{"branch", cs.Branch},
+		{"title", cs.Title},
+		{"message", cs.Message},
+		{"diff", cs.Diff},
+	} {
+		if field.value == "" {
+			errs = errors.Append(errs, errors.Newf("%s is missing", field.name))
+		}
+	}
+	if len(cs.Diff) > maxAdditionalChangesetDiffBytes {
+		errs = errors.Append(errs, errors.Newf("diff is %d bytes, more than the maximum of %d", len(cs.Diff), maxAdditionalChangesetDiffBytes))
+	}
+	return errs
+}
+
+// additionalRepos resolves the repositories of AdditionalChangesets with
+// NewCoordinatorOpts.ResolveRepository, once per name.
+type additionalRepos struct {
+	mu    sync.Mutex
+	repos map[string]*graphql.Repository
+}
+
+func (a *additionalRepos) resolve(ctx context.Context, resolve RepositoryResolver, name string) (*graphql.Repository, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if repo, ok := a.repos[name]; ok {
+		return repo, nil
+	}
+	if resolve == nil {
+		return nil, errors.New("additional changesets can't be created without a Sourcegraph instance to resolve their repositories")
+	}
+	repo, err := resolve(ctx, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "resolving repository %s", name)
+	}
+	if !repo.HasBranch() {
+		return nil, errors.Newf("repository %s has no default branch", name)
+	}
+	if a.repos == nil {
+		a.repos = make(map[string]*graphql.Repository)
+	}
+	a.repos[name] = repo
+	return repo, nil
+}
+
+func (a *additionalRepos) all() []*graphql.Repository {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	repos := make([]*graphql.Repository, 0, len(a.repos))
+	for _, name := range slices.Sorted(maps.Keys(a.repos)) {
+		repos = append(repos, a.repos[name])
+	}
+	return repos
+}
+
+// AdditionalRepositories returns the repositories of the additional
+// changesets declared by the outputs of the Tasks so far, which aren't
+// necessarily the repositories of any Task.
+func (c *Coordinator) AdditionalRepositories() []*graphql.Repository {
+	return c.additional.all()
+}
+
+// buildAdditionalChangesetSpecs builds the ChangesetSpecs of the
+// AdditionalChangesets declared in outputs.
+func (c *Coordinator) buildAdditionalChangesetSpecs(ctx context.Context, task *Task, batchSpec *batcheslib.BatchSpec, outputs map[string]any) ([]*batcheslib.ChangesetSpec, error) {
+	changesets, err := task.additionalChangesets(outputs)
+	if err != nil || len(changesets) == 0 {
+		return nil, err
+	}
+
+	version := 1
+	if c.opts.BinaryDiffs {
+		version = 2
+	}
+	author := batcheslib.ChangesetSpecAuthor{Name: "Sourcegraph", Email: "batch-changes@sourcegraph.com"}
+	if c.opts.DefaultAuthor != nil {
+		author = *c.opts.DefaultAuthor
+	}
+
+	specs := make([]*batcheslib.ChangesetSpec, 0, len(changesets))
+	for _, cs := range changesets {
+		repo, err := c.additional.resolve(ctx, c.opts.ResolveRepository, cs.Repository)
+		if err != nil {
+			return nil, err
+		}
+
+		var published any
+		if batchSpec.ChangesetTemplate != nil && batchSpec.ChangesetTemplate.Published != nil {
+			published = batchSpec.ChangesetTemplate.Published.ValueWithSuffix(repo.Name, cs.Branch)
+		}
+		specs = append(specs, &batcheslib.ChangesetSpec{
+			BaseRepository: repo.ID,
+			HeadRepository: repo.ID,
+			BaseRef:        repo.BaseRef(),
+			BaseRev:        repo.Rev(),
+			HeadRef:        git.EnsureRefPrefix(cs.Branch),
+			Title:          cs.Title,
+			Body:           cs.Body,
+			Commits: []batcheslib.GitCommitDescription{{
+				Version:     version,
+				Message:     cs.Message,
+				AuthorName:  author.Name,
+				AuthorEmail: author.Email,
+				Diff:        []byte(cs.Diff),
+			}},
+			Published: batcheslib.PublishedValue{Val: published},
+		})
+	}
+	return specs, nil
+}
@@ -0,0 +1,164 @@
+package executor
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	batcheslib "github.com/sourcegraph/sourcegraph/lib/batches"
+	"github.com/sourcegraph/sourcegraph/lib/batches/execution"
+	"github.com/sourcegraph/sourcegraph/lib/batches/template"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+
+	"github.com/sourcegraph/src-cli/internal/batches/graphql"
+)
+
+func TestTask_AdditionalChangesets(t *testing.T) {
+	task := &Task{Steps: []batcheslib.Step{{
+		Run: "./codemod",
+		Outputs: batcheslib.Outputs{
+			"companions": {Value: "${{ step.stdout }}", Format: "json", Changesets: true},
+			"other":      {Value: "${{ step.stdout }}", Format: "json"},
+		},
+	}}}
+	companion := map[string]any{
+		"repository": "github.com/sourcegraph/config",
+		"branch":     "companion",
+		"title":      "Register service",
+		"message":    "Register service",
+		"diff":       "dummydiff",
+	}
+
+	changesets, err := task.additionalChangesets(map[string]any{
+		"companions": []any{companion},
+		"other":      []any{companion, companion},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []AdditionalChangeset{{Repository: "github.com/sourcegraph/config", Branch: "companion", Title: "Register service", Message: "Register service", Diff: "dummydiff"}}
+	if diff := cmp.Diff(want, changesets); diff != "" {
+		t.Errorf("wrong changesets (-want +have):\n%s", diff)
+	}
+
+	tooMany := make([]any, maxAdditionalChangesets+1)
+	for i := range tooMany {
+		tooMany[i] = companion
+	}
+	tooLarge := map[string]any{}
+	for k, v := range companion {
+		tooLarge[k] = v
+	}
+	tooLarge["diff"] = strings.Repeat("+", maxAdditionalChangesetDiffBytes+1)
+
+	for name, tt := range map[string]struct {
+		value   any
+		wantErr string
+	}{
+		"not a list":     {value: "companion", wantErr: "is not a list of changesets"},
+		"missing fields": {value: []any{map[string]any{"repository": "github.com/sourcegraph/config"}}, wantErr: "branch is missing"},
+		"too many":       {value: tooMany, wantErr: "more than the maximum of 10"},
+		"diff too large": {value: []any{tooLarge}, wantErr: "diff is 1048577 bytes"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := task.additionalChangesets(map[string]any{"companions": tt.value})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("wrong error. want=%q, have=%v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestCoordinator_BuildAdditionalChangesetSpecs(t *testing.T) {
+	configRepo := &graphql.Repository{
+		ID:            "config",
+		Name:          "github.com/sourcegraph/config",
+		DefaultBranch: &graphql.Branch{Name: "main", Target: graphql.Target{OID: "c0nf1g"}},
+	}
+	var resolved []string
+	resolve := func(ctx context.Context, name string) (*graphql.Repository, error) {
+		resolved = append(resolved, name)
+		if name != configRepo.Name {
+			return nil, errors.New("no repository found")
+		}
+		return configRepo, nil
+	}
+
+	newTask := func(repo *graphql.Repository) *Task {
+		return &Task{
+			Repository:            repo,
+			BatchChangeAttributes: &template.BatchChangeAttributes{},
+			Steps: []batcheslib.Step{{
+				Run:     "./codemod",
+				Outputs: batcheslib.Outputs{"companions": {Value: "${{ step.stdout }}", Format: "json", Changesets: true}},
+			}},
+		}
+	}
+	companion := func(repo string) execution.AfterStepResult {
+		return execution.AfterStepResult{
+			Diff: []byte(`dummydiff1`),
+			Outputs: map[string]any{"companions": []any{map[string]any{
+				"repository": repo,
+				"branch":     "register-service",
+				"title":      "Register service",
+				"message":    "Register service",
+				"diff":       "dummydiff2",
+			}}},
+		}
+	}
+
+	coord := &Coordinator{opts: NewCoordinatorOpts{ResolveRepository: resolve}}
+	batchSpec := &batcheslib.BatchSpec{ChangesetTemplate: testChangesetTemplate}
+
+	specs, err := coord.buildChangesetSpecs(context.Background(), newTask(testRepo1), batchSpec, companion(configRepo.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != 2 {
+		t.Fatalf("wrong number of specs. want=2, have=%d", len(specs))
+	}
+	want := &batcheslib.ChangesetSpec{
+		BaseRepository: configRepo.ID,
+		HeadRepository: configRepo.ID,
+		BaseRef:        "refs/heads/main",
+		BaseRev:        "c0nf1g",
+		HeadRef:        "refs/heads/register-service",
+		Title:          "Register service",
+		Commits: []batcheslib.GitCommitDescription{{
+			Version:     1,
+			Message:     "Register service",
+			AuthorName:  "Sourcegraph",
+			AuthorEmail: "batch-changes@sourcegraph.com",
+			Diff:        []byte(`dummydiff2`),
+		}},
+		Published: batcheslib.PublishedValue{Val: false},
+	}
+	if diff := cmp.Diff(want, specs[1]); diff != "" {
+		t.Errorf("wrong additional spec (-want +have):\n%s", diff)
+	}
+
+	// The repository is only resolved once.
+	if _, err := coord.buildChangesetSpecs(context.Background(), newTask(testRepo2), batchSpec, companion(configRepo.Name)); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{configRepo.Name}, resolved); diff != "" {
+		t.Errorf("wrong resolved repositories (-want +have):\n%s", diff)
+	}
+	if diff := cmp.Diff([]*graphql.Repository{configRepo}, coord.AdditionalRepositories()); diff != "" {
+		t.Errorf("wrong additional repositories (-want +have):\n%s", diff)
+	}
+
+	// Repositories that don't exist fail the Task.
+	_, err = coord.buildChangesetSpecs(context.Background(), newTask(testRepo1), batchSpec, companion("github.com/sourcegraph/missing"))
+	if err == nil || !strings.Contains(err.Error(), "resolving repository github.com/sourcegraph/missing") {
+		t.Errorf("wrong error for missing repository: %v", err)
+	}
+
+	// Without a resolver, no additional changesets can be created.
+	coord = &Coordinator{}
+	if _, err := coord.buildChangesetSpecs(context.Background(), newTask(testRepo1), batchSpec, companion(configRepo.Name)); err == nil {
+		t.Error("no error without a resolver")
+	}
+}
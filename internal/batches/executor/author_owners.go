@@ -0,0 +1,126 @@
+package executor
+
+import (
+	"bufio"
+	"io"
+	"net/mail"
+	"path"
+	"strings"
+
+	batcheslib "github.com/sourcegraph/sourcegraph/lib/batches"
+	"github.com/sourcegraph/sourcegraph/lib/batches/git"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+)
+
+// AuthorOwners maps the files of a repository to the authors of the commits
+// that change them, like a CODEOWNERS file maps them to their owners.
+type AuthorOwners struct {
+	rules []ownerRule
+}
+
+type ownerRule struct {
+	pattern string
+	author  batcheslib.ChangesetSpecAuthor
+}
+
+// ParseAuthorOwners parses a file in the CODEOWNERS format, whose owners are
+// commit authors in the form "Name <email>":
+//
+//	# Comments and empty lines are ignored.
+//	*.go        Go Team <go-team@example.com>
+//	/docs/      Docs Team <docs@example.com>
+//
+// Like in CODEOWNERS files, the last pattern that matches a file determines
+// its author. Patterns that start with or contain a slash are relative to the
+// root of the repository, other patterns match files or directories with that
+// name anywhere. Patterns that end with a slash only match directories, and
+// "*" matches any characters but a slash.
+func ParseAuthorOwners(r io.Reader) (*AuthorOwners, error) {
+	var owners AuthorOwners
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		pattern, owner := fields[0], strings.Join(fields[1:], " ")
+		if owner == "" {
+			return nil, errors.Newf("line %d: no author for pattern %q", line, pattern)
+		}
+		if _, err := path.Match(strings.Trim(pattern, "/"), ""); err != nil {
+			return nil, errors.Wrapf(err, "line %d: invalid pattern %q", line, pattern)
+		}
+		author, err := ParseAuthor(owner)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", line)
+		}
+		owners.rules = append(owners.rules, ownerRule{pattern: pattern, author: *author})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &owners, nil
+}
+
+// ParseAuthor parses an author in the form "Name <email>".
+func ParseAuthor(s string) (*batcheslib.ChangesetSpecAuthor, error) {
+	addr, err := mail.ParseAddress(s)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid author %q, must be in the form \"Name <email>\"", s)
+	}
+	return &batcheslib.ChangesetSpecAuthor{Name: addr.Name, Email: addr.Address}, nil
+}
+
+// Author returns the author of the changes, if all changed files have the
+// same author.
+func (o *AuthorOwners) Author(changes git.Changes) (*batcheslib.ChangesetSpecAuthor, bool) {
+	var author *batcheslib.ChangesetSpecAuthor
+	for _, files := range [][]string{changes.Modified, changes.Added, changes.Deleted, changes.Renamed} {
+		for _, file := range files {
+			a, ok := o.fileAuthor(file)
+			if !ok || (author != nil && *a != *author) {
+				return nil, false
+			}
+			author = a
+		}
+	}
+	return author, author != nil
+}
+
+// fileAuthor returns the author of the last rule that matches file.
+func (o *AuthorOwners) fileAuthor(file string) (*batcheslib.ChangesetSpecAuthor, bool) {
+	for i := len(o.rules) - 1; i >= 0; i-- {
+		if o.rules[i].matches(file) {
+			return &o.rules[i].author, true
+		}
+	}
+	return nil, false
+}
+
+func (r ownerRule) matches(file string) bool {
+	pattern := strings.TrimPrefix(r.pattern, "/")
+	anchored := pattern != r.pattern || strings.Contains(strings.TrimSuffix(pattern, "/"), "/")
+	onlyDirs := strings.HasSuffix(pattern, "/")
+	pattern = strings.TrimSuffix(pattern, "/")
+
+	components := strings.Split(strings.TrimPrefix(file, "/"), "/")
+	for i := range components {
+		// Patterns match directories with all files below them, but only
+		// match the file itself if they don't end with a slash.
+		if onlyDirs && i == len(components)-1 {
+			return false
+		}
+		var name string
+		if anchored {
+			name = strings.Join(components[:i+1], "/")
+		} else {
+			name = components[i]
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
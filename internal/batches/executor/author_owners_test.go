@@ -0,0 +1,164 @@
+package executor
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	batcheslib "github.com/sourcegraph/sourcegraph/lib/batches"
+	"github.com/sourcegraph/sourcegraph/lib/batches/execution"
+	"github.com/sourcegraph/sourcegraph/lib/batches/git"
+	"github.com/sourcegraph/sourcegraph/lib/batches/template"
+
+	"github.com/sourcegraph/src-cli/internal/batches/mock"
+)
+
+const testAuthorOwners = `
+# Everything else is owned by the platform team.
+*              Platform <platform@example.com>
+
+*.md           Docs <docs@example.com>
+/cmd/          CLI Team <cli@example.com>
+internal/api   API Team <api@example.com>
+vendor/        Vendored <vendor@example.com>
+`
+
+func TestAuthorOwners(t *testing.T) {
+	owners, err := ParseAuthorOwners(strings.NewReader(testAuthorOwners))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	platform := &batcheslib.ChangesetSpecAuthor{Name: "Platform", Email: "platform@example.com"}
+	docs := &batcheslib.ChangesetSpecAuthor{Name: "Docs", Email: "docs@example.com"}
+	cli := &batcheslib.ChangesetSpecAuthor{Name: "CLI Team", Email: "cli@example.com"}
+	api := &batcheslib.ChangesetSpecAuthor{Name: "API Team", Email: "api@example.com"}
+	vendor := &batcheslib.ChangesetSpecAuthor{Name: "Vendored", Email: "vendor@example.com"}
+
+	tests := []struct {
+		name    string
+		changes git.Changes
+		want    *batcheslib.ChangesetSpecAuthor
+	}{
+		{name: "no changes"},
+		{name: "catch-all", changes: git.Changes{Modified: []string{"main.go"}}, want: platform},
+		{name: "unanchored glob", changes: git.Changes{Added: []string{"docs/a/README.md"}}, want: docs},
+		{name: "anchored directory", changes: git.Changes{Modified: []string{"cmd/src/main.go"}, Deleted: []string{"cmd/old.go"}}, want: cli},
+		{name: "anchored directory elsewhere", changes: git.Changes{Modified: []string{"lib/cmd/main.go"}}, want: platform},
+		{name: "later rule wins", changes: git.Changes{Modified: []string{"cmd/README.md"}}, want: cli},
+		{name: "pattern with slash", changes: git.Changes{Modified: []string{"internal/api/client.go"}}, want: api},
+		{name: "unanchored directory", changes: git.Changes{Renamed: []string{"lib/vendor/x.go"}}, want: vendor},
+		{name: "directory pattern matches no file", changes: git.Changes{Added: []string{"vendor"}}, want: platform},
+		{name: "multiple owners", changes: git.Changes{Modified: []string{"cmd/main.go", "README.md"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			have, ok := owners.Author(tt.changes)
+			if ok != (tt.want != nil) {
+				t.Fatalf("wrong ok. want=%t, have=%t", tt.want != nil, ok)
+			}
+			if diff := cmp.Diff(tt.want, have); diff != "" {
+				t.Errorf("wrong author (-want +have):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("no matching rule", func(t *testing.T) {
+		owners, err := ParseAuthorOwners(strings.NewReader("*.md Docs <docs@example.com>"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := owners.Author(git.Changes{Modified: []string{"README.md", "main.go"}}); ok {
+			t.Error("unexpected author")
+		}
+	})
+
+	for name, input := range map[string]string{
+		"missing author":  "*.go\n",
+		"invalid author":  "*.go Go Team\n",
+		"invalid pattern": "[ Go Team <go@example.com>\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseAuthorOwners(strings.NewReader(input)); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
+
+func TestCoordinator_FallbackAuthor(t *testing.T) {
+	owners, err := ParseAuthorOwners(strings.NewReader("/cmd/ CLI Team <cli@example.com>\n*.md Docs <docs@example.com>\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultAuthor := &batcheslib.ChangesetSpecAuthor{Name: "Default", Email: "default@example.com"}
+
+	withoutAuthor := *testChangesetTemplate
+	withoutAuthor.Commit.Author = nil
+
+	tests := []struct {
+		name          string
+		template      *batcheslib.ChangesetTemplate
+		owners        *AuthorOwners
+		defaultAuthor *batcheslib.ChangesetSpecAuthor
+		changes       git.Changes
+		want          batcheslib.ChangesetSpecAuthor
+	}{
+		{
+			name:          "template author",
+			template:      testChangesetTemplate,
+			owners:        owners,
+			defaultAuthor: defaultAuthor,
+			changes:       git.Changes{Modified: []string{"cmd/main.go"}},
+			want:          batcheslib.ChangesetSpecAuthor{Name: testChangesetTemplate.Commit.Author.Name, Email: testChangesetTemplate.Commit.Author.Email},
+		},
+		{
+			name:          "single owner",
+			template:      &withoutAuthor,
+			owners:        owners,
+			defaultAuthor: defaultAuthor,
+			changes:       git.Changes{Modified: []string{"cmd/main.go"}},
+			want:          batcheslib.ChangesetSpecAuthor{Name: "CLI Team", Email: "cli@example.com"},
+		},
+		{
+			name:          "multiple owners",
+			template:      &withoutAuthor,
+			owners:        owners,
+			defaultAuthor: defaultAuthor,
+			changes:       git.Changes{Modified: []string{"cmd/main.go", "README.md"}},
+			want:          *defaultAuthor,
+		},
+		{
+			name:     "no default author",
+			template: &withoutAuthor,
+			owners:   owners,
+			changes:  git.Changes{Modified: []string{"main.go"}},
+			want:     batcheslib.ChangesetSpecAuthor{Name: "Sourcegraph", Email: "batch-changes@sourcegraph.com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			coord := Coordinator{opts: NewCoordinatorOpts{
+				Logger:        mock.LogNoOpManager{},
+				AuthorOwners:  tt.owners,
+				DefaultAuthor: tt.defaultAuthor,
+			}}
+			batchSpec := &batcheslib.BatchSpec{Name: "my-batch-change", ChangesetTemplate: tt.template}
+			task := &Task{Repository: testRepo1, BatchChangeAttributes: &template.BatchChangeAttributes{Name: batchSpec.Name}}
+
+			specs, err := coord.buildChangesetSpecs(context.Background(), task, batchSpec, execution.AfterStepResult{Diff: []byte(`dummydiff1`), ChangedFiles: tt.changes})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(specs) != 1 || len(specs[0].Commits) != 1 {
+				t.Fatalf("wrong number of specs: %d", len(specs))
+			}
+			have := batcheslib.ChangesetSpecAuthor{Name: specs[0].Commits[0].AuthorName, Email: specs[0].Commits[0].AuthorEmail}
+			if diff := cmp.Diff(tt.want, have); diff != "" {
+				t.Errorf("wrong author (-want +have):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package executor
+
+import (
+	"maps"
+	"slices"
+
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+)
+
+// CacheKeyRecord holds the components of the cache keys of the Tasks of a
+// run, as returned by cache.CacheKey.Components, by the name of the Task in
+// the RunReport. Only the key of the last step of every Task is recorded.
+type CacheKeyRecord map[string]map[string]string
+
+// CacheMiss explains why a Task wasn't served from the cache, compared to the
+// CacheKeyRecord of an earlier run.
+type CacheMiss struct {
+	// Task is the name of the Task in the RunReport.
+	Task string
+	// New is true if the Task wasn't part of the earlier run.
+	New bool
+	// Changed are the components of the cache key that are different from
+	// the earlier run, sorted. If it's empty for a Task that isn't New, none
+	// of its inputs changed, and its cached result was removed or couldn't
+	// be read.
+	Changed []string
+}
+
+// CacheKeyRecord returns the CacheKeyRecord of tasks.
+func (c *Coordinator) CacheKeyRecord(tasks []*Task) (CacheKeyRecord, error) {
+	record := make(CacheKeyRecord, len(tasks))
+	for _, task := range tasks {
+		if len(task.Steps) == 0 {
+			continue
+		}
+		components, err := c.cacheKey(task, c.opts.GlobalEnv, len(task.Steps)-1).Components()
+		if err != nil {
+			return nil, errors.Wrapf(err, "computing cache key of %s", task.Repository.Name)
+		}
+		record[reportName(task)] = components
+	}
+	return record, nil
+}
+
+// ExplainMisses compares the cache keys of misses, which have to be in r, to
+// the ones in prev, which was recorded by an earlier run.
+func (r CacheKeyRecord) ExplainMisses(prev CacheKeyRecord, misses []*Task) []CacheMiss {
+	explained := make([]CacheMiss, 0, len(misses))
+	for _, task := range misses {
+		name := reportName(task)
+		cur, ok := r[name]
+		if !ok {
+			continue
+		}
+		old, ok := prev[name]
+		if !ok {
+			explained = append(explained, CacheMiss{Task: name, New: true})
+			continue
+		}
+
+		miss := CacheMiss{Task: name}
+		// Components that only exist on one side, such as the ones of an
+		// added step, changed too.
+		components := slices.Collect(maps.Keys(cur))
+		for component := range old {
+			if _, ok := cur[component]; !ok {
+				components = append(components, component)
+			}
+		}
+		slices.Sort(components)
+		for _, component := range components {
+			if cur[component] != old[component] {
+				miss.Changed = append(miss.Changed, component)
+			}
+		}
+		explained = append(explained, miss)
+	}
+	return explained
+}
@@ -0,0 +1,67 @@
+package executor
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	batcheslib "github.com/sourcegraph/sourcegraph/lib/batches"
+	"github.com/sourcegraph/sourcegraph/lib/batches/template"
+
+	"github.com/sourcegraph/src-cli/internal/batches/graphql"
+)
+
+func TestCacheKeyRecord_ExplainMisses(t *testing.T) {
+	attrs := &template.BatchChangeAttributes{Name: "cache-keys-test"}
+	steps := []batcheslib.Step{
+		{Run: "echo 1", Container: "alpine:3"},
+		{Run: "echo 2", Container: "alpine:3"},
+	}
+	coord := &Coordinator{opts: NewCoordinatorOpts{}}
+
+	prev, err := coord.CacheKeyRecord([]*Task{
+		{Repository: testRepo1, Steps: steps, BatchChangeAttributes: attrs},
+		{Repository: testRepo2, Steps: steps, BatchChangeAttributes: attrs},
+		{Repository: testRepo2, Path: "sub", Steps: steps, BatchChangeAttributes: attrs},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The run script of the second step changed for the first repository,
+	// and the second one has a new revision and an image that was pinned.
+	changedSteps := []batcheslib.Step{steps[0], {Run: "echo two", Container: "alpine:3"}}
+	pinnedSteps := []batcheslib.Step{{Run: "echo 1", Container: "alpine@sha256:0123456789abcdef0123456789abcdef"}, steps[1]}
+	movedRepo := *testRepo2
+	movedRepo.DefaultBranch = &graphql.Branch{Name: "main", Target: graphql.Target{OID: "c0ff33"}}
+	tasks := []*Task{
+		{Repository: testRepo1, Steps: changedSteps, BatchChangeAttributes: attrs},
+		{Repository: &movedRepo, Steps: pinnedSteps, BatchChangeAttributes: attrs},
+		{Repository: testRepo2, Path: "sub", Steps: steps, BatchChangeAttributes: attrs},
+		{Repository: testRepo1, Path: "new", Steps: append(steps, batcheslib.Step{Run: "echo 3"}), BatchChangeAttributes: attrs},
+	}
+	record, err := coord.CacheKeyRecord(tasks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []CacheMiss{
+		{Task: testRepo1.Name, Changed: []string{"step 2 run"}},
+		{Task: testRepo2.Name, Changed: []string{"revision", "step 1 container"}},
+		{Task: testRepo2.Name + ":sub"},
+		{Task: testRepo1.Name + ":new", New: true},
+	}
+	if diff := cmp.Diff(want, record.ExplainMisses(prev, tasks)); diff != "" {
+		t.Errorf("wrong misses (-want +have):\n%s", diff)
+	}
+
+	// Added steps are changes too.
+	longer := []*Task{{Repository: testRepo1, Steps: append(steps, batcheslib.Step{Run: "echo 3"}), BatchChangeAttributes: attrs}}
+	if record, err = coord.CacheKeyRecord(longer); err != nil {
+		t.Fatal(err)
+	}
+	want = []CacheMiss{{Task: testRepo1.Name, Changed: []string{"step 3", "step 3 container", "step 3 env", "step 3 run"}}}
+	if diff := cmp.Diff(want, record.ExplainMisses(prev, longer)); diff != "" {
+		t.Errorf("wrong misses for added step (-want +have):\n%s", diff)
+	}
+}
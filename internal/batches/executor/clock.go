@@ -0,0 +1,46 @@
+package executor
+
+import (
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Clock tells the executor and the Coordinator the time, for the timestamps
+// of Tasks, Events and TaskStatuses. It's NewExecutorOpts.Clock, so that tests
+// can use a clock they control. The phase timings of
+// NewExecutorOpts.VerboseTimings aren't affected, since they measure
+// durations with the monotonic clock.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// clock returns NewExecutorOpts.Clock, or the real clock if it's not set.
+func (o NewExecutorOpts) clock() Clock {
+	if o.Clock == nil {
+		return realClock{}
+	}
+	return o.Clock
+}
+
+// jitter returns random durations for NewExecutorOpts.StartJitter. It's safe
+// for concurrent use.
+type jitter struct {
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// n returns a random duration in [0, d). It uses the global source of
+// randomness if j.rand is nil.
+func (j *jitter) n(d time.Duration) time.Duration {
+	if j.rand == nil {
+		return rand.N(d)
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return time.Duration(j.rand.Int64N(int64(d)))
+}
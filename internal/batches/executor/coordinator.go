@@ -2,19 +2,38 @@ package executor
 
 import (
 	"context"
-
+	"encoding/json"
+	"io"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sourcegraph/conc/pool"
+	"github.com/sourcegraph/go-diff/diff"
 	"github.com/sourcegraph/sourcegraph/lib/errors"
 
 	batcheslib "github.com/sourcegraph/sourcegraph/lib/batches"
 	"github.com/sourcegraph/sourcegraph/lib/batches/execution"
 	"github.com/sourcegraph/sourcegraph/lib/batches/execution/cache"
+	"github.com/sourcegraph/sourcegraph/lib/batches/git"
 
+	"github.com/sourcegraph/src-cli/internal/batches/graphql"
 	"github.com/sourcegraph/src-cli/internal/batches/log"
+	"github.com/sourcegraph/src-cli/internal/batches/util"
 )
 
 type taskExecutor interface {
 	Start(context.Context, []*Task, TaskExecutionUI)
 	Wait() ([]taskResult, error)
+	CancelTask(repoName string) bool
+	SubscribeLog(key string) (*log.Subscription, bool)
+	Pause()
+	Resume()
+	Paused() bool
+
+	setResultHandler(func(taskResult))
 }
 
 // Coordinator coordinates the execution of Tasks. It makes use of an executor,
@@ -24,29 +43,184 @@ type Coordinator struct {
 	opts NewCoordinatorOpts
 
 	exec taskExecutor
+	// completeHook is shared with the executor, so that the calls of the hook
+	// for cached and executed Tasks are serialized.
+	completeHook *taskCompleteHook
+	// events is shared with the executor, so that the events of cached and
+	// executed Tasks end up in the same stream.
+	events *eventLog
+	// spill is shared with the executor, which spills the diffs of the Tasks
+	// that the Coordinator builds the ChangesetSpecs of.
+	spill *diffSpill
+
+	cacheHits   atomic.Int64
+	cacheMisses atomic.Int64
+	cacheClears atomic.Int64
+	readErrors  atomic.Int64
+
+	// filtered is the number of Tasks whose diff was dropped because it's
+	// below ExecOpts.MinChangedLines.
+	filtered atomic.Int64
+
+	// missingListed holds the names in RepoList and OnlyRepos that none of
+	// the Tasks passed to FilterTasks is in.
+	missingListed []string
+
+	// unchanged holds the names of the repositories of the Tasks that
+	// CheckCache found a cached empty diff for in ExecOpts.RequireChanges
+	// mode.
+	unchanged []string
+
+	// uploaded holds the IDs of the ChangesetSpecs that were uploaded by
+	// ExecuteAndBuildSpecs in UploadConcurrently mode.
+	uploadedMu sync.Mutex
+	uploaded   map[*batcheslib.ChangesetSpec]graphql.ChangesetSpecID
+
+	// specsMu serializes the writes to opts.SpecsWriter.
+	specsMu sync.Mutex
+
+	// additional holds the repositories of the additional changesets
+	// declared by the outputs of the Tasks.
+	additional additionalRepos
+
+	reporter runReporter
+}
+
+// CacheStats holds the number of Tasks that were completely served from the
+// cache, that had to be executed, and whose cache entries were cleared.
+type CacheStats struct {
+	Hits   int
+	Misses int
+	Clears int
+	// ReadErrors is the number of cached results that couldn't be read and
+	// were treated as misses because of ExecOpts.CacheReadFailuresAreMisses.
+	ReadErrors int
+}
+
+// CacheStats returns the CacheStats accumulated by CheckCache and ClearCache.
+func (c *Coordinator) CacheStats() CacheStats {
+	return CacheStats{
+		Hits:       int(c.cacheHits.Load()),
+		Misses:     int(c.cacheMisses.Load()),
+		Clears:     int(c.cacheClears.Load()),
+		ReadErrors: int(c.readErrors.Load()),
+	}
 }
 
 type NewCoordinatorOpts struct {
 	ExecOpts NewExecutorOpts
 
+	// OnlyRepos limits execution to the repositories with the given names.
+	// If empty, all repositories are executed.
+	OnlyRepos []string
+	// RepoList, if set, limits execution to the repositories with the given
+	// names as well, such as the ones read from a curated list with
+	// ParseRepoList.
+	RepoList []string
+
 	Cache       cache.Cache
 	Logger      log.LogManager
 	GlobalEnv   []string
 	BinaryDiffs bool
+	// BodyFooter is a changeset template that's appended to the body of
+	// every changeset, such as a disclaimer.
+	BodyFooter string
+	// DefaultAuthor is the author of the commits of changesets whose
+	// changeset template doesn't specify one, and whose changes aren't all
+	// owned by the same author in AuthorOwners. If nil, the Sourcegraph
+	// default author is used.
+	DefaultAuthor *batcheslib.ChangesetSpecAuthor
+	// AuthorOwners, if set, determines the author of the commits of
+	// changesets whose changeset template doesn't specify one.
+	AuthorOwners *AuthorOwners
+	// FileLabels, if set, derives labels from the files changed by every
+	// Task that produces changeset specs, which are added to the RunReport.
+	FileLabels FileLabels
+	// ResolveRepository resolves the repositories of the additional
+	// changesets declared by outputs with Changesets set. If nil, Tasks that
+	// declare additional changesets fail.
+	ResolveRepository RepositoryResolver
 
 	IsRemote bool
+
+	// UploadConcurrently makes ExecuteAndBuildSpecs upload the ChangesetSpecs
+	// of every Task with UploadSpec as soon as the Task finished, so that the
+	// uploads overlap with the execution of the remaining Tasks.
+	UploadConcurrently bool
+	UploadSpec         SpecUploader
+
+	// SpecsWriter, if set, makes ExecuteAndBuildSpecs write the ChangesetSpecs
+	// of every Task to it as JSON lines as soon as the Task finished, so that
+	// the specs of the finished Tasks are kept if the execution is aborted.
+	SpecsWriter io.Writer
+	// DiscardSpecs makes ExecuteAndBuildSpecs not return the ChangesetSpecs
+	// of the executed Tasks, which are only written to SpecsWriter, so that
+	// they don't have to be held in memory.
+	DiscardSpecs bool
+	// OnCacheHit, if set, is called by CheckCache with every Task that's
+	// completely served from the cache and the ChangesetSpecs built for it,
+	// as soon as they're found. Cached Tasks are never executed, so they
+	// aren't passed to the TaskExecutionUI.
+	OnCacheHit func(task *Task, specs []*batcheslib.ChangesetSpec)
 }
 
 func NewCoordinator(opts NewCoordinatorOpts) *Coordinator {
+	exec := NewExecutor(opts.ExecOpts)
 	return &Coordinator{
-		opts: opts,
-		exec: NewExecutor(opts.ExecOpts),
+		opts:         opts,
+		exec:         exec,
+		completeHook: exec.completeHook,
+		events:       exec.events,
+		spill:        exec.spill,
+	}
+}
+
+// FilteredTasks returns the number of Tasks for which no changeset specs were
+// built because their diff changed fewer than ExecOpts.MinChangedLines lines.
+func (c *Coordinator) FilteredTasks() int {
+	return int(c.filtered.Load())
+}
+
+// Report returns the outcomes of the Tasks passed to CheckCache and
+// ExecuteAndBuildSpecs so far.
+func (c *Coordinator) Report() RunReport {
+	report := c.reporter.get()
+	report.Annotations = maps.Clone(c.opts.ExecOpts.Annotations)
+	return report
+}
+
+// UploadedChangesetSpecID returns the ID of the given ChangesetSpec, if it was
+// already uploaded by ExecuteAndBuildSpecs.
+func (c *Coordinator) UploadedChangesetSpecID(spec *batcheslib.ChangesetSpec) (graphql.ChangesetSpecID, bool) {
+	c.uploadedMu.Lock()
+	defer c.uploadedMu.Unlock()
+
+	id, ok := c.uploaded[spec]
+	return id, ok
+}
+
+// LoadChangesetSpec returns spec with the diffs of its commits. If they were
+// spilled to disk because of ExecOpts.SpillDiffsOver, they're read back into
+// a copy of spec, so that they only take up memory while the copy is used.
+func (c *Coordinator) LoadChangesetSpec(spec *batcheslib.ChangesetSpec) (*batcheslib.ChangesetSpec, error) {
+	loaded, err := c.spill.loadSpec(spec)
+	if err != nil {
+		return nil, errors.Wrapf(err, "loading changeset spec for %s", spec.BaseRepository)
 	}
+	return loaded, nil
+}
+
+// RemoveSpilledDiffs removes the files the diffs were spilled to because of
+// ExecOpts.SpillDiffsOver. The ChangesetSpecs whose diffs were spilled can't
+// be loaded anymore afterwards.
+func (c *Coordinator) RemoveSpilledDiffs() error {
+	return c.spill.remove()
 }
 
 // CheckCache checks whether the internal ExecutionCache contains
 // ChangesetSpecs for the given Tasks. If cached ChangesetSpecs exist, those
-// are returned, otherwise the Task, to be executed later.
+// are returned, otherwise the Task, to be executed later. The cached
+// ChangesetSpecs are also written to opts.SpecsWriter, if it's set.
 func (c *Coordinator) CheckCache(ctx context.Context, batchSpec *batcheslib.BatchSpec, tasks []*Task) (uncached []*Task, specs []*batcheslib.ChangesetSpec, err error) {
 	for _, t := range tasks {
 		cachedSpecs, found, err := c.checkCacheForTask(ctx, batchSpec, t)
@@ -55,29 +229,180 @@ func (c *Coordinator) CheckCache(ctx context.Context, batchSpec *batcheslib.Batc
 		}
 
 		if !found {
+			c.cacheMisses.Add(1)
 			uncached = append(uncached, t)
 			continue
 		}
 
+		c.cacheHits.Add(1)
+		c.reporter.add(&c.reporter.report.Cached, t)
+		c.events.emit(EventTaskCached, t, nil)
+		if c.opts.OnCacheHit != nil {
+			c.opts.OnCacheHit(t, cachedSpecs)
+		}
+		if err := c.writeSpecs(cachedSpecs); err != nil {
+			return nil, nil, err
+		}
+		if err := c.spill.spillSpecs(cachedSpecs); err != nil {
+			return nil, nil, err
+		}
 		specs = append(specs, cachedSpecs...)
 	}
 
 	return uncached, specs, nil
 }
 
+// FilterTasks drops all Tasks whose repository isn't listed in OnlyRepos or
+// RepoList, and, if ExecOpts.Wave is set, all Tasks that AssignWaves doesn't
+// assign to that wave. It returns the remaining Tasks and the number of Tasks
+// that were dropped. If none is set, all Tasks are returned.
+func (c *Coordinator) FilterTasks(tasks []*Task) (filtered []*Task, skipped int) {
+	if len(c.opts.OnlyRepos) == 0 && len(c.opts.RepoList) == 0 && c.opts.ExecOpts.Wave == "" {
+		return tasks, 0
+	}
+
+	// Waves are assigned before the Tasks are limited to OnlyRepos, so that
+	// the waves don't depend on it.
+	if c.opts.ExecOpts.Wave != "" {
+		AssignWaves(tasks, c.opts.ExecOpts.Waves)
+	}
+
+	// only and listed record for every name whether any of the Tasks is in
+	// that repository, even if the Task is dropped.
+	only := make(map[string]bool, len(c.opts.OnlyRepos))
+	for _, name := range c.opts.OnlyRepos {
+		only[name] = false
+	}
+	listed := make(map[string]bool, len(c.opts.RepoList))
+	for _, name := range c.opts.RepoList {
+		listed[name] = false
+	}
+
+	for _, t := range tasks {
+		_, inOnly := only[t.Repository.Name]
+		if inOnly {
+			only[t.Repository.Name] = true
+		}
+		_, inListed := listed[t.Repository.Name]
+		if inListed {
+			listed[t.Repository.Name] = true
+		}
+
+		if (len(only) > 0 && !inOnly) || (len(listed) > 0 && !inListed) {
+			skipped++
+			continue
+		}
+		if c.opts.ExecOpts.Wave != "" && t.Wave != c.opts.ExecOpts.Wave {
+			skipped++
+			continue
+		}
+		filtered = append(filtered, t)
+	}
+
+	c.missingListed = nil
+	for _, name := range c.opts.RepoList {
+		if !listed[name] {
+			c.missingListed = append(c.missingListed, name)
+		}
+	}
+	for _, name := range c.opts.OnlyRepos {
+		if !only[name] && !slices.Contains(c.missingListed, name) {
+			c.missingListed = append(c.missingListed, name)
+		}
+	}
+	return filtered, skipped
+}
+
+// InFlight returns the TaskStatus of every Task that's currently being
+// executed, in the order they were started. It can be called while
+// ExecuteAndBuildSpecs is running, such as to diagnose runs that appear to be
+// stuck.
+func (c *Coordinator) InFlight() []TaskStatus {
+	return c.events.inFlightStatuses()
+}
+
+// MissingListedRepos returns the names in RepoList and OnlyRepos that none of
+// the Tasks passed to FilterTasks is in, such as misspelled names, in the order
+// they're listed, starting with RepoList.
+func (c *Coordinator) MissingListedRepos() []string {
+	return c.missingListed
+}
+
+// LimitTasks drops the Tasks after the first ExecOpts.MaxTasks, if it's set. It
+// returns the remaining Tasks and the number of Tasks that were dropped.
+func (c *Coordinator) LimitTasks(tasks []*Task) (limited []*Task, dropped int) {
+	max := c.opts.ExecOpts.MaxTasks
+	if max <= 0 || len(tasks) <= max {
+		return tasks, 0
+	}
+	return tasks[:max], len(tasks) - max
+}
+
+// CancelTask cancels the running Tasks in the repository with the given name
+// while letting all other Tasks continue. It returns whether a running Task
+// was found.
+func (c *Coordinator) CancelTask(repoName string) bool {
+	return c.exec.CancelTask(repoName)
+}
+
+// SubscribeLog subscribes to the live log of the running Task with the given
+// TaskStatus, such as one loaded from the StatusStore. The Subscription
+// receives the recent lines of the log and then every line as it's written,
+// until the Task is done or the Subscription is closed. It returns false if
+// the Task isn't running.
+func (c *Coordinator) SubscribeLog(status TaskStatus) (*log.Subscription, bool) {
+	return c.exec.SubscribeLog(status.Key())
+}
+
+// Pause stops new Tasks from being started by ExecuteAndBuildSpecs until
+// Resume is called, while the running Tasks finish.
+func (c *Coordinator) Pause() {
+	c.exec.Pause()
+}
+
+// Resume starts Tasks again after Pause.
+func (c *Coordinator) Resume() {
+	c.exec.Resume()
+}
+
+// Paused returns whether the Coordinator is paused.
+func (c *Coordinator) Paused() bool {
+	return c.exec.Paused()
+}
+
+// ClearCache clears the cache entries of the Tasks, and all other entries of
+// their batch changes, such as the ones of repositories that aren't in the
+// batch spec anymore. The entries of other batch changes are kept.
 func (c *Coordinator) ClearCache(ctx context.Context, tasks []*Task) error {
+	scopes := make(map[string]struct{})
 	for _, task := range tasks {
 		for i := len(task.Steps) - 1; i > -1; i-- {
-			key := task.CacheKey(c.opts.GlobalEnv, c.opts.ExecOpts.WorkingDirectory, i)
+			key := c.cacheKey(task, c.opts.GlobalEnv, i)
 			if err := c.opts.Cache.Clear(ctx, key); err != nil {
 				return errors.Wrapf(err, "clearing cache for step %d in %q", i, task.Repository.Name)
 			}
+			if scope := key.Scope(); scope != "" {
+				scopes[scope] = struct{}{}
+			}
+		}
+		c.cacheClears.Add(1)
+	}
+	for _, scope := range slices.Sorted(maps.Keys(scopes)) {
+		if err := c.opts.Cache.ClearScope(ctx, scope); err != nil {
+			return errors.Wrapf(err, "clearing cache of batch change %q", scope)
 		}
 	}
 	return nil
 }
 
 func (c *Coordinator) checkCacheForTask(ctx context.Context, batchSpec *batcheslib.BatchSpec, task *Task) (specs []*batcheslib.ChangesetSpec, found bool, err error) {
+	// The cache key doesn't include the precondition, so Tasks whose
+	// precondition isn't met are never served from the cache. The executor
+	// skips them, or reports the error of the precondition.
+	if met, err := task.preconditionMet(); err != nil || !met {
+		return specs, false, nil
+	}
+
 	if err := c.loadCachedStepResults(ctx, task, c.opts.GlobalEnv); err != nil {
 		return specs, false, err
 	}
@@ -86,22 +411,70 @@ func (c *Coordinator) checkCacheForTask(ctx context.Context, batchSpec *batchesl
 	// we build changeset specs and return.
 	// TODO: This doesn't consider skipped steps.
 	if task.CachedStepResultFound && task.CachedStepResult.StepIndex == len(task.Steps)-1 {
+		if err := c.cachedTaskCompleted(task); err != nil {
+			return specs, false, err
+		}
+
+		if task.changesetSkippedBy(task.CachedStepResult.Outputs) != "" {
+			return specs, true, nil
+		}
+
 		// If the cached result resulted in an empty diff, we don't need to
 		// add it to the list of specs that are displayed to the user and
 		// send to the server. Instead, we can just report that the task is
 		// complete and move on.
 		if len(task.CachedStepResult.Diff) == 0 {
+			if c.opts.ExecOpts.RequireChanges {
+				c.unchanged = append(c.unchanged, task.Repository.Name)
+			}
+			return specs, true, nil
+		}
+		if _, below := c.belowMinChangedLines(task.CachedStepResult.Diff); below {
+			c.filtered.Add(1)
 			return specs, true, nil
 		}
 
-		specs, err = c.buildChangesetSpecs(task, batchSpec, task.CachedStepResult)
+		specs, err = c.buildChangesetSpecs(ctx, task, batchSpec, task.CachedStepResult)
 		return specs, true, err
 	}
 
 	return specs, false, nil
 }
 
-func (c *Coordinator) buildChangesetSpecs(task *Task, batchSpec *batcheslib.BatchSpec, result execution.AfterStepResult) ([]*batcheslib.ChangesetSpec, error) {
+// cachedTaskCompleted calls the task completion hook for a Task that is
+// completely served from the cache.
+func (c *Coordinator) cachedTaskCompleted(task *Task) error {
+	if !c.completeHook.enabled() {
+		return nil
+	}
+
+	l, err := c.opts.Logger.AddTask(util.SlugForPathInRepo(task.Repository.Name, task.Repository.Rev(), task.Path))
+	if err != nil {
+		return errors.Wrap(err, "creating log file")
+	}
+	defer l.Close()
+
+	now := c.opts.ExecOpts.clock().Now()
+	completion := TaskCompletion{
+		Task:       task,
+		Cached:     true,
+		Diff:       task.CachedStepResult.Diff,
+		EnqueuedAt: now,
+		StartedAt:  now,
+		FinishedAt: now,
+	}
+	if err := c.completeHook.call(completion, l); err != nil {
+		l.MarkErrored()
+		return errors.Wrapf(err, "completing cached task for %s", task.Repository.Name)
+	}
+	return nil
+}
+
+func (c *Coordinator) buildChangesetSpecs(ctx context.Context, task *Task, batchSpec *batcheslib.BatchSpec, result execution.AfterStepResult) ([]*batcheslib.ChangesetSpec, error) {
+	if err := c.writePatch(task, result.Diff); err != nil {
+		return nil, err
+	}
+
 	version := 1
 	if c.opts.BinaryDiffs {
 		version = 2
@@ -112,31 +485,103 @@ func (c *Coordinator) buildChangesetSpecs(task *Task, batchSpec *batcheslib.Batc
 			Name:        task.Repository.Name,
 			FileMatches: task.Repository.SortedFileMatches(),
 			BaseRef:     task.Repository.BaseRef(),
-			BaseRev:     task.Repository.Rev(),
+			BaseRev:     task.BaseRev(),
 		},
 		Path:                  task.Path,
 		BatchChangeAttributes: task.BatchChangeAttributes,
 		Template:              batchSpec.ChangesetTemplate,
 		TransformChanges:      batchSpec.TransformChanges,
+		BodyFooter:            c.opts.BodyFooter,
 
 		Result: execution.AfterStepResult{
 			Version:      version,
 			Diff:         result.Diff,
 			ChangedFiles: result.ChangedFiles,
 			Outputs:      result.Outputs,
+
+			Commits:         result.Commits,
+			UncommittedDiff: result.UncommittedDiff,
 		},
 	}
 
-	return batcheslib.BuildChangesetSpecs(input, c.opts.BinaryDiffs, nil)
+	specs, err := batcheslib.BuildChangesetSpecs(input, c.opts.BinaryDiffs, c.fallbackAuthor(result.ChangedFiles))
+	if err != nil {
+		return nil, err
+	}
+	// The additional changesets declared by the outputs are only created
+	// along with the changesets of the Task's own repository.
+	additional, err := c.buildAdditionalChangesetSpecs(ctx, task, batchSpec, result.Outputs)
+	if err != nil {
+		return nil, errors.Wrap(err, "building additional changeset specs")
+	}
+	specs = append(specs, additional...)
+	if labels := c.opts.FileLabels.Labels(result.ChangedFiles); len(labels) > 0 {
+		c.reporter.label(task, labels)
+	}
+	c.reporter.built(task, specs)
+	return specs, nil
+}
+
+// fallbackAuthor returns the author of the commits of changesets whose
+// changeset template doesn't specify one: the single author that owns all
+// changes in AuthorOwners, or else DefaultAuthor.
+func (c *Coordinator) fallbackAuthor(changes git.Changes) *batcheslib.ChangesetSpecAuthor {
+	if c.opts.AuthorOwners != nil {
+		if author, ok := c.opts.AuthorOwners.Author(changes); ok {
+			return author
+		}
+	}
+	return c.opts.DefaultAuthor
+}
+
+// belowMinChangedLines returns the number of lines added and removed by d, and
+// whether that's below ExecOpts.MinChangedLines. Diffs that can't be parsed,
+// or that contain files without hunks, such as binary files or renames, are
+// never below the threshold.
+func (c *Coordinator) belowMinChangedLines(d []byte) (changed int, below bool) {
+	if c.opts.ExecOpts.MinChangedLines <= 0 {
+		return 0, false
+	}
+
+	fileDiffs, err := diff.ParseMultiFileDiff(d)
+	if err != nil {
+		return 0, false
+	}
+	for _, fd := range fileDiffs {
+		if len(fd.Hunks) == 0 {
+			return 0, false
+		}
+		stat := fd.Stat()
+		changed += int(stat.Added + 2*stat.Changed + stat.Deleted)
+	}
+	return changed, changed < c.opts.ExecOpts.MinChangedLines
+}
+
+// cacheKey returns the key of the cached result of the step with stepIndex,
+// which depends on the diff options of the executor.
+func (c *Coordinator) cacheKey(task *Task, globalEnv []string, stepIndex int) *cache.CacheKey {
+	return task.cacheKey(globalEnv, c.opts.ExecOpts.WorkingDirectory, stepIndex, c.opts.ExecOpts.DiffOptions)
 }
 
 func (c *Coordinator) loadCachedStepResults(ctx context.Context, task *Task, globalEnv []string) error {
+	// Diffs without the contents of binary files can't be applied to the
+	// workspace to resume the execution after a cached step, so only the
+	// result of the last step can be used.
+	first := 0
+	if c.opts.ExecOpts.DiffOptions.NoBinary {
+		first = len(task.Steps) - 1
+	}
+
 	// We start at the back so that we can find the _last_ cached step,
 	// then restart execution on the following step.
-	for i := len(task.Steps) - 1; i > -1; i-- {
-		key := task.CacheKey(globalEnv, c.opts.ExecOpts.WorkingDirectory, i)
+	for i := len(task.Steps) - 1; i >= first; i-- {
+		key := c.cacheKey(task, globalEnv, i)
 
 		result, found, err := c.opts.Cache.Get(ctx, key)
+		if err != nil && c.opts.ExecOpts.CacheReadFailuresAreMisses {
+			c.readErrors.Add(1)
+			continue
+		}
 		if err != nil {
 			return errors.Wrapf(err, "checking for cached diff for step %d", i)
 		}
@@ -153,63 +598,214 @@ func (c *Coordinator) loadCachedStepResults(ctx context.Context, task *Task, glo
 }
 
 func (c *Coordinator) buildSpecs(ctx context.Context, batchSpec *batcheslib.BatchSpec, taskResult taskResult, ui TaskExecutionUI) ([]*batcheslib.ChangesetSpec, error) {
-	if len(taskResult.stepResults) == 0 {
+	stepResults, err := taskResult.loadStepResults()
+	if err != nil {
+		c.reporter.failed(taskResult.task, err)
+		return nil, err
+	}
+	if len(stepResults) == 0 {
+		c.reporter.add(&c.reporter.report.Empty, taskResult.task)
 		return nil, nil
 	}
 
-	lastStepResult := taskResult.stepResults[len(taskResult.stepResults)-1]
+	lastStepResult := stepResults[len(stepResults)-1]
+
+	// A step can decide that no changeset should be created, regardless of
+	// the diff.
+	if output := taskResult.task.changesetSkippedBy(lastStepResult.Outputs); output != "" {
+		ui.TaskChangesetSpecsSkipped(taskResult.task, output)
+		c.reporter.add(&c.reporter.report.Skipped, taskResult.task)
+		return nil, nil
+	}
 
 	// If the steps didn't result in any diff, we don't need to create a
 	// changeset spec that's displayed to the user and send to the server.
 	if len(lastStepResult.Diff) == 0 {
+		c.reporter.add(&c.reporter.report.Empty, taskResult.task)
+		return nil, nil
+	}
+	if changed, below := c.belowMinChangedLines(lastStepResult.Diff); below {
+		c.filtered.Add(1)
+		ui.TaskChangesetSpecsFiltered(taskResult.task, changed)
+		c.reporter.add(&c.reporter.report.Empty, taskResult.task)
 		return nil, nil
 	}
 
 	// Build the changeset specs.
-	specs, err := c.buildChangesetSpecs(taskResult.task, batchSpec, lastStepResult)
+	specs, err := c.buildChangesetSpecs(ctx, taskResult.task, batchSpec, lastStepResult)
 	if err != nil {
+		c.reporter.failed(taskResult.task, err)
 		return nil, err
 	}
+	c.reporter.add(&c.reporter.report.Created, taskResult.task)
 
 	ui.TaskChangesetSpecsBuilt(taskResult.task, specs)
 	return specs, nil
 }
 
+// streamSpecs builds the ChangesetSpecs for the given taskResult, writes them
+// to opts.SpecsWriter if it's set, and uploads them in UploadConcurrently
+// mode. The built specs are returned even if uploading them failed.
+func (c *Coordinator) streamSpecs(ctx context.Context, batchSpec *batcheslib.BatchSpec, taskResult taskResult, ui TaskExecutionUI) ([]*batcheslib.ChangesetSpec, error) {
+	specs, err := c.buildSpecs(ctx, batchSpec, taskResult, ui)
+	if err != nil {
+		return nil, errors.Wrapf(err, "building changeset specs for %s", taskResult.task.Repository.Name)
+	}
+
+	if err := c.writeSpecs(specs); err != nil {
+		return specs, err
+	}
+	if !c.opts.UploadConcurrently {
+		return specs, nil
+	}
+
+	for _, spec := range specs {
+		id, err := UploadChangesetSpec(ctx, c.opts.UploadSpec, spec)
+		if err != nil {
+			err = ChangesetSpecUploadErr{Err: err, Repository: taskResult.task.Repository.Name}
+			ui.TaskChangesetSpecsUploadFailed(taskResult.task, err)
+			return specs, err
+		}
+
+		c.uploadedMu.Lock()
+		if c.uploaded == nil {
+			c.uploaded = make(map[*batcheslib.ChangesetSpec]graphql.ChangesetSpecID)
+		}
+		c.uploaded[spec] = id
+		c.uploadedMu.Unlock()
+	}
+
+	return specs, nil
+}
+
+// writeSpecs writes specs to opts.SpecsWriter, one JSON object per line.
+func (c *Coordinator) writeSpecs(specs []*batcheslib.ChangesetSpec) error {
+	if c.opts.SpecsWriter == nil || len(specs) == 0 {
+		return nil
+	}
+
+	c.specsMu.Lock()
+	defer c.specsMu.Unlock()
+
+	enc := json.NewEncoder(c.opts.SpecsWriter)
+	for _, spec := range specs {
+		if err := enc.Encode(spec); err != nil {
+			return errors.Wrap(err, "writing changeset spec")
+		}
+	}
+	return nil
+}
+
+type streamedSpecs struct {
+	specs []*batcheslib.ChangesetSpec
+	err   error
+}
+
 // ExecuteAndBuildSpecs executes the given tasks and builds changeset specs for the results.
 // It calls the ui on updates.
 func (c *Coordinator) ExecuteAndBuildSpecs(ctx context.Context, batchSpec *batcheslib.BatchSpec, tasks []*Task, ui TaskExecutionUI) ([]*batcheslib.ChangesetSpec, []string, error) {
 	ui.Start(tasks)
 
+	// In UploadConcurrently mode, or if the specs are written to
+	// SpecsWriter, the specs of every Task are built, written and uploaded as
+	// soon as it finished, while the other Tasks keep running.
+	var (
+		uploads    = pool.New().WithMaxGoroutines(max(c.opts.ExecOpts.Parallelism, 1))
+		streamedMu sync.Mutex
+		streamed   = make(map[*Task]streamedSpecs)
+	)
+	if c.opts.UploadConcurrently || c.opts.SpecsWriter != nil {
+		c.exec.setResultHandler(func(res taskResult) {
+			uploads.Go(func() {
+				specs, err := c.streamSpecs(ctx, batchSpec, res, ui)
+				if c.opts.DiscardSpecs {
+					specs = nil
+				} else if spillErr := c.spill.spillSpecs(specs); spillErr != nil {
+					err = errors.Append(err, spillErr)
+				}
+				streamedMu.Lock()
+				streamed[res.task] = streamedSpecs{specs: specs, err: err}
+				streamedMu.Unlock()
+			})
+		})
+	}
+
 	// Run executor.
 	c.exec.Start(ctx, tasks, ui)
 	results, errs := c.exec.Wait()
+	uploads.Wait()
 
 	// Write all step cache results to the cache.
 	for _, res := range results {
-		for _, stepRes := range res.stepResults {
-			cacheKey := res.task.CacheKey(c.opts.GlobalEnv, c.opts.ExecOpts.WorkingDirectory, stepRes.StepIndex)
+		cachingStarted := time.Now()
+		stepResults, err := res.loadStepResults()
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "caching results of %s", res.task.Repository.Name)
+		}
+		for _, stepRes := range stepResults {
+			cacheKey := c.cacheKey(res.task, c.opts.GlobalEnv, stepRes.StepIndex)
 			if err := c.opts.Cache.Set(ctx, cacheKey, stepRes); err != nil {
 				return nil, nil, errors.Wrapf(err, "caching result for step %d", stepRes.StepIndex)
 			}
 		}
+		// The log of the Task is closed by now, so the time it took to cache
+		// its results is only reported to the UI.
+		if res.timer != nil {
+			res.timer.record(PhaseCache, time.Since(cachingStarted))
+			ui.TaskPhaseTimings(res.task, res.timer.phaseDurations())
+		}
+	}
+
+	// Tasks whose empty diff was cached fail just like the executed ones in
+	// RequireChanges mode.
+	for _, name := range c.unchanged {
+		errs = errors.Append(errs, errors.Wrapf(ErrNoChanges, "cached result for %s", name))
 	}
 
 	var specs []*batcheslib.ChangesetSpec
 
 	// Build ChangesetSpecs if possible and add to list.
 	for _, taskResult := range results {
-		// Don't build changeset specs for failed workspaces.
+		// Don't build changeset specs for failed workspaces. Tasks that
+		// failed before they were started don't have a result.
 		if taskResult.err != nil {
+			if taskResult.task != nil {
+				c.reporter.failed(taskResult.task, taskResult.err)
+			}
 			continue
 		}
 
+		// The specs of the Tasks that have been streamed are already built.
+		// Failed uploads are retried by the caller.
+		if s, ok := streamed[taskResult.task]; ok {
+			if s.err != nil {
+				errs = errors.Append(errs, s.err)
+			}
+			specs = append(specs, s.specs...)
+			continue
+		}
+
+		// A failure to build the specs, such as a broken template in the
+		// changesetTemplate, only fails this task, not the whole execution.
 		taskSpecs, err := c.buildSpecs(ctx, batchSpec, taskResult, ui)
 		if err != nil {
-			return nil, nil, err
+			errs = errors.Append(errs, errors.Wrapf(err, "building changeset specs for %s", taskResult.task.Repository.Name))
+			continue
+		}
+		if err := c.spill.spillSpecs(taskSpecs); err != nil {
+			errs = errors.Append(errs, err)
+			continue
 		}
 
 		specs = append(specs, taskSpecs...)
 	}
+	for _, res := range results {
+		res.removeSpilled()
+	}
 
+	// Like Wait, return the errors grouped by Task.
+	if multi, ok := errs.(errors.MultiError); ok {
+		errs = newRunErrors(multi.Errors()...)
+	}
 	return specs, c.opts.Logger.LogFiles(), errs
 }
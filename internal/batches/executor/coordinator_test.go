@@ -1,16 +1,22 @@
 package executor
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 
 	"github.com/sourcegraph/sourcegraph/lib/batches/execution"
 	"github.com/sourcegraph/sourcegraph/lib/batches/overridable"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
 
 	batcheslib "github.com/sourcegraph/sourcegraph/lib/batches"
 	"github.com/sourcegraph/sourcegraph/lib/batches/execution/cache"
@@ -18,13 +24,35 @@ import (
 	"github.com/sourcegraph/sourcegraph/lib/batches/template"
 
 	"github.com/sourcegraph/src-cli/internal/batches/graphql"
+	"github.com/sourcegraph/src-cli/internal/batches/log"
 	"github.com/sourcegraph/src-cli/internal/batches/mock"
 	"github.com/sourcegraph/src-cli/internal/batches/util"
+	"github.com/sourcegraph/src-cli/internal/batches/workspace"
 )
 
 func TestCoordinator_Execute(t *testing.T) {
 	publishedFalse := overridable.FromBoolOrString(false)
+	var publishedDraftInSrcCLI overridable.BoolOrString
+	if err := json.Unmarshal([]byte(`[{"*": true}, {"github.com/sourcegraph/src-cli": "draft"}]`), &publishedDraftInSrcCLI); err != nil {
+		t.Fatal(err)
+	}
+	draftTemplate := *testChangesetTemplate
+	draftTemplate.Published = &publishedDraftInSrcCLI
+	updateTemplate := *testChangesetTemplate
+	updateTemplate.UpdateBranch = true
+
+	var publishedPerBranch overridable.BoolOrString
+	if err := json.Unmarshal([]byte(`[{"*": true}, {"github.com/sourcegraph/src-cli": "draft"}, {"*@in-directory-*": false}, {"github.com/sourcegraph/sourcegraph@in-directory-b": "draft"}]`), &publishedPerBranch); err != nil {
+		t.Fatal(err)
+	}
+	branchTemplate := *testChangesetTemplate
+	branchTemplate.Published = &publishedPerBranch
 	srcCLITask := &Task{Repository: testRepo1, Steps: []batcheslib.Step{{Run: "echo Hello World"}}}
+	// The head branch of the changeset in testRepo1 exists, see
+	// Service.ResolveHeadBranches.
+	headRepo1 := *testRepo1
+	headRepo1.Branch = graphql.Branch{Name: "main", Target: graphql.Target{OID: "h34db33f"}}
+	headTask := &Task{Repository: &headRepo1, Steps: []batcheslib.Step{{Run: "echo Hello again"}}}
 	sourcegraphTask := &Task{Repository: testRepo2, Steps: []batcheslib.Step{{Run: "echo Hello Sourcegraph"}}}
 
 	buildSpecFor := func(repo *graphql.Repository, modify func(*batcheslib.ChangesetSpec)) *batcheslib.ChangesetSpec {
@@ -183,6 +211,216 @@ func TestCoordinator_Execute(t *testing.T) {
 				}),
 			},
 		},
+		{
+			name:  "body footer",
+			tasks: []*Task{srcCLITask, sourcegraphTask},
+
+			batchSpec: &batcheslib.BatchSpec{
+				Name:        "my-batch-change",
+				Description: "the description",
+				ChangesetTemplate: &batcheslib.ChangesetTemplate{
+					Title: testChangesetTemplate.Title,
+					// The body of the changeset in sourcegraph already
+					// contains the footer, so it's not appended again.
+					Body:      `commit body${{ if eq repository.name "github.com/sourcegraph/sourcegraph" }} -- Created by my-batch-change${{ end }}`,
+					Branch:    testChangesetTemplate.Branch,
+					Commit:    testChangesetTemplate.Commit,
+					Published: testChangesetTemplate.Published,
+				},
+			},
+
+			executor: &dummyExecutor{
+				results: []taskResult{
+					{task: srcCLITask, stepResults: []execution.AfterStepResult{{Version: 2, Diff: []byte(`dummydiff1`)}}},
+					{task: sourcegraphTask, stepResults: []execution.AfterStepResult{{Version: 2, Diff: []byte(`dummydiff2`)}}},
+				},
+			},
+			opts: NewCoordinatorOpts{BodyFooter: "Created by ${{ batch_change.name }}"},
+
+			wantCacheEntries: 2,
+			wantSpecs: []*batcheslib.ChangesetSpec{
+				buildSpecFor(testRepo1, func(spec *batcheslib.ChangesetSpec) {
+					spec.Body = "commit body\n\nCreated by my-batch-change"
+					spec.Commits[0].Diff = []byte(`dummydiff1`)
+				}),
+				buildSpecFor(testRepo2, func(spec *batcheslib.ChangesetSpec) {
+					spec.Body = "commit body -- Created by my-batch-change"
+					spec.Commits[0].Diff = []byte(`dummydiff2`)
+				}),
+			},
+		},
+		{
+			name:  "diff stat in changesetTemplate",
+			tasks: []*Task{srcCLITask},
+
+			batchSpec: &batcheslib.BatchSpec{
+				ChangesetTemplate: &batcheslib.ChangesetTemplate{
+					Title:  testChangesetTemplate.Title,
+					Body:   testChangesetTemplate.Body,
+					Branch: testChangesetTemplate.Branch,
+					Commit: batcheslib.ExpandedGitCommitDescription{
+						Message: "Update ${{ diff_stat.files_changed }} files on ${{ repository.branch }} (+${{ diff_stat.insertions }}/-${{ diff_stat.deletions }})",
+						Author:  testChangesetTemplate.Commit.Author,
+					},
+					Published: &publishedFalse,
+				},
+			},
+
+			executor: &dummyExecutor{
+				results: []taskResult{
+					{task: srcCLITask, stepResults: []execution.AfterStepResult{{Version: 2, Diff: nestedChangesDiff}}},
+				},
+			},
+			opts: NewCoordinatorOpts{},
+
+			wantCacheEntries: 1,
+			wantSpecs: []*batcheslib.ChangesetSpec{
+				buildSpecFor(testRepo1, func(spec *batcheslib.ChangesetSpec) {
+					spec.Commits[0].Message = "Update 3 files on main (+6/-0)"
+					spec.Commits[0].Diff = nestedChangesDiff
+				}),
+			},
+		},
+		{
+			name:  "commits made by steps",
+			tasks: []*Task{srcCLITask},
+
+			batchSpec: &batcheslib.BatchSpec{
+				ChangesetTemplate: testChangesetTemplate,
+			},
+
+			executor: &dummyExecutor{
+				results: []taskResult{
+					{task: srcCLITask, stepResults: []execution.AfterStepResult{{
+						Version: 2,
+						Diff:    []byte(`dummydiff1`),
+						Commits: []execution.Commit{
+							{StepIndex: 0, Message: "Format code", Diff: []byte(`dummydiff-format`)},
+							{StepIndex: 1, Message: "Update dependencies", AuthorName: "Deps Bot", AuthorEmail: "deps@example.com", Diff: []byte(`dummydiff-deps`)},
+						},
+						UncommittedDiff: []byte(`dummydiff-rest`),
+					}}},
+				},
+			},
+			opts: NewCoordinatorOpts{},
+
+			wantCacheEntries: 1,
+			wantSpecs: []*batcheslib.ChangesetSpec{
+				buildSpecFor(testRepo1, func(spec *batcheslib.ChangesetSpec) {
+					template := spec.Commits[0]
+					spec.Commits = []batcheslib.GitCommitDescription{template, template, template}
+					spec.Commits[0].Message = "Format code"
+					spec.Commits[0].Diff = []byte(`dummydiff-format`)
+					spec.Commits[1].Message = "Update dependencies"
+					spec.Commits[1].AuthorName = "Deps Bot"
+					spec.Commits[1].AuthorEmail = "deps@example.com"
+					spec.Commits[1].Diff = []byte(`dummydiff-deps`)
+					spec.Commits[2].Diff = []byte(`dummydiff-rest`)
+				}),
+			},
+		},
+		{
+			name:  "broken changesetTemplate field",
+			tasks: []*Task{srcCLITask},
+
+			batchSpec: &batcheslib.BatchSpec{
+				ChangesetTemplate: &batcheslib.ChangesetTemplate{
+					Title:  testChangesetTemplate.Title,
+					Body:   testChangesetTemplate.Body,
+					Branch: testChangesetTemplate.Branch,
+					Commit: batcheslib.ExpandedGitCommitDescription{
+						Message: "${{ repository.does_not_exist.field }}",
+						Author:  testChangesetTemplate.Commit.Author,
+					},
+				},
+			},
+
+			executor: &dummyExecutor{
+				results: []taskResult{
+					{task: srcCLITask, stepResults: []execution.AfterStepResult{{Version: 2, Diff: []byte(`dummydiff1`)}}},
+				},
+			},
+			opts: NewCoordinatorOpts{},
+
+			wantCacheEntries: 1,
+			wantSpecs:        []*batcheslib.ChangesetSpec{},
+			wantErrInclude:   `rendering changeset template field "commit.message"`,
+		},
+		{
+			name:  "published per repository",
+			tasks: []*Task{srcCLITask, sourcegraphTask},
+
+			batchSpec: &batcheslib.BatchSpec{
+				ChangesetTemplate: &draftTemplate,
+			},
+
+			executor: &dummyExecutor{
+				results: []taskResult{
+					{task: srcCLITask, stepResults: []execution.AfterStepResult{{Version: 2, Diff: []byte(`dummydiff1`)}}},
+					{task: sourcegraphTask, stepResults: []execution.AfterStepResult{{Version: 2, Diff: []byte(`dummydiff2`)}}},
+				},
+			},
+			opts: NewCoordinatorOpts{},
+
+			wantCacheEntries: 2,
+			wantSpecs: []*batcheslib.ChangesetSpec{
+				buildSpecFor(testRepo1, func(spec *batcheslib.ChangesetSpec) {
+					spec.Published = batcheslib.PublishedValue{Val: "draft"}
+				}),
+				buildSpecFor(testRepo2, func(spec *batcheslib.ChangesetSpec) {
+					spec.Commits[0].Diff = []byte(`dummydiff2`)
+					spec.Published = batcheslib.PublishedValue{Val: true}
+				}),
+			},
+		},
+		{
+			name:  "published per branch",
+			tasks: []*Task{srcCLITask, sourcegraphTask},
+
+			batchSpec: &batcheslib.BatchSpec{
+				ChangesetTemplate: &branchTemplate,
+				TransformChanges: &batcheslib.TransformChanges{
+					Group: []batcheslib.Group{
+						{Directory: "a/b/c", Branch: "in-directory-c"},
+						{Directory: "a/b", Branch: "in-directory-b", Repository: testRepo2.Name},
+					},
+				},
+			},
+
+			executor: &dummyExecutor{
+				results: []taskResult{
+					{task: srcCLITask, stepResults: []execution.AfterStepResult{{Version: 2, Diff: nestedChangesDiff}}},
+					{task: sourcegraphTask, stepResults: []execution.AfterStepResult{{Version: 2, Diff: nestedChangesDiff}}},
+				},
+			},
+			opts: NewCoordinatorOpts{},
+
+			wantCacheEntries: 2,
+			wantSpecs: []*batcheslib.ChangesetSpec{
+				// Matched by the rule for the repository only.
+				buildSpecFor(testRepo1, func(spec *batcheslib.ChangesetSpec) {
+					spec.HeadRef = "refs/heads/" + testChangesetTemplate.Branch
+					spec.Commits[0].Diff = []byte(nestedChangesDiffSubdirA + nestedChangesDiffSubdirB)
+					spec.Published = batcheslib.PublishedValue{Val: "draft"}
+				}),
+				// Matched by the rule for the repository and branch.
+				buildSpecFor(testRepo2, func(spec *batcheslib.ChangesetSpec) {
+					spec.HeadRef = "refs/heads/in-directory-b"
+					spec.Commits[0].Diff = []byte(nestedChangesDiffSubdirB + nestedChangesDiffSubdirC)
+					spec.Published = batcheslib.PublishedValue{Val: "draft"}
+				}),
+				// Matched by the rule for the branch in any repository.
+				buildSpecFor(testRepo1, func(spec *batcheslib.ChangesetSpec) {
+					spec.HeadRef = "refs/heads/in-directory-c"
+					spec.Commits[0].Diff = []byte(nestedChangesDiffSubdirC)
+				}),
+				buildSpecFor(testRepo2, func(spec *batcheslib.ChangesetSpec) {
+					spec.HeadRef = util.EnsureRefPrefix(testChangesetTemplate.Branch)
+					spec.Commits[0].Diff = []byte(nestedChangesDiffSubdirA)
+					spec.Published = batcheslib.PublishedValue{Val: true}
+				}),
+			},
+		},
 		{
 			name: "transform group",
 
@@ -264,6 +502,62 @@ func TestCoordinator_Execute(t *testing.T) {
 				}),
 			},
 		},
+		{
+			name:  "update branch",
+			tasks: []*Task{headTask, sourcegraphTask},
+
+			batchSpec: &batcheslib.BatchSpec{
+				ChangesetTemplate: &updateTemplate,
+			},
+
+			executor: &dummyExecutor{
+				results: []taskResult{
+					{task: headTask, stepResults: []execution.AfterStepResult{{Version: 2, Diff: []byte(`dummydiff1`)}}},
+					{task: sourcegraphTask, stepResults: []execution.AfterStepResult{{Version: 2, Diff: []byte(`dummydiff2`)}}},
+				},
+			},
+			opts: NewCoordinatorOpts{},
+
+			wantCacheEntries: 2,
+			wantSpecs: []*batcheslib.ChangesetSpec{
+				// The changes are committed on top of the existing head branch.
+				buildSpecFor(&headRepo1, func(spec *batcheslib.ChangesetSpec) {
+					spec.BaseRef = "refs/heads/main"
+					spec.BaseRev = "h34db33f"
+					spec.Commits[0].Diff = []byte(`dummydiff1`)
+				}),
+				// The head branch doesn't exist yet, so it's created from the
+				// base branch.
+				buildSpecFor(testRepo2, func(spec *batcheslib.ChangesetSpec) {
+					spec.Commits[0].Diff = []byte(`dummydiff2`)
+				}),
+			},
+		},
+		{
+			name:  "update branch depending on outputs",
+			tasks: []*Task{headTask},
+
+			batchSpec: &batcheslib.BatchSpec{
+				ChangesetTemplate: &batcheslib.ChangesetTemplate{
+					Title:        testChangesetTemplate.Title,
+					Body:         testChangesetTemplate.Body,
+					Branch:       "update-${{ outputs.name }}",
+					Commit:       testChangesetTemplate.Commit,
+					UpdateBranch: true,
+				},
+			},
+
+			executor: &dummyExecutor{
+				results: []taskResult{
+					{task: headTask, stepResults: []execution.AfterStepResult{{Version: 2, Diff: []byte(`dummydiff1`), Outputs: map[string]any{"name": "foo"}}}},
+				},
+			},
+			opts: NewCoordinatorOpts{},
+
+			wantCacheEntries: 1,
+			wantSpecs:        []*batcheslib.ChangesetSpec{},
+			wantErrInclude:   "changesetTemplate.branch can only depend on the batch change and the repository",
+		},
 	}
 
 	for _, tc := range tests {
@@ -435,54 +729,1046 @@ func TestCoordinator_Execute_StepCaching(t *testing.T) {
 	assertCacheSize(t, cache, 6)
 }
 
-// execAndEnsure executes the given Task with the given cache and dummyExecutor
-// in a new Coordinator, setting cb as the startCallback on the executor.
-func execAndEnsure(t *testing.T, coord *Coordinator, exec *dummyExecutor, batchSpec *batcheslib.BatchSpec, task *Task, cb startCallback) {
-	t.Helper()
-
-	// Setup the callback
-	exec.startCb = cb
+func TestCoordinator_Execute_StepCaching_AppendedStep(t *testing.T) {
+	cache := newInMemoryExecutionCache()
 
-	// Check cache
-	uncached, cachedSpecs, err := coord.CheckCache(context.Background(), batchSpec, []*Task{task})
-	if err != nil {
+	workingDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(workingDir, "format.sh"), []byte("gofmt -w ."), 0644); err != nil {
 		t.Fatal(err)
 	}
 
-	// Execute
-	freshSpecs, _, err := coord.ExecuteAndBuildSpecs(context.Background(), batchSpec, uncached, newDummyTaskExecutionUI())
-	if err != nil {
-		t.Fatalf("execution of task failed: %s", err)
+	task := &Task{
+		Steps: []batcheslib.Step{
+			{Run: `echo "one"`},
+			{Run: `echo "two"`},
+		},
+		Repository:            testRepo1,
+		BatchChangeAttributes: &template.BatchChangeAttributes{},
 	}
 
-	specs := append(cachedSpecs, freshSpecs...)
+	executor := &dummyExecutor{}
+	executor.results = []taskResult{{
+		task: task,
+		stepResults: []execution.AfterStepResult{
+			{Version: 2, StepIndex: 0, Diff: []byte(`step-0-diff`)},
+			{Version: 2, StepIndex: 1, Diff: []byte(`step-1-diff`)},
+		},
+	}}
 
-	// Sanity check, because we're not interested in the specs
-	if have, want := len(specs), 1; have != want {
-		t.Fatalf("Wrong number of specs. want=%d, have=%d", want, have)
+	coord := &Coordinator{
+		opts: NewCoordinatorOpts{
+			ExecOpts: NewExecutorOpts{WorkingDirectory: workingDir},
+			Cache:    cache,
+			Logger:   mock.LogNoOpManager{},
+		},
+		exec: executor,
 	}
 
-	// Ensure callback was called
-	if !exec.startCbCalled {
-		t.Fatalf("expected the startCallback to be called, but was not")
-	}
-	exec.startCbCalled = false
-}
+	batchSpec := &batcheslib.BatchSpec{ChangesetTemplate: testChangesetTemplate}
 
-// assertCacheSize asserts the cache's size.
-func assertCacheSize(t *testing.T, cache *inMemoryExecutionCache, want int) {
-	t.Helper()
+	execAndEnsure(t, coord, executor, batchSpec, task, assertNoCachedResult(t))
+	assertCacheSize(t, cache, 2)
 
-	if have := cache.size(); have != want {
-		t.Fatalf("wrong cache size. have=%d, want=%d", have, want)
-	}
+	task.CachedStepResultFound = false
+
+	// Appending a step, even one that mounts a file, only executes the new
+	// step on top of the result of the previous ones.
+	task.Steps = append(task.Steps, batcheslib.Step{
+		Run:   `sh /tmp/format.sh`,
+		Mount: []batcheslib.Mount{{Path: "format.sh", Mountpoint: "/tmp/format.sh"}},
+	})
+	execAndEnsure(t, coord, executor, batchSpec, task, func(_ context.Context, tasks []*Task, _ TaskExecutionUI) {
+		if !tasks[0].CachedStepResultFound {
+			t.Fatal("no cached result found")
+		}
+		if have, want := tasks[0].CachedStepResult.StepIndex, 1; have != want {
+			t.Fatalf("wrong cached step. want=%d, have=%d", want, have)
+		}
+	})
 }
 
-// expectCachedResultForStep returns a function that can be used as a
-// startCallback on dummyExecutor to assert that the first Task has no cached results.
-func assertNoCachedResult(t *testing.T) func(context.Context, []*Task, TaskExecutionUI) {
-	return func(_ context.Context, tasks []*Task, ui TaskExecutionUI) {
-		t.Helper()
+func TestCoordinator_ClearCache_OtherBatchChanges(t *testing.T) {
+	ctx := context.Background()
+	cache := newInMemoryExecutionCache()
+
+	steps := []batcheslib.Step{{Run: `echo "one"`}}
+	bump := &Task{Repository: testRepo1, Steps: steps, BatchChangeAttributes: &template.BatchChangeAttributes{Name: "dependency-bump"}}
+	header := &Task{Repository: testRepo1, Steps: steps, BatchChangeAttributes: &template.BatchChangeAttributes{Name: "license-header"}}
+	// A repository that was removed from the batch spec.
+	removed := &Task{Repository: testRepo2, Steps: steps, BatchChangeAttributes: bump.BatchChangeAttributes}
+	for _, task := range []*Task{bump, header, removed} {
+		if err := cache.Set(ctx, task.CacheKey(nil, "", 0), execution.AfterStepResult{StepIndex: 0, Diff: []byte(`dummydiff1`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertCacheSize(t, cache, 3)
+
+	// Clearing the cache of a batch change clears all of its results, and
+	// keeps the results of the other batch changes, even for the same steps
+	// in the same repository.
+	coord := &Coordinator{opts: NewCoordinatorOpts{Cache: cache, Logger: mock.LogNoOpManager{}}}
+	if err := coord.ClearCache(ctx, []*Task{bump}); err != nil {
+		t.Fatal(err)
+	}
+	assertCacheSize(t, cache, 1)
+	if _, found, err := cache.Get(ctx, header.CacheKey(nil, "", 0)); err != nil || !found {
+		t.Errorf("cached result of other batch change cleared: found=%t, err=%v", found, err)
+	}
+}
+
+func TestCoordinator_FilterTasks(t *testing.T) {
+	tasks := []*Task{
+		{Repository: testRepo1},
+		{Repository: testRepo1, Path: "a/b"},
+		{Repository: testRepo2},
+	}
+
+	t.Run("no filter", func(t *testing.T) {
+		coord := NewCoordinator(NewCoordinatorOpts{})
+		filtered, skipped := coord.FilterTasks(tasks)
+		if diff := cmp.Diff(tasks, filtered); diff != "" {
+			t.Errorf("wrong tasks (-want +got):\n%s", diff)
+		}
+		if skipped != 0 {
+			t.Errorf("wrong number of skipped tasks. want=%d, have=%d", 0, skipped)
+		}
+	})
+
+	t.Run("only one repo", func(t *testing.T) {
+		coord := NewCoordinator(NewCoordinatorOpts{OnlyRepos: []string{testRepo1.Name}})
+		filtered, skipped := coord.FilterTasks(tasks)
+		if diff := cmp.Diff(tasks[:2], filtered); diff != "" {
+			t.Errorf("wrong tasks (-want +got):\n%s", diff)
+		}
+		if skipped != 1 {
+			t.Errorf("wrong number of skipped tasks. want=%d, have=%d", 1, skipped)
+		}
+	})
+
+	t.Run("wave", func(t *testing.T) {
+		waves := []Wave{{Name: "canary", Size: 1}, {Name: "rest"}}
+
+		coord := NewCoordinator(NewCoordinatorOpts{ExecOpts: NewExecutorOpts{Waves: waves, Wave: "canary"}})
+		filtered, skipped := coord.FilterTasks(tasks)
+		// testRepo2 comes first in the order of the repository names.
+		if diff := cmp.Diff(tasks[2:], filtered); diff != "" {
+			t.Errorf("wrong tasks (-want +got):\n%s", diff)
+		}
+		if skipped != 2 {
+			t.Errorf("wrong number of skipped tasks. want=%d, have=%d", 2, skipped)
+		}
+
+		coord = NewCoordinator(NewCoordinatorOpts{OnlyRepos: []string{testRepo1.Name}, ExecOpts: NewExecutorOpts{Waves: waves, Wave: "rest"}})
+		filtered, skipped = coord.FilterTasks(tasks)
+		if diff := cmp.Diff(tasks[:2], filtered); diff != "" {
+			t.Errorf("wrong tasks (-want +got):\n%s", diff)
+		}
+		if skipped != 1 {
+			t.Errorf("wrong number of skipped tasks. want=%d, have=%d", 1, skipped)
+		}
+	})
+
+	t.Run("repo list", func(t *testing.T) {
+		coord := NewCoordinator(NewCoordinatorOpts{RepoList: []string{"github.com/sourcegraph/src-cl", testRepo2.Name}})
+		filtered, skipped := coord.FilterTasks(tasks)
+		if diff := cmp.Diff(tasks[2:], filtered); diff != "" {
+			t.Errorf("wrong tasks (-want +got):\n%s", diff)
+		}
+		if skipped != 2 {
+			t.Errorf("wrong number of skipped tasks. want=%d, have=%d", 2, skipped)
+		}
+		if diff := cmp.Diff([]string{"github.com/sourcegraph/src-cl"}, coord.MissingListedRepos()); diff != "" {
+			t.Errorf("wrong missing repos (-want +got):\n%s", diff)
+		}
+
+		// Listed repositories are found even if -only-repos skips them.
+		coord = NewCoordinator(NewCoordinatorOpts{RepoList: []string{testRepo1.Name, testRepo2.Name}, OnlyRepos: []string{testRepo1.Name}})
+		filtered, skipped = coord.FilterTasks(tasks)
+		if diff := cmp.Diff(tasks[:2], filtered); diff != "" {
+			t.Errorf("wrong tasks (-want +got):\n%s", diff)
+		}
+		if skipped != 1 {
+			t.Errorf("wrong number of skipped tasks. want=%d, have=%d", 1, skipped)
+		}
+		if missing := coord.MissingListedRepos(); len(missing) != 0 {
+			t.Errorf("repos reported as missing: %v", missing)
+		}
+	})
+
+	t.Run("only repos not found", func(t *testing.T) {
+		coord := NewCoordinator(NewCoordinatorOpts{
+			OnlyRepos: []string{"github.com/sourcegraph/src-cl", testRepo1.Name, "github.com/sourcegraph/sourcegrap"},
+			RepoList:  []string{testRepo2.Name, "github.com/sourcegraph/sourcegrap"},
+		})
+		filtered, skipped := coord.FilterTasks(tasks)
+		if len(filtered) != 0 {
+			t.Errorf("wrong number of tasks. want=%d, have=%d", 0, len(filtered))
+		}
+		if skipped != 3 {
+			t.Errorf("wrong number of skipped tasks. want=%d, have=%d", 3, skipped)
+		}
+		// testRepo1 is found even though -repo-list skips it, and names in
+		// both lists are only reported once.
+		want := []string{"github.com/sourcegraph/sourcegrap", "github.com/sourcegraph/src-cl"}
+		if diff := cmp.Diff(want, coord.MissingListedRepos()); diff != "" {
+			t.Errorf("wrong missing repos (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestCoordinator_InFlight(t *testing.T) {
+	start := time.Date(2026, 10, 15, 10, 0, 0, 0, time.UTC)
+	coord := NewCoordinator(NewCoordinatorOpts{ExecOpts: NewExecutorOpts{Clock: &fakeClock{now: start}}})
+	first := &Task{Repository: testRepo1}
+	second := &Task{Repository: testRepo2, Path: "sub", TempDir: "/tmp/batch-1"}
+	queued := &Task{Repository: testRepo2}
+
+	// The statuses are kept even without an EventWriter or a StatusStore.
+	for _, task := range []*Task{first, second, queued} {
+		coord.events.emit(EventTaskEnqueued, task, nil)
+	}
+	coord.events.emit(EventTaskStarted, first, nil)
+	coord.events.emit(EventTaskStarted, second, func(e *Event) { e.TempDir = second.TempDir })
+	coord.events.emit(EventStepStarted, first, func(e *Event) { e.Step = 1 })
+	coord.events.emit(EventStepFinished, first, func(e *Event) { e.Step = 1 })
+	coord.events.emit(EventStepStarted, first, func(e *Event) { e.Step = 2 })
+
+	want := []TaskStatus{
+		{Repository: testRepo1.Name, Rev: testRepo1.Rev(), State: EventStepStarted, Step: 2, StartedAt: start.Add(3 * time.Second), UpdatedAt: start.Add(7 * time.Second)},
+		{Repository: testRepo2.Name, Rev: testRepo2.Rev(), Path: "sub", State: EventTaskStarted, StartedAt: start.Add(4 * time.Second), UpdatedAt: start.Add(4 * time.Second), TempDir: "/tmp/batch-1"},
+	}
+	if diff := cmp.Diff(want, coord.InFlight()); diff != "" {
+		t.Errorf("wrong in-flight statuses (-want +got):\n%s", diff)
+	}
+
+	// Finished Tasks aren't in flight anymore.
+	coord.events.emit(EventTaskCompleted, first, nil)
+	coord.events.emit(EventTaskFailed, second, func(e *Event) { e.Error = "exit 1" })
+	if inFlight := coord.InFlight(); len(inFlight) != 0 {
+		t.Errorf("finished tasks are in flight: %+v", inFlight)
+	}
+}
+
+func TestCoordinator_LimitTasks(t *testing.T) {
+	tasks := []*Task{
+		{Repository: testRepo1},
+		{Repository: testRepo1, Path: "a/b"},
+		{Repository: testRepo2},
+	}
+
+	for _, tc := range []struct {
+		maxTasks    int
+		wantTasks   []*Task
+		wantDropped int
+	}{
+		{maxTasks: 0, wantTasks: tasks, wantDropped: 0},
+		{maxTasks: 2, wantTasks: tasks[:2], wantDropped: 1},
+		{maxTasks: 3, wantTasks: tasks, wantDropped: 0},
+		{maxTasks: 5, wantTasks: tasks, wantDropped: 0},
+	} {
+		coord := NewCoordinator(NewCoordinatorOpts{ExecOpts: NewExecutorOpts{MaxTasks: tc.maxTasks}})
+		limited, dropped := coord.LimitTasks(tasks)
+		if diff := cmp.Diff(tc.wantTasks, limited); diff != "" {
+			t.Errorf("MaxTasks %d: wrong tasks (-want +got):\n%s", tc.maxTasks, diff)
+		}
+		if dropped != tc.wantDropped {
+			t.Errorf("MaxTasks %d: wrong number of dropped tasks. want=%d, have=%d", tc.maxTasks, tc.wantDropped, dropped)
+		}
+	}
+}
+
+func TestCoordinator_CacheStats(t *testing.T) {
+	ctx := context.Background()
+	cachedTask := &Task{Repository: testRepo1, Steps: []batcheslib.Step{{Run: "echo cached"}}}
+	uncachedTask := &Task{Repository: testRepo2, Steps: []batcheslib.Step{{Run: "echo uncached"}}}
+
+	cache := newInMemoryExecutionCache()
+	if err := cache.Set(ctx, cachedTask.CacheKey(nil, "", 0), execution.AfterStepResult{StepIndex: 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	coord := NewCoordinator(NewCoordinatorOpts{Cache: cache})
+	if _, _, err := coord.CheckCache(ctx, &batcheslib.BatchSpec{}, []*Task{cachedTask, uncachedTask}); err != nil {
+		t.Fatal(err)
+	}
+	if err := coord.ClearCache(ctx, []*Task{cachedTask}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := CacheStats{Hits: 1, Misses: 1, Clears: 1}
+	if diff := cmp.Diff(want, coord.CacheStats()); diff != "" {
+		t.Errorf("wrong cache stats (-want +got):\n%s", diff)
+	}
+}
+
+func TestCoordinator_OnCacheHit(t *testing.T) {
+	ctx := context.Background()
+	batchSpec := &batcheslib.BatchSpec{Name: "my-batch-change", ChangesetTemplate: testChangesetTemplate}
+	attrs := &template.BatchChangeAttributes{Name: batchSpec.Name}
+	cachedTask := &Task{Repository: testRepo1, BatchChangeAttributes: attrs, Steps: []batcheslib.Step{{Run: "echo cached"}}}
+	uncachedTask := &Task{Repository: testRepo2, BatchChangeAttributes: attrs, Steps: []batcheslib.Step{{Run: "echo uncached"}}}
+
+	cache := newInMemoryExecutionCache()
+	if err := cache.Set(ctx, cachedTask.CacheKey(nil, "", 0), execution.AfterStepResult{StepIndex: 0, Diff: []byte(`dummydiff1`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	hits := map[*Task][]*batcheslib.ChangesetSpec{}
+	var events bytes.Buffer
+	coord := NewCoordinator(NewCoordinatorOpts{
+		Cache:    cache,
+		Logger:   mock.LogNoOpManager{},
+		ExecOpts: NewExecutorOpts{EventWriter: &events},
+		OnCacheHit: func(task *Task, specs []*batcheslib.ChangesetSpec) {
+			hits[task] = specs
+		},
+	})
+	_, specs, err := coord.CheckCache(ctx, batchSpec, []*Task{cachedTask, uncachedTask})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != 1 {
+		t.Fatalf("wrong number of specs: %d", len(specs))
+	}
+	if diff := cmp.Diff(map[*Task][]*batcheslib.ChangesetSpec{cachedTask: specs}, hits); diff != "" {
+		t.Errorf("wrong cache hits (-want +got):\n%s", diff)
+	}
+
+	// Cached Tasks are also reported to the EventWriter.
+	var event Event
+	if err := json.Unmarshal(events.Bytes(), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != EventTaskCached || event.Repository != testRepo1.Name {
+		t.Errorf("wrong event: %+v", event)
+	}
+}
+
+func TestCoordinator_DiffOptions(t *testing.T) {
+	ctx := context.Background()
+	task := &Task{Repository: testRepo1, Steps: []batcheslib.Step{{Run: "echo one"}, {Run: "echo two"}}}
+
+	// The result of the first step was cached with the default options.
+	cache := newInMemoryExecutionCache()
+	if err := cache.Set(ctx, task.CacheKey(nil, "", 0), execution.AfterStepResult{StepIndex: 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		opts      workspace.DiffOptions
+		wantFound bool
+	}{
+		{name: "default options", opts: workspace.DiffOptions{ContextLines: workspace.DefaultDiffContextLines}, wantFound: true},
+		{name: "more context", opts: workspace.DiffOptions{ContextLines: 10}},
+		{name: "no renames", opts: workspace.DiffOptions{NoRenames: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			coord := NewCoordinator(NewCoordinatorOpts{Cache: cache, ExecOpts: NewExecutorOpts{DiffOptions: tc.opts}})
+			task := *task
+			if err := coord.loadCachedStepResults(ctx, &task, nil); err != nil {
+				t.Fatal(err)
+			}
+			if task.CachedStepResultFound != tc.wantFound {
+				t.Errorf("wrong cache result. want found=%t, have=%t", tc.wantFound, task.CachedStepResultFound)
+			}
+		})
+	}
+
+	t.Run("no binary", func(t *testing.T) {
+		opts := workspace.DiffOptions{NoBinary: true}
+		coord := NewCoordinator(NewCoordinatorOpts{Cache: cache, ExecOpts: NewExecutorOpts{DiffOptions: opts}})
+		if err := cache.Set(ctx, coord.cacheKey(task, nil, 0), execution.AfterStepResult{StepIndex: 0}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Diffs without binary contents can't be replayed, so the result of
+		// the first step isn't used.
+		partial := *task
+		if err := coord.loadCachedStepResults(ctx, &partial, nil); err != nil {
+			t.Fatal(err)
+		}
+		if partial.CachedStepResultFound {
+			t.Error("result of the first step used")
+		}
+
+		if err := cache.Set(ctx, coord.cacheKey(task, nil, 1), execution.AfterStepResult{StepIndex: 1}); err != nil {
+			t.Fatal(err)
+		}
+		complete := *task
+		if err := coord.loadCachedStepResults(ctx, &complete, nil); err != nil {
+			t.Fatal(err)
+		}
+		if !complete.CachedStepResultFound || complete.CachedStepResult.StepIndex != 1 {
+			t.Errorf("result of the last step not used: %+v", complete.CachedStepResult)
+		}
+	})
+}
+
+func TestCoordinator_CacheReadFailuresAreMisses(t *testing.T) {
+	ctx := context.Background()
+	batchSpec := &batcheslib.BatchSpec{ChangesetTemplate: testChangesetTemplate}
+	task := &Task{
+		Repository:            testRepo1,
+		BatchChangeAttributes: &template.BatchChangeAttributes{},
+		Steps:                 []batcheslib.Step{{Run: `echo "one"`}},
+	}
+
+	diskCache := ExecutionDiskCache{Dir: t.TempDir()}
+	key := task.CacheKey(nil, "", 0)
+	if err := diskCache.Set(ctx, key, execution.AfterStepResult{StepIndex: 0, Diff: []byte(`dummydiff1`)}); err != nil {
+		t.Fatal(err)
+	}
+	path, err := diskCache.cacheFilePath(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Reading the corrupt entry deletes it.
+	corrupt := func(t *testing.T) {
+		if err := os.WriteFile(path, []byte("corrupt"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("strict", func(t *testing.T) {
+		corrupt(t)
+		coord := &Coordinator{opts: NewCoordinatorOpts{Cache: diskCache, Logger: mock.LogNoOpManager{}}}
+		if _, _, err := coord.CheckCache(ctx, batchSpec, []*Task{task}); err == nil {
+			t.Fatal("no error for corrupt cache entry")
+		}
+	})
+
+	t.Run("misses", func(t *testing.T) {
+		corrupt(t)
+		executor := &dummyExecutor{results: []taskResult{{
+			task:        task,
+			stepResults: []execution.AfterStepResult{{StepIndex: 0, Diff: []byte(`dummydiff1`)}},
+		}}}
+		coord := &Coordinator{
+			opts: NewCoordinatorOpts{
+				ExecOpts: NewExecutorOpts{CacheReadFailuresAreMisses: true},
+				Cache:    diskCache,
+				Logger:   mock.LogNoOpManager{},
+			},
+			exec: executor,
+		}
+
+		// The Task is executed again and its result replaces the corrupt one.
+		execAndEnsure(t, coord, executor, batchSpec, task, assertNoCachedResult(t))
+		if have, want := coord.CacheStats(), (CacheStats{Misses: 1, ReadErrors: 1}); have != want {
+			t.Errorf("wrong cache stats. want=%+v, have=%+v", want, have)
+		}
+		if _, found, err := diskCache.Get(ctx, key); err != nil || !found {
+			t.Errorf("cached result not replaced: found=%t, err=%v", found, err)
+		}
+	})
+}
+
+func TestCoordinator_OnTaskComplete_Cached(t *testing.T) {
+	ctx := context.Background()
+	cachedTask := &Task{Repository: testRepo1, Steps: []batcheslib.Step{{Run: "echo cached"}}}
+	uncachedTask := &Task{Repository: testRepo2, Steps: []batcheslib.Step{{Run: "echo uncached"}}}
+
+	cache := newInMemoryExecutionCache()
+	if err := cache.Set(ctx, cachedTask.CacheKey(nil, "", 0), execution.AfterStepResult{StepIndex: 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	var completions []TaskCompletion
+	hookErr := errors.New("hook failed")
+	for _, fail := range []bool{false, true} {
+		completions = nil
+		coord := NewCoordinator(NewCoordinatorOpts{
+			Cache:  cache,
+			Logger: mock.LogNoOpManager{},
+			ExecOpts: NewExecutorOpts{
+				OnTaskComplete: func(c TaskCompletion) error {
+					completions = append(completions, c)
+					return hookErr
+				},
+				FailOnTaskCompleteErr: fail,
+			},
+		})
+
+		// Only the Task that's served from the cache completes here. The
+		// other one completes when it's executed.
+		_, _, err := coord.CheckCache(ctx, &batcheslib.BatchSpec{}, []*Task{cachedTask, uncachedTask})
+		if fail != errors.Is(err, hookErr) {
+			t.Errorf("FailOnTaskCompleteErr=%t: wrong error %v", fail, err)
+		}
+		if len(completions) != 1 || completions[0].Task != cachedTask || !completions[0].Cached {
+			t.Errorf("FailOnTaskCompleteErr=%t: wrong completions %+v", fail, completions)
+		}
+	}
+}
+
+func TestCoordinator_MinChangedLines(t *testing.T) {
+	ctx := context.Background()
+	batchSpec := &batcheslib.BatchSpec{Name: "my-batch-change", ChangesetTemplate: testChangesetTemplate}
+	attrs := &template.BatchChangeAttributes{Name: batchSpec.Name}
+
+	// Changes a single line, which counts as one removed and one added line.
+	const trivialDiff = "diff --git a/README.md b/README.md\n--- a/README.md\n+++ b/README.md\n@@ -1 +1 @@\n-# README \n+# README\n"
+	const largerDiff = "diff --git a/README.md b/README.md\n--- a/README.md\n+++ b/README.md\n@@ -1 +1,3 @@\n-# README \n+# README\n+\n+Hello World\n"
+
+	trivialTask := &Task{Repository: testRepo1, BatchChangeAttributes: attrs, Steps: []batcheslib.Step{{Run: "trivial"}}}
+	largerTask := &Task{Repository: testRepo2, BatchChangeAttributes: attrs, Steps: []batcheslib.Step{{Run: "larger"}}}
+	cachedTrivialTask := &Task{Repository: testRepo1, BatchChangeAttributes: attrs, Steps: []batcheslib.Step{{Run: "cached trivial"}}}
+
+	cache := newInMemoryExecutionCache()
+	if err := cache.Set(ctx, cachedTrivialTask.CacheKey(nil, "", 0), execution.AfterStepResult{StepIndex: 0, Diff: []byte(trivialDiff)}); err != nil {
+		t.Fatal(err)
+	}
+
+	coord := Coordinator{
+		exec: &dummyExecutor{
+			results: []taskResult{
+				{task: trivialTask, stepResults: []execution.AfterStepResult{{Diff: []byte(trivialDiff)}}},
+				{task: largerTask, stepResults: []execution.AfterStepResult{{Diff: []byte(largerDiff)}}},
+			},
+		},
+		opts: NewCoordinatorOpts{
+			ExecOpts: NewExecutorOpts{MinChangedLines: 3},
+			Cache:    cache,
+			Logger:   mock.LogNoOpManager{},
+		},
+	}
+
+	uncached, cachedSpecs, err := coord.CheckCache(ctx, batchSpec, []*Task{cachedTrivialTask})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uncached) != 0 || len(cachedSpecs) != 0 {
+		t.Fatalf("cached trivial diff not filtered: %d uncached tasks, %d specs", len(uncached), len(cachedSpecs))
+	}
+
+	ui := newDummyTaskExecutionUI()
+	specs, _, err := coord.ExecuteAndBuildSpecs(ctx, batchSpec, []*Task{trivialTask, largerTask}, ui)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(specs), 1; have != want {
+		t.Fatalf("wrong number of changeset specs. want=%d, have=%d", want, have)
+	}
+	if have, want := specs[0].BaseRepository, testRepo2.ID; have != want {
+		t.Errorf("wrong repository. want=%q, have=%q", want, have)
+	}
+	if diff := cmp.Diff(map[*Task]int{trivialTask: 2}, ui.filtered); diff != "" {
+		t.Errorf("wrong filtered tasks reported to the UI (-want +got):\n%s", diff)
+	}
+	if have, want := coord.FilteredTasks(), 2; have != want {
+		t.Errorf("wrong number of filtered tasks. want=%d, have=%d", want, have)
+	}
+}
+
+func TestCoordinator_RequireChanges(t *testing.T) {
+	ctx := context.Background()
+	batchSpec := &batcheslib.BatchSpec{Name: "my-batch-change", ChangesetTemplate: testChangesetTemplate}
+	attrs := &template.BatchChangeAttributes{Name: batchSpec.Name}
+
+	changedTask := &Task{Repository: testRepo1, BatchChangeAttributes: attrs, Steps: []batcheslib.Step{{Run: "changed"}}}
+	cachedTask := &Task{Repository: testRepo2, BatchChangeAttributes: attrs, Steps: []batcheslib.Step{{Run: "cached unchanged"}}}
+
+	cache := newInMemoryExecutionCache()
+	if err := cache.Set(ctx, cachedTask.CacheKey(nil, "", 0), execution.AfterStepResult{StepIndex: 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	coord := Coordinator{
+		exec: &dummyExecutor{
+			results: []taskResult{
+				{task: changedTask, stepResults: []execution.AfterStepResult{{Diff: []byte(`dummydiff1`)}}},
+			},
+		},
+		opts: NewCoordinatorOpts{
+			ExecOpts: NewExecutorOpts{RequireChanges: true},
+			Cache:    cache,
+			Logger:   mock.LogNoOpManager{},
+		},
+	}
+
+	uncached, cachedSpecs, err := coord.CheckCache(ctx, batchSpec, []*Task{cachedTask})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uncached) != 0 || len(cachedSpecs) != 0 {
+		t.Fatalf("wrong cache result: %d uncached tasks, %d specs", len(uncached), len(cachedSpecs))
+	}
+
+	specs, _, err := coord.ExecuteAndBuildSpecs(ctx, batchSpec, []*Task{changedTask}, newDummyTaskExecutionUI())
+	if !errors.Is(err, ErrNoChanges) {
+		t.Fatalf("wrong error. want=%q, have=%v", ErrNoChanges, err)
+	}
+	if want := "cached result for " + testRepo2.Name; !strings.Contains(err.Error(), want) {
+		t.Errorf("error doesn't include %q: %s", want, err)
+	}
+	if have, want := len(specs), 1; have != want {
+		t.Fatalf("wrong number of changeset specs. want=%d, have=%d", want, have)
+	}
+}
+
+func TestCoordinator_PatchOutputDir(t *testing.T) {
+	ctx := context.Background()
+	batchSpec := &batcheslib.BatchSpec{Name: "my-batch-change", ChangesetTemplate: testChangesetTemplate}
+	attrs := &template.BatchChangeAttributes{Name: batchSpec.Name}
+
+	executedTask := &Task{Repository: testRepo1, BatchChangeAttributes: attrs, Steps: []batcheslib.Step{{Run: "executed"}}}
+	emptyTask := &Task{Repository: testRepo1, Path: "empty/dir", BatchChangeAttributes: attrs, Steps: []batcheslib.Step{{Run: "empty"}}}
+	cachedTask := &Task{Repository: testRepo2, Path: "a/b", BatchChangeAttributes: attrs, Steps: []batcheslib.Step{{Run: "cached"}}}
+
+	cache := newInMemoryExecutionCache()
+	if err := cache.Set(ctx, cachedTask.CacheKey(nil, "", 0), execution.AfterStepResult{StepIndex: 0, Diff: []byte(`dummydiff2`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "patches")
+	coord := Coordinator{
+		exec: &dummyExecutor{
+			results: []taskResult{
+				{task: executedTask, stepResults: []execution.AfterStepResult{{Diff: []byte(`dummydiff1`)}}},
+				{task: emptyTask, stepResults: []execution.AfterStepResult{{}}},
+			},
+		},
+		opts: NewCoordinatorOpts{
+			ExecOpts: NewExecutorOpts{PatchOutputDir: dir},
+			Cache:    cache,
+			Logger:   mock.LogNoOpManager{},
+		},
+	}
+
+	if _, _, err := coord.CheckCache(ctx, batchSpec, []*Task{cachedTask}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := coord.ExecuteAndBuildSpecs(ctx, batchSpec, []*Task{executedTask, emptyTask}, newDummyTaskExecutionUI()); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	wantNames := []string{
+		"github.com%2Fsourcegraph%2Fsourcegraph%2Fa%2Fb.json",
+		"github.com%2Fsourcegraph%2Fsourcegraph%2Fa%2Fb.patch",
+		"github.com%2Fsourcegraph%2Fsrc-cli.json",
+		"github.com%2Fsourcegraph%2Fsrc-cli.patch",
+	}
+	if diff := cmp.Diff(wantNames, names); diff != "" {
+		t.Fatalf("wrong files (-want +have):\n%s", diff)
+	}
+
+	patch, err := os.ReadFile(filepath.Join(dir, wantNames[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := string(patch), "dummydiff2"; have != want {
+		t.Errorf("wrong patch. want=%q, have=%q", want, have)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, wantNames[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metadata patchMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		t.Fatal(err)
+	}
+	wantMetadata := patchMetadata{
+		Repository: testRepo2.Name,
+		Path:       "a/b",
+		BaseRef:    testRepo2.BaseRef(),
+		BaseRev:    testRepo2.Rev(),
+	}
+	if diff := cmp.Diff(wantMetadata, metadata); diff != "" {
+		t.Errorf("wrong metadata (-want +have):\n%s", diff)
+	}
+}
+
+func TestCoordinator_Report(t *testing.T) {
+	ctx := context.Background()
+	batchSpec := &batcheslib.BatchSpec{Name: "my-batch-change", ChangesetTemplate: testChangesetTemplate}
+	attrs := &template.BatchChangeAttributes{Name: batchSpec.Name}
+
+	task := func(name, path string, steps ...batcheslib.Step) *Task {
+		repo := *testRepo1
+		repo.ID, repo.Name = name, name
+		return &Task{Repository: &repo, Path: path, BatchChangeAttributes: attrs, Steps: steps}
+	}
+	cachedTask := task("cached", "", batcheslib.Step{Run: "cached"})
+	createdTask := task("created", "sub/dir", batcheslib.Step{Run: "created"})
+	emptyTask := task("empty", "", batcheslib.Step{Run: "empty"})
+	skippedTask := task("skipped", "", batcheslib.Step{Run: "skipped", Outputs: batcheslib.Outputs{"skip": {Value: "true", SkipChangeset: true}}})
+	failedTask := task("failed", "", batcheslib.Step{Run: "failed"})
+	timedOutTask := task("timed-out", "", batcheslib.Step{Run: "timed out"})
+
+	cache := newInMemoryExecutionCache()
+	cachedChanges := git.Changes{Modified: []string{"main.go", "README.md"}}
+	if err := cache.Set(ctx, cachedTask.CacheKey(nil, "", 0), execution.AfterStepResult{StepIndex: 0, Diff: []byte(`dummydiff1`), ChangedFiles: cachedChanges}); err != nil {
+		t.Fatal(err)
+	}
+
+	failedErr := TaskExecutionErr{Err: errors.New("exit 1"), Repository: "failed"}
+	timedOutErr := TaskExecutionErr{Err: &errTimeoutReached{timeout: time.Minute}, Repository: "timed-out"}
+	coord := Coordinator{
+		exec: &dummyExecutor{
+			results: []taskResult{
+				{task: createdTask, stepResults: []execution.AfterStepResult{{Diff: []byte(`dummydiff1`), ChangedFiles: git.Changes{Added: []string{"web/app.tsx", "web/index.ts"}}}}},
+				{task: emptyTask, stepResults: []execution.AfterStepResult{{}}},
+				{task: skippedTask, stepResults: []execution.AfterStepResult{{Diff: []byte(`dummydiff1`), Outputs: map[string]any{"skip": "true"}}}},
+				{task: failedTask, err: failedErr},
+				{task: timedOutTask, err: timedOutErr},
+			},
+			waitErr: errors.Append(failedErr, timedOutErr),
+		},
+		opts: NewCoordinatorOpts{Cache: cache, Logger: mock.LogNoOpManager{}, FileLabels: DefaultFileLabels},
+	}
+
+	if _, _, err := coord.CheckCache(ctx, batchSpec, []*Task{cachedTask}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := coord.ExecuteAndBuildSpecs(ctx, batchSpec, []*Task{createdTask, emptyTask, skippedTask, failedTask, timedOutTask}, newDummyTaskExecutionUI()); err == nil {
+		t.Fatal("no error returned")
+	}
+
+	want := RunReport{
+		Created:  []string{"created:sub/dir"},
+		Cached:   []string{"cached"},
+		Empty:    []string{"empty"},
+		Skipped:  []string{"skipped"},
+		Failed:   []string{"failed"},
+		TimedOut: []string{"timed-out"},
+		Labels: map[string][]string{
+			"cached":          {"docs", "lang:go"},
+			"created:sub/dir": {"lang:ts"},
+		},
+	}
+	report := coord.Report()
+	if diff := cmp.Diff(want, report); diff != "" {
+		t.Errorf("wrong report (-want +have):\n%s", diff)
+	}
+	if have, want := report.Total(), 6; have != want {
+		t.Errorf("wrong total. want=%d, have=%d", want, have)
+	}
+}
+
+func TestCoordinator_SkipChangeset(t *testing.T) {
+	ctx := context.Background()
+	batchSpec := &batcheslib.BatchSpec{Name: "my-batch-change", ChangesetTemplate: testChangesetTemplate}
+	attrs := &template.BatchChangeAttributes{Name: batchSpec.Name}
+	const d = "diff --git a/README.md b/README.md\n--- a/README.md\n+++ b/README.md\n@@ -1 +1 @@\n-# README \n+# README\n"
+
+	steps := func(run string) []batcheslib.Step {
+		return []batcheslib.Step{{
+			Run: run,
+			Outputs: batcheslib.Outputs{
+				"skip":    {Value: "${{ step.stdout }}", SkipChangeset: true},
+				"message": {Value: "skip"},
+			},
+		}}
+	}
+	skippedTask := &Task{Repository: testRepo1, BatchChangeAttributes: attrs, Steps: steps("echo skip")}
+	keptTask := &Task{Repository: testRepo2, BatchChangeAttributes: attrs, Steps: steps("echo keep")}
+	cachedSkippedTask := &Task{Repository: testRepo1, BatchChangeAttributes: attrs, Steps: steps("echo cached")}
+
+	cache := newInMemoryExecutionCache()
+	result := execution.AfterStepResult{StepIndex: 0, Diff: []byte(d), Outputs: map[string]any{"skip": "true\n"}}
+	if err := cache.Set(ctx, cachedSkippedTask.CacheKey(nil, "", 0), result); err != nil {
+		t.Fatal(err)
+	}
+
+	coord := Coordinator{
+		exec: &dummyExecutor{
+			results: []taskResult{
+				{task: skippedTask, stepResults: []execution.AfterStepResult{{Diff: []byte(d), Outputs: map[string]any{"skip": "skip\n", "message": "skip"}}}},
+				{task: keptTask, stepResults: []execution.AfterStepResult{{Diff: []byte(d), Outputs: map[string]any{"skip": "keep\n", "message": "skip"}}}},
+			},
+		},
+		opts: NewCoordinatorOpts{Cache: cache, Logger: mock.LogNoOpManager{}},
+	}
+
+	uncached, cachedSpecs, err := coord.CheckCache(ctx, batchSpec, []*Task{cachedSkippedTask})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uncached) != 0 || len(cachedSpecs) != 0 {
+		t.Fatalf("cached task not skipped: %d uncached tasks, %d specs", len(uncached), len(cachedSpecs))
+	}
+
+	ui := newDummyTaskExecutionUI()
+	specs, _, err := coord.ExecuteAndBuildSpecs(ctx, batchSpec, []*Task{skippedTask, keptTask}, ui)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(specs), 1; have != want {
+		t.Fatalf("wrong number of changeset specs. want=%d, have=%d", want, have)
+	}
+	if have, want := specs[0].BaseRepository, testRepo2.ID; have != want {
+		t.Errorf("wrong repository. want=%q, have=%q", want, have)
+	}
+	if diff := cmp.Diff(map[*Task]string{skippedTask: "skip"}, ui.skipped); diff != "" {
+		t.Errorf("wrong skipped tasks reported to the UI (-want +got):\n%s", diff)
+	}
+}
+
+func TestCoordinator_SpecsWriter(t *testing.T) {
+	ctx := context.Background()
+	batchSpec := &batcheslib.BatchSpec{Name: "my-batch-change", ChangesetTemplate: testChangesetTemplate}
+	attrs := &template.BatchChangeAttributes{Name: batchSpec.Name}
+	cachedTask := &Task{Repository: testRepo1, BatchChangeAttributes: attrs, Steps: []batcheslib.Step{{Run: "echo cached"}}}
+	srcCLITask := &Task{Repository: testRepo1, BatchChangeAttributes: attrs, Steps: []batcheslib.Step{{Run: "echo Hello World"}}}
+	sourcegraphTask := &Task{Repository: testRepo2, BatchChangeAttributes: attrs, Steps: []batcheslib.Step{{Run: "echo Hello Sourcegraph"}}}
+
+	cache := newInMemoryExecutionCache()
+	if err := cache.Set(ctx, cachedTask.CacheKey(nil, "", 0), execution.AfterStepResult{StepIndex: 0, Diff: []byte(`cacheddiff`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, discard := range []bool{false, true} {
+		var buf bytes.Buffer
+		coord := Coordinator{
+			exec: &dummyExecutor{
+				results: []taskResult{
+					{task: srcCLITask, stepResults: []execution.AfterStepResult{{Diff: []byte(`dummydiff1`)}}},
+					{task: sourcegraphTask, stepResults: []execution.AfterStepResult{{Diff: []byte(`dummydiff2`)}}},
+				},
+			},
+			opts: NewCoordinatorOpts{
+				Cache:        cache,
+				Logger:       mock.LogNoOpManager{},
+				SpecsWriter:  &buf,
+				DiscardSpecs: discard,
+			},
+		}
+
+		_, cachedSpecs, err := coord.CheckCache(ctx, batchSpec, []*Task{cachedTask})
+		if err != nil {
+			t.Fatal(err)
+		}
+		specs, _, err := coord.ExecuteAndBuildSpecs(ctx, batchSpec, []*Task{srcCLITask, sourcegraphTask}, newDummyTaskExecutionUI())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 2
+		if discard {
+			want = 0
+		}
+		if have := len(specs); have != want {
+			t.Errorf("DiscardSpecs=%t: wrong number of changeset specs. want=%d, have=%d", discard, want, have)
+		}
+
+		var written []*batcheslib.ChangesetSpec
+		dec := json.NewDecoder(&buf)
+		for dec.More() {
+			var spec batcheslib.ChangesetSpec
+			if err := dec.Decode(&spec); err != nil {
+				t.Fatal(err)
+			}
+			written = append(written, &spec)
+		}
+		if have, want := len(written), 3; have != want {
+			t.Fatalf("DiscardSpecs=%t: wrong number of written changeset specs. want=%d, have=%d", discard, want, have)
+		}
+		// Version 1 of the commits isn't written, since it's the default.
+		if diff := cmp.Diff(cachedSpecs[0], written[0], cmpopts.IgnoreFields(batcheslib.GitCommitDescription{}, "Version")); diff != "" {
+			t.Errorf("DiscardSpecs=%t: wrong cached changeset spec written (-want +have):\n%s", discard, diff)
+		}
+	}
+}
+
+func TestCoordinator_SpillDiffsOver(t *testing.T) {
+	ctx := context.Background()
+	batchSpec := &batcheslib.BatchSpec{Name: "my-batch-change", ChangesetTemplate: testChangesetTemplate}
+	attrs := &template.BatchChangeAttributes{Name: batchSpec.Name}
+	largeTask := &Task{Repository: testRepo1, BatchChangeAttributes: attrs, Steps: []batcheslib.Step{{Run: "echo large"}}}
+	smallTask := &Task{Repository: testRepo2, BatchChangeAttributes: attrs, Steps: []batcheslib.Step{{Run: "echo small"}}}
+
+	const largeDiff = "a diff that is larger than the limit"
+	spill := newDiffSpill(16, t.TempDir())
+
+	// The executor spills the diffs of the large Task when it finished.
+	largeResult := taskResult{task: largeTask, stepResults: []execution.AfterStepResult{{Diff: []byte(largeDiff)}}}
+	if err := spill.spillStepResults(&largeResult); err != nil {
+		t.Fatal(err)
+	}
+	if largeResult.spilled == nil || largeResult.stepResults[0].Diff != nil {
+		t.Fatal("large diff not spilled")
+	}
+
+	cache := newInMemoryExecutionCache()
+	coord := Coordinator{
+		exec: &dummyExecutor{
+			results: []taskResult{
+				largeResult,
+				{task: smallTask, stepResults: []execution.AfterStepResult{{Diff: []byte(`small`)}}},
+			},
+		},
+		spill: spill,
+		opts: NewCoordinatorOpts{
+			Cache:  cache,
+			Logger: mock.LogNoOpManager{},
+		},
+	}
+
+	specs, _, err := coord.ExecuteAndBuildSpecs(ctx, batchSpec, []*Task{largeTask, smallTask}, newDummyTaskExecutionUI())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(specs), 2; have != want {
+		t.Fatalf("wrong number of changeset specs. want=%d, have=%d", want, have)
+	}
+
+	// The results are cached with the diff, and the file of the step results
+	// is removed once the specs are built.
+	cached, ok, err := cache.Get(ctx, coord.cacheKey(largeTask, nil, 0))
+	if err != nil || !ok {
+		t.Fatalf("result not cached: %v", err)
+	}
+	if have, want := string(cached.Diff), largeDiff; have != want {
+		t.Errorf("wrong cached diff. want=%q, have=%q", want, have)
+	}
+	if _, err := os.Stat(largeResult.spilled.path); !os.IsNotExist(err) {
+		t.Errorf("spilled step results not removed: %v", err)
+	}
+
+	// The diff of the large spec is only on disk until it's loaded.
+	if specs[0].Commits[0].Diff != nil {
+		t.Errorf("diff of large changeset spec not spilled: %q", specs[0].Commits[0].Diff)
+	}
+	loaded, err := coord.LoadChangesetSpec(specs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := string(loaded.Commits[0].Diff), largeDiff; have != want {
+		t.Errorf("wrong loaded diff. want=%q, have=%q", want, have)
+	}
+	if specs[0].Commits[0].Diff != nil {
+		t.Error("loading changeset spec changed the spilled spec")
+	}
+	if loaded, err := coord.LoadChangesetSpec(specs[1]); err != nil || loaded != specs[1] {
+		t.Errorf("small changeset spec not returned as is: %v", err)
+	}
+
+	if err := coord.RemoveSpilledDiffs(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(spill.dir); !os.IsNotExist(err) {
+		t.Errorf("spilled diffs not removed: %v", err)
+	}
+}
+
+func TestCoordinator_UploadConcurrently(t *testing.T) {
+	batchSpec := &batcheslib.BatchSpec{Name: "my-batch-change", ChangesetTemplate: testChangesetTemplate}
+	attrs := &template.BatchChangeAttributes{Name: batchSpec.Name}
+	srcCLITask := &Task{Repository: testRepo1, BatchChangeAttributes: attrs, Steps: []batcheslib.Step{{Run: "echo Hello World"}}}
+	sourcegraphTask := &Task{Repository: testRepo2, BatchChangeAttributes: attrs, Steps: []batcheslib.Step{{Run: "echo Hello Sourcegraph"}}}
+
+	uploadErr := errors.New("upload failed")
+	exec := &dummyExecutor{
+		results: []taskResult{
+			{task: srcCLITask, stepResults: []execution.AfterStepResult{{Diff: []byte(`dummydiff1`)}}},
+			{task: sourcegraphTask, stepResults: []execution.AfterStepResult{{Diff: []byte(`dummydiff2`)}}},
+		},
+	}
+	coord := Coordinator{
+		exec: exec,
+		opts: NewCoordinatorOpts{
+			Cache:              newInMemoryExecutionCache(),
+			Logger:             mock.LogNoOpManager{},
+			UploadConcurrently: true,
+			UploadSpec: func(ctx context.Context, spec *batcheslib.ChangesetSpec) (graphql.ChangesetSpecID, error) {
+				if spec.BaseRepository == testRepo2.ID {
+					return "", uploadErr
+				}
+				return graphql.ChangesetSpecID("spec-" + spec.BaseRepository), nil
+			},
+		},
+	}
+
+	ui := newDummyTaskExecutionUI()
+	specs, _, err := coord.ExecuteAndBuildSpecs(context.Background(), batchSpec, []*Task{srcCLITask, sourcegraphTask}, ui)
+
+	var uploadFailed ChangesetSpecUploadErr
+	if !errors.As(err, &uploadFailed) {
+		t.Fatalf("expected ChangesetSpecUploadErr, got %v", err)
+	}
+	if have, want := uploadFailed.Repository, testRepo2.Name; have != want {
+		t.Errorf("wrong repository in error. want=%q, have=%q", want, have)
+	}
+	if !errors.Is(ui.uploadErrs[sourcegraphTask], uploadErr) {
+		t.Errorf("upload failure not reported to the UI: %v", ui.uploadErrs)
+	}
+
+	// Specs that failed to upload are still returned, so that the caller
+	// can retry them.
+	if have, want := len(specs), 2; have != want {
+		t.Fatalf("wrong number of changeset specs. want=%d, have=%d", want, have)
+	}
+	for _, spec := range specs {
+		id, uploaded := coord.UploadedChangesetSpecID(spec)
+		if spec.BaseRepository == testRepo2.ID {
+			if uploaded {
+				t.Errorf("spec for %s reported as uploaded", testRepo2.Name)
+			}
+			continue
+		}
+		if have, want := id, graphql.ChangesetSpecID("spec-"+testRepo1.ID); have != want {
+			t.Errorf("wrong changeset spec ID. want=%q, have=%q", want, have)
+		}
+	}
+}
+
+// execAndEnsure executes the given Task with the given cache and dummyExecutor
+// in a new Coordinator, setting cb as the startCallback on the executor.
+func execAndEnsure(t *testing.T, coord *Coordinator, exec *dummyExecutor, batchSpec *batcheslib.BatchSpec, task *Task, cb startCallback) {
+	t.Helper()
+
+	// Setup the callback
+	exec.startCb = cb
+
+	// Check cache
+	uncached, cachedSpecs, err := coord.CheckCache(context.Background(), batchSpec, []*Task{task})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Execute
+	freshSpecs, _, err := coord.ExecuteAndBuildSpecs(context.Background(), batchSpec, uncached, newDummyTaskExecutionUI())
+	if err != nil {
+		t.Fatalf("execution of task failed: %s", err)
+	}
+
+	specs := append(cachedSpecs, freshSpecs...)
+
+	// Sanity check, because we're not interested in the specs
+	if have, want := len(specs), 1; have != want {
+		t.Fatalf("Wrong number of specs. want=%d, have=%d", want, have)
+	}
+
+	// Ensure callback was called
+	if !exec.startCbCalled {
+		t.Fatalf("expected the startCallback to be called, but was not")
+	}
+	exec.startCbCalled = false
+}
+
+// assertCacheSize asserts the cache's size.
+func assertCacheSize(t *testing.T, cache *inMemoryExecutionCache, want int) {
+	t.Helper()
+
+	if have := cache.size(); have != want {
+		t.Fatalf("wrong cache size. have=%d, want=%d", have, want)
+	}
+}
+
+// expectCachedResultForStep returns a function that can be used as a
+// startCallback on dummyExecutor to assert that the first Task has no cached results.
+func assertNoCachedResult(t *testing.T) func(context.Context, []*Task, TaskExecutionUI) {
+	return func(_ context.Context, tasks []*Task, ui TaskExecutionUI) {
+		t.Helper()
 
 		task := tasks[0]
 		if task.CachedStepResultFound {
@@ -501,6 +1787,10 @@ func newDummyTaskExecutionUI() *dummyTaskExecutionUI {
 		finished:        map[*Task]struct{}{},
 		finishedWithErr: map[*Task]struct{}{},
 		specs:           map[*Task][]*batcheslib.ChangesetSpec{},
+		uploadErrs:      map[*Task]error{},
+		filtered:        map[*Task]int{},
+		skipped:         map[*Task]string{},
+		timings:         map[*Task][]PhaseDuration{},
 	}
 }
 
@@ -511,6 +1801,10 @@ type dummyTaskExecutionUI struct {
 	finished        map[*Task]struct{}
 	finishedWithErr map[*Task]struct{}
 	specs           map[*Task][]*batcheslib.ChangesetSpec
+	uploadErrs      map[*Task]error
+	filtered        map[*Task]int
+	skipped         map[*Task]string
+	timings         map[*Task][]PhaseDuration
 }
 
 func (d *dummyTaskExecutionUI) Start([]*Task)    {}
@@ -539,6 +1833,31 @@ func (d *dummyTaskExecutionUI) TaskChangesetSpecsBuilt(t *Task, specs []*batches
 
 	d.specs[t] = specs
 }
+func (d *dummyTaskExecutionUI) TaskChangesetSpecsUploadFailed(t *Task, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.uploadErrs[t] = err
+}
+func (d *dummyTaskExecutionUI) TaskChangesetSpecsFiltered(t *Task, changedLines int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.filtered[t] = changedLines
+}
+func (d *dummyTaskExecutionUI) TaskChangesetSpecsSkipped(t *Task, output string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.skipped[t] = output
+}
+
+func (d *dummyTaskExecutionUI) TaskPhaseTimings(t *Task, durations []PhaseDuration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.timings[t] = durations
+}
 
 func (d *dummyTaskExecutionUI) StepsExecutionUI(t *Task) StepsExecutionUI {
 	return NoopStepsExecUI{}
@@ -552,6 +1871,8 @@ type dummyExecutor struct {
 
 	results []taskResult
 	waitErr error
+
+	onResult func(taskResult)
 }
 
 func (d *dummyExecutor) Start(ctx context.Context, ts []*Task, ui TaskExecutionUI) {
@@ -563,18 +1884,38 @@ func (d *dummyExecutor) Start(ctx context.Context, ts []*Task, ui TaskExecutionU
 }
 
 func (d *dummyExecutor) Wait() ([]taskResult, error) {
+	if d.onResult != nil {
+		for _, res := range d.results {
+			if res.err == nil {
+				d.onResult(res)
+			}
+		}
+	}
 	return d.results, d.waitErr
 }
 
+func (d *dummyExecutor) CancelTask(repoName string) bool { return false }
+
+func (d *dummyExecutor) SubscribeLog(key string) (*log.Subscription, bool) { return nil, false }
+
+func (d *dummyExecutor) Pause()       {}
+func (d *dummyExecutor) Resume()      {}
+func (d *dummyExecutor) Paused() bool { return false }
+
+func (d *dummyExecutor) setResultHandler(onResult func(taskResult)) { d.onResult = onResult }
+
 // inMemoryExecutionCache provides an in-memory cache for testing purposes.
 type inMemoryExecutionCache struct {
 	cache map[string]any
-	mu    sync.RWMutex
+	// scopes holds the scope of every key in cache that has one.
+	scopes map[string]string
+	mu     sync.RWMutex
 }
 
 func newInMemoryExecutionCache() *inMemoryExecutionCache {
 	return &inMemoryExecutionCache{
-		cache: make(map[string]any),
+		cache:  make(map[string]any),
+		scopes: make(map[string]string),
 	}
 }
 
@@ -618,6 +1959,9 @@ func (c *inMemoryExecutionCache) Set(ctx context.Context, key cache.Keyer, resul
 	defer c.mu.Unlock()
 
 	c.cache[k] = result
+	if scope := key.Scope(); scope != "" {
+		c.scopes[k] = scope
+	}
 	return nil
 }
 
@@ -631,6 +1975,20 @@ func (c *inMemoryExecutionCache) Clear(ctx context.Context, key cache.Keyer) err
 	defer c.mu.Unlock()
 
 	delete(c.cache, k)
+	delete(c.scopes, k)
+	return nil
+}
+
+func (c *inMemoryExecutionCache) ClearScope(ctx context.Context, scope string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, s := range c.scopes {
+		if s == scope {
+			delete(c.cache, k)
+			delete(c.scopes, k)
+		}
+	}
 	return nil
 }
 
@@ -665,3 +2023,78 @@ index 7f96c22..43df362 100644
 `
 
 var nestedChangesDiff = []byte(nestedChangesDiffSubdirA + nestedChangesDiffSubdirB + nestedChangesDiffSubdirC)
+
+func TestCoordinator_PhaseTimings(t *testing.T) {
+	ctx := context.Background()
+	batchSpec := &batcheslib.BatchSpec{Name: "my-batch-change", ChangesetTemplate: testChangesetTemplate}
+	attrs := &template.BatchChangeAttributes{Name: batchSpec.Name}
+
+	timedTask := &Task{Repository: testRepo1, BatchChangeAttributes: attrs, Steps: []batcheslib.Step{{Run: "timed"}}}
+	untimedTask := &Task{Repository: testRepo2, BatchChangeAttributes: attrs, Steps: []batcheslib.Step{{Run: "untimed"}}}
+
+	timer := newPhaseTimer(&log.NoopTaskLogger{}, time.Now())
+	timer.start(PhaseSteps, "Step 1")()
+
+	coord := Coordinator{
+		exec: &dummyExecutor{
+			results: []taskResult{
+				{task: timedTask, stepResults: []execution.AfterStepResult{{Diff: []byte(`dummydiff1`)}}, timer: timer},
+				{task: untimedTask, stepResults: []execution.AfterStepResult{{Diff: []byte(`dummydiff2`)}}},
+			},
+		},
+		opts: NewCoordinatorOpts{
+			Cache:  newInMemoryExecutionCache(),
+			Logger: mock.LogNoOpManager{},
+		},
+	}
+
+	ui := newDummyTaskExecutionUI()
+	if _, _, err := coord.ExecuteAndBuildSpecs(ctx, batchSpec, []*Task{timedTask, untimedTask}, ui); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := ui.timings[untimedTask]; ok {
+		t.Error("timings reported for task without timer")
+	}
+	var phases []Phase
+	for _, d := range ui.timings[timedTask] {
+		phases = append(phases, d.Phase)
+	}
+	if diff := cmp.Diff([]Phase{PhaseSteps, PhaseCache}, phases); diff != "" {
+		t.Errorf("wrong phases (-want +have):\n%s", diff)
+	}
+}
+
+func TestCoordinator_CheckCache_Precondition(t *testing.T) {
+	ctx := context.Background()
+	batchSpec := &batcheslib.BatchSpec{Name: "my-batch-change", ChangesetTemplate: testChangesetTemplate}
+	task := &Task{
+		Repository:            testRepo1,
+		BatchChangeAttributes: &template.BatchChangeAttributes{Name: batchSpec.Name},
+		Steps:                 []batcheslib.Step{{Run: "echo Hello World"}},
+	}
+
+	cache := newInMemoryExecutionCache()
+	if err := cache.Set(ctx, task.CacheKey(nil, "", 0), execution.AfterStepResult{StepIndex: 0, Diff: []byte(`dummydiff1`)}); err != nil {
+		t.Fatal(err)
+	}
+	coord := Coordinator{opts: NewCoordinatorOpts{Cache: cache, Logger: mock.LogNoOpManager{}}}
+
+	task.Precondition = `${{ matches repository.name "*/sourcegraph" }}`
+	uncached, specs, err := coord.CheckCache(ctx, batchSpec, []*Task{task})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uncached) != 1 || len(specs) != 0 {
+		t.Fatalf("task with unmet precondition served from cache: uncached=%d, specs=%d", len(uncached), len(specs))
+	}
+
+	task.Precondition = `${{ matches repository.name "*/src-cli" }}`
+	uncached, specs, err = coord.CheckCache(ctx, batchSpec, []*Task{task})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uncached) != 0 || len(specs) != 1 {
+		t.Fatalf("task with met precondition not served from cache: uncached=%d, specs=%d", len(uncached), len(specs))
+	}
+}
@@ -0,0 +1,226 @@
+package executor
+
+import (
+	"io"
+	"os"
+	"slices"
+	"sync"
+
+	batcheslib "github.com/sourcegraph/sourcegraph/lib/batches"
+	"github.com/sourcegraph/sourcegraph/lib/batches/execution"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+)
+
+// diffSpill moves the diffs of finished Tasks out of memory into files while
+// they wait to be cached, built into ChangesetSpecs and uploaded, so that
+// memory doesn't grow with the number of large diffs that are in flight at
+// the same time. Only the diffs are moved; everything else stays in memory.
+// It's shared by the executor and the Coordinator.
+//
+// A nil *diffSpill keeps all diffs in memory.
+type diffSpill struct {
+	// over is the size in bytes the diffs of a Task or ChangesetSpec have to
+	// exceed to be spilled.
+	over    int64
+	tempDir string
+
+	dirOnce sync.Once
+	dir     string
+	dirErr  error
+
+	specsMu sync.Mutex
+	specs   map[*batcheslib.ChangesetSpec]*spilledDiffs
+}
+
+func newDiffSpill(over int64, tempDir string) *diffSpill {
+	if over <= 0 {
+		return nil
+	}
+	return &diffSpill{over: over, tempDir: tempDir, specs: make(map[*batcheslib.ChangesetSpec]*spilledDiffs)}
+}
+
+// spilledDiffs are diffs that were written one after the other to a file.
+type spilledDiffs struct {
+	path  string
+	sizes []int
+}
+
+// spill writes the diffs fields point to into a file and clears them, if
+// together they're larger than s.over. It returns nil if they're kept in
+// memory.
+func (s *diffSpill) spill(fields []*[]byte) (*spilledDiffs, error) {
+	if s == nil {
+		return nil, nil
+	}
+	var total int64
+	for _, field := range fields {
+		total += int64(len(*field))
+	}
+	if total <= s.over {
+		return nil, nil
+	}
+
+	s.dirOnce.Do(func() {
+		s.dir, s.dirErr = os.MkdirTemp(s.tempDir, "spilled-diffs-")
+	})
+	if s.dirErr != nil {
+		return nil, errors.Wrap(s.dirErr, "creating directory for spilled diffs")
+	}
+
+	f, err := os.CreateTemp(s.dir, "diffs-*")
+	if err != nil {
+		return nil, errors.Wrap(err, "creating file for spilled diffs")
+	}
+	spilled := &spilledDiffs{path: f.Name(), sizes: make([]int, len(fields))}
+	for i, field := range fields {
+		if _, err := f.Write(*field); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return nil, errors.Wrap(err, "writing spilled diffs")
+		}
+		spilled.sizes[i] = len(*field)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return nil, errors.Wrap(err, "writing spilled diffs")
+	}
+
+	// Empty diffs are left as they are, so that they're still nil or empty
+	// after loading them.
+	for _, field := range fields {
+		if len(*field) > 0 {
+			*field = nil
+		}
+	}
+	return spilled, nil
+}
+
+// load reads the diffs back into fields, which have to point to the same
+// fields, in the same order, as the ones they were spilled from.
+func (d *spilledDiffs) load(fields []*[]byte) error {
+	if len(fields) != len(d.sizes) {
+		return errors.Newf("expected %d spilled diffs, got %d", len(d.sizes), len(fields))
+	}
+
+	f, err := os.Open(d.path)
+	if err != nil {
+		return errors.Wrap(err, "reading spilled diffs")
+	}
+	defer f.Close()
+
+	for i, field := range fields {
+		if d.sizes[i] == 0 {
+			continue
+		}
+		diff := make([]byte, d.sizes[i])
+		if _, err := io.ReadFull(f, diff); err != nil {
+			return errors.Wrap(err, "reading spilled diffs")
+		}
+		*field = diff
+	}
+	return nil
+}
+
+// spillStepResults spills the diffs of the step results of r.
+func (s *diffSpill) spillStepResults(r *taskResult) error {
+	spilled, err := s.spill(stepResultDiffs(r.stepResults))
+	if err != nil {
+		return err
+	}
+	r.spilled = spilled
+	return nil
+}
+
+// loadStepResults returns the step results of r, with the diffs read back if
+// they were spilled. The step results of r are left as they are, so that the
+// diffs only take up memory while the returned ones are used.
+func (r taskResult) loadStepResults() ([]execution.AfterStepResult, error) {
+	if r.spilled == nil {
+		return r.stepResults, nil
+	}
+
+	results := slices.Clone(r.stepResults)
+	for i := range results {
+		results[i].Commits = slices.Clone(results[i].Commits)
+	}
+	if err := r.spilled.load(stepResultDiffs(results)); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// removeSpilled removes the file the diffs of r were spilled to, if any.
+func (r taskResult) removeSpilled() {
+	if r.spilled != nil {
+		os.Remove(r.spilled.path)
+	}
+}
+
+func stepResultDiffs(results []execution.AfterStepResult) (fields []*[]byte) {
+	for i := range results {
+		r := &results[i]
+		fields = append(fields, &r.Diff, &r.UncommittedDiff)
+		for j := range r.Commits {
+			fields = append(fields, &r.Commits[j].Diff)
+		}
+	}
+	return fields
+}
+
+// spillSpecs spills the diffs of the commits of each of specs.
+func (s *diffSpill) spillSpecs(specs []*batcheslib.ChangesetSpec) error {
+	if s == nil {
+		return nil
+	}
+	for _, spec := range specs {
+		spilled, err := s.spill(specDiffs(spec))
+		if err != nil {
+			return err
+		}
+		if spilled != nil {
+			s.specsMu.Lock()
+			s.specs[spec] = spilled
+			s.specsMu.Unlock()
+		}
+	}
+	return nil
+}
+
+// loadSpec returns spec, or a copy of it with the diffs read back if they
+// were spilled.
+func (s *diffSpill) loadSpec(spec *batcheslib.ChangesetSpec) (*batcheslib.ChangesetSpec, error) {
+	if s == nil {
+		return spec, nil
+	}
+	s.specsMu.Lock()
+	spilled, ok := s.specs[spec]
+	s.specsMu.Unlock()
+	if !ok {
+		return spec, nil
+	}
+
+	loaded := *spec
+	loaded.Commits = slices.Clone(spec.Commits)
+	if err := spilled.load(specDiffs(&loaded)); err != nil {
+		return nil, err
+	}
+	return &loaded, nil
+}
+
+func specDiffs(spec *batcheslib.ChangesetSpec) (fields []*[]byte) {
+	for i := range spec.Commits {
+		fields = append(fields, &spec.Commits[i].Diff)
+	}
+	return fields
+}
+
+// remove removes the files of all spilled diffs.
+func (s *diffSpill) remove() error {
+	if s == nil || s.dir == "" {
+		return nil
+	}
+	s.specsMu.Lock()
+	s.specs = make(map[*batcheslib.ChangesetSpec]*spilledDiffs)
+	s.specsMu.Unlock()
+	return os.RemoveAll(s.dir)
+}
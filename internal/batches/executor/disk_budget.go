@@ -0,0 +1,59 @@
+package executor
+
+import (
+	"archive/zip"
+	"context"
+	"os"
+
+	"golang.org/x/sync/semaphore"
+
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+)
+
+// diskBudget limits the disk space used by the workspaces of all Tasks at the
+// same time. Tasks reserve the estimated size of their workspace before it's
+// created, and wait while the budget is used up by other Tasks.
+type diskBudget struct {
+	max int64
+	sem *semaphore.Weighted
+}
+
+func newDiskBudget(max int64) *diskBudget {
+	return &diskBudget{max: max, sem: semaphore.NewWeighted(max)}
+}
+
+// reserve reserves size bytes, and calls waiting first if it has to wait for
+// other Tasks to release theirs. Workspaces larger than the budget reserve all
+// of it, so that they are created once no other workspace exists. The returned
+// function releases the reservation.
+func (b *diskBudget) reserve(ctx context.Context, size int64, waiting func(size int64)) (release func(), err error) {
+	size = min(size, b.max)
+	if !b.sem.TryAcquire(size) {
+		waiting(size)
+		if err := b.sem.Acquire(ctx, size); err != nil {
+			return nil, err
+		}
+	}
+	return func() { b.sem.Release(size) }, nil
+}
+
+// estimateWorkspaceSize estimates the disk space used by a workspace created
+// from the repository archive at path: the unpacked files, and a git
+// repository of about the size of the archive.
+func estimateWorkspaceSize(path string) (int64, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return 0, errors.Wrap(err, "opening repository archive")
+	}
+	defer r.Close()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, errors.Wrap(err, "getting size of repository archive")
+	}
+	size := fi.Size()
+	for _, f := range r.File {
+		size += int64(f.UncompressedSize64)
+	}
+	return size, nil
+}
@@ -0,0 +1,207 @@
+package executor
+
+import (
+	"cmp"
+	"encoding/json"
+	"io"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sourcegraph/sourcegraph/lib/batches/git"
+)
+
+// EventType is the state transition an Event describes.
+type EventType string
+
+const (
+	EventTaskEnqueued  EventType = "task-enqueued"
+	EventTaskStarted   EventType = "task-started"
+	EventTaskCached    EventType = "task-cached"
+	EventTaskCompleted EventType = "task-completed"
+	EventTaskFailed    EventType = "task-failed"
+	EventStepSkipped   EventType = "step-skipped"
+	EventStepStarted   EventType = "step-started"
+	EventStepFinished  EventType = "step-finished"
+	EventStepFailed    EventType = "step-failed"
+)
+
+// Event is a state transition of a Task. Events are written to
+// NewExecutorOpts.EventWriter as lines of JSON, in the order they happen.
+type Event struct {
+	Time       time.Time `json:"time"`
+	Type       EventType `json:"type"`
+	Repository string    `json:"repository"`
+	Rev        string    `json:"rev"`
+	Path       string    `json:"path,omitempty"`
+	// Step is the number of the step, starting at 1, for the step events.
+	Step int `json:"step,omitempty"`
+	// ExitCode is the exit code of a failed step, if it exited.
+	ExitCode int `json:"exitCode,omitempty"`
+	// Error is the error a Task or step failed with.
+	Error string `json:"error,omitempty"`
+	// TempDir is Task.TempDir, for the task-started event.
+	TempDir string `json:"tempDir,omitempty"`
+	// CorrelationID is NewExecutorOpts.CorrelationID.
+	CorrelationID string `json:"correlationID,omitempty"`
+}
+
+// eventLog writes Events to NewExecutorOpts.EventWriter and updates the
+// TaskStatus of their Task in NewExecutorOpts.StatusStore. It's shared by the
+// executor and the Coordinator, and serializes the writes, so that the events
+// of Tasks that are executed in parallel don't interleave. It also keeps the
+// TaskStatus of the Tasks that are being executed, for Coordinator.InFlight.
+//
+// A nil *eventLog discards all events.
+type eventLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	// failed is set once a write failed. The events are only a record of the
+	// run, so a broken writer doesn't fail it, but no more events are written.
+	failed bool
+
+	statuses      StatusStore
+	clock         Clock
+	correlationID string
+	// statusesFailed is set once storing a status failed. Like the events,
+	// no more statuses are stored afterwards.
+	statusesFailed bool
+
+	// inFlight holds the TaskStatus of every Task that was started and hasn't
+	// finished yet, by TaskStatus.Key. It's kept whether there's a
+	// StatusStore or not.
+	inFlight map[string]TaskStatus
+}
+
+func newEventLog(w io.Writer, statuses StatusStore, clock Clock, correlationID string) *eventLog {
+	l := &eventLog{statuses: statuses, clock: clock, correlationID: correlationID, inFlight: make(map[string]TaskStatus)}
+	if w != nil {
+		l.enc = json.NewEncoder(w)
+	}
+	return l
+}
+
+// emit writes an Event of the given type for task. fill, if set, fills in the
+// fields that are specific to the type.
+func (l *eventLog) emit(typ EventType, task *Task, fill func(e *Event)) {
+	if l == nil {
+		return
+	}
+
+	e := Event{
+		Time:       l.clock.Now().UTC(),
+		Type:       typ,
+		Repository: task.Repository.Name,
+		Rev:        task.Repository.Rev(),
+		Path:       task.Path,
+
+		CorrelationID: l.correlationID,
+	}
+	if fill != nil {
+		fill(&e)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.enc != nil && !l.failed && l.enc.Encode(e) != nil {
+		l.failed = true
+	}
+	if l.statuses != nil && !l.statusesFailed && l.updateStatus(e) != nil {
+		l.statusesFailed = true
+	}
+	l.updateInFlight(e)
+}
+
+// updateStatus stores the TaskStatus of the Task of e after e.
+func (l *eventLog) updateStatus(e Event) error {
+	status := TaskStatus{Repository: e.Repository, Rev: e.Rev, Path: e.Path}
+	prev, ok, err := l.statuses.Load(status.Key())
+	if err != nil {
+		return err
+	}
+	if ok {
+		status = prev
+	}
+	return l.statuses.Store(status.after(e))
+}
+
+// updateInFlight updates the in-flight TaskStatus of the Task of e after e.
+func (l *eventLog) updateInFlight(e Event) {
+	key := TaskStatus{Repository: e.Repository, Rev: e.Rev, Path: e.Path}.Key()
+	switch e.Type {
+	case EventTaskStarted:
+		l.inFlight[key] = TaskStatus{Repository: e.Repository, Rev: e.Rev, Path: e.Path}.after(e)
+	case EventTaskCompleted, EventTaskFailed:
+		delete(l.inFlight, key)
+	default:
+		if status, ok := l.inFlight[key]; ok {
+			l.inFlight[key] = status.after(e)
+		}
+	}
+}
+
+// inFlightStatuses returns the TaskStatus of every Task that was started and
+// hasn't finished yet, in the order they were started.
+func (l *eventLog) inFlightStatuses() []TaskStatus {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.SortedFunc(maps.Values(l.inFlight), func(a, b TaskStatus) int {
+		return cmp.Or(a.StartedAt.Compare(b.StartedAt), cmp.Compare(a.Key(), b.Key()))
+	})
+}
+
+// taskFinished writes the event for a Task that was executed and finished
+// with err.
+func (l *eventLog) taskFinished(task *Task, err error) {
+	if err == nil {
+		l.emit(EventTaskCompleted, task, nil)
+		return
+	}
+	l.emit(EventTaskFailed, task, func(e *Event) { e.Error = err.Error() })
+}
+
+// stepsUI returns a StepsExecutionUI that writes the events of the steps of
+// task before passing them on to ui.
+func (l *eventLog) stepsUI(task *Task, ui StepsExecutionUI) StepsExecutionUI {
+	if l == nil {
+		return ui
+	}
+	return &eventStepsUI{StepsExecutionUI: ui, events: l, task: task}
+}
+
+type eventStepsUI struct {
+	StepsExecutionUI
+	events *eventLog
+	task   *Task
+}
+
+func (ui *eventStepsUI) StepSkipped(step int) {
+	ui.events.emit(EventStepSkipped, ui.task, func(e *Event) { e.Step = step })
+	ui.StepsExecutionUI.StepSkipped(step)
+}
+
+func (ui *eventStepsUI) StepStarted(step int, runScript string, env map[string]string) {
+	ui.events.emit(EventStepStarted, ui.task, func(e *Event) { e.Step = step })
+	ui.StepsExecutionUI.StepStarted(step, runScript, env)
+}
+
+func (ui *eventStepsUI) StepFinished(step int, diff []byte, changes git.Changes, outputs map[string]any) {
+	ui.events.emit(EventStepFinished, ui.task, func(e *Event) { e.Step = step })
+	ui.StepsExecutionUI.StepFinished(step, diff, changes, outputs)
+}
+
+func (ui *eventStepsUI) StepFailed(step int, err error, exitCode int) {
+	ui.events.emit(EventStepFailed, ui.task, func(e *Event) {
+		e.Step = step
+		e.Error = err.Error()
+		if exitCode > 0 {
+			e.ExitCode = exitCode
+		}
+	})
+	ui.StepsExecutionUI.StepFailed(step, err, exitCode)
+}
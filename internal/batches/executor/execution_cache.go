@@ -1,10 +1,15 @@
 package executor
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"io"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/sourcegraph/sourcegraph/lib/errors"
 
@@ -26,13 +31,38 @@ type ExecutionDiskCache struct {
 
 const cacheFileExt = ".json"
 
+// scopesDir is the directory in ExecutionDiskCache.Dir that holds a directory
+// for the entries of every scope. Entries without a scope are stored in Dir
+// directly.
+const scopesDir = "batch-changes"
+
+// gzipMagic are the first bytes of every gzip stream. Cache files written by
+// older versions of src-cli are uncompressed JSON, so we use them to decide
+// whether a cache file needs to be decompressed.
+var gzipMagic = []byte{0x1f, 0x8b}
+
 func (c ExecutionDiskCache) cacheFilePath(key cache.Keyer) (string, error) {
 	keyString, err := key.Key()
 	if err != nil {
 		return "", errors.Wrap(err, "calculating execution cache key")
 	}
 
-	return filepath.Join(c.Dir, key.Slug(), keyString+cacheFileExt), nil
+	dir := c.Dir
+	if scope := key.Scope(); scope != "" {
+		dir = c.scopeDir(scope)
+	}
+	return filepath.Join(dir, key.Slug(), keyString+cacheFileExt), nil
+}
+
+// scopeDir returns the directory of the entries of the given scope. Batch
+// change names only contain word characters, dots and dashes, but can still
+// be "." or "..".
+func (c ExecutionDiskCache) scopeDir(scope string) string {
+	name := url.PathEscape(scope)
+	if strings.Trim(name, ".") == "" {
+		name = strings.ReplaceAll(name, ".", "%2E")
+	}
+	return filepath.Join(c.Dir, scopesDir, name)
 }
 
 func readCacheFile(path string, result any) (bool, error) {
@@ -45,6 +75,17 @@ func readCacheFile(path string, result any) (bool, error) {
 		return false, err
 	}
 
+	if bytes.HasPrefix(data, gzipMagic) {
+		data, err = gunzip(data)
+		if err != nil {
+			// Delete the invalid data to avoid causing an error for next time.
+			if err := os.Remove(path); err != nil {
+				return false, errors.Wrap(err, "while deleting cache file with invalid gzip data")
+			}
+			return false, errors.Wrapf(err, "decompressing cache file %s", path)
+		}
+	}
+
 	if err := json.Unmarshal(data, result); err != nil {
 		// Delete the invalid data to avoid causing an error for next time.
 		if err := os.Remove(path); err != nil {
@@ -62,11 +103,71 @@ func (c ExecutionDiskCache) writeCacheFile(path string, result any) error {
 		return errors.Wrap(err, "serializing cache content to JSON")
 	}
 
+	compressed, err := gzipBytes(raw)
+	if err != nil {
+		return errors.Wrap(err, "compressing cache content")
+	}
+
 	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
 		return err
 	}
 
-	return os.WriteFile(path, raw, 0600)
+	return writeFileAtomically(path, compressed)
+}
+
+// writeCacheData writes data to f. It's a variable so that tests can
+// interrupt writes.
+var writeCacheData = func(f *os.File, data []byte) error {
+	_, err := f.Write(data)
+	return err
+}
+
+// writeFileAtomically writes data to a temporary file next to path and then
+// renames it to path. This way, a cache file is either complete or doesn't
+// exist, even if src is killed while writing it, and a partial write can't be
+// read as an entry with a truncated diff later. The temporary files of
+// interrupted writes start with a dot and never match a cache key.
+func writeFileAtomically(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return errors.Wrap(err, "creating cache file")
+	}
+	if err := writeCacheData(f, data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return errors.Wrap(err, "writing cache file")
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, "writing cache file")
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, "writing cache file")
+	}
+	return nil
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gunzip(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	return io.ReadAll(zr)
 }
 
 func (c ExecutionDiskCache) Clear(ctx context.Context, key cache.Keyer) error {
@@ -82,6 +183,13 @@ func (c ExecutionDiskCache) Clear(ctx context.Context, key cache.Keyer) error {
 	return os.Remove(path)
 }
 
+func (c ExecutionDiskCache) ClearScope(ctx context.Context, scope string) error {
+	if scope == "" {
+		return errors.New("no scope to clear given")
+	}
+	return os.RemoveAll(c.scopeDir(scope))
+}
+
 func (c ExecutionDiskCache) Get(ctx context.Context, key cache.Keyer) (execution.AfterStepResult, bool, error) {
 	var result execution.AfterStepResult
 	path, err := c.cacheFilePath(key)
@@ -114,6 +222,10 @@ func (ExecutionNoOpCache) Clear(ctx context.Context, key cache.Keyer) error {
 	return nil
 }
 
+func (ExecutionNoOpCache) ClearScope(ctx context.Context, scope string) error {
+	return nil
+}
+
 func (ExecutionNoOpCache) Set(ctx context.Context, key cache.Keyer, result execution.AfterStepResult) error {
 	return nil
 }
@@ -2,6 +2,11 @@ package executor
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -10,6 +15,8 @@ import (
 	"github.com/sourcegraph/sourcegraph/lib/batches/execution"
 	"github.com/sourcegraph/sourcegraph/lib/batches/execution/cache"
 	"github.com/sourcegraph/sourcegraph/lib/batches/git"
+	"github.com/sourcegraph/sourcegraph/lib/batches/template"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
 )
 
 var cacheRepo1 = batcheslib.Repository{
@@ -89,6 +96,207 @@ func TestExecutionDiskCache_GetSet(t *testing.T) {
 	assertCacheMiss(t, cache, cacheKey1)
 }
 
+func TestExecutionDiskCache_ClearScope(t *testing.T) {
+	ctx := context.Background()
+	c := ExecutionDiskCache{Dir: t.TempDir()}
+
+	steps := []batcheslib.Step{{Run: "echo 'Hello World'", Container: "alpine:3"}}
+	keyFor := func(name string, repo batcheslib.Repository) *cache.CacheKey {
+		return &cache.CacheKey{Repository: repo, Steps: steps, BatchChangeAttributes: &template.BatchChangeAttributes{Name: name}}
+	}
+	bump1, bump2 := keyFor("dependency-bump", cacheRepo1), keyFor("dependency-bump", cacheRepo2)
+	header := keyFor("license-header", cacheRepo1)
+	dots := keyFor("..", cacheRepo1)
+	unscoped := &cache.CacheKey{Repository: cacheRepo1, Steps: steps}
+
+	value := execution.AfterStepResult{Version: 2, Diff: testDiff, Outputs: map[string]any{}}
+	for _, key := range []*cache.CacheKey{bump1, bump2, header, dots, unscoped} {
+		if err := c.Set(ctx, key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.ClearScope(ctx, "dependency-bump"); err != nil {
+		t.Fatal(err)
+	}
+	assertCacheMiss(t, c, bump1)
+	assertCacheMiss(t, c, bump2)
+	assertCacheHit(t, c, header, value)
+	assertCacheHit(t, c, dots, value)
+	assertCacheHit(t, c, unscoped, value)
+
+	// Scopes can't escape the directory of the cache.
+	if err := c.ClearScope(ctx, ".."); err != nil {
+		t.Fatal(err)
+	}
+	assertCacheMiss(t, c, dots)
+	assertCacheHit(t, c, header, value)
+	assertCacheHit(t, c, unscoped, value)
+
+	if err := c.ClearScope(ctx, ""); err == nil {
+		t.Error("clearing the empty scope didn't fail")
+	}
+}
+
+func TestExecutionDiskCache_ReadsUncompressedEntries(t *testing.T) {
+	key := &cache.CacheKey{
+		Repository: cacheRepo1,
+		Steps: []batcheslib.Step{
+			{Run: "echo 'Hello World'", Container: "alpine:3"},
+		},
+	}
+
+	value := execution.AfterStepResult{
+		Version: 2,
+		Diff:    testDiff,
+		ChangedFiles: git.Changes{
+			Added: []string{"README.md"},
+		},
+		Outputs: map[string]any{},
+	}
+
+	c := ExecutionDiskCache{Dir: t.TempDir()}
+
+	// Write a cache entry the way older versions of src-cli did: as plain
+	// JSON, without compression.
+	path, err := c.cacheFilePath(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := json.Marshal(&value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	assertCacheHit(t, c, key, value)
+}
+
+func TestExecutionDiskCache_InterruptedSet(t *testing.T) {
+	ctx := context.Background()
+
+	key := &cache.CacheKey{
+		Repository: cacheRepo1,
+		Steps: []batcheslib.Step{
+			{Run: "echo 'Hello World'", Container: "alpine:3"},
+		},
+	}
+	value := execution.AfterStepResult{
+		Version: 2,
+		Diff:    testDiff,
+		ChangedFiles: git.Changes{
+			Added: []string{"README.md"},
+		},
+		Outputs: map[string]any{},
+	}
+
+	c := ExecutionDiskCache{Dir: t.TempDir()}
+
+	// Simulate src being interrupted halfway through writing the file.
+	interrupt := func(t *testing.T) {
+		orig := writeCacheData
+		writeCacheData = func(f *os.File, data []byte) error {
+			if _, err := f.Write(data[:len(data)/2]); err != nil {
+				return err
+			}
+			return errors.New("interrupted")
+		}
+		t.Cleanup(func() { writeCacheData = orig })
+	}
+
+	t.Run("new entry", func(t *testing.T) {
+		interrupt(t)
+
+		if err := c.Set(ctx, key, value); err == nil {
+			t.Fatal("cache.Set returned no error")
+		}
+		assertCacheMiss(t, c, key)
+
+		// The partial write isn't left behind either.
+		path, err := c.cacheFilePath(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := os.ReadDir(filepath.Dir(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 0 {
+			t.Fatalf("unexpected files in cache directory: %v", entries)
+		}
+	})
+
+	t.Run("existing entry", func(t *testing.T) {
+		if err := c.Set(ctx, key, value); err != nil {
+			t.Fatalf("cache.Set returned unexpected error: %s", err)
+		}
+
+		interrupt(t)
+
+		changed := value
+		changed.Diff = append([]byte("diff --git a/main.go b/main.go\n"), testDiff...)
+		if err := c.Set(ctx, key, changed); err == nil {
+			t.Fatal("cache.Set returned no error")
+		}
+
+		// The entry that was there before is still intact.
+		assertCacheHit(t, c, key, value)
+	})
+}
+
+func BenchmarkExecutionDiskCache_Set(b *testing.B) {
+	// Build a diff that resembles what a large-ish batch change produces: many
+	// files with similar, mostly textual, changes.
+	var diff strings.Builder
+	for i := range 200 {
+		fmt.Fprintf(&diff, "diff --git a/pkg/file%d.go b/pkg/file%d.go\n", i, i)
+		fmt.Fprintf(&diff, "index 2a93cde..a83f668 100644\n--- a/pkg/file%d.go\n+++ b/pkg/file%d.go\n", i, i)
+		diff.WriteString("@@ -1,6 +1,6 @@\n package pkg\n \n-import \"github.com/pkg/errors\"\n+import \"github.com/sourcegraph/sourcegraph/lib/errors\"\n \n func main() {}\n")
+	}
+
+	value := execution.AfterStepResult{
+		Version: 2,
+		Diff:    []byte(diff.String()),
+		Outputs: map[string]any{},
+	}
+	key := &cache.CacheKey{
+		Repository: cacheRepo1,
+		Steps: []batcheslib.Step{
+			{Run: "comby -in-place", Container: "comby/comby"},
+		},
+	}
+
+	c := ExecutionDiskCache{Dir: b.TempDir()}
+	path, err := c.cacheFilePath(key)
+	if err != nil {
+		b.Fatal(err)
+	}
+	uncompressed, err := json.Marshal(&value)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for range b.N {
+		if err := c.Set(context.Background(), key, value); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportMetric(float64(len(uncompressed)), "uncompressed-bytes")
+	b.ReportMetric(float64(info.Size()), "compressed-bytes")
+}
+
 func assertCacheHit(t *testing.T, c ExecutionDiskCache, k cache.Keyer, want execution.AfterStepResult) {
 	t.Helper()
 
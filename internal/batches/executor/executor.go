@@ -3,6 +3,14 @@ package executor
 import (
 	"context"
 	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sourcegraph/conc/pool"
@@ -10,24 +18,39 @@ import (
 	"github.com/sourcegraph/sourcegraph/lib/errors"
 
 	"github.com/sourcegraph/src-cli/internal/batches/docker"
+	"github.com/sourcegraph/src-cli/internal/batches/graphql"
 	"github.com/sourcegraph/src-cli/internal/batches/log"
 	"github.com/sourcegraph/src-cli/internal/batches/repozip"
 	"github.com/sourcegraph/src-cli/internal/batches/util"
 	"github.com/sourcegraph/src-cli/internal/batches/workspace"
 
 	"github.com/sourcegraph/sourcegraph/lib/batches/execution"
+	"github.com/sourcegraph/sourcegraph/lib/batches/git"
 )
 
 type TaskExecutionErr struct {
 	Err        error
 	Logfile    string
 	Repository string
+
+	// Step is the 1-indexed number of the step that failed, or 0 if the
+	// failure didn't happen while running a step.
+	Step int
+	// Container is the image of the failed step.
+	Container string
+	// ExitCode is the exit code of the failed step, or -1 if the step failed
+	// without exiting.
+	ExitCode int
 }
 
 func (e TaskExecutionErr) Cause() error {
 	return e.Err
 }
 
+func (e TaskExecutionErr) Unwrap() error {
+	return e.Err
+}
+
 func (e TaskExecutionErr) Error() string {
 	return fmt.Sprintf(
 		"execution in %s failed: %s (see %s for details)",
@@ -38,17 +61,56 @@ func (e TaskExecutionErr) Error() string {
 }
 
 func (e TaskExecutionErr) StatusText() string {
-	if stepErr, ok := e.Err.(stepFailedErr); ok {
-		return stepErr.SingleLineError()
+	if errors.Is(e.Err, ErrTaskCancelled) {
+		return "Cancelled"
+	}
+	var stepErr stepFailedErr
+	if errors.As(e.Err, &stepErr) {
+		return stepErr.Summary() + ": " + stepErr.SingleLineError()
 	}
 	return e.Err.Error()
 }
 
+// WorkspaceCreationErr is the error a Task fails with when its workspace
+// couldn't be created, for example because the repository archive couldn't be
+// downloaded. It's returned before any step runs, which means the failure is
+// caused by the environment and not by the steps of the batch spec.
+type WorkspaceCreationErr struct {
+	Repository string
+	Err        error
+}
+
+func (e WorkspaceCreationErr) Cause() error {
+	return e.Err
+}
+
+func (e WorkspaceCreationErr) Unwrap() error {
+	return e.Err
+}
+
+func (e WorkspaceCreationErr) Error() string {
+	return fmt.Sprintf("workspace creation failed: %s", e.Err)
+}
+
+// ErrTaskCancelled is the error a Task fails with when it was cancelled through
+// CancelTask.
+var ErrTaskCancelled = errors.New("cancelled")
+
+// ErrNoChanges is the error a Task fails with in RequireChanges mode when its
+// steps produced an empty diff.
+var ErrNoChanges = errors.New("expected changes but none were produced")
+
 // taskResult is a combination of a Task and the result of its execution.
 type taskResult struct {
 	task        *Task
 	stepResults []execution.AfterStepResult
-	err         error
+	// spilled holds the diffs of stepResults if they were spilled to disk
+	// because of NewExecutorOpts.SpillDiffsOver. Use loadStepResults to get
+	// the step results with their diffs.
+	spilled *spilledDiffs
+	err     error
+	// timer is only set in NewExecutorOpts.VerboseTimings mode.
+	timer *phaseTimer
 }
 
 type imageEnsurer func(ctx context.Context, name string) (docker.Image, error)
@@ -69,52 +131,410 @@ type NewExecutorOpts struct {
 	GlobalEnv        []string
 	ForceRoot        bool
 	FailFast         bool
+	// CacheReadFailuresAreMisses makes the Coordinator treat cached results
+	// that can't be read, such as corrupt cache entries, as if they weren't
+	// cached, so that the steps are executed again, instead of failing. The
+	// failures are counted in CacheStats.ReadErrors.
+	CacheReadFailuresAreMisses bool
+	// MaxTasks, if set, limits execution to this many Tasks, so that a new
+	// batch spec can be tried out on a few repositories of a broad query.
+	// Unlike Parallelism, it limits the total number of Tasks, not the ones
+	// executed at once.
+	MaxTasks int
+	// Waves split the Tasks into waves with AssignWaves, and Wave, if set,
+	// limits execution to the Tasks in the wave with that name. Since the
+	// cache is shared, executing all Tasks after executing a wave only
+	// executes the Tasks that weren't in it.
+	Waves []Wave
+	Wave  string
+	// TempDirs, if set, are assigned to the Tasks round-robin to hold their
+	// workspaces and temporary files instead of TempDir, to spread their I/O
+	// across disks.
+	TempDirs []string
+	// LogStream, if set, receives the log output of all tasks in addition
+	// to their log files.
+	LogStream *log.Stream
+	// LogFormatter, if set, formats the log files of the Tasks that support
+	// it, starting with a header that describes the Task. It doesn't affect
+	// LogStream.
+	LogFormatter log.Formatter
+	// Annotations are metadata of the run, such as the team or ticket it's
+	// for. They're written to the start of the log file of every Task and
+	// returned in Coordinator.Report, and don't affect the execution or the
+	// cache keys.
+	Annotations map[string]string
+	// CorrelationID, if set, ties the run to the system that started it,
+	// such as the trace of a CI job. It's passed to every step in the
+	// SRC_CORRELATION_ID environment variable, and written to the start of
+	// the log file of every Task and to every Event. Like the other built-in
+	// environment variables, it isn't part of the cache keys.
+	CorrelationID string
+	// VerboseTimings makes the Tasks log when each phase of their execution
+	// starts and ends, and report the total duration of each Phase to
+	// TaskExecutionUI.TaskPhaseTimings.
+	VerboseTimings bool
+	// DiffTransform, if set, is called with the final diff of every
+	// successfully executed Task. The diff it returns is used to build the
+	// changeset specs, and is the one that's cached. If it returns an error,
+	// the Task fails with it. The diffs of the commits made by steps that set
+	// a commit aren't transformed.
+	DiffTransform func(repo *graphql.Repository, diff []byte) ([]byte, error)
+	// NormalizeDiff, if set, normalizes the final diff of every successfully
+	// executed Task after DiffTransform, so that runs that make the same
+	// changes produce the same diff, no matter the order of the files or the
+	// context of the hunks. The normalized diff is the one that's cached and
+	// used to build the changeset specs. Like with DiffTransform, the diffs
+	// of the commits made by steps aren't normalized.
+	NormalizeDiff bool
+	// MinChangedLines, if set, makes the Coordinator treat the diffs of Tasks
+	// that add and remove fewer lines than this in total like empty diffs, so
+	// that no changeset specs are built for trivial changes.
+	MinChangedLines int
+	// RequireChanges makes Tasks whose steps didn't change anything fail with
+	// ErrNoChanges instead of succeeding without a changeset, for batch
+	// changes that must change every repository. Tasks that a step output
+	// deliberately skipped don't fail.
+	RequireChanges bool
+	// OnTaskComplete, if set, is called exactly once for every Task that
+	// completed, whether it failed, succeeded, didn't change anything or, when
+	// using a Coordinator, was served from the cache. Calls are serialized.
+	// Errors it returns are written to the log of the Task, and only fail the
+	// Task if FailOnTaskCompleteErr is set.
+	OnTaskComplete        func(TaskCompletion) error
+	FailOnTaskCompleteErr bool
+	// SecretResolver resolves the secrets that steps reference by name. The
+	// values are resolved right before a step is executed and are never
+	// cached: the cache keys only contain the names.
+	SecretResolver func(name string) (string, error)
+	// KeepWorkspaces determines which workspaces are kept after their Task
+	// has been executed. The directories of kept workspaces are recorded in
+	// Task.KeptWorkspace.
+	KeepWorkspaces KeepWorkspaces
+	// StartJitter, if set, delays the start of each of the first Parallelism
+	// Tasks by a random duration up to StartJitter, so that they don't all
+	// create their workspaces at the same time. Later Tasks aren't delayed,
+	// since they start whenever an earlier Task finishes.
+	StartJitter time.Duration
+	// Rand, if set, is the source of randomness for StartJitter, so that the
+	// delays are deterministic in tests.
+	Rand *rand.Rand
+	// Clock, if set, is used for the timestamps of the Tasks, Events and
+	// TaskStatuses instead of the real time.
+	Clock Clock
+	// DiffParallelism, if above 1, is the number of git processes that
+	// compute the diff of a workspace after each step, for workspaces that
+	// support it, which speeds up steps that change many files. The diff is
+	// the same as with a single process.
+	DiffParallelism int
+	// DiffOptions configure the diffs that are taken of the workspaces, and
+	// thereby the diffs of the changesets. They're part of the cache keys,
+	// unless they're the defaults.
+	DiffOptions workspace.DiffOptions
+	// ReuseContainers, if set, executes consecutive steps of a Task that use
+	// the same image and container settings in one long-lived container with
+	// `docker exec`, rather than starting a container per step. Steps that
+	// mount files or paths still get a container of their own.
+	ReuseContainers bool
+	// MaxWorkspaceDiskBytes, if set, limits the estimated disk space used by
+	// the workspaces of all Tasks at the same time. Tasks wait before their
+	// workspace is created while the limit is reached, so fewer than
+	// Parallelism Tasks may run at once.
+	MaxWorkspaceDiskBytes int64
+	// PatchOutputDir, if set, makes the Coordinator write the final diff of
+	// every Task that changesets are created for to this directory, including
+	// cached ones, together with the repository and revision it applies to,
+	// so that the changes can be reviewed and applied without Sourcegraph.
+	PatchOutputDir string
+	// EventWriter, if set, receives an Event as a line of JSON for every
+	// state transition of every Task, from being enqueued over the execution
+	// of its steps to its completion, including Tasks served from the cache
+	// by a Coordinator, so that the timeline of a run can be reconstructed.
+	EventWriter io.Writer
+	// StatusStore, if set, keeps the TaskStatus of every Task up to date
+	// with its Events, including Tasks served from the cache by a
+	// Coordinator. Errors of the store don't fail the run, but stop the
+	// statuses from being updated.
+	StatusStore StatusStore
+	// SpillDiffsOver, if set, is the size in bytes above which the diffs of a
+	// finished Task, and of the ChangesetSpecs built from them, are moved to
+	// files in TempDir until they're needed, so that memory stays bounded no
+	// matter how many Tasks with large diffs finish before their specs are
+	// uploaded. Use Coordinator.LoadChangesetSpec to get the diffs of a
+	// ChangesetSpec.
+	SpillDiffsOver int64
 
 	BinaryDiffs bool
 }
 
+const (
+	// maxParallelismPerCPU is the number of concurrent tasks per CPU core above
+	// which CheckParallelism warns.
+	maxParallelismPerCPU = 2
+	// minMemoryPerTask is the amount of memory in bytes we expect a single
+	// task to need at least.
+	minMemoryPerTask = 512 * 1024 * 1024
+)
+
+// CheckParallelism returns an error describing why the given parallelism is
+// likely too high for a machine with the given number of CPUs and memory in
+// bytes, or nil if it looks reasonable. Unknown resources (0) aren't checked.
+//
+// The returned error is meant to be shown as a warning: running with it is
+// still possible, but will likely thrash the machine.
+func CheckParallelism(parallelism, cpus int, memory int64) error {
+	var errs error
+	if cpus > 0 && parallelism > cpus*maxParallelismPerCPU {
+		errs = errors.Append(errs, errors.Newf("parallelism of %d is more than %d times the %d available CPUs", parallelism, maxParallelismPerCPU, cpus))
+	}
+	if memory > 0 && int64(parallelism)*minMemoryPerTask > memory {
+		errs = errors.Append(errs, errors.Newf("parallelism of %d needs more than the %d MiB of available memory", parallelism, memory/1024/1024))
+	}
+	return errs
+}
+
+// AutoParallelism returns the parallelism to use when none was requested
+// explicitly: one task per CPU, but no more than fit into the given memory in
+// bytes. It always returns at least 1.
+func AutoParallelism(cpus int, memory int64) int {
+	parallelism := cpus
+	if memory > 0 {
+		parallelism = min(parallelism, int(memory/minMemoryPerTask))
+	}
+	return max(parallelism, 1)
+}
+
 type executor struct {
 	opts NewExecutorOpts
 
 	workPool      *pool.ResultContextPool[*taskResult]
 	doneEnqueuing chan struct{}
+	// cancel cancels the context of all Tasks started by Start.
+	cancel context.CancelFunc
+
+	// nextTempDir is the index of the next entry in TempDirs to use.
+	nextTempDir atomic.Uint64
+	// started is the number of Tasks started so far.
+	started atomic.Int64
+
+	// cancels holds the cancel functions of the currently running Tasks.
+	cancelsMu sync.Mutex
+	cancels   map[*Task]context.CancelCauseFunc
+
+	// tails holds the log.Tails of the currently running Tasks, by the key
+	// of their TaskStatus.
+	tails sync.Map
+
+	// resumed is non-nil while the executor is paused, and closed by Resume.
+	pauseMu sync.Mutex
+	resumed chan struct{}
+
+	// onResult, if set, is called with the result of every Task that
+	// finished successfully, as soon as it finished.
+	onResult func(taskResult)
+
+	completeHook *taskCompleteHook
+	events       *eventLog
+	spill        *diffSpill
+
+	// diskBudget is nil if the disk usage of the workspaces isn't limited.
+	diskBudget *diskBudget
+
+	clock  Clock
+	jitter *jitter
 }
 
 func NewExecutor(opts NewExecutorOpts) *executor {
-	return &executor{
+	x := &executor{
 		opts:          opts,
 		doneEnqueuing: make(chan struct{}),
+		cancels:       make(map[*Task]context.CancelCauseFunc),
+		completeHook:  newTaskCompleteHook(opts),
+		events:        newEventLog(opts.EventWriter, opts.StatusStore, opts.clock(), opts.CorrelationID),
+		spill:         newDiffSpill(opts.SpillDiffsOver, opts.TempDir),
+		clock:         opts.clock(),
+		jitter:        &jitter{rand: opts.Rand},
+	}
+	if opts.MaxWorkspaceDiskBytes > 0 {
+		x.diskBudget = newDiskBudget(opts.MaxWorkspaceDiskBytes)
+	}
+	return x
+}
+
+// CancelTask cancels the currently running Tasks in the repository with the
+// given name, without affecting the other Tasks. The cancelled Tasks fail with
+// ErrTaskCancelled. It returns whether a running Task was found.
+func (x *executor) CancelTask(repoName string) bool {
+	x.cancelsMu.Lock()
+	defer x.cancelsMu.Unlock()
+
+	found := false
+	for task, cancel := range x.cancels {
+		if task.Repository.Name == repoName {
+			cancel(ErrTaskCancelled)
+			found = true
+		}
+	}
+	return found
+}
+
+// SubscribeLog subscribes to the log of the running Task whose TaskStatus has
+// the given key. It returns false if no such Task is running.
+func (x *executor) SubscribeLog(key string) (*log.Subscription, bool) {
+	tail, ok := x.tails.Load(key)
+	if !ok {
+		return nil, false
+	}
+	return tail.(*log.Tail).Subscribe(), true
+}
+
+// Pause stops the executor from starting Tasks until Resume is called. The
+// Tasks that are already running aren't affected.
+func (x *executor) Pause() {
+	x.pauseMu.Lock()
+	defer x.pauseMu.Unlock()
+
+	if x.resumed == nil {
+		x.resumed = make(chan struct{})
+	}
+}
+
+// Resume starts Tasks again after Pause.
+func (x *executor) Resume() {
+	x.pauseMu.Lock()
+	defer x.pauseMu.Unlock()
+
+	if x.resumed != nil {
+		close(x.resumed)
+		x.resumed = nil
+	}
+}
+
+// Paused returns whether the executor is paused.
+func (x *executor) Paused() bool {
+	x.pauseMu.Lock()
+	defer x.pauseMu.Unlock()
+
+	return x.resumed != nil
+}
+
+// waitWhilePaused blocks while the executor is paused, or until ctx is
+// cancelled.
+func (x *executor) waitWhilePaused(ctx context.Context) error {
+	for {
+		x.pauseMu.Lock()
+		resumed := x.resumed
+		x.pauseMu.Unlock()
+		if resumed == nil {
+			return nil
+		}
+
+		select {
+		case <-resumed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 }
 
+// startDelay returns how long to wait before starting the next Task, which is
+// a random duration up to StartJitter for the first Parallelism Tasks.
+func (x *executor) startDelay() time.Duration {
+	if x.opts.StartJitter <= 0 || x.started.Add(1) > int64(max(x.opts.Parallelism, 1)) {
+		return 0
+	}
+	return x.jitter.n(x.opts.StartJitter)
+}
+
+func (x *executor) setResultHandler(onResult func(taskResult)) {
+	x.onResult = onResult
+}
+
 // Start starts the execution of the given Tasks in goroutines, calling the
 // given taskStatusHandler to update the progress of the tasks.
+//
+// In FailFast mode, no more Tasks are started after the first one failed, and
+// the Tasks that are still running are cancelled. While the executor is
+// paused, the Tasks wait before being started.
 func (x *executor) Start(ctx context.Context, tasks []*Task, ui TaskExecutionUI) {
+	stream := make(chan *Task, len(tasks))
+	for _, task := range tasks {
+		stream <- task
+	}
+	close(stream)
+	x.StartStream(ctx, stream, ui)
+}
+
+// StartStream is like Start, but starts the Tasks as they're received from
+// tasks, so that the first Tasks are executed while the later ones are still
+// being resolved. It returns once tasks is closed and all Tasks have been
+// enqueued, and Wait waits for that too.
+func (x *executor) StartStream(ctx context.Context, tasks <-chan *Task, ui TaskExecutionUI) {
 	defer func() { close(x.doneEnqueuing) }()
 
+	ctx, x.cancel = context.WithCancel(ctx)
+
 	x.workPool = pool.NewWithResults[*taskResult]().WithMaxGoroutines(x.opts.Parallelism).WithContext(ctx)
 	if x.opts.FailFast {
-		x.workPool = x.workPool.WithCancelOnError()
+		x.workPool = x.workPool.WithFailFast()
 	}
 
-	for _, task := range tasks {
+	for {
 		select {
 		case <-ctx.Done():
 			return
 		default:
 		}
 
+		var task *Task
+		select {
+		case <-ctx.Done():
+			return
+		case t, ok := <-tasks:
+			if !ok {
+				return
+			}
+			task = t
+		}
+		x.events.emit(EventTaskEnqueued, task, nil)
+		enqueuedAt := x.clock.Now()
+
 		x.workPool.Go(func(c context.Context) (*taskResult, error) {
-			return x.do(c, task, ui)
+			// The context might have been cancelled while we were waiting
+			// for a free slot in the pool, or while the executor was paused.
+			if err := x.waitWhilePaused(c); err != nil {
+				return nil, err
+			}
+			if err := c.Err(); err != nil {
+				return nil, err
+			}
+
+			result, err := x.do(c, task, ui, enqueuedAt)
+			if err == nil {
+				if err = x.spill.spillStepResults(result); err != nil {
+					err = errors.Wrapf(err, "spilling diffs of %s", task.Repository.Name)
+					result.err = err
+				}
+			}
+			if err != nil && x.opts.FailFast {
+				x.cancel()
+			}
+			if err == nil && x.onResult != nil {
+				x.onResult(*result)
+			}
+			return result, err
 		})
 	}
 }
 
-// Wait blocks until all Tasks enqueued with Start have been executed.
+// Wait blocks until all Tasks enqueued with Start or StartStream have been
+// executed. If any Task failed, the returned error is a *RunErrors. In
+// FailFast mode, it only contains the first error encountered.
 func (x *executor) Wait() ([]taskResult, error) {
 	<-x.doneEnqueuing
 
 	r, err := x.workPool.Wait()
+	x.cancel()
+
 	results := make([]taskResult, len(r))
 	for i, r := range r {
 		if r == nil {
@@ -127,30 +547,139 @@ func (x *executor) Wait() ([]taskResult, error) {
 			results[i] = *r
 		}
 	}
-	return results, err
+	if err == nil || x.opts.FailFast {
+		return results, newRunErrors(err)
+	}
+	// The pool joins the errors of all Tasks.
+	errs := []error{err}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	}
+	return results, newRunErrors(errs...)
 }
 
-func (x *executor) do(ctx context.Context, task *Task, ui TaskExecutionUI) (result *taskResult, err error) {
+func (x *executor) do(ctx context.Context, task *Task, ui TaskExecutionUI, enqueuedAt time.Time) (result *taskResult, err error) {
+	// Spread out the start of the first Tasks. Like Tasks that are waiting
+	// for a free slot, Tasks that are cancelled while waiting never start.
+	delay := x.startDelay()
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
 	// Ensure that the status is updated when we're done.
 	defer func() {
+		x.events.taskFinished(task, err)
 		ui.TaskFinished(task, err)
 	}()
 
+	// Give the task its own context, so that it can be cancelled on its own.
+	ctx, cancel := context.WithCancelCause(ctx)
+	x.cancelsMu.Lock()
+	x.cancels[task] = cancel
+	x.cancelsMu.Unlock()
+	defer func() {
+		x.cancelsMu.Lock()
+		delete(x.cancels, task)
+		x.cancelsMu.Unlock()
+		cancel(nil)
+	}()
+
+	creator, tempDir := x.opts.Creator, x.opts.TempDir
+	if len(x.opts.TempDirs) > 0 {
+		tempDir = x.opts.TempDirs[(x.nextTempDir.Add(1)-1)%uint64(len(x.opts.TempDirs))]
+		task.TempDir = tempDir
+		if dc, ok := creator.(workspace.DirCreator); ok {
+			creator = dc.InDir(tempDir)
+		}
+	}
+
+	// Pin the Task to the commit its repository was resolved to, so that the
+	// archive and the changeset specs use the same one.
+	if task.PinnedRev == "" {
+		task.PinnedRev = task.Repository.Rev()
+	}
+
 	// We're away!
 	ui.TaskStarted(task)
+	x.events.emit(EventTaskStarted, task, func(e *Event) { e.TempDir = task.TempDir })
+	startedAt := x.clock.Now()
 
 	// Let's set up our logging.
-	l, err := x.opts.Logger.AddTask(util.SlugForPathInRepo(task.Repository.Name, task.Repository.Rev(), task.Path))
+	slug := util.SlugForPathInRepo(task.Repository.Name, task.Repository.Rev(), task.Path)
+	l, err := x.opts.Logger.AddTask(slug)
 	if err != nil {
-		return nil, errors.Wrap(err, "creating log file")
+		err = errors.Wrap(err, "creating log file")
+		completion := TaskCompletion{Task: task, Err: err, EnqueuedAt: enqueuedAt, StartedAt: startedAt, FinishedAt: x.clock.Now()}
+		return nil, errors.Append(err, x.completeHook.call(completion, &log.NoopTaskLogger{}))
 	}
 	defer l.Close()
 
+	// skippedBy is the name of the output that signalled that no changeset
+	// should be created for the task, if any.
+	var skippedBy string
+
+	// This runs before the logger is closed, so that errors of the hook can
+	// still be logged.
+	defer func() {
+		completion := TaskCompletion{Task: task, Err: err, EnqueuedAt: enqueuedAt, StartedAt: startedAt, FinishedAt: x.clock.Now()}
+		if err == nil && result != nil && skippedBy == "" && len(result.stepResults) > 0 {
+			completion.Diff = result.stepResults[len(result.stepResults)-1].Diff
+		}
+		if hookErr := x.completeHook.call(completion, l); hookErr != nil && err == nil && result != nil {
+			err = hookErr
+			result.err = err
+			l.MarkErrored()
+		}
+	}()
+	if fl, ok := l.(log.FormattableTaskLogger); ok && x.opts.LogFormatter != nil {
+		if err := fl.Format(x.opts.LogFormatter, logHeader(task, startedAt, x.opts.Annotations, x.opts.CorrelationID)); err != nil {
+			return nil, err
+		}
+	} else {
+		// Without a header, the annotations and the correlation ID are the
+		// first lines of the log.
+		if len(x.opts.Annotations) > 0 {
+			l.Logf("Annotations: %s", formatAnnotations(x.opts.Annotations))
+		}
+		if x.opts.CorrelationID != "" {
+			l.Logf("Correlation ID: %s", x.opts.CorrelationID)
+		}
+	}
+	if delay > 0 {
+		l.Logf("Delayed start by %s", delay)
+	}
+	if task.TempDir != "" {
+		l.Logf("Using temporary directory %s", task.TempDir)
+	}
+	if x.opts.LogStream != nil {
+		name := task.Repository.Name
+		if task.Path != "" {
+			name += ":" + task.Path
+		}
+		l = x.opts.LogStream.Tee(l, name)
+	}
+	tail := log.NewTail()
+	x.tails.Store(slug, tail)
+	defer func() {
+		x.tails.Delete(slug)
+		tail.Close()
+	}()
+	l = tail.Tee(l)
+	var timer *phaseTimer
+	if x.opts.VerboseTimings {
+		// The timings are measured with the monotonic clock, not x.clock.
+		timer = newPhaseTimer(l, time.Now())
+	}
+
 	// Now checkout the archive.
 	repoArchive := x.opts.RepoArchiveRegistry.Checkout(
 		repozip.RepoRevision{
 			RepoName: task.Repository.Name,
-			Commit:   task.Repository.Rev(),
+			Commit:   task.BaseRev(),
 		},
 		task.ArchivePathToFetch(),
 	)
@@ -159,26 +688,78 @@ func (x *executor) do(ctx context.Context, task *Task, ui TaskExecutionUI) (resu
 	opts := &RunStepsOpts{
 		Task:             task,
 		Logger:           l,
-		WC:               x.opts.Creator,
+		WC:               creator,
 		EnsureImage:      x.opts.EnsureImage,
-		TempDir:          x.opts.TempDir,
+		TempDir:          tempDir,
 		GlobalEnv:        x.opts.GlobalEnv,
+		CorrelationID:    x.opts.CorrelationID,
 		Timeout:          x.opts.Timeout,
 		RepoArchive:      repoArchive,
 		WorkingDirectory: x.opts.WorkingDirectory,
 		ForceRoot:        x.opts.ForceRoot,
+		SecretResolver:   x.opts.SecretResolver,
+		KeepWorkspaces:   x.opts.KeepWorkspaces,
 		BinaryDiffs:      x.opts.BinaryDiffs,
+		DiffParallelism:  x.opts.DiffParallelism,
+		DiffOptions:      x.opts.DiffOptions,
+		ReuseContainers:  x.opts.ReuseContainers,
+		diskBudget:       x.diskBudget,
+		timer:            timer,
 
-		UI: ui.StepsExecutionUI(task),
+		UI: x.events.stepsUI(task, ui.StepsExecutionUI(task)),
+	}
+	stepResults, err := runStepsRecovered(ctx, opts)
+	if err == nil && len(stepResults) > 0 {
+		if skippedBy = task.changesetSkippedBy(stepResults[len(stepResults)-1].Outputs); skippedBy != "" {
+			l.Logf("Not creating a changeset: output %q says to skip it", skippedBy)
+		}
+	}
+	if err == nil && skippedBy == "" && x.opts.DiffTransform != nil && len(stepResults) > 0 {
+		last := &stepResults[len(stepResults)-1]
+		var diff []byte
+		if diff, err = x.opts.DiffTransform(task.Repository, last.Diff); err != nil {
+			err = errors.Wrap(err, "transforming diff")
+		} else {
+			last.Diff = diff
+		}
+	}
+	if err == nil && skippedBy == "" && x.opts.NormalizeDiff && len(stepResults) > 0 {
+		last := &stepResults[len(stepResults)-1]
+		var diff []byte
+		if diff, err = normalizeDiff(last.Diff); err != nil {
+			err = errors.Wrap(err, "normalizing diff")
+		} else if last.ChangedFiles, err = git.ChangesInDiff(diff); err != nil {
+			err = errors.Wrap(err, "getting changed files in normalized diff")
+		} else {
+			last.Diff = diff
+		}
+	}
+	if err == nil && skippedBy == "" && x.opts.RequireChanges && (len(stepResults) == 0 || len(stepResults[len(stepResults)-1].Diff) == 0) {
+		err = ErrNoChanges
 	}
-	stepResults, err := RunSteps(ctx, opts)
 	if err != nil {
+		// Whatever the steps failed with, the root cause is the cancellation.
+		if errors.Is(context.Cause(ctx), ErrTaskCancelled) {
+			err = ErrTaskCancelled
+		}
+
 		// Create a more visual error for the UI.
-		err = TaskExecutionErr{
+		taskErr := TaskExecutionErr{
 			Err:        err,
 			Logfile:    l.Path(),
 			Repository: task.Repository.Name,
+			ExitCode:   -1,
 		}
+		var stepErr stepFailedErr
+		var stepTimeout *errStepTimeoutReached
+		if errors.As(err, &stepErr) {
+			taskErr.Step = stepErr.Step
+			taskErr.Container = stepErr.Container
+			taskErr.ExitCode = stepErr.ExitCode
+		} else if errors.As(err, &stepTimeout) {
+			taskErr.Step = stepTimeout.step
+		}
+		err = taskErr
 		l.MarkErrored()
 	}
 
@@ -186,5 +767,45 @@ func (x *executor) do(ctx context.Context, task *Task, ui TaskExecutionUI) (resu
 		task:        task,
 		stepResults: stepResults,
 		err:         err,
+		timer:       timer,
 	}, err
 }
+
+// runStepsRecovered calls RunSteps and turns a panic into an error of the
+// Task, so that it doesn't abort the other Tasks. The deferred cleanups of
+// RunSteps have already run when the panic is recovered.
+func runStepsRecovered(ctx context.Context, opts *RunStepsOpts) (stepResults []execution.AfterStepResult, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			opts.Logger.Logf("Panic while executing steps: %v\n%s", r, debug.Stack())
+			err = errors.Errorf("panic while executing steps: %v", r)
+		}
+	}()
+	return RunSteps(ctx, opts)
+}
+
+// logHeader returns the log.Header of the log file of the Task.
+func logHeader(task *Task, startedAt time.Time, annotations map[string]string, correlationID string) log.Header {
+	steps := make([]string, len(task.Steps))
+	for i, step := range task.Steps {
+		steps[i] = step.Run
+	}
+	return log.Header{
+		Repository:    task.Repository.Name,
+		Rev:           task.Repository.Rev(),
+		Path:          task.Path,
+		Steps:         steps,
+		StartedAt:     startedAt,
+		Annotations:   annotations,
+		CorrelationID: correlationID,
+	}
+}
+
+// formatAnnotations returns the annotations as key=value pairs, sorted by key.
+func formatAnnotations(annotations map[string]string) string {
+	pairs := make([]string, 0, len(annotations))
+	for _, k := range slices.Sorted(maps.Keys(annotations)) {
+		pairs = append(pairs, k+"="+annotations[k])
+	}
+	return strings.Join(pairs, ", ")
+}
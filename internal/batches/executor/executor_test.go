@@ -3,14 +3,18 @@ package executor
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"math/rand/v2"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -27,6 +31,8 @@ import (
 
 	"github.com/sourcegraph/src-cli/internal/api"
 	"github.com/sourcegraph/src-cli/internal/batches/docker"
+	"github.com/sourcegraph/src-cli/internal/batches/graphql"
+	"github.com/sourcegraph/src-cli/internal/batches/log"
 	"github.com/sourcegraph/src-cli/internal/batches/mock"
 	"github.com/sourcegraph/src-cli/internal/batches/repozip"
 	"github.com/sourcegraph/src-cli/internal/batches/workspace"
@@ -82,6 +88,20 @@ func TestExecutor_Integration(t *testing.T) {
 
 		failFast         bool
 		workingDirectory string
+		diffTransform    func(*graphql.Repository, []byte) ([]byte, error)
+		secretResolver   func(string) (string, error)
+		keepWorkspaces   KeepWorkspaces
+		parallelism      int
+		requireChanges   bool
+		correlationID    string
+
+		// wantKeptWorkspaces are the names of the repositories whose
+		// workspaces are kept.
+		wantKeptWorkspaces []string
+		// wantCommits are the files added by the commits of the steps, by
+		// commit message. The files added after the last commit are under
+		// the empty message.
+		wantCommits map[string][]string
 	}{
 		{
 			name: "success",
@@ -113,6 +133,27 @@ func TestExecutor_Integration(t *testing.T) {
 			wantFinished:   2,
 			wantCacheCount: 4,
 		},
+		{
+			name: "success exit codes",
+			archives: []mock.RepoArchive{
+				{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{
+					"README.md": "# Welcome to the README\n",
+				}},
+			},
+			steps: []batcheslib.Step{
+				{Run: `echo -e "foobar\n" >> README.md; exit 3`, SuccessExitCodes: []int{0, 3}},
+			},
+			tasks: []*Task{
+				{Repository: testRepo1},
+			},
+			wantFilesChanged: filesByRepository{
+				testRepo1.ID: filesByPath{
+					rootPath: []string{"README.md"},
+				},
+			},
+			wantFinished:   1,
+			wantCacheCount: 1,
+		},
 		{
 			name: "empty",
 			archives: []mock.RepoArchive{
@@ -157,6 +198,37 @@ func TestExecutor_Integration(t *testing.T) {
 			wantErrInclude:      "execution in github.com/sourcegraph/src-cli failed: Timeout reached. Execution took longer than 100ms.",
 			wantFinishedWithErr: 1,
 		},
+		{
+			name: "step timeout",
+			archives: []mock.RepoArchive{
+				{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{"README.md": "line 1"}},
+			},
+			steps: []batcheslib.Step{
+				{Run: `echo "quick" >> README.md`, Timeout: "1m"},
+				{Run: `while true; do echo "zZzzZ" && sleep 0.05; done`, Timeout: "100ms"},
+			},
+			tasks: []*Task{
+				{Repository: testRepo1},
+			},
+			executorTimeout:     time.Minute,
+			wantErrInclude:      "execution in github.com/sourcegraph/src-cli failed: step 2 timed out after 100ms",
+			wantFinishedWithErr: 1,
+		},
+		{
+			name: "task timeout before step timeout",
+			archives: []mock.RepoArchive{
+				{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{"README.md": "line 1"}},
+			},
+			steps: []batcheslib.Step{
+				{Run: `while true; do echo "zZzzZ" && sleep 0.05; done`, Timeout: "1m"},
+			},
+			tasks: []*Task{
+				{Repository: testRepo1},
+			},
+			executorTimeout:     100 * time.Millisecond,
+			wantErrInclude:      "execution in github.com/sourcegraph/src-cli failed: Timeout reached. Execution took longer than 100ms.",
+			wantFinishedWithErr: 1,
+		},
 		{
 			name: "templated steps",
 			archives: []mock.RepoArchive{
@@ -253,293 +325,2112 @@ func TestExecutor_Integration(t *testing.T) {
 			wantCacheCount: 15,
 		},
 		{
-			name: "step condition",
+			name: "step working directory",
+			archives: []mock.RepoArchive{
+				{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{
+					"README.md":       "# Welcome to the README\n",
+					"a/b/message.txt": "b-dir",
+				}},
+			},
+			steps: []batcheslib.Step{
+				{Run: `echo "Hello" > hello.txt`, WorkingDir: "a/b"},
+				{Run: `echo "Hello" > hello.txt`},
+			},
+			tasks: []*Task{
+				{Repository: testRepo1},
+			},
+			wantFilesChanged: filesByRepository{
+				testRepo1.ID: filesByPath{
+					rootPath: []string{"a/b/hello.txt", "hello.txt"},
+				},
+			},
+			wantFinished:   1,
+			wantCacheCount: 2,
+		},
+		{
+			name: "step stdin",
 			archives: []mock.RepoArchive{
 				{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{
 					"README.md": "# Welcome to the README\n",
 				}},
-				{RepoName: testRepo2.Name, Commit: testRepo2.Rev(), Files: map[string]string{
-					"README.md": "# Sourcegraph README\n",
+			},
+			steps: []batcheslib.Step{
+				{Run: `read -r name && touch "$(basename "$name").txt"`, Stdin: "${{ repository.name }}\n"},
+			},
+			tasks: []*Task{
+				{Repository: testRepo1},
+			},
+			wantFilesChanged: filesByRepository{
+				testRepo1.ID: filesByPath{
+					rootPath: []string{"src-cli.txt"},
+				},
+			},
+			wantFinished:   1,
+			wantCacheCount: 1,
+		},
+		{
+			name: "step without network fails",
+			archives: []mock.RepoArchive{
+				{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{
+					"README.md": "# Welcome to the README\n",
 				}},
 			},
 			steps: []batcheslib.Step{
-				{Run: `echo -e "foobar\n" >> README.md`},
-				{
-					Run: `echo "foobar" >> hello.txt`,
-					If:  `${{ matches repository.name "github.com/sourcegraph/sourcegra*" }}`,
+				{Run: `exit 6`, Network: batcheslib.StepNetworkNone},
+			},
+			tasks: []*Task{
+				{Repository: testRepo1},
+			},
+			wantErrInclude:      "The step has no network access because of `network: none`.",
+			wantFinishedWithErr: 1,
+		},
+		{
+			name: "step with command",
+			archives: []mock.RepoArchive{
+				{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{
+					"README.md": "# Welcome to the README\n",
+				}},
+			},
+			steps: []batcheslib.Step{
+				// Without a shell, neither the space nor the && are interpreted.
+				{Command: []string{"touch", "${{ step.modified_files | len }} files && more.txt"}},
+			},
+			tasks: []*Task{
+				{Repository: testRepo1},
+			},
+			wantFilesChanged: filesByRepository{
+				testRepo1.ID: filesByPath{
+					rootPath: []string{"0 files && more.txt"},
+				},
+			},
+			wantFinished:   1,
+			wantCacheCount: 1,
+		},
+		{
+			name: "step with entrypoint",
+			archives: []mock.RepoArchive{
+				{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{
+					"README.md": "# Welcome to the README\n",
+				}},
+			},
+			steps: []batcheslib.Step{
+				// The command is passed to the entrypoint.
+				{Entrypoint: []string{"env", "GREETING=hello"}, Command: []string{"sh", "-c", `touch "$GREETING.txt"`}},
+			},
+			tasks: []*Task{
+				{Repository: testRepo1},
+			},
+			wantFilesChanged: filesByRepository{
+				testRepo1.ID: filesByPath{
+					rootPath: []string{"hello.txt"},
 				},
+			},
+			wantFinished:   1,
+			wantCacheCount: 1,
+		},
+		{
+			name: "step with workspace files",
+			archives: []mock.RepoArchive{
+				{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{
+					"README.md": "# Welcome to the README\n",
+				}},
+			},
+			steps: []batcheslib.Step{
 				{
-					Run: `echo "foobar" >> in-path.txt`,
-					If:  `${{ matches steps.path "sub/directory/of/repo" }}`,
+					Run: `cat config/name.txt > name.txt && echo changed >> changed.txt`,
+					Files: map[string]string{
+						"config/name.txt": "${{ repository.name }}\n",
+						"changed.txt":     "unchanged",
+					},
 				},
 			},
 			tasks: []*Task{
 				{Repository: testRepo1},
-				{Repository: testRepo2, Path: "sub/directory/of/repo"},
 			},
 			wantFilesChanged: filesByRepository{
 				testRepo1.ID: filesByPath{
-					rootPath: []string{"README.md"},
-				},
-				testRepo2.ID: {
-					"sub/directory/of/repo": []string{"README.md", "hello.txt", "in-path.txt"},
+					rootPath: []string{"changed.txt", "name.txt"},
 				},
 			},
-			wantFinished:   2,
-			wantCacheCount: 4,
+			wantFinished:   1,
+			wantCacheCount: 1,
 		},
 		{
-			name: "skips errors",
+			name: "step with secrets",
 			archives: []mock.RepoArchive{
 				{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{
 					"README.md": "# Welcome to the README\n",
 				}},
-				{RepoName: testRepo2.Name, Commit: testRepo2.Rev(), Files: map[string]string{
-					"README.md": "# Sourcegraph README\n",
-				}},
 			},
 			steps: []batcheslib.Step{
-				{Run: `echo -e "foobar\n" >> README.md`},
 				{
-					Run: `exit 1`,
-					If:  fmt.Sprintf(`${{ eq repository.name %q }}`, testRepo2.Name),
+					Run:     `[ "$API_TOKEN" = "s3cr3t" ] && echo ok > token-checked.txt`,
+					Secrets: []string{"API_TOKEN"},
 				},
 			},
 			tasks: []*Task{
 				{Repository: testRepo1},
-				{Repository: testRepo2},
+			},
+			secretResolver: func(name string) (string, error) {
+				if name != "API_TOKEN" {
+					return "", errors.Newf("unknown secret %q", name)
+				}
+				return "s3cr3t", nil
 			},
 			wantFilesChanged: filesByRepository{
 				testRepo1.ID: filesByPath{
-					rootPath: []string{"README.md"},
+					rootPath: []string{"token-checked.txt"},
 				},
-				testRepo2.ID: {},
 			},
-			wantErrInclude:      "execution in github.com/sourcegraph/sourcegraph failed: run: exit 1",
-			wantFinished:        1,
-			wantFinishedWithErr: 1,
-			wantCacheCount:      2,
+			wantFinished:   1,
+			wantCacheCount: 1,
 		},
 		{
-			name: "fail fast mode",
+			name: "local runner",
 			archives: []mock.RepoArchive{
 				{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{
 					"README.md": "# Welcome to the README\n",
 				}},
-				{RepoName: testRepo2.Name, Commit: testRepo2.Rev(), Files: map[string]string{
-					"README.md": "# Sourcegraph README\n",
-				}},
 			},
+			// The image doesn't exist, since it isn't used.
 			steps: []batcheslib.Step{
 				{
-					Run: `exit 1`,
-					// We must fail for the first repository, so that the other repo's work is cancelled in fail fast mode.
-					If: fmt.Sprintf(`${{ eq repository.name %q }}`, testRepo1.Name),
+					Run:       `echo "foobar" >> README.md && pwd > dir.txt`,
+					Container: "not-pulled",
+				},
+			},
+			tasks: []*Task{
+				{Repository: testRepo1, Runner: RunnerLocal},
+			},
+			wantFilesChanged: filesByRepository{
+				testRepo1.ID: filesByPath{
+					rootPath: []string{"README.md", "dir.txt"},
 				},
+			},
+			wantFinished:   1,
+			wantCacheCount: 1,
+		},
+		{
+			name: "built-in environment variables",
+			archives: []mock.RepoArchive{
+				{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{
+					"README.md":     "# Welcome to the README\n",
+					"docs/index.md": "# Docs\n",
+				}},
+			},
+			// The local runner is used, since dummydocker ignores the
+			// environment.
+			steps: []batcheslib.Step{
 				{
-					// We introduce an artificial way for the second repository, so that it can't complete before the failure of the first one.
-					Run: `sleep 0.1`,
-					If:  fmt.Sprintf(`${{ eq repository.name %q }}`, testRepo2.Name),
+					Run:        `test "$SRC_REPO_NAME" = github.com/sourcegraph/src-cli && cd / && touch "$SRC_WORKSPACE/$SRC_REPO_REV.txt"`,
+					Container:  "not-pulled",
+					WorkingDir: "docs",
 				},
-				{Run: `echo -e "foobar\n" >> README.md`},
 			},
 			tasks: []*Task{
-				{Repository: testRepo1},
-				{Repository: testRepo2},
+				{Repository: testRepo1, Runner: RunnerLocal},
 			},
-			wantErrInclude: "execution in github.com/sourcegraph/src-cli failed: run: exit 1",
-			// In fail fast mode, we expect that other steps are cancelled.
-			wantFinished:        0,
-			wantFinishedWithErr: 2,
-			failFast:            true,
+			wantFilesChanged: filesByRepository{
+				testRepo1.ID: filesByPath{
+					rootPath: []string{"d34db33f.txt"},
+				},
+			},
+			wantFinished:   1,
+			wantCacheCount: 1,
 		},
 		{
-			name: "mount path",
+			name: "correlation ID",
 			archives: []mock.RepoArchive{
 				{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{
 					"README.md": "# Welcome to the README\n",
 				}},
 			},
 			steps: []batcheslib.Step{
-				{
-					Run:   mountScript,
-					Mount: []batcheslib.Mount{{Path: "sample.sh", Mountpoint: mountScript}},
+				{Run: `touch "$SRC_CORRELATION_ID.txt"`, Container: "not-pulled"},
+			},
+			tasks: []*Task{
+				{Repository: testRepo1, Runner: RunnerLocal},
+			},
+			correlationID: "run-42",
+			wantFilesChanged: filesByRepository{
+				testRepo1.ID: filesByPath{
+					rootPath: []string{"run-42.txt"},
 				},
 			},
+			wantFinished:   1,
+			wantCacheCount: 1,
+		},
+		{
+			name: "local runner with network none",
+			archives: []mock.RepoArchive{
+				{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{
+					"README.md": "# Welcome to the README\n",
+				}},
+			},
+			steps: []batcheslib.Step{
+				{Run: `echo "foobar" >> README.md`, Network: batcheslib.StepNetworkNone},
+			},
+			tasks: []*Task{
+				{Repository: testRepo1, Runner: RunnerLocal},
+			},
+			wantErrInclude:      "network: none can't be used with the local runner",
+			wantFinishedWithErr: 1,
+		},
+		{
+			name: "step with secrets but no resolver",
+			archives: []mock.RepoArchive{
+				{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{
+					"README.md": "# Welcome to the README\n",
+				}},
+			},
+			steps: []batcheslib.Step{
+				{Run: `echo "$API_TOKEN" > token.txt`, Secrets: []string{"API_TOKEN"}},
+			},
+			tasks: []*Task{
+				{Repository: testRepo1},
+			},
+			wantErrInclude:      "no secret resolver is configured",
+			wantFinishedWithErr: 1,
+		},
+		{
+			name: "steps with commits",
+			archives: []mock.RepoArchive{
+				{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{
+					"README.md": "# Welcome to the README\n",
+				}},
+			},
+			steps: []batcheslib.Step{
+				{Run: `echo a > a.txt`, Commit: &batcheslib.StepCommit{Message: `Add ${{ join step.added_files ", " }}`}},
+				{Run: `echo b > b.txt`},
+				{Run: `echo c > c.txt`, Commit: &batcheslib.StepCommit{Message: "Add b and c"}},
+				{Run: `true`, Commit: &batcheslib.StepCommit{Message: "Nothing"}},
+				{Run: `echo d > d.txt`},
+			},
 			tasks: []*Task{
 				{Repository: testRepo1},
 			},
 			wantFilesChanged: filesByRepository{
 				testRepo1.ID: filesByPath{
-					rootPath: []string{"README.md"},
+					rootPath: []string{"a.txt", "b.txt", "c.txt", "d.txt"},
 				},
 			},
-			wantFinished:     1,
-			wantCacheCount:   1,
-			workingDirectory: tempDir,
+			wantCommits: map[string][]string{
+				"Add a.txt":   {"a.txt"},
+				"Add b and c": {"b.txt", "c.txt"},
+				"":            {"d.txt"},
+			},
+			wantFinished:   1,
+			wantCacheCount: 5,
 		},
+		{
+			name: "keep workspaces of failed tasks",
+			archives: []mock.RepoArchive{
+				{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{
+					"README.md": "# Welcome to the README\n",
+				}},
+				{RepoName: testRepo2.Name, Commit: testRepo2.Rev(), Files: map[string]string{
+					"README.md": "# Sourcegraph README\n",
+				}},
+			},
+			steps: []batcheslib.Step{
+				{Run: `echo "changed" >> README.md; [ "${{ repository.name }}" != "` + testRepo2.Name + `" ]`},
+			},
+			tasks: []*Task{
+				{Repository: testRepo1},
+				{Repository: testRepo2},
+			},
+			keepWorkspaces: KeepWorkspacesOnFailure,
+			wantFilesChanged: filesByRepository{
+				testRepo1.ID: filesByPath{
+					rootPath: []string{"README.md"},
+				},
+			},
+			wantErrInclude:      "execution in github.com/sourcegraph/sourcegraph failed",
+			wantFinished:        1,
+			wantFinishedWithErr: 1,
+			wantCacheCount:      1,
+			wantKeptWorkspaces:  []string{testRepo2.Name},
+		},
+		{
+			name: "workspace creation fails",
+			archives: []mock.RepoArchive{
+				{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{
+					"README.md": "# Welcome to the README\n",
+				}},
+			},
+			steps: []batcheslib.Step{
+				{Run: `echo -e "foobar\n" >> README.md`},
+			},
+			tasks: []*Task{
+				// There's no archive for testRepo2.
+				{Repository: testRepo2},
+			},
+			wantErrInclude:      "workspace creation failed: fetching repo",
+			wantFinishedWithErr: 1,
+		},
+		{
+			name: "step exceeding memory limit",
+			archives: []mock.RepoArchive{
+				{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{
+					"README.md": "# Welcome to the README\n",
+				}},
+			},
+			steps: []batcheslib.Step{
+				{Run: `exit 137`, Memory: "512m", CPUs: 0.5},
+			},
+			tasks: []*Task{
+				{Repository: testRepo1},
+			},
+			wantErrInclude:      "The step exceeded its memory limit of 512m.",
+			wantFinishedWithErr: 1,
+		},
+		{
+			name: "step condition",
+			archives: []mock.RepoArchive{
+				{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{
+					"README.md": "# Welcome to the README\n",
+				}},
+				{RepoName: testRepo2.Name, Commit: testRepo2.Rev(), Files: map[string]string{
+					"README.md": "# Sourcegraph README\n",
+				}},
+			},
+			steps: []batcheslib.Step{
+				{Run: `echo -e "foobar\n" >> README.md`},
+				{
+					Run: `echo "foobar" >> hello.txt`,
+					If:  `${{ matches repository.name "github.com/sourcegraph/sourcegra*" }}`,
+				},
+				{
+					Run: `echo "foobar" >> in-path.txt`,
+					If:  `${{ matches steps.path "sub/directory/of/repo" }}`,
+				},
+			},
+			tasks: []*Task{
+				{Repository: testRepo1},
+				{Repository: testRepo2, Path: "sub/directory/of/repo"},
+			},
+			wantFilesChanged: filesByRepository{
+				testRepo1.ID: filesByPath{
+					rootPath: []string{"README.md"},
+				},
+				testRepo2.ID: {
+					"sub/directory/of/repo": []string{"README.md", "hello.txt", "in-path.txt"},
+				},
+			},
+			wantFinished:   2,
+			wantCacheCount: 4,
+		},
+		{
+			name: "skips errors",
+			archives: []mock.RepoArchive{
+				{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{
+					"README.md": "# Welcome to the README\n",
+				}},
+				{RepoName: testRepo2.Name, Commit: testRepo2.Rev(), Files: map[string]string{
+					"README.md": "# Sourcegraph README\n",
+				}},
+			},
+			steps: []batcheslib.Step{
+				{Run: `echo -e "foobar\n" >> README.md`},
+				{
+					Run: `exit 1`,
+					If:  fmt.Sprintf(`${{ eq repository.name %q }}`, testRepo2.Name),
+				},
+			},
+			tasks: []*Task{
+				{Repository: testRepo1},
+				{Repository: testRepo2},
+			},
+			wantFilesChanged: filesByRepository{
+				testRepo1.ID: filesByPath{
+					rootPath: []string{"README.md"},
+				},
+				testRepo2.ID: {},
+			},
+			wantErrInclude:      "execution in github.com/sourcegraph/sourcegraph failed: run: exit 1",
+			wantFinished:        1,
+			wantFinishedWithErr: 1,
+			wantCacheCount:      2,
+		},
+		{
+			name: "fail fast mode",
+			archives: []mock.RepoArchive{
+				{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{
+					"README.md": "# Welcome to the README\n",
+				}},
+				{RepoName: testRepo2.Name, Commit: testRepo2.Rev(), Files: map[string]string{
+					"README.md": "# Sourcegraph README\n",
+				}},
+			},
+			steps: []batcheslib.Step{
+				{
+					Run: `exit 1`,
+					// We must fail for the first repository, so that the other repo's work is cancelled in fail fast mode.
+					If: fmt.Sprintf(`${{ eq repository.name %q }}`, testRepo1.Name),
+				},
+				{
+					// We introduce an artificial way for the second repository, so that it can't complete before the failure of the first one.
+					Run: `sleep 0.1`,
+					If:  fmt.Sprintf(`${{ eq repository.name %q }}`, testRepo2.Name),
+				},
+				{Run: `echo -e "foobar\n" >> README.md`},
+			},
+			tasks: []*Task{
+				{Repository: testRepo1},
+				{Repository: testRepo2},
+			},
+			wantErrInclude: "execution in github.com/sourcegraph/src-cli failed: run: exit 1",
+			// In fail fast mode, we expect that other steps are cancelled.
+			wantFinished:        0,
+			wantFinishedWithErr: 2,
+			failFast:            true,
+			// Both tasks need to run at the same time for the second one to
+			// be cancelled, rather than not started at all.
+			parallelism: 2,
+		},
+		{
+			name: "fail fast mode stops starting tasks",
+			archives: []mock.RepoArchive{
+				{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{
+					"README.md": "# Welcome to the README\n",
+				}},
+				{RepoName: testRepo2.Name, Commit: testRepo2.Rev(), Files: map[string]string{
+					"README.md": "# Sourcegraph README\n",
+				}},
+			},
+			steps: []batcheslib.Step{
+				{Run: `exit 1`},
+			},
+			tasks: []*Task{
+				{Repository: testRepo1},
+				{Repository: testRepo2},
+			},
+			wantErrInclude: "execution in github.com/sourcegraph/src-cli failed: run: exit 1",
+			// With a single slot, the second task is never started.
+			wantFinished:        0,
+			wantFinishedWithErr: 1,
+			failFast:            true,
+			parallelism:         1,
+		},
+		{
+			name: "mount path",
+			archives: []mock.RepoArchive{
+				{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{
+					"README.md": "# Welcome to the README\n",
+				}},
+			},
+			steps: []batcheslib.Step{
+				{
+					Run:   mountScript,
+					Mount: []batcheslib.Mount{{Path: "sample.sh", Mountpoint: mountScript}},
+				},
+			},
+			tasks: []*Task{
+				{Repository: testRepo1},
+			},
+			wantFilesChanged: filesByRepository{
+				testRepo1.ID: filesByPath{
+					rootPath: []string{"README.md"},
+				},
+			},
+			wantFinished:     1,
+			wantCacheCount:   1,
+			workingDirectory: tempDir,
+		},
+		{
+			name: "diff transform",
+			archives: []mock.RepoArchive{
+				{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{
+					"README.md": "# Welcome to the README\n",
+				}},
+				{RepoName: testRepo2.Name, Commit: testRepo2.Rev(), Files: map[string]string{
+					"README.md": "# Sourcegraph README\n",
+				}},
+			},
+			steps: []batcheslib.Step{
+				{Run: `echo -e "foobar\n" >> README.md`},
+			},
+			tasks: []*Task{
+				{Repository: testRepo1},
+				{Repository: testRepo2},
+			},
+			diffTransform: func(repo *graphql.Repository, diff []byte) ([]byte, error) {
+				if repo.ID == testRepo2.ID {
+					return nil, errors.New("formatter failed")
+				}
+				return diff, nil
+			},
+			wantFilesChanged: filesByRepository{
+				testRepo1.ID: filesByPath{
+					rootPath: []string{"README.md"},
+				},
+			},
+			wantErrInclude:      "transforming diff: formatter failed",
+			wantFinished:        1,
+			wantFinishedWithErr: 1,
+			wantCacheCount:      2,
+		},
+		{
+			name: "require changes",
+			archives: []mock.RepoArchive{
+				{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{
+					"README.md": "# Welcome to the README\n",
+				}},
+				{RepoName: testRepo2.Name, Commit: testRepo2.Rev(), Files: map[string]string{
+					"main.go": "package main\n",
+				}},
+			},
+			steps: []batcheslib.Step{
+				{Run: `if [ -f README.md ]; then echo -e "foobar\n" >> README.md; fi`},
+			},
+			tasks: []*Task{
+				{Repository: testRepo1},
+				{Repository: testRepo2},
+			},
+			requireChanges: true,
+			wantFilesChanged: filesByRepository{
+				testRepo1.ID: filesByPath{
+					rootPath: []string{"README.md"},
+				},
+			},
+			wantErrInclude:      "execution in github.com/sourcegraph/sourcegraph failed: expected changes but none were produced",
+			wantFinished:        1,
+			wantFinishedWithErr: 1,
+			wantCacheCount:      2,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			// Make sure that the steps and tasks are setup properly
+			images := make(map[string]docker.Image)
+			for _, step := range tc.steps {
+				images[step.Container] = &mock.Image{RawDigest: step.Container}
+			}
+			for _, task := range tc.tasks {
+				task.BatchChangeAttributes = defaultBatchChangeAttributes
+				task.Steps = tc.steps
+			}
+
+			// Setup a mock test server so we also test the downloading of archives
+			mux := mock.NewZipArchivesMux(t, nil, tc.archives...)
+
+			middle := func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					next.ServeHTTP(w, r)
+				})
+			}
+			for _, additionalFiles := range tc.additionalFiles {
+				mock.HandleAdditionalFiles(mux, additionalFiles, middle)
+			}
+
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+
+			// Setup an api.Client that points to this test server
+			var clientBuffer bytes.Buffer
+			u, _ := url.ParseRequestURI(ts.URL)
+			client := api.NewClient(api.ClientOpts{EndpointURL: u, Out: &clientBuffer})
+
+			// Temp dir for log files and downloaded archives
+			testTempDir := t.TempDir()
+
+			ctx := context.Background()
+			cr, _ := workspace.NewCreator(ctx, "bind", testTempDir, testTempDir, images)
+			// Setup executor
+			parallelism := 0
+			if tc.failFast {
+				parallelism = 1
+			}
+			opts := NewExecutorOpts{
+				Creator:             cr,
+				RepoArchiveRegistry: repozip.NewArchiveRegistry(client, testTempDir, false),
+				Logger:              mock.LogNoOpManager{},
+				EnsureImage:         imageMapEnsurer(images),
+
+				TempDir:          testTempDir,
+				Parallelism:      runtime.GOMAXPROCS(parallelism),
+				Timeout:          tc.executorTimeout,
+				FailFast:         tc.failFast,
+				WorkingDirectory: tc.workingDirectory,
+				DiffTransform:    tc.diffTransform,
+				SecretResolver:   tc.secretResolver,
+				KeepWorkspaces:   tc.keepWorkspaces,
+				RequireChanges:   tc.requireChanges,
+				CorrelationID:    tc.correlationID,
+			}
+
+			if opts.Timeout == 0 {
+				opts.Timeout = 30 * time.Second
+			}
+			if tc.parallelism != 0 {
+				opts.Parallelism = tc.parallelism
+			}
+
+			dummyUI := newDummyTaskExecutionUI()
+			executor := NewExecutor(opts)
+
+			// Run executor
+			executor.Start(ctx, tc.tasks, dummyUI)
+
+			results, err := executor.Wait()
+			if tc.wantErrInclude == "" {
+				if err != nil {
+					t.Fatalf("execution failed: %s", err)
+				}
+			} else {
+				if err == nil {
+					t.Fatalf("expected error to include %q, but got no error", tc.wantErrInclude)
+				} else if !strings.Contains(strings.ToLower(err.Error()), strings.ToLower(tc.wantErrInclude)) {
+					t.Errorf("wrong error. have=%q want included=%q", err, tc.wantErrInclude)
+				}
+			}
+
+			wantResults := 0
+			resultsFound := map[string]map[string]bool{}
+			for repo, byPath := range tc.wantFilesChanged {
+				wantResults += len(byPath)
+				resultsFound[repo] = map[string]bool{}
+				for path := range byPath {
+					resultsFound[repo][path] = false
+				}
+			}
+
+			var keptWorkspaces []string
+			for _, task := range tc.tasks {
+				if task.KeptWorkspace == "" {
+					continue
+				}
+				if _, err := os.Stat(filepath.Join(task.KeptWorkspace, "README.md")); err != nil {
+					t.Errorf("workspace of %s wasn't kept: %s", task.Repository.Name, err)
+				}
+				keptWorkspaces = append(keptWorkspaces, task.Repository.Name)
+			}
+			if diff := cmp.Diff(tc.wantKeptWorkspaces, keptWorkspaces); diff != "" {
+				t.Errorf("wrong kept workspaces (-want +have):\n%s", diff)
+			}
+
+			haveResults := 0
+			for _, res := range results {
+				if res.err == nil {
+					haveResults++
+				}
+			}
+
+			if have, want := haveResults, wantResults; have != want {
+				t.Fatalf("wrong number of results. want=%d, have=%d", want, have)
+			}
+
+			for _, taskResult := range results {
+				if taskResult.err != nil {
+					continue
+				}
+
+				repoID := taskResult.task.Repository.ID
+				path := taskResult.task.Path
+
+				wantFiles, ok := tc.wantFilesChanged[repoID]
+				if !ok {
+					t.Fatalf("unexpected file changes in repo %s", repoID)
+				}
+
+				resultsFound[repoID][path] = true
+
+				wantFilesInPath, ok := wantFiles[path]
+				if !ok {
+					t.Fatalf("spec for repo %q and path %q but no files expected in that branch", repoID, path)
+				}
+
+				lastStepResult := taskResult.stepResults[len(taskResult.stepResults)-1]
+
+				fileDiffs, err := diff.ParseMultiFileDiff(lastStepResult.Diff)
+				if err != nil {
+					t.Fatalf("failed to parse diff: %s", err)
+				}
+
+				if have, want := len(fileDiffs), len(wantFilesInPath); have != want {
+					t.Fatalf("repo %s: wrong number of fileDiffs. want=%d, have=%d", repoID, want, have)
+				}
+
+				diffsByName := map[string]*diff.FileDiff{}
+				for _, fd := range fileDiffs {
+					if fd.NewName == "/dev/null" {
+						diffsByName[fd.OrigName] = fd
+					} else {
+						diffsByName[fd.NewName] = fd
+					}
+				}
+
+				for _, file := range wantFilesInPath {
+					if _, ok := diffsByName[file]; !ok {
+						t.Errorf("%s was not changed (diffsByName=%#v)", file, diffsByName)
+					}
+				}
+
+				if tc.wantCommits != nil {
+					haveCommits := map[string][]string{}
+					for _, c := range lastStepResult.Commits {
+						changes, err := git.ChangesInDiff(c.Diff)
+						if err != nil {
+							t.Fatal(err)
+						}
+						haveCommits[c.Message] = changes.Added
+					}
+					changes, err := git.ChangesInDiff(lastStepResult.UncommittedDiff)
+					if err != nil {
+						t.Fatal(err)
+					}
+					haveCommits[""] = changes.Added
+					if diff := cmp.Diff(tc.wantCommits, haveCommits); diff != "" {
+						t.Errorf("wrong commits (-want +have):\n%s", diff)
+					}
+				}
+			}
+
+			for repo, paths := range resultsFound {
+				for path, found := range paths {
+					for !found {
+						t.Fatalf("expected spec to be created in path %s of repo %s, but was not", path, repo)
+					}
+				}
+			}
+
+			// Make sure that all the Tasks have been updated correctly
+			if have, want := len(dummyUI.finished), tc.wantFinished; have != want {
+				t.Fatalf("wrong number of UI finished tasks. want=%d, have=%d", want, have)
+			}
+			if have, want := len(dummyUI.finishedWithErr), tc.wantFinishedWithErr; have != want {
+				t.Fatalf("wrong number of UI finished-with-err tasks. want=%d, have=%d", want, have)
+			}
+		})
+	}
+}
+
+func TestExecutor_CancelTask(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test doesn't work on Windows because dummydocker is written in bash")
+	}
+
+	addToPath(t, "testdata/dummydocker")
+
+	archives := []mock.RepoArchive{
+		{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{
+			"README.md": "# Welcome to the README\n",
+			"hang":      "",
+		}},
+		{RepoName: testRepo2.Name, Commit: testRepo2.Rev(), Files: map[string]string{
+			"README.md": "# Sourcegraph README\n",
+		}},
+	}
+	// Only the task in testRepo1 hangs. `exec` makes sure the sleep is
+	// killed along with dummydocker.
+	steps := []batcheslib.Step{
+		{Run: `[[ -f "hang" ]] && exec sleep 30; echo "foobar" >> README.md`},
+	}
+	images := map[string]docker.Image{"": &mock.Image{}}
+	attributes := &template.BatchChangeAttributes{Name: "cancel-test"}
+	tasks := []*Task{
+		{Repository: testRepo1, Steps: steps, BatchChangeAttributes: attributes},
+		{Repository: testRepo2, Steps: steps, BatchChangeAttributes: attributes},
+	}
+
+	ts := httptest.NewServer(mock.NewZipArchivesMux(t, nil, archives...))
+	defer ts.Close()
+
+	var clientBuffer bytes.Buffer
+	u, _ := url.ParseRequestURI(ts.URL)
+	client := api.NewClient(api.ClientOpts{EndpointURL: u, Out: &clientBuffer})
+
+	testTempDir := t.TempDir()
+
+	ctx := context.Background()
+	cr, _ := workspace.NewCreator(ctx, "bind", testTempDir, testTempDir, images)
+	executor := NewExecutor(NewExecutorOpts{
+		Creator:             cr,
+		RepoArchiveRegistry: repozip.NewArchiveRegistry(client, testTempDir, false),
+		Logger:              mock.LogNoOpManager{},
+		EnsureImage:         imageMapEnsurer(images),
+		TempDir:             testTempDir,
+		Parallelism:         2,
+		Timeout:             time.Minute,
+	})
+
+	dummyUI := newDummyTaskExecutionUI()
+	executor.Start(ctx, tasks, dummyUI)
+
+	require.Eventually(t, func() bool {
+		return executor.CancelTask(testRepo1.Name)
+	}, 10*time.Second, 10*time.Millisecond)
+
+	results, err := executor.Wait()
+	require.ErrorIs(t, err, ErrTaskCancelled)
+	var runErrs *RunErrors
+	require.True(t, errors.As(err, &runErrs))
+	require.Len(t, runErrs.ByKind()[TaskErrorCancelled], 1)
+
+	for _, res := range results {
+		switch res.task.Repository.Name {
+		case testRepo1.Name:
+			var taskErr TaskExecutionErr
+			require.True(t, errors.As(res.err, &taskErr))
+			require.Equal(t, "Cancelled", taskErr.StatusText())
+		case testRepo2.Name:
+			require.NoError(t, res.err)
+		}
+	}
+	require.Len(t, dummyUI.finished, 1)
+	require.Len(t, dummyUI.finishedWithErr, 1)
+}
+
+func TestExecutor_SubscribeLog(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test doesn't work on Windows because dummydocker is written in bash")
+	}
+
+	addToPath(t, "testdata/dummydocker")
+
+	archives := []mock.RepoArchive{
+		{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{
+			"README.md": "# Welcome to the README\n",
+		}},
+	}
+	// The step waits for the test to create the release file, so that the
+	// test can subscribe while it's running.
+	release := filepath.Join(t.TempDir(), "release")
+	steps := []batcheslib.Step{
+		{Run: fmt.Sprintf(`echo waiting; while [[ ! -f %q ]]; do sleep 0.05; done; echo released`, release)},
+	}
+	images := map[string]docker.Image{"": &mock.Image{}}
+	task := &Task{Repository: testRepo1, Steps: steps, BatchChangeAttributes: &template.BatchChangeAttributes{Name: "subscribe-test"}}
+
+	ts := httptest.NewServer(mock.NewZipArchivesMux(t, nil, archives...))
+	defer ts.Close()
+
+	var clientBuffer bytes.Buffer
+	u, _ := url.ParseRequestURI(ts.URL)
+	client := api.NewClient(api.ClientOpts{EndpointURL: u, Out: &clientBuffer})
+
+	testTempDir := t.TempDir()
+
+	ctx := context.Background()
+	cr, _ := workspace.NewCreator(ctx, "bind", testTempDir, testTempDir, images)
+	executor := NewExecutor(NewExecutorOpts{
+		Creator:             cr,
+		RepoArchiveRegistry: repozip.NewArchiveRegistry(client, testTempDir, false),
+		Logger:              mock.LogNoOpManager{},
+		EnsureImage:         imageMapEnsurer(images),
+		TempDir:             testTempDir,
+		Parallelism:         1,
+		Timeout:             time.Minute,
+	})
+
+	key := TaskStatus{Repository: testRepo1.Name, Rev: testRepo1.Rev()}.Key()
+	_, ok := executor.SubscribeLog(key)
+	require.False(t, ok, "subscribed to a task that isn't running")
+
+	executor.Start(ctx, []*Task{task}, newDummyTaskExecutionUI())
+
+	var sub, closed *log.Subscription
+	require.Eventually(t, func() bool {
+		sub, ok = executor.SubscribeLog(key)
+		return ok
+	}, 10*time.Second, 10*time.Millisecond)
+	closed, _ = executor.SubscribeLog(key)
+
+	// Lines that were logged before subscribing are received too.
+	waitForLine := func(text string) {
+		t.Helper()
+		for {
+			select {
+			case line, ok := <-sub.Lines():
+				require.True(t, ok, "subscription closed before %q was logged", text)
+				if line.Prefix == "stdout" && line.Text == text {
+					return
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("%q wasn't logged", text)
+			}
+		}
+	}
+	waitForLine("waiting")
+
+	// Closing a subscription doesn't affect the task or other subscriptions.
+	closed.Close()
+	closed.Close()
+	require.NoError(t, os.WriteFile(release, nil, 0o600))
+	waitForLine("released")
+
+	_, err := executor.Wait()
+	require.NoError(t, err)
+	for range sub.Lines() {
+	}
+	require.Zero(t, sub.Dropped())
+	_, ok = executor.SubscribeLog(key)
+	require.False(t, ok, "subscribed to a finished task")
+}
+
+func TestExecutor_Pause(t *testing.T) {
+	executor := NewExecutor(NewExecutorOpts{})
+	require.NoError(t, executor.waitWhilePaused(context.Background()))
+
+	executor.Pause()
+	executor.Pause()
+	require.True(t, executor.Paused())
+
+	done := make(chan error)
+	go func() { done <- executor.waitWhilePaused(context.Background()) }()
+	select {
+	case err := <-done:
+		t.Fatalf("task started while paused: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	executor.Resume()
+	require.False(t, executor.Paused())
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("task not started after resuming")
+	}
+
+	// Cancelled Tasks don't wait for the executor to be resumed.
+	executor.Pause()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, executor.waitWhilePaused(ctx), context.Canceled)
+}
+
+func TestExecutor_StartJitter(t *testing.T) {
+	executor := NewExecutor(NewExecutorOpts{Parallelism: 3})
+	require.Zero(t, executor.startDelay())
+
+	executor = NewExecutor(NewExecutorOpts{Parallelism: 3, StartJitter: time.Second})
+	for range 3 {
+		delay := executor.startDelay()
+		require.GreaterOrEqual(t, delay, time.Duration(0))
+		require.Less(t, delay, time.Second)
+	}
+	// Only the first wave of Tasks is delayed.
+	require.Zero(t, executor.startDelay())
+
+	// With the same source of randomness, the delays are the same.
+	delays := func() (delays []time.Duration) {
+		executor := NewExecutor(NewExecutorOpts{Parallelism: 3, StartJitter: time.Second, Rand: rand.New(rand.NewPCG(1, 2))})
+		for range 3 {
+			delays = append(delays, executor.startDelay())
+		}
+		return delays
+	}
+	require.Equal(t, delays(), delays())
+}
+
+// fakeClock is a Clock that advances by a second every time it's read.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now
+	c.now = c.now.Add(time.Second)
+	return now
+}
+
+func TestExecutor_Clock(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test doesn't work on Windows because dummydocker is written in bash")
+	}
+
+	addToPath(t, "testdata/dummydocker")
+
+	archives := []mock.RepoArchive{
+		{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{"README.md": "# Welcome to the README\n"}},
+	}
+	images := map[string]docker.Image{"": &mock.Image{}}
+	task := &Task{
+		Repository:            testRepo1,
+		Steps:                 []batcheslib.Step{{Run: `echo "foobar" >> README.md`}},
+		BatchChangeAttributes: &template.BatchChangeAttributes{Name: "clock-test"},
+	}
+
+	ts := httptest.NewServer(mock.NewZipArchivesMux(t, nil, archives...))
+	defer ts.Close()
+
+	var clientBuffer bytes.Buffer
+	u, _ := url.ParseRequestURI(ts.URL)
+	client := api.NewClient(api.ClientOpts{EndpointURL: u, Out: &clientBuffer})
+
+	testTempDir := t.TempDir()
+	ctx := context.Background()
+	cr, _ := workspace.NewCreator(ctx, "bind", testTempDir, testTempDir, images)
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var events bytes.Buffer
+	statuses := NewMemoryStatusStore()
+	var completion TaskCompletion
+	executor := NewExecutor(NewExecutorOpts{
+		Creator:             cr,
+		RepoArchiveRegistry: repozip.NewArchiveRegistry(client, testTempDir, false),
+		Logger:              mock.LogNoOpManager{},
+		EventWriter:         &events,
+		StatusStore:         statuses,
+		EnsureImage:         imageMapEnsurer(images),
+		TempDir:             testTempDir,
+		Parallelism:         1,
+		Timeout:             time.Minute,
+		Clock:               &fakeClock{now: start},
+		OnTaskComplete: func(c TaskCompletion) error {
+			completion = c
+			return nil
+		},
+	})
+
+	executor.Start(ctx, []*Task{task}, newDummyTaskExecutionUI())
+	_, err := executor.Wait()
+	require.NoError(t, err)
+
+	// The clock is read for the enqueued event, the enqueueing, the started
+	// event, the start, the two step events and the end, in that order.
+	require.Equal(t, start.Add(1*time.Second), completion.EnqueuedAt)
+	require.Equal(t, start.Add(3*time.Second), completion.StartedAt)
+	require.Equal(t, start.Add(6*time.Second), completion.FinishedAt)
+	require.Equal(t, 2*time.Second, completion.QueueTime())
+	require.Equal(t, 3*time.Second, completion.ExecutionTime())
+
+	var times []time.Time
+	for _, line := range strings.Split(strings.TrimSuffix(events.String(), "\n"), "\n") {
+		var e Event
+		require.NoError(t, json.Unmarshal([]byte(line), &e), line)
+		times = append(times, e.Time)
+	}
+	require.Equal(t, []time.Time{start, start.Add(2 * time.Second), start.Add(4 * time.Second), start.Add(5 * time.Second), start.Add(7 * time.Second)}, times)
+
+	status, ok, err := statuses.Load(TaskStatus{Repository: testRepo1.Name, Rev: testRepo1.Rev()}.Key())
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, start.Add(2*time.Second), status.StartedAt)
+	require.Equal(t, start.Add(7*time.Second), status.UpdatedAt)
+}
+
+func TestDiskBudget(t *testing.T) {
+	ctx := context.Background()
+	b := newDiskBudget(100)
+	notWaiting := func(int64) { t.Error("reservation waited unexpectedly") }
+
+	release, err := b.reserve(ctx, 60, notWaiting)
+	require.NoError(t, err)
+
+	// The second reservation waits until the first one is released.
+	waiting := make(chan int64, 1)
+	reserved := make(chan struct{})
+	go func() {
+		release, err := b.reserve(ctx, 60, func(size int64) { waiting <- size })
+		if err == nil {
+			release()
+		}
+		close(reserved)
+	}()
+	require.Equal(t, int64(60), <-waiting)
+	release()
+	<-reserved
+
+	// Workspaces larger than the budget reserve all of it.
+	release, err = b.reserve(ctx, 1000, notWaiting)
+	require.NoError(t, err)
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = b.reserve(cancelled, 1, func(int64) {})
+	require.ErrorIs(t, err, context.Canceled)
+	release()
+}
+
+func TestExecutor_CleanupOnCancel(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test doesn't work on Windows because dummydocker is written in bash")
+	}
+
+	addToPath(t, "testdata/dummydocker")
+
+	archives := []mock.RepoArchive{
+		{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{
+			"README.md": "# Welcome to the README\n",
+		}},
+	}
+	// `exec` makes sure the sleep is killed along with dummydocker.
+	steps := []batcheslib.Step{{Run: `touch started && exec sleep 30`}}
+	images := map[string]docker.Image{"": &mock.Image{}}
+	tasks := []*Task{
+		{Repository: testRepo1, Steps: steps, BatchChangeAttributes: &template.BatchChangeAttributes{Name: "cleanup-test"}},
+	}
+
+	ts := httptest.NewServer(mock.NewZipArchivesMux(t, nil, archives...))
+	defer ts.Close()
+
+	var clientBuffer bytes.Buffer
+	u, _ := url.ParseRequestURI(ts.URL)
+	client := api.NewClient(api.ClientOpts{EndpointURL: u, Out: &clientBuffer})
+
+	// The archives are kept, so they're downloaded to a different directory.
+	testTempDir := t.TempDir()
+	archiveDir := t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cr, _ := workspace.NewCreator(ctx, "bind", testTempDir, testTempDir, images)
+	executor := NewExecutor(NewExecutorOpts{
+		Creator:             cr,
+		RepoArchiveRegistry: repozip.NewArchiveRegistry(client, archiveDir, false),
+		Logger:              mock.LogNoOpManager{},
+		EnsureImage:         imageMapEnsurer(images),
+		TempDir:             testTempDir,
+		Parallelism:         1,
+		Timeout:             time.Minute,
+	})
+
+	executor.Start(ctx, tasks, newDummyTaskExecutionUI())
+
+	// Wait until the step is running in its workspace, then interrupt.
+	require.Eventually(t, func() bool {
+		started, _ := filepath.Glob(filepath.Join(testTempDir, "workspace-*", "started"))
+		return len(started) > 0
+	}, 10*time.Second, 10*time.Millisecond)
+	cancel()
+
+	_, err := executor.Wait()
+	require.Error(t, err)
+
+	entries, err := os.ReadDir(testTempDir)
+	require.NoError(t, err)
+	var left []string
+	for _, e := range entries {
+		left = append(left, e.Name())
+	}
+	require.Empty(t, left, "temporary files left behind after cancellation")
+}
+
+func TestExecutor_OnTaskComplete(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test doesn't work on Windows because dummydocker is written in bash")
+	}
+
+	addToPath(t, "testdata/dummydocker")
+
+	archives := []mock.RepoArchive{
+		{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{"README.md": "# Welcome to the README\n"}},
+		{RepoName: testRepo2.Name, Commit: testRepo2.Rev(), Files: map[string]string{"README.md": "# Sourcegraph README\n"}},
+	}
+	images := map[string]docker.Image{"": &mock.Image{}}
+	attrs := &template.BatchChangeAttributes{Name: "hook-test"}
+	changed := &Task{Repository: testRepo1, Steps: []batcheslib.Step{{Run: `echo "foobar" >> README.md`}}, BatchChangeAttributes: attrs}
+	unchanged := &Task{Repository: testRepo2, Steps: []batcheslib.Step{{Run: `true`}}, BatchChangeAttributes: attrs}
+	failed := &Task{Repository: testRepo2, Path: "sub", Steps: []batcheslib.Step{{Run: `exit 1`}}, BatchChangeAttributes: attrs}
+
+	ts := httptest.NewServer(mock.NewZipArchivesMux(t, nil, archives...))
+	defer ts.Close()
+
+	var clientBuffer bytes.Buffer
+	u, _ := url.ParseRequestURI(ts.URL)
+	client := api.NewClient(api.ClientOpts{EndpointURL: u, Out: &clientBuffer})
+
+	testTempDir := t.TempDir()
+	ctx := context.Background()
+	cr, _ := workspace.NewCreator(ctx, "bind", testTempDir, testTempDir, images)
+
+	// The hook doesn't synchronize, because its calls are serialized.
+	var inHook int
+	completions := map[*Task]TaskCompletion{}
+	calls := map[*Task]int{}
+	executor := NewExecutor(NewExecutorOpts{
+		Creator:             cr,
+		RepoArchiveRegistry: repozip.NewArchiveRegistry(client, testTempDir, false),
+		Logger:              mock.LogNoOpManager{},
+		EnsureImage:         imageMapEnsurer(images),
+		TempDir:             testTempDir,
+		Parallelism:         3,
+		Timeout:             time.Minute,
+		OnTaskComplete: func(c TaskCompletion) error {
+			inHook++
+			defer func() { inHook-- }()
+			if inHook > 1 {
+				t.Error("hook called concurrently")
+			}
+
+			completions[c.Task] = c
+			calls[c.Task]++
+			if c.Task == unchanged {
+				return errors.New("posting to chat failed")
+			}
+			return nil
+		},
+		FailOnTaskCompleteErr: true,
+	})
+
+	executor.Start(ctx, []*Task{changed, unchanged, failed}, newDummyTaskExecutionUI())
+	results, err := executor.Wait()
+	require.Error(t, err)
+
+	require.Equal(t, map[*Task]int{changed: 1, unchanged: 1, failed: 1}, calls)
+	require.NoError(t, completions[changed].Err)
+	require.NotEmpty(t, completions[changed].Diff)
+	require.NoError(t, completions[unchanged].Err)
+	require.Empty(t, completions[unchanged].Diff)
+	require.Error(t, completions[failed].Err)
+	require.False(t, completions[changed].FinishedAt.Before(completions[changed].StartedAt))
+
+	// With FailOnTaskCompleteErr, the failing hook fails the Task.
+	for _, res := range results {
+		if res.task == unchanged {
+			require.ErrorContains(t, res.err, "task completion hook failed: posting to chat failed")
+		}
+	}
+}
+
+func TestExecutor_StartStream(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test doesn't work on Windows because dummydocker is written in bash")
+	}
+
+	addToPath(t, "testdata/dummydocker")
+
+	archives := []mock.RepoArchive{
+		{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{"README.md": "# Welcome to the README\n"}},
+		{RepoName: testRepo2.Name, Commit: testRepo2.Rev(), Files: map[string]string{"README.md": "# Sourcegraph README\n"}},
+	}
+	images := map[string]docker.Image{"": &mock.Image{}}
+	attrs := &template.BatchChangeAttributes{Name: "stream-test"}
+	first := &Task{Repository: testRepo1, Steps: []batcheslib.Step{{Run: `echo "foobar" >> README.md`}}, BatchChangeAttributes: attrs}
+	second := &Task{Repository: testRepo2, Steps: []batcheslib.Step{{Run: `echo "foobar" >> README.md`}}, BatchChangeAttributes: attrs}
+
+	ts := httptest.NewServer(mock.NewZipArchivesMux(t, nil, archives...))
+	defer ts.Close()
+
+	var clientBuffer bytes.Buffer
+	u, _ := url.ParseRequestURI(ts.URL)
+	client := api.NewClient(api.ClientOpts{EndpointURL: u, Out: &clientBuffer})
+
+	testTempDir := t.TempDir()
+	ctx := context.Background()
+	cr, _ := workspace.NewCreator(ctx, "bind", testTempDir, testTempDir, images)
+
+	completed := make(chan *Task, 2)
+	executor := NewExecutor(NewExecutorOpts{
+		Creator:             cr,
+		RepoArchiveRegistry: repozip.NewArchiveRegistry(client, testTempDir, false),
+		Logger:              mock.LogNoOpManager{},
+		EnsureImage:         imageMapEnsurer(images),
+		TempDir:             testTempDir,
+		Parallelism:         2,
+		Timeout:             time.Minute,
+		OnTaskComplete: func(c TaskCompletion) error {
+			completed <- c.Task
+			return nil
+		},
+	})
+
+	tasks := make(chan *Task)
+	go executor.StartStream(ctx, tasks, newDummyTaskExecutionUI())
+
+	// The first Task is executed before the second one is resolved.
+	tasks <- first
+	require.Equal(t, first, <-completed)
+
+	// Wait waits for the Tasks that are still being resolved.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		tasks <- second
+		close(tasks)
+	}()
+	results, err := executor.Wait()
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	require.Equal(t, second, <-completed)
+}
+
+func TestExecutor_LogFormatter(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test doesn't work on Windows because dummydocker is written in bash")
+	}
+
+	addToPath(t, "testdata/dummydocker")
+
+	archives := []mock.RepoArchive{
+		{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{"README.md": "# Welcome to the README\n"}},
+	}
+	images := map[string]docker.Image{"": &mock.Image{}}
+	task := &Task{
+		Repository:            testRepo1,
+		Steps:                 []batcheslib.Step{{Run: `echo "hello world"`}},
+		BatchChangeAttributes: &template.BatchChangeAttributes{Name: "log-test"},
+	}
+
+	ts := httptest.NewServer(mock.NewZipArchivesMux(t, nil, archives...))
+	defer ts.Close()
+
+	var clientBuffer bytes.Buffer
+	u, _ := url.ParseRequestURI(ts.URL)
+	client := api.NewClient(api.ClientOpts{EndpointURL: u, Out: &clientBuffer})
+
+	testTempDir := t.TempDir()
+	ctx := context.Background()
+	cr, _ := workspace.NewCreator(ctx, "bind", testTempDir, testTempDir, images)
+
+	logManager := log.NewDiskManager(t.TempDir(), true)
+	executor := NewExecutor(NewExecutorOpts{
+		Creator:             cr,
+		RepoArchiveRegistry: repozip.NewArchiveRegistry(client, testTempDir, false),
+		Logger:              logManager,
+		LogFormatter:        log.JSONFormatter{},
+		EnsureImage:         imageMapEnsurer(images),
+		TempDir:             testTempDir,
+		Parallelism:         1,
+		Timeout:             time.Minute,
+		Annotations:         map[string]string{"ticket": "ABC-123"},
+	})
+
+	executor.Start(ctx, []*Task{task}, newDummyTaskExecutionUI())
+	_, err := executor.Wait()
+	require.NoError(t, err)
+
+	files := logManager.LogFiles()
+	require.Len(t, files, 1)
+	data, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	var header struct{ Header log.Header }
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &header))
+	require.Equal(t, testRepo1.Name, header.Header.Repository)
+	require.Equal(t, testRepo1.Rev(), header.Header.Rev)
+	require.Equal(t, []string{`echo "hello world"`}, header.Header.Steps)
+	require.Equal(t, map[string]string{"ticket": "ABC-123"}, header.Header.Annotations)
+
+	var stdout []string
+	for _, line := range lines[1:] {
+		var entry struct{ Prefix, Message string }
+		require.NoError(t, json.Unmarshal([]byte(line), &entry), line)
+		if entry.Prefix == "stdout" {
+			stdout = append(stdout, entry.Message)
+		}
+	}
+	require.Contains(t, stdout, "hello world")
+}
+
+func TestFormatAnnotations(t *testing.T) {
+	require.Equal(t, "", formatAnnotations(nil))
+	require.Equal(t, "owner=batch-team, ticket=ABC-123", formatAnnotations(map[string]string{"ticket": "ABC-123", "owner": "batch-team"}))
+}
+
+func TestExecutor_VerboseTimings(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test doesn't work on Windows because dummydocker is written in bash")
+	}
+
+	addToPath(t, "testdata/dummydocker")
+
+	archives := []mock.RepoArchive{
+		{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{"README.md": "# Welcome to the README\n"}},
+	}
+	images := map[string]docker.Image{"": &mock.Image{}}
+	task := &Task{
+		Repository:            testRepo1,
+		Steps:                 []batcheslib.Step{{Run: `echo "foobar" >> README.md`}, {Run: `echo "barfoo" >> README.md`}},
+		BatchChangeAttributes: &template.BatchChangeAttributes{Name: "timings-test"},
+	}
+
+	ts := httptest.NewServer(mock.NewZipArchivesMux(t, nil, archives...))
+	defer ts.Close()
+
+	var clientBuffer bytes.Buffer
+	u, _ := url.ParseRequestURI(ts.URL)
+	client := api.NewClient(api.ClientOpts{EndpointURL: u, Out: &clientBuffer})
+
+	testTempDir := t.TempDir()
+	ctx := context.Background()
+	cr, _ := workspace.NewCreator(ctx, "bind", testTempDir, testTempDir, images)
+
+	logManager := log.NewDiskManager(t.TempDir(), true)
+	executor := NewExecutor(NewExecutorOpts{
+		Creator:             cr,
+		RepoArchiveRegistry: repozip.NewArchiveRegistry(client, testTempDir, false),
+		Logger:              logManager,
+		VerboseTimings:      true,
+		EnsureImage:         imageMapEnsurer(images),
+		TempDir:             testTempDir,
+		Parallelism:         1,
+		Timeout:             time.Minute,
+	})
+
+	executor.Start(ctx, []*Task{task}, newDummyTaskExecutionUI())
+	results, err := executor.Wait()
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+
+	var phases []Phase
+	for _, d := range results[0].timer.phaseDurations() {
+		phases = append(phases, d.Phase)
+	}
+	require.Equal(t, []Phase{PhaseArchiveDownload, PhaseWorkspaceCreation, PhaseSteps, PhaseDiff}, phases)
+
+	files := logManager.LogFiles()
+	require.Len(t, files, 1)
+	data, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	for _, what := range []string{"Archive download", "Workspace creation", "Step 1", "Diff of step 1", "Step 2", "Diff of step 2"} {
+		require.Regexp(t, `\[Timing \+[^\]]+\] `+what+` started`, string(data))
+		require.Regexp(t, `\[Timing \+[^\]]+\] `+what+` finished after `, string(data))
+	}
+}
+
+func TestExecutor_Precondition(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test doesn't work on Windows because dummydocker is written in bash")
+	}
+
+	addToPath(t, "testdata/dummydocker")
+
+	// Only the archive of the first repository is served, so fetching the
+	// second one fails.
+	archives := []mock.RepoArchive{
+		{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{"README.md": "# Welcome to the README\n"}},
+	}
+	images := map[string]docker.Image{"": &mock.Image{}}
+	attributes := &template.BatchChangeAttributes{Name: "precondition-test"}
+	precondition := `${{ matches repository.name "*/src-cli" }}`
+	steps := []batcheslib.Step{{Run: `echo "foobar" >> README.md`}}
+	met := &Task{Repository: testRepo1, Steps: steps, BatchChangeAttributes: attributes, Precondition: precondition}
+	unmet := &Task{Repository: testRepo2, Steps: steps, BatchChangeAttributes: attributes, Precondition: precondition}
+
+	ts := httptest.NewServer(mock.NewZipArchivesMux(t, nil, archives...))
+	defer ts.Close()
+
+	var clientBuffer bytes.Buffer
+	u, _ := url.ParseRequestURI(ts.URL)
+	client := api.NewClient(api.ClientOpts{EndpointURL: u, Out: &clientBuffer})
+
+	testTempDir := t.TempDir()
+	ctx := context.Background()
+	cr, _ := workspace.NewCreator(ctx, "bind", testTempDir, testTempDir, images)
+
+	executor := NewExecutor(NewExecutorOpts{
+		Creator:             cr,
+		RepoArchiveRegistry: repozip.NewArchiveRegistry(client, testTempDir, false),
+		Logger:              mock.LogNoOpManager{},
+		EnsureImage:         imageMapEnsurer(images),
+		TempDir:             testTempDir,
+		Parallelism:         2,
+		Timeout:             time.Minute,
+	})
+
+	executor.Start(ctx, []*Task{met, unmet}, newDummyTaskExecutionUI())
+	results, err := executor.Wait()
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+
+	for _, res := range results {
+		switch res.task {
+		case met:
+			require.Len(t, res.stepResults, 1)
+			require.NotEmpty(t, res.stepResults[0].Diff)
+		case unmet:
+			require.Empty(t, res.stepResults)
+		}
+	}
+
+	t.Run("invalid precondition", func(t *testing.T) {
+		invalid := &Task{Repository: testRepo1, Steps: steps, BatchChangeAttributes: attributes, Precondition: `${{ repository.nope }}`}
+		executor := NewExecutor(NewExecutorOpts{
+			Creator:             cr,
+			RepoArchiveRegistry: repozip.NewArchiveRegistry(client, testTempDir, false),
+			Logger:              mock.LogNoOpManager{},
+			EnsureImage:         imageMapEnsurer(images),
+			TempDir:             testTempDir,
+			Parallelism:         1,
+			Timeout:             time.Minute,
+		})
+		executor.Start(ctx, []*Task{invalid}, newDummyTaskExecutionUI())
+		_, err := executor.Wait()
+		require.ErrorContains(t, err, "evaluating precondition")
+	})
+}
+
+// closeErrCreator creates workspaces with the wrapped Creator whose Close
+// fails after deleting them.
+type closeErrCreator struct{ workspace.Creator }
+
+func (c closeErrCreator) Create(ctx context.Context, repo *graphql.Repository, steps []batcheslib.Step, archive repozip.Archive) (workspace.Workspace, error) {
+	ws, err := c.Creator.Create(ctx, repo, steps, archive)
+	return closeErrWorkspace{ws}, err
+}
+
+type closeErrWorkspace struct{ workspace.Workspace }
+
+func (w closeErrWorkspace) Close(ctx context.Context) error {
+	w.Workspace.Close(ctx)
+	return errors.New("permission denied")
+}
+
+// panicCreator panics when a workspace is created.
+type panicCreator struct{}
+
+func (panicCreator) Create(context.Context, *graphql.Repository, []batcheslib.Step, repozip.Archive) (workspace.Workspace, error) {
+	panic("boom")
+}
+
+func TestExecutor_Cleanup(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test doesn't work on Windows because dummydocker is written in bash")
+	}
+
+	addToPath(t, "testdata/dummydocker")
+
+	archives := []mock.RepoArchive{
+		{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{"README.md": "# Welcome to the README\n"}},
+		{RepoName: testRepo2.Name, Commit: testRepo2.Rev(), Files: map[string]string{"README.md": "# Sourcegraph README\n"}},
+	}
+	images := map[string]docker.Image{"": &mock.Image{}}
+	attributes := &template.BatchChangeAttributes{Name: "cleanup-test"}
+	steps := []batcheslib.Step{{Run: `echo "foobar" >> README.md`}}
+
+	ts := httptest.NewServer(mock.NewZipArchivesMux(t, nil, archives...))
+	defer ts.Close()
+
+	var clientBuffer bytes.Buffer
+	u, _ := url.ParseRequestURI(ts.URL)
+	client := api.NewClient(api.ClientOpts{EndpointURL: u, Out: &clientBuffer})
+
+	testTempDir := t.TempDir()
+	ctx := context.Background()
+	cr, _ := workspace.NewCreator(ctx, "bind", testTempDir, testTempDir, images)
+
+	newExecutor := func(creator workspace.Creator) *executor {
+		return NewExecutor(NewExecutorOpts{
+			Creator:             creator,
+			RepoArchiveRegistry: repozip.NewArchiveRegistry(client, testTempDir, false),
+			Logger:              mock.LogNoOpManager{},
+			EnsureImage:         imageMapEnsurer(images),
+			TempDir:             testTempDir,
+			Parallelism:         2,
+			Timeout:             time.Minute,
+		})
+	}
+
+	t.Run("cleanup error", func(t *testing.T) {
+		task := &Task{Repository: testRepo1, Steps: steps, BatchChangeAttributes: attributes}
+
+		executor := newExecutor(closeErrCreator{cr})
+		executor.Start(ctx, []*Task{task}, newDummyTaskExecutionUI())
+		results, err := executor.Wait()
+
+		// Cleanup errors don't fail the Task.
+		require.NoError(t, err)
+		require.Len(t, results, 1)
+		require.NotEmpty(t, results[0].stepResults)
+		require.ErrorContains(t, task.CleanupErr, "deleting workspace: permission denied")
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		task1 := &Task{Repository: testRepo1, Steps: steps, BatchChangeAttributes: attributes}
+		task2 := &Task{Repository: testRepo2, Steps: steps, BatchChangeAttributes: attributes}
+
+		executor := newExecutor(panicCreator{})
+		executor.Start(ctx, []*Task{task1, task2}, newDummyTaskExecutionUI())
+		_, err := executor.Wait()
+
+		var runErrs *RunErrors
+		require.True(t, errors.As(err, &runErrs))
+		require.Len(t, runErrs.Tasks, 2)
+		for _, taskErr := range runErrs.Tasks {
+			require.ErrorContains(t, taskErr, "panic while executing steps: boom")
+		}
+	})
+}
+
+func TestExecutor_ReuseContainers(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test doesn't work on Windows because dummydocker is written in bash")
+	}
+
+	addToPath(t, "testdata/dummydocker")
+
+	archives := []mock.RepoArchive{
+		{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{"README.md": "# Welcome to the README\n"}},
+	}
+	images := map[string]docker.Image{"": &mock.Image{}}
+	task := &Task{
+		Repository: testRepo1,
+		Steps: []batcheslib.Step{
+			{Run: `echo "foobar" >> README.md`},
+			{Command: []string{"bash", "-c", `echo "barfoo" >> README.md`}},
+			// Steps with files to mount get a container of their own.
+			{Run: `echo "bazbar" >> README.md`, Files: map[string]string{"/tmp/file.txt": "hello"}},
+			// Steps with other container settings get another container.
+			{Run: `echo "foobaz" >> README.md`, Memory: "1g"},
+			{Run: `echo "barbaz" >> README.md`},
+		},
+		BatchChangeAttributes: &template.BatchChangeAttributes{Name: "reuse-containers-test"},
+	}
+
+	ts := httptest.NewServer(mock.NewZipArchivesMux(t, nil, archives...))
+	defer ts.Close()
+
+	var clientBuffer bytes.Buffer
+	u, _ := url.ParseRequestURI(ts.URL)
+	client := api.NewClient(api.ClientOpts{EndpointURL: u, Out: &clientBuffer})
+
+	testTempDir := t.TempDir()
+	ctx := context.Background()
+	cr, _ := workspace.NewCreator(ctx, "bind", testTempDir, testTempDir, images)
+
+	logManager := log.NewDiskManager(t.TempDir(), true)
+	executor := NewExecutor(NewExecutorOpts{
+		Creator:             cr,
+		RepoArchiveRegistry: repozip.NewArchiveRegistry(client, testTempDir, false),
+		Logger:              logManager,
+		ReuseContainers:     true,
+		EnsureImage:         imageMapEnsurer(images),
+		TempDir:             testTempDir,
+		Parallelism:         1,
+		Timeout:             time.Minute,
+	})
+
+	executor.Start(ctx, []*Task{task}, newDummyTaskExecutionUI())
+	results, err := executor.Wait()
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.NoError(t, task.CleanupErr)
+
+	stepResults := results[0].stepResults
+	require.Contains(t, string(stepResults[len(stepResults)-1].Diff), "+foobar\n+barfoo\n+bazbar\n+foobaz\n+barbaz\n")
+
+	files := logManager.LogFiles()
+	require.Len(t, files, 1)
+	data, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	require.Equal(t, 2, strings.Count(string(data), "to share between steps"))
+	for step, shared := range map[int]bool{1: true, 2: true, 3: false, 4: true, 5: true} {
+		require.Equal(t, shared, strings.Contains(string(data), fmt.Sprintf("[Step %d] executing in shared container", step)), "step %d", step)
+	}
+
+	// The directories of the step scripts are removed with the containers.
+	scriptDirs, err := filepath.Glob(filepath.Join(testTempDir, "*-scripts*"))
+	require.NoError(t, err)
+	require.Empty(t, scriptDirs)
+}
+
+func TestExecutor_EventWriter(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test doesn't work on Windows because dummydocker is written in bash")
+	}
+
+	addToPath(t, "testdata/dummydocker")
+
+	archives := []mock.RepoArchive{
+		{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{"README.md": "# Welcome to the README\n"}},
+		{RepoName: testRepo2.Name, Commit: testRepo2.Rev(), Files: map[string]string{"README.md": "# Sourcegraph README\n"}},
+	}
+	images := map[string]docker.Image{"": &mock.Image{}}
+	attrs := &template.BatchChangeAttributes{Name: "events-test"}
+	tasks := []*Task{
+		{
+			Repository:            testRepo1,
+			Steps:                 []batcheslib.Step{{Run: `echo "foobar" >> README.md`}, {Run: `exit 3`}},
+			BatchChangeAttributes: attrs,
+		},
+		{
+			Repository:            testRepo2,
+			Steps:                 []batcheslib.Step{{Run: `echo "foobar" >> README.md`}},
+			BatchChangeAttributes: attrs,
+		},
+	}
+
+	ts := httptest.NewServer(mock.NewZipArchivesMux(t, nil, archives...))
+	defer ts.Close()
+
+	var clientBuffer bytes.Buffer
+	u, _ := url.ParseRequestURI(ts.URL)
+	client := api.NewClient(api.ClientOpts{EndpointURL: u, Out: &clientBuffer})
+
+	testTempDir := t.TempDir()
+	ctx := context.Background()
+	cr, _ := workspace.NewCreator(ctx, "bind", testTempDir, testTempDir, images)
+
+	var events bytes.Buffer
+	statuses := NewMemoryStatusStore()
+	logManager := log.NewDiskManager(t.TempDir(), true)
+	executor := NewExecutor(NewExecutorOpts{
+		Creator:             cr,
+		RepoArchiveRegistry: repozip.NewArchiveRegistry(client, testTempDir, false),
+		Logger:              logManager,
+		LogFormatter:        log.JSONFormatter{},
+		CorrelationID:       "run-42",
+		EventWriter:         &events,
+		StatusStore:         statuses,
+		EnsureImage:         imageMapEnsurer(images),
+		TempDir:             testTempDir,
+		Parallelism:         2,
+		Timeout:             time.Minute,
+	})
+
+	executor.Start(ctx, tasks, newDummyTaskExecutionUI())
+	_, err := executor.Wait()
+	require.Error(t, err)
+
+	// The events of the Tasks interleave, but each line is a whole event.
+	types := map[string][]EventType{}
+	var failed []Event
+	for _, line := range strings.Split(strings.TrimSuffix(events.String(), "\n"), "\n") {
+		var e Event
+		require.NoError(t, json.Unmarshal([]byte(line), &e), line)
+		require.False(t, e.Time.IsZero())
+		require.Equal(t, "run-42", e.CorrelationID)
+		types[e.Repository] = append(types[e.Repository], e.Type)
+		if e.Type == EventStepFailed {
+			failed = append(failed, e)
+		}
+	}
+	require.Equal(t, map[string][]EventType{
+		testRepo1.Name: {EventTaskEnqueued, EventTaskStarted, EventStepStarted, EventStepFinished, EventStepStarted, EventStepFailed, EventTaskFailed},
+		testRepo2.Name: {EventTaskEnqueued, EventTaskStarted, EventStepStarted, EventStepFinished, EventTaskCompleted},
+	}, types)
+	require.Len(t, failed, 1)
+	require.Equal(t, 2, failed[0].Step)
+	require.Equal(t, 3, failed[0].ExitCode)
+	require.Equal(t, testRepo1.Rev(), failed[0].Rev)
+
+	// The statuses are those after the last event of each Task.
+	failedStatus, ok, err := statuses.Load(TaskStatus{Repository: testRepo1.Name, Rev: testRepo1.Rev()}.Key())
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, EventTaskFailed, failedStatus.State)
+	require.Equal(t, 2, failedStatus.Step)
+	require.NotEmpty(t, failedStatus.Error)
+	require.False(t, failedStatus.StartedAt.IsZero())
+	completedStatus, ok, err := statuses.Load(TaskStatus{Repository: testRepo2.Name, Rev: testRepo2.Rev()}.Key())
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, EventTaskCompleted, completedStatus.State)
+	require.Empty(t, completedStatus.Error)
+
+	// The log files start with the correlation ID.
+	require.Len(t, logManager.LogFiles(), 2)
+	for _, path := range logManager.LogFiles() {
+		f, err := os.Open(path)
+		require.NoError(t, err)
+		var first struct{ Header log.Header }
+		require.NoError(t, json.NewDecoder(f).Decode(&first))
+		f.Close()
+		require.Equal(t, "run-42", first.Header.CorrelationID)
 	}
+}
 
-	for _, tc := range tests {
-		t.Run(tc.name, func(t *testing.T) {
-			// Make sure that the steps and tasks are setup properly
-			images := make(map[string]docker.Image)
-			for _, step := range tc.steps {
-				images[step.Container] = &mock.Image{RawDigest: step.Container}
-			}
-			for _, task := range tc.tasks {
-				task.BatchChangeAttributes = defaultBatchChangeAttributes
-				task.Steps = tc.steps
-			}
+func TestExecutor_Finally(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test doesn't work on Windows because dummydocker is written in bash")
+	}
 
-			// Setup a mock test server so we also test the downloading of archives
-			mux := mock.NewZipArchivesMux(t, nil, tc.archives...)
+	addToPath(t, "testdata/dummydocker")
 
-			middle := func(next http.Handler) http.Handler {
-				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-					next.ServeHTTP(w, r)
-				})
-			}
-			for _, additionalFiles := range tc.additionalFiles {
-				mock.HandleAdditionalFiles(mux, additionalFiles, middle)
-			}
+	archives := []mock.RepoArchive{
+		{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{"README.md": "# Welcome to the README\n"}},
+	}
+	images := map[string]docker.Image{"": &mock.Image{}}
 
-			ts := httptest.NewServer(mux)
-			defer ts.Close()
+	ts := httptest.NewServer(mock.NewZipArchivesMux(t, nil, archives...))
+	defer ts.Close()
 
-			// Setup an api.Client that points to this test server
-			var clientBuffer bytes.Buffer
-			u, _ := url.ParseRequestURI(ts.URL)
-			client := api.NewClient(api.ClientOpts{EndpointURL: u, Out: &clientBuffer})
+	var clientBuffer bytes.Buffer
+	u, _ := url.ParseRequestURI(ts.URL)
+	client := api.NewClient(api.ClientOpts{EndpointURL: u, Out: &clientBuffer})
 
-			// Temp dir for log files and downloaded archives
-			testTempDir := t.TempDir()
+	for _, tc := range []struct {
+		name    string
+		steps   []batcheslib.Step
+		finally []batcheslib.Step
+		wantErr string
+	}{
+		{
+			name:    "steps succeed",
+			steps:   []batcheslib.Step{{Run: `echo "foobar" >> README.md`}},
+			finally: []batcheslib.Step{{Run: `echo "cleaned up" | tee -a README.md`}},
+		},
+		{
+			name:    "step fails",
+			steps:   []batcheslib.Step{{Run: `echo "foobar" >> README.md`}, {Run: `exit 1`}, {Run: `echo "never executed"`}},
+			finally: []batcheslib.Step{{Run: `exit 2`}, {Run: `echo "cleaned up" | tee -a README.md`}},
+			wantErr: "run: exit 1",
+		},
+		{
+			name:    "finally step fails",
+			steps:   []batcheslib.Step{{Run: `echo "foobar" >> README.md`}},
+			finally: []batcheslib.Step{{Run: `exit 2`}, {Run: `echo "cleaned up" | tee -a README.md`}},
+			wantErr: "finally step 1: run: exit 2",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			task := &Task{
+				Repository:            testRepo1,
+				Steps:                 tc.steps,
+				Finally:               tc.finally,
+				BatchChangeAttributes: &template.BatchChangeAttributes{Name: "finally-test"},
+			}
 
+			testTempDir := t.TempDir()
 			ctx := context.Background()
 			cr, _ := workspace.NewCreator(ctx, "bind", testTempDir, testTempDir, images)
-			// Setup executor
-			parallelism := 0
-			if tc.failFast {
-				parallelism = 1
-			}
-			opts := NewExecutorOpts{
+
+			logManager := log.NewDiskManager(t.TempDir(), true)
+			executor := NewExecutor(NewExecutorOpts{
 				Creator:             cr,
 				RepoArchiveRegistry: repozip.NewArchiveRegistry(client, testTempDir, false),
-				Logger:              mock.LogNoOpManager{},
+				Logger:              logManager,
 				EnsureImage:         imageMapEnsurer(images),
+				TempDir:             testTempDir,
+				Parallelism:         1,
+				Timeout:             time.Minute,
+			})
 
-				TempDir:          testTempDir,
-				Parallelism:      runtime.GOMAXPROCS(parallelism),
-				Timeout:          tc.executorTimeout,
-				FailFast:         tc.failFast,
-				WorkingDirectory: tc.workingDirectory,
+			executor.Start(ctx, []*Task{task}, newDummyTaskExecutionUI())
+			results, err := executor.Wait()
+			if tc.wantErr != "" {
+				require.ErrorContains(t, err, tc.wantErr)
+			} else {
+				require.NoError(t, err)
+				// The changes of the finally steps aren't part of the diff.
+				stepResults := results[0].stepResults
+				diff := string(stepResults[len(stepResults)-1].Diff)
+				require.Contains(t, diff, "+foobar")
+				require.NotContains(t, diff, "cleaned up")
 			}
 
-			if opts.Timeout == 0 {
-				opts.Timeout = 30 * time.Second
-			}
+			// The finally steps are executed no matter what failed.
+			files := logManager.LogFiles()
+			require.Len(t, files, 1)
+			data, err := os.ReadFile(files[0])
+			require.NoError(t, err)
+			require.Contains(t, string(data), "stdout | cleaned up")
+			require.NotContains(t, string(data), "stdout | never executed")
+		})
+	}
+}
 
-			dummyUI := newDummyTaskExecutionUI()
-			executor := NewExecutor(opts)
+func TestExecutor_TempDirs(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test doesn't work on Windows because dummydocker is written in bash")
+	}
 
-			// Run executor
-			executor.Start(ctx, tc.tasks, dummyUI)
+	addToPath(t, "testdata/dummydocker")
 
-			results, err := executor.Wait()
-			if tc.wantErrInclude == "" {
-				if err != nil {
-					t.Fatalf("execution failed: %s", err)
-				}
-			} else {
-				if err == nil {
-					t.Fatalf("expected error to include %q, but got no error", tc.wantErrInclude)
-				} else if !strings.Contains(strings.ToLower(err.Error()), strings.ToLower(tc.wantErrInclude)) {
-					t.Errorf("wrong error. have=%q want included=%q", err, tc.wantErrInclude)
-				}
-			}
+	archives := []mock.RepoArchive{
+		{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{"README.md": "# Welcome to the README\n"}},
+		{RepoName: testRepo2.Name, Commit: testRepo2.Rev(), Files: map[string]string{"README.md": "# Sourcegraph README\n"}},
+	}
+	steps := []batcheslib.Step{{Run: `echo "foobar" >> README.md`}}
+	images := map[string]docker.Image{"": &mock.Image{}}
+	attributes := &template.BatchChangeAttributes{Name: "temp-dirs-test"}
+	tasks := []*Task{
+		{Repository: testRepo1, Steps: steps, BatchChangeAttributes: attributes},
+		{Repository: testRepo2, Steps: steps, BatchChangeAttributes: attributes},
+	}
 
-			wantResults := 0
-			resultsFound := map[string]map[string]bool{}
-			for repo, byPath := range tc.wantFilesChanged {
-				wantResults += len(byPath)
-				resultsFound[repo] = map[string]bool{}
-				for path := range byPath {
-					resultsFound[repo][path] = false
-				}
-			}
+	ts := httptest.NewServer(mock.NewZipArchivesMux(t, nil, archives...))
+	defer ts.Close()
 
-			haveResults := 0
-			for _, res := range results {
-				if res.err == nil {
-					haveResults++
-				}
-			}
+	var clientBuffer bytes.Buffer
+	u, _ := url.ParseRequestURI(ts.URL)
+	client := api.NewClient(api.ClientOpts{EndpointURL: u, Out: &clientBuffer})
 
-			if have, want := haveResults, wantResults; have != want {
-				t.Fatalf("wrong number of results. want=%d, have=%d", want, have)
-			}
+	testTempDir := t.TempDir()
+	tempDirs := []string{t.TempDir(), t.TempDir()}
 
-			for _, taskResult := range results {
-				if taskResult.err != nil {
-					continue
-				}
+	ctx := context.Background()
+	cr, _ := workspace.NewCreator(ctx, "bind", testTempDir, testTempDir, images)
+	executor := NewExecutor(NewExecutorOpts{
+		Creator:             cr,
+		RepoArchiveRegistry: repozip.NewArchiveRegistry(client, testTempDir, false),
+		Logger:              mock.LogNoOpManager{},
+		EnsureImage:         imageMapEnsurer(images),
+		TempDir:             testTempDir,
+		TempDirs:            tempDirs,
+		Parallelism:         1,
+		Timeout:             time.Minute,
+	})
 
-				repoID := taskResult.task.Repository.ID
-				path := taskResult.task.Path
+	executor.Start(ctx, tasks, newDummyTaskExecutionUI())
+	_, err := executor.Wait()
+	require.NoError(t, err)
 
-				wantFiles, ok := tc.wantFilesChanged[repoID]
-				if !ok {
-					t.Fatalf("unexpected file changes in repo %s", repoID)
-				}
+	require.ElementsMatch(t, tempDirs, []string{tasks[0].TempDir, tasks[1].TempDir})
+	// The workspaces were created in, and removed from, the temp dirs.
+	for _, dir := range tempDirs {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	}
+}
 
-				resultsFound[repoID][path] = true
+// branchMovingUI moves the branch of the repository of every Task to the
+// commit moved as soon as the Task is started.
+type branchMovingUI struct {
+	*dummyTaskExecutionUI
+	moved string
+}
 
-				wantFilesInPath, ok := wantFiles[path]
-				if !ok {
-					t.Fatalf("spec for repo %q and path %q but no files expected in that branch", repoID, path)
-				}
+func (ui *branchMovingUI) TaskStarted(task *Task) {
+	ui.dummyTaskExecutionUI.TaskStarted(task)
+	repo := *task.Repository
+	repo.Branch = graphql.Branch{Name: repo.DefaultBranch.Name, Target: graphql.Target{OID: ui.moved}}
+	task.Repository = &repo
+}
 
-				lastStepResult := taskResult.stepResults[len(taskResult.stepResults)-1]
+func TestExecutor_PinnedRev(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test doesn't work on Windows because dummydocker is written in bash")
+	}
 
-				fileDiffs, err := diff.ParseMultiFileDiff(lastStepResult.Diff)
-				if err != nil {
-					t.Fatalf("failed to parse diff: %s", err)
-				}
+	addToPath(t, "testdata/dummydocker")
 
-				if have, want := len(fileDiffs), len(wantFilesInPath); have != want {
-					t.Fatalf("repo %s: wrong number of fileDiffs. want=%d, have=%d", repoID, want, have)
-				}
+	// Only the commit the repository was resolved to can be fetched.
+	archives := []mock.RepoArchive{
+		{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{"README.md": "# Welcome to the README\n"}},
+	}
+	images := map[string]docker.Image{"": &mock.Image{}}
+	batchSpec := &batcheslib.BatchSpec{Name: "pinned-rev-test", ChangesetTemplate: testChangesetTemplate}
+	task := &Task{
+		Repository:            testRepo1,
+		Steps:                 []batcheslib.Step{{Run: `echo "foobar" >> README.md`}},
+		BatchChangeAttributes: &template.BatchChangeAttributes{Name: batchSpec.Name},
+	}
 
-				diffsByName := map[string]*diff.FileDiff{}
-				for _, fd := range fileDiffs {
-					if fd.NewName == "/dev/null" {
-						diffsByName[fd.OrigName] = fd
-					} else {
-						diffsByName[fd.NewName] = fd
-					}
-				}
+	ts := httptest.NewServer(mock.NewZipArchivesMux(t, nil, archives...))
+	defer ts.Close()
 
-				for _, file := range wantFilesInPath {
-					if _, ok := diffsByName[file]; !ok {
-						t.Errorf("%s was not changed (diffsByName=%#v)", file, diffsByName)
-					}
-				}
-			}
+	var clientBuffer bytes.Buffer
+	u, _ := url.ParseRequestURI(ts.URL)
+	client := api.NewClient(api.ClientOpts{EndpointURL: u, Out: &clientBuffer})
 
-			for repo, paths := range resultsFound {
-				for path, found := range paths {
-					for !found {
-						t.Fatalf("expected spec to be created in path %s of repo %s, but was not", path, repo)
-					}
-				}
+	testTempDir := t.TempDir()
+	ctx := context.Background()
+	cr, _ := workspace.NewCreator(ctx, "bind", testTempDir, testTempDir, images)
+	coord := NewCoordinator(NewCoordinatorOpts{
+		Cache:  newInMemoryExecutionCache(),
+		Logger: mock.LogNoOpManager{},
+		ExecOpts: NewExecutorOpts{
+			Creator:             cr,
+			RepoArchiveRegistry: repozip.NewArchiveRegistry(client, testTempDir, false),
+			Logger:              mock.LogNoOpManager{},
+			EnsureImage:         imageMapEnsurer(images),
+			TempDir:             testTempDir,
+			Parallelism:         1,
+			Timeout:             time.Minute,
+		},
+	})
+
+	// The branch advances right after the Task was started.
+	ui := &branchMovingUI{dummyTaskExecutionUI: newDummyTaskExecutionUI(), moved: "m0v3d"}
+	specs, _, err := coord.ExecuteAndBuildSpecs(ctx, batchSpec, []*Task{task}, ui)
+	require.NoError(t, err)
+	require.Equal(t, "m0v3d", task.Repository.Rev())
+
+	// The archive was fetched at, and the changeset spec is based on, the
+	// pinned commit.
+	require.Equal(t, testRepo1.Rev(), task.PinnedRev)
+	require.Len(t, specs, 1)
+	require.Equal(t, testRepo1.Rev(), specs[0].BaseRev)
+	require.Equal(t, testRepo1.BaseRef(), specs[0].BaseRef)
+}
+
+func TestTaskExecutionErr_StatusText(t *testing.T) {
+	tests := map[string]struct {
+		err  TaskExecutionErr
+		want string
+	}{
+		"step exited": {
+			err: TaskExecutionErr{Err: stepFailedErr{
+				Step:      4,
+				Container: "golang:1.19",
+				ExitCode:  2,
+				Stderr:    "go: cannot find main module\nmore output",
+				Err:       errors.New("exit status 2"),
+			}},
+			want: "step 4 (golang:1.19) exited 2: go: cannot find main module",
+		},
+		"step failed to start": {
+			err: TaskExecutionErr{Err: stepFailedErr{
+				Step:      1,
+				Container: "alpine:3",
+				ExitCode:  -1,
+				Err:       errors.New("docker not found"),
+			}},
+			want: "step 1 (alpine:3) failed: docker not found",
+		},
+		"workspace creation failed": {
+			err:  TaskExecutionErr{Err: WorkspaceCreationErr{Repository: "github.com/sourcegraph/src-cli", Err: errors.New("fetching repo: 404")}},
+			want: "workspace creation failed: fetching repo: 404",
+		},
+		"not a step error": {
+			err:  TaskExecutionErr{Err: errors.New("fetching repo: 404")},
+			want: "fetching repo: 404",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if have := tc.err.StatusText(); have != tc.want {
+				t.Errorf("wrong status text. want=%q, have=%q", tc.want, have)
 			}
+		})
+	}
+}
 
-			// Make sure that all the Tasks have been updated correctly
-			if have, want := len(dummyUI.finished), tc.wantFinished; have != want {
-				t.Fatalf("wrong number of UI finished tasks. want=%d, have=%d", want, have)
+func TestCheckParallelism(t *testing.T) {
+	const gib = 1024 * 1024 * 1024
+
+	tests := map[string]struct {
+		parallelism int
+		cpus        int
+		memory      int64
+		wantErr     string
+	}{
+		"reasonable":       {parallelism: 8, cpus: 8, memory: 16 * gib},
+		"unknown":          {parallelism: 64},
+		"too many for cpu": {parallelism: 64, cpus: 8, wantErr: "parallelism of 64 is more than 2 times the 8 available CPUs"},
+		"too many for mem": {parallelism: 8, cpus: 8, memory: 2 * gib, wantErr: "parallelism of 8 needs more than the 2048 MiB of available memory"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := CheckParallelism(tc.parallelism, tc.cpus, tc.memory)
+			if tc.wantErr == "" {
+				require.NoError(t, err)
+				return
 			}
-			if have, want := len(dummyUI.finishedWithErr), tc.wantFinishedWithErr; have != want {
-				t.Fatalf("wrong number of UI finished-with-err tasks. want=%d, have=%d", want, have)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tc.wantErr)
+		})
+	}
+}
+
+func TestAutoParallelism(t *testing.T) {
+	const gib = 1024 * 1024 * 1024
+
+	tests := map[string]struct {
+		cpus   int
+		memory int64
+		want   int
+	}{
+		"cpu bound":      {cpus: 8, memory: 16 * gib, want: 8},
+		"memory bound":   {cpus: 8, memory: 2 * gib, want: 4},
+		"unknown memory": {cpus: 8, want: 8},
+		"nothing known":  {want: 1},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if have := AutoParallelism(tc.cpus, tc.memory); have != tc.want {
+				t.Errorf("wrong parallelism. want=%d, have=%d", tc.want, have)
 			}
 		})
 	}
@@ -743,6 +2634,60 @@ echo "previous_step.modified_files=${{ previous_step.modified_files }}" >> READM
 		}
 	})
 
+	t.Run("commits cached", func(t *testing.T) {
+		archive := mock.RepoArchive{
+			RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{
+				"README.md": "# Welcome to the README\n",
+			},
+		}
+
+		newFileDiff := func(name string) string {
+			return fmt.Sprintf("diff --git %[1]s %[1]s\nnew file mode 100644\n--- /dev/null\n+++ %[1]s\n@@ -0,0 +1 @@\n+%[1]s\n", name)
+		}
+
+		task := &Task{
+			Repository:            testRepo1,
+			BatchChangeAttributes: &template.BatchChangeAttributes{},
+			Steps: []batcheslib.Step{
+				{Run: `echo a.txt > a.txt`, Commit: &batcheslib.StepCommit{Message: "Add a"}},
+				{Run: `echo b.txt > b.txt`},
+				{Run: `echo c.txt > c.txt`, Commit: &batcheslib.StepCommit{Message: "Add b and c"}},
+			},
+			CachedStepResultFound: true,
+			CachedStepResult: execution.AfterStepResult{
+				Version:   2,
+				StepIndex: 1,
+				Diff:      []byte(newFileDiff("a.txt") + newFileDiff("b.txt")),
+				Outputs:   map[string]any{},
+				Commits: []execution.Commit{
+					{StepIndex: 0, Message: "Add a", Diff: []byte(newFileDiff("a.txt"))},
+				},
+				UncommittedDiff: []byte(newFileDiff("b.txt")),
+			},
+		}
+
+		results, err := testExecuteTasks(t, []*Task{task}, archive)
+		if err != nil {
+			t.Fatalf("execution failed: %s", err)
+		}
+
+		lastStepResult := results[0].stepResults[len(results[0].stepResults)-1]
+		if have, want := len(lastStepResult.Commits), 2; have != want {
+			t.Fatalf("wrong number of commits. want=%d, have=%d", want, have)
+		}
+		// The new commit only contains the changes after the cached commit.
+		changes, err := git.ChangesInDiff(lastStepResult.Commits[1].Diff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff([]string{"b.txt", "c.txt"}, changes.Added); diff != "" {
+			t.Errorf("wrong files in commit (-want +have):\n%s", diff)
+		}
+		if len(lastStepResult.UncommittedDiff) != 0 {
+			t.Errorf("unexpected uncommitted diff:\n%s", lastStepResult.UncommittedDiff)
+		}
+	})
+
 	t.Run("step stdout cached", func(t *testing.T) {
 		archive := mock.RepoArchive{
 			RepoName: testRepo1.Name, Commit: testRepo1.Rev(),
@@ -870,3 +2815,26 @@ func imageMapEnsurer(m map[string]docker.Image) imageEnsurer {
 		return nil, errors.New(fmt.Sprintf("image for %s not found", container))
 	}
 }
+
+func TestReproduceCommand(t *testing.T) {
+	t.Run("docker", func(t *testing.T) {
+		cmd := exec.Command("docker", "run", "--rm", "-e", "GREETING=hello world", "-e", "API_TOKEN", "--", "alpine@sha256:1234", "/bin/sh", "/tmp/run.sh")
+		cmd.Dir = "/tmp/my workspace"
+		cmd.Env = []string{"API_TOKEN=secret-value"}
+
+		have := reproduceCommand(cmd, false, map[string]string{"GREETING": "hello world"}, []string{"API_TOKEN"})
+		want := `cd '/tmp/my workspace' && docker run --rm -e 'GREETING=hello world' -e API_TOKEN -- alpine@sha256:1234 /bin/sh /tmp/run.sh`
+		require.Equal(t, want, have)
+	})
+
+	t.Run("local", func(t *testing.T) {
+		cmd := exec.Command("/bin/sh", "-c", "echo $GREETING")
+		cmd.Dir = "/tmp/workspace"
+		cmd.Env = []string{"GREETING=hello", "API_TOKEN=secret-value"}
+
+		have := reproduceCommand(cmd, true, map[string]string{"GREETING": "hello"}, []string{"API_TOKEN"})
+		want := `cd /tmp/workspace && env GREETING=hello API_TOKEN="$API_TOKEN" /bin/sh -c 'echo $GREETING'`
+		require.Equal(t, want, have)
+		require.NotContains(t, have, "secret-value")
+	})
+}
@@ -0,0 +1,120 @@
+package executor
+
+import (
+	"maps"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/sourcegraph/sourcegraph/lib/batches/git"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+)
+
+// FileLabels maps the files a Task changes to labels, such as lang:go, by
+// which its changesets can be told apart. Keys that start with a dot are file
+// extensions, which are matched case-insensitively. Other keys are file
+// names, such as Dockerfile, and take precedence over extensions.
+type FileLabels map[string]string
+
+// DefaultFileLabels are the FileLabels ParseFileLabels starts from for
+// "default".
+var DefaultFileLabels = FileLabels{
+	".go":    "lang:go",
+	".ts":    "lang:ts",
+	".tsx":   "lang:ts",
+	".js":    "lang:js",
+	".jsx":   "lang:js",
+	".mjs":   "lang:js",
+	".py":    "lang:python",
+	".java":  "lang:java",
+	".kt":    "lang:kotlin",
+	".scala": "lang:scala",
+	".rb":    "lang:ruby",
+	".rs":    "lang:rust",
+	".c":     "lang:c",
+	".h":     "lang:c",
+	".cc":    "lang:cpp",
+	".cpp":   "lang:cpp",
+	".hpp":   "lang:cpp",
+	".cs":    "lang:csharp",
+	".php":   "lang:php",
+	".swift": "lang:swift",
+	".sh":    "lang:shell",
+	".tf":    "lang:terraform",
+	".yaml":  "config:yaml",
+	".yml":   "config:yaml",
+	".json":  "config:json",
+	".toml":  "config:toml",
+	".md":    "docs",
+
+	"Dockerfile":   "docker",
+	"go.mod":       "deps:go",
+	"go.sum":       "deps:go",
+	"package.json": "deps:js",
+}
+
+// ParseFileLabels parses a comma-separated list of key=label pairs, such as
+// ".proto=lang:proto,Makefile=build". The item "default" adds
+// DefaultFileLabels, which the pairs after it can override, or remove with an
+// empty label, such as ".md=". An empty string returns nil, which labels no
+// files.
+func ParseFileLabels(s string) (FileLabels, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	labels := FileLabels{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "default" {
+			maps.Copy(labels, DefaultFileLabels)
+			continue
+		}
+
+		key, label, ok := strings.Cut(item, "=")
+		key, label = strings.TrimSpace(key), strings.TrimSpace(label)
+		if !ok || key == "" || key == "." || strings.Contains(key, "/") {
+			return nil, errors.Newf(`%q must be "default" or an extension or file name and a label, such as .go=lang:go`, item)
+		}
+		if strings.HasPrefix(key, ".") {
+			key = strings.ToLower(key)
+		}
+		if label == "" {
+			delete(labels, key)
+		} else {
+			labels[key] = label
+		}
+	}
+	return labels, nil
+}
+
+// Labels returns the sorted labels of the changed files. Files that don't
+// match any key don't add a label.
+func (l FileLabels) Labels(changes git.Changes) []string {
+	if len(l) == 0 {
+		return nil
+	}
+
+	var labels []string
+	for _, files := range [][]string{changes.Modified, changes.Added, changes.Deleted, changes.Renamed} {
+		for _, file := range files {
+			if label, ok := l.fileLabel(file); ok && !slices.Contains(labels, label) {
+				labels = append(labels, label)
+			}
+		}
+	}
+	slices.Sort(labels)
+	return labels
+}
+
+func (l FileLabels) fileLabel(file string) (string, bool) {
+	name := path.Base(file)
+	if label, ok := l[name]; ok {
+		return label, true
+	}
+	if ext := path.Ext(name); ext != "" {
+		label, ok := l[strings.ToLower(ext)]
+		return label, ok
+	}
+	return "", false
+}
@@ -0,0 +1,75 @@
+package executor
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/sourcegraph/sourcegraph/lib/batches/git"
+)
+
+func TestParseFileLabels(t *testing.T) {
+	labels, err := ParseFileLabels("default, .PROTO=lang:proto, Makefile=build, .md=, .go=golang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := labels[".proto"], "lang:proto"; have != want {
+		t.Errorf("wrong label for .proto. want=%q, have=%q", want, have)
+	}
+	if have, want := labels["Makefile"], "build"; have != want {
+		t.Errorf("wrong label for Makefile. want=%q, have=%q", want, have)
+	}
+	if have, want := labels[".go"], "golang"; have != want {
+		t.Errorf("wrong label for .go. want=%q, have=%q", want, have)
+	}
+	if _, ok := labels[".md"]; ok {
+		t.Error(".md wasn't removed")
+	}
+	if have, want := labels[".ts"], DefaultFileLabels[".ts"]; have != want {
+		t.Errorf("wrong default label for .ts. want=%q, have=%q", want, have)
+	}
+
+	labels, err = ParseFileLabels(".go=lang:go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(FileLabels{".go": "lang:go"}, labels); diff != "" {
+		t.Errorf("wrong labels without defaults (-want +have):\n%s", diff)
+	}
+
+	if labels, err := ParseFileLabels(""); err != nil || labels != nil {
+		t.Errorf("empty string returned labels=%v, err=%v", labels, err)
+	}
+	for _, invalid := range []string{"lang:go", "=lang:go", ".=dot", "cmd/main.go=go", "defaults"} {
+		if _, err := ParseFileLabels(invalid); err == nil {
+			t.Errorf("no error for %q", invalid)
+		}
+	}
+}
+
+func TestFileLabels_Labels(t *testing.T) {
+	labels := FileLabels{".go": "lang:go", ".ts": "lang:ts", ".tsx": "lang:ts", "Dockerfile": "docker", ".md": "docs"}
+
+	tests := []struct {
+		name    string
+		changes git.Changes
+		want    []string
+	}{
+		{name: "no changes"},
+		{name: "extensions", changes: git.Changes{Modified: []string{"main.go", "web/app.tsx"}, Added: []string{"web/index.ts"}}, want: []string{"lang:go", "lang:ts"}},
+		{name: "case-insensitive extension", changes: git.Changes{Deleted: []string{"docs/README.MD"}}, want: []string{"docs"}},
+		{name: "file name", changes: git.Changes{Renamed: []string{"build/Dockerfile"}}, want: []string{"docker"}},
+		{name: "unknown files", changes: git.Changes{Modified: []string{"Makefile", "script.sh"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := cmp.Diff(tt.want, labels.Labels(tt.changes)); diff != "" {
+				t.Errorf("wrong labels (-want +have):\n%s", diff)
+			}
+		})
+	}
+
+	if have := FileLabels(nil).Labels(git.Changes{Modified: []string{"main.go"}}); have != nil {
+		t.Errorf("nil FileLabels returned labels %v", have)
+	}
+}
@@ -0,0 +1,232 @@
+package executor
+
+import (
+	"html/template"
+	"io"
+	"maps"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	batcheslib "github.com/sourcegraph/sourcegraph/lib/batches"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+)
+
+const (
+	// htmlReportCollapsedDiffLines is the number of lines above which a diff
+	// is collapsed in the HTML report.
+	htmlReportCollapsedDiffLines = 50
+	// htmlReportMaxDiffLines is the number of lines above which a diff is
+	// truncated in the HTML report.
+	htmlReportMaxDiffLines = 1000
+)
+
+type htmlReportTask struct {
+	Name    string
+	Outcome string
+	// Status is nil if ExecOpts.StatusStore isn't set.
+	Status     *TaskStatus
+	Changesets []htmlReportChangeset
+}
+
+type htmlReportChangeset struct {
+	Repository string
+	Branch     string
+	Title      string
+	Published  string
+	Diff       []htmlReportDiffLine
+	Collapsed  bool
+	// Truncated is the number of lines of the diff that aren't shown.
+	Truncated int
+	// PatchURL is the URL of the patch written to ExecOpts.PatchOutputDir,
+	// if any. It's a file URL, which html/template would reject otherwise.
+	PatchURL template.URL
+}
+
+type htmlReportDiffLine struct {
+	Class string
+	Text  string
+}
+
+// WriteHTMLReport writes a self-contained HTML page to w that summarizes the
+// Tasks passed to CheckCache and ExecuteAndBuildSpecs so far, to review their
+// changes before previewing them on the Sourcegraph instance. Every Task is
+// listed with its outcome, its final TaskStatus if ExecOpts.StatusStore is
+// set, and the repository, title, published state and diff of the
+// ChangesetSpecs that were built for it.
+//
+// Long diffs are collapsed, and very long ones truncated, with a link to the
+// full patch if ExecOpts.PatchOutputDir is set.
+func (c *Coordinator) WriteHTMLReport(w io.Writer) error {
+	report := c.Report()
+	c.reporter.mu.Lock()
+	taskByName := maps.Clone(c.reporter.tasks)
+	specsByName := maps.Clone(c.reporter.specs)
+	c.reporter.mu.Unlock()
+
+	repoNames := make(map[string]string)
+	for _, repo := range c.AdditionalRepositories() {
+		repoNames[repo.ID] = repo.Name
+	}
+
+	var tasks []htmlReportTask
+	for _, group := range []struct {
+		outcome string
+		names   []string
+	}{
+		{"created", report.Created},
+		{"cached", report.Cached},
+		{"empty", report.Empty},
+		{"skipped", report.Skipped},
+		{"failed", report.Failed},
+		{"timed out", report.TimedOut},
+	} {
+		for _, name := range group.names {
+			task := taskByName[name]
+			t := htmlReportTask{Name: name, Outcome: group.outcome}
+			if store := c.opts.ExecOpts.StatusStore; store != nil {
+				key := TaskStatus{Repository: task.Repository.Name, Rev: task.Repository.Rev(), Path: task.Path}.Key()
+				status, ok, err := store.Load(key)
+				if err != nil {
+					return errors.Wrapf(err, "loading status of %s", name)
+				}
+				if ok {
+					t.Status = &status
+				}
+			}
+			for _, spec := range specsByName[name] {
+				cs, err := c.htmlReportChangeset(task, spec, repoNames)
+				if err != nil {
+					return err
+				}
+				t.Changesets = append(t.Changesets, cs)
+			}
+			tasks = append(tasks, t)
+		}
+	}
+	slices.SortStableFunc(tasks, func(a, b htmlReportTask) int { return strings.Compare(a.Name, b.Name) })
+
+	return errors.Wrap(htmlReportTemplate.Execute(w, map[string]any{
+		"GeneratedAt":   c.opts.ExecOpts.clock().Now(),
+		"CorrelationID": c.opts.ExecOpts.CorrelationID,
+		"Report":        report,
+		"Tasks":         tasks,
+	}), "writing HTML report")
+}
+
+func (c *Coordinator) htmlReportChangeset(task *Task, spec *batcheslib.ChangesetSpec, repoNames map[string]string) (htmlReportChangeset, error) {
+	spec, err := c.LoadChangesetSpec(spec)
+	if err != nil {
+		return htmlReportChangeset{}, err
+	}
+
+	cs := htmlReportChangeset{
+		Repository: task.Repository.Name,
+		Branch:     strings.TrimPrefix(spec.HeadRef, "refs/heads/"),
+		Title:      spec.Title,
+		Published:  publishedState(spec.Published),
+	}
+	// Only the changesets in the Task's own repository have its patch.
+	if spec.BaseRepository != task.Repository.ID {
+		cs.Repository = repoNames[spec.BaseRepository]
+	} else if dir := c.opts.ExecOpts.PatchOutputDir; dir != "" {
+		if abs, err := filepath.Abs(filepath.Join(dir, patchFileName(task)+".patch")); err == nil {
+			cs.PatchURL = template.URL((&url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}).String())
+		}
+	}
+
+	var diff strings.Builder
+	for _, commit := range spec.Commits {
+		diff.Write(commit.Diff)
+	}
+	lines := strings.Split(strings.TrimSuffix(diff.String(), "\n"), "\n")
+	cs.Collapsed = len(lines) > htmlReportCollapsedDiffLines
+	if len(lines) > htmlReportMaxDiffLines {
+		cs.Truncated = len(lines) - htmlReportMaxDiffLines
+		lines = lines[:htmlReportMaxDiffLines]
+	}
+	for _, line := range lines {
+		cs.Diff = append(cs.Diff, htmlReportDiffLine{Class: diffLineClass(line), Text: line})
+	}
+	return cs, nil
+}
+
+// publishedState describes the published state of a changeset.
+func publishedState(p batcheslib.PublishedValue) string {
+	switch {
+	case p.True():
+		return "published"
+	case p.False():
+		return "unpublished"
+	case p.Draft():
+		return "draft"
+	case p.PushedOnly():
+		return "pushed only"
+	default:
+		return "set on Sourcegraph"
+	}
+}
+
+func diffLineClass(line string) string {
+	switch {
+	case strings.HasPrefix(line, "+++"), strings.HasPrefix(line, "---"), strings.HasPrefix(line, "diff "):
+		return "file"
+	case strings.HasPrefix(line, "@@"):
+		return "hunk"
+	case strings.HasPrefix(line, "+"):
+		return "add"
+	case strings.HasPrefix(line, "-"):
+		return "del"
+	default:
+		return ""
+	}
+}
+
+var htmlReportTemplate = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>src batch run report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+.task { border-top: 1px solid #ccc; padding: 1em 0; }
+.outcome { font-size: small; padding: 0.1em 0.4em; border-radius: 0.3em; background: #eee; }
+.failed, .error { color: #a00; }
+pre { background: #f8f8f8; padding: 0.5em; overflow-x: auto; }
+.add { background: #e6ffed; }
+.del { background: #ffeef0; }
+.hunk { color: #6f42c1; }
+.file { font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>src batch run report</h1>
+<p>
+Generated at {{.GeneratedAt.Format "2006-01-02 15:04:05 MST"}}{{with .CorrelationID}} for run {{.}}{{end}}:
+{{len .Report.Created}} created, {{len .Report.Cached}} cached, {{len .Report.Empty}} empty,
+{{len .Report.Skipped}} skipped, {{len .Report.Failed}} failed, {{len .Report.TimedOut}} timed out.
+</p>
+{{range .Tasks}}
+<div class="task">
+<h2>{{.Name}} <span class="outcome{{if eq .Outcome "failed" "timed out"}} failed{{end}}">{{.Outcome}}</span></h2>
+{{with .Status}}
+<p>
+Last state: {{.State}}{{if .Step}} in step {{.Step}}{{end}}, at {{.UpdatedAt.Format "15:04:05"}}.
+{{with .Error}}<br><span class="error">{{.}}</span>{{end}}
+</p>
+{{end}}
+{{range .Changesets}}
+<h3>{{.Title}}</h3>
+<p>{{.Repository}}, branch <code>{{.Branch}}</code>, {{.Published}}{{with .PatchURL}}, <a href="{{.}}">full patch</a>{{end}}</p>
+<details{{if not .Collapsed}} open{{end}}>
+<summary>Diff ({{len .Diff}} lines{{if .Truncated}}, {{.Truncated}} more not shown{{end}})</summary>
+<pre>{{range .Diff}}<span class="{{.Class}}">{{.Text}}</span>
+{{end}}</pre>
+</details>
+{{end}}
+</div>
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,85 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	batcheslib "github.com/sourcegraph/sourcegraph/lib/batches"
+	"github.com/sourcegraph/sourcegraph/lib/batches/execution"
+	"github.com/sourcegraph/sourcegraph/lib/batches/template"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+
+	"github.com/sourcegraph/src-cli/internal/batches/mock"
+)
+
+func TestCoordinator_WriteHTMLReport(t *testing.T) {
+	ctx := context.Background()
+	batchSpec := &batcheslib.BatchSpec{Name: "my-batch-change", ChangesetTemplate: testChangesetTemplate}
+	attrs := &template.BatchChangeAttributes{Name: batchSpec.Name}
+
+	smallTask := &Task{Repository: testRepo1, BatchChangeAttributes: attrs, Steps: []batcheslib.Step{{Run: "small"}}}
+	largeTask := &Task{Repository: testRepo2, BatchChangeAttributes: attrs, Steps: []batcheslib.Step{{Run: "large"}}}
+	failedTask := &Task{Repository: testRepo1, Path: "failed", BatchChangeAttributes: attrs, Steps: []batcheslib.Step{{Run: "failed"}}}
+
+	smallDiff := "diff --git a/README.md b/README.md\n--- a/README.md\n+++ b/README.md\n@@ -1 +1 @@\n-# Welcome\n+# <script>alert(1)</script>\n"
+	var largeDiff strings.Builder
+	largeDiff.WriteString("diff --git a/big.txt b/big.txt\n")
+	for i := range htmlReportMaxDiffLines + 10 {
+		fmt.Fprintf(&largeDiff, "+line %d\n", i)
+	}
+
+	statuses := NewMemoryStatusStore()
+	if err := statuses.Store(TaskStatus{Repository: failedTask.Repository.Name, Rev: failedTask.Repository.Rev(), Path: failedTask.Path, State: EventTaskFailed, Step: 1, Error: "exit status 1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "patches")
+	coord := Coordinator{
+		exec: &dummyExecutor{
+			results: []taskResult{
+				{task: smallTask, stepResults: []execution.AfterStepResult{{Diff: []byte(smallDiff)}}},
+				{task: largeTask, stepResults: []execution.AfterStepResult{{Diff: []byte(largeDiff.String())}}},
+				{task: failedTask, err: errors.New("exit status 1")},
+			},
+		},
+		opts: NewCoordinatorOpts{
+			ExecOpts: NewExecutorOpts{PatchOutputDir: dir, StatusStore: statuses},
+			Cache:    newInMemoryExecutionCache(),
+			Logger:   mock.LogNoOpManager{},
+		},
+	}
+	// The failed Task fails the execution, but is still in the report.
+	_, _, _ = coord.ExecuteAndBuildSpecs(ctx, batchSpec, []*Task{smallTask, largeTask, failedTask}, newDummyTaskExecutionUI())
+
+	var buf bytes.Buffer
+	if err := coord.WriteHTMLReport(&buf); err != nil {
+		t.Fatal(err)
+	}
+	html := buf.String()
+
+	for _, want := range []string{
+		"2 created, 0 cached, 0 empty,",
+		"<h2>" + testRepo1.Name + ` <span class="outcome">created</span></h2>`,
+		"<h2>" + testRepo1.Name + `:failed <span class="outcome failed">failed</span></h2>`,
+		"Last state: task-failed in step 1",
+		`<span class="error">exit status 1</span>`,
+		"<h3>commit title</h3>",
+		"branch <code>commit-branch</code>, unpublished",
+		`<span class="add">&#43;# &lt;script&gt;alert(1)&lt;/script&gt;</span>`,
+		`<span class="hunk">@@ -1 &#43;1 @@</span>`,
+		"<details open>\n<summary>Diff (6 lines)</summary>",
+		"<details>\n<summary>Diff (1000 lines, 11 more not shown)</summary>",
+		`<a href="file://` + filepath.ToSlash(dir) + "/github.com%252Fsourcegraph%252Fsrc-cli.patch\">full patch</a>",
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("report doesn't contain %q:\n%s", want, html)
+		}
+	}
+	if strings.Contains(html, "<script>") {
+		t.Error("diff isn't escaped")
+	}
+}
@@ -0,0 +1,43 @@
+package executor
+
+import (
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+)
+
+// KeepWorkspaces determines which workspaces are kept on disk after their Task
+// has been executed, instead of being deleted, so that they can be inspected.
+type KeepWorkspaces string
+
+const (
+	// KeepWorkspacesNone deletes all workspaces. It's the default.
+	KeepWorkspacesNone KeepWorkspaces = "none"
+	// KeepWorkspacesOnFailure keeps the workspaces of failed Tasks.
+	KeepWorkspacesOnFailure KeepWorkspaces = "on-failure"
+	// KeepWorkspacesAll keeps all workspaces.
+	KeepWorkspacesAll KeepWorkspaces = "all"
+)
+
+// ParseKeepWorkspaces parses one of "none", "on-failure" and "all". An empty
+// string is KeepWorkspacesNone.
+func ParseKeepWorkspaces(s string) (KeepWorkspaces, error) {
+	switch k := KeepWorkspaces(s); k {
+	case "":
+		return KeepWorkspacesNone, nil
+	case KeepWorkspacesNone, KeepWorkspacesOnFailure, KeepWorkspacesAll:
+		return k, nil
+	default:
+		return "", errors.Newf("%q is not one of none, on-failure and all", s)
+	}
+}
+
+// keep returns whether a workspace is kept if its Task failed with err.
+func (k KeepWorkspaces) keep(err error) bool {
+	switch k {
+	case KeepWorkspacesAll:
+		return true
+	case KeepWorkspacesOnFailure:
+		return err != nil
+	default:
+		return false
+	}
+}
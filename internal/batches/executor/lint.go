@@ -0,0 +1,276 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+
+	batcheslib "github.com/sourcegraph/sourcegraph/lib/batches"
+)
+
+// LintFinding is a likely mistake in the run script of a step.
+type LintFinding struct {
+	// StepIndex is the index of the step in the batch spec.
+	StepIndex int
+	// Line is the line in the script the finding refers to, starting at 1.
+	// It's 0 if the finding refers to the whole script.
+	Line    int
+	Message string
+}
+
+func (f LintFinding) String() string {
+	if f.Line == 0 {
+		return fmt.Sprintf("step %d: %s", f.StepIndex+1, f.Message)
+	}
+	return fmt.Sprintf("step %d, line %d: %s", f.StepIndex+1, f.Line, f.Message)
+}
+
+// LintSteps checks the run scripts of the given steps for common shell
+// mistakes, such as unquoted variables, without running them. Steps that use
+// a command instead of a script aren't checked.
+//
+// If linter is set, it's run with sh -c for every script in addition to the
+// built-in checks, with the script on standard input. Every line it prints
+// when it exits with a non-zero exit code becomes a finding. The scripts are
+// passed as they're written in the batch spec, before templates are rendered.
+func LintSteps(ctx context.Context, steps []batcheslib.Step, linter string) ([]LintFinding, error) {
+	var findings []LintFinding
+	for i, step := range steps {
+		if step.Run == "" {
+			continue
+		}
+
+		for _, issue := range lintScript(step.Run) {
+			findings = append(findings, LintFinding{StepIndex: i, Line: issue.line, Message: issue.message})
+		}
+
+		if linter == "" {
+			continue
+		}
+		lines, err := runLinter(ctx, linter, step.Run)
+		if err != nil {
+			return nil, errors.Wrapf(err, "linting step %d", i+1)
+		}
+		for _, line := range lines {
+			findings = append(findings, LintFinding{StepIndex: i, Message: line})
+		}
+	}
+	return findings, nil
+}
+
+func runLinter(ctx context.Context, linter, script string) ([]string, error) {
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", linter)
+	cmd.Stdin = strings.NewReader(script)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	err := cmd.Run()
+	if err == nil {
+		return nil, nil
+	}
+
+	// Linters signal findings with a non-zero exit code, but 126 and 127
+	// mean that sh couldn't run the linter at all.
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() == 126 || exitErr.ExitCode() == 127 {
+		return nil, errors.Wrapf(err, "running linter %q: %s", linter, strings.TrimSpace(out.String()))
+	}
+
+	var lines []string
+	for line := range strings.SplitSeq(out.String(), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+type lintIssue struct {
+	line    int
+	message string
+}
+
+var (
+	heredocPattern    = regexp.MustCompile(`<<(-?)\s*['"]?([A-Za-z_][A-Za-z0-9_]*)['"]?`)
+	assignmentPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=$`)
+)
+
+// lintScript implements the built-in checks of LintSteps. It's not a shell
+// parser: it only tracks quotes, comments, here-documents, arithmetic and
+// [[ ]] tests well enough to find unquoted variables in typical scripts.
+func lintScript(script string) (issues []lintIssue) {
+	lines := strings.Split(script, "\n")
+
+	if strings.HasPrefix(strings.TrimSpace(script), "#!") {
+		issues = append(issues, lintIssue{
+			line:    1,
+			message: "the shebang is ignored: run is executed with /bin/bash, or /bin/sh if the image doesn't contain bash",
+		})
+	}
+
+	var (
+		inSingle, inDouble bool
+		inTest             bool
+		bashSyntaxReported bool
+		heredocEnd         string
+		heredocIndented    bool
+	)
+	for n, line := range lines {
+		if heredocEnd != "" {
+			l := line
+			if heredocIndented {
+				l = strings.TrimLeft(l, "\t")
+			}
+			if l == heredocEnd {
+				heredocEnd = ""
+			}
+			continue
+		}
+
+		reportBashSyntax := func(syntax string) {
+			if !bashSyntaxReported {
+				bashSyntaxReported = true
+				issues = append(issues, lintIssue{
+					line:    n + 1,
+					message: fmt.Sprintf("%s is bash syntax, but run is executed with /bin/sh if the image doesn't contain bash", syntax),
+				})
+			}
+		}
+
+		wordStart := 0
+		for i := 0; i < len(line); i++ {
+			c := line[i]
+			rest := line[i:]
+
+			if inSingle {
+				if c == '\'' {
+					inSingle = false
+				}
+				continue
+			}
+
+			switch {
+			case c == '\\':
+				i++
+				continue
+			case c == '"':
+				inDouble = !inDouble
+				continue
+			case inDouble:
+				// Variables in double quotes are fine, and nothing else in
+				// double quotes is of interest.
+				continue
+			case c == '\'':
+				inSingle = true
+				continue
+			case c == ' ' || c == '\t' || c == ';' || c == '|' || c == '&':
+				wordStart = i + 1
+				continue
+			case c == '#' && i == wordStart:
+				// A comment.
+				i = len(line)
+				continue
+			case strings.HasPrefix(rest, "[["):
+				reportBashSyntax("[[ ]]")
+				inTest = true
+				i++
+				continue
+			case strings.HasPrefix(rest, "]]"):
+				inTest = false
+				i++
+				continue
+			case strings.HasPrefix(rest, "<("):
+				reportBashSyntax("<( )")
+				continue
+			case strings.HasPrefix(rest, "$((") || strings.HasPrefix(rest, "(("):
+				// Arithmetic doesn't split words.
+				if end := strings.Index(rest, "))"); end >= 0 {
+					i += end + 1
+				} else {
+					i = len(line)
+				}
+				continue
+			case strings.HasPrefix(rest, "<<") && !strings.HasPrefix(rest, "<<<"):
+				if m := heredocPattern.FindStringSubmatch(rest); m != nil {
+					heredocIndented = m[1] == "-"
+					heredocEnd = m[2]
+					i += len(m[0]) - 1
+				}
+				continue
+			case c != '$':
+				continue
+			}
+
+			name, length := variableAt(rest)
+			if name == "" {
+				continue
+			}
+			i += length - 1
+			if inTest || assignmentPattern.MatchString(line[wordStart:i-length+1]) || strings.TrimSpace(line[:i-length+1]) == "case" {
+				continue
+			}
+			issues = append(issues, lintIssue{
+				line:    n + 1,
+				message: fmt.Sprintf("$%s isn't quoted, so its value is split at whitespace and expanded as a glob pattern; use \"$%s\"", name, name),
+			})
+		}
+	}
+
+	return issues
+}
+
+// variableAt returns the name of the variable that's expanded at the start of
+// s, which starts with a $, and the length of the expansion. Templates, such
+// as ${{ repository.name }}, and special parameters, such as $1 or $?, aren't
+// considered variables.
+func variableAt(s string) (name string, length int) {
+	if strings.HasPrefix(s, "${{") {
+		return "", 0
+	}
+
+	if strings.HasPrefix(s, "${") {
+		end := strings.IndexByte(s, '}')
+		if end < 0 || !isVariableName(s[2:end]) {
+			return "", 0
+		}
+		return s[2:end], end + 1
+	}
+
+	end := 1
+	for end < len(s) && isVariableChar(s[end], end == 1) {
+		end++
+	}
+	if end == 1 {
+		return "", 0
+	}
+	return s[1:end], end
+}
+
+func isVariableName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isVariableChar(s[i], i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func isVariableChar(c byte, first bool) bool {
+	switch {
+	case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		return true
+	case c >= '0' && c <= '9':
+		return !first
+	default:
+		return false
+	}
+}
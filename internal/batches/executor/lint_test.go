@@ -0,0 +1,136 @@
+package executor
+
+import (
+	"context"
+	"runtime"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	batcheslib "github.com/sourcegraph/sourcegraph/lib/batches"
+)
+
+func TestLintScript(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   []lintIssue
+	}{
+		{
+			name:   "quoted variables",
+			script: "echo \"$FOO\" \"${BAR}\" '$BAZ'\ncp \"$SRC\" \"$DST\"",
+		},
+		{
+			name:   "unquoted variables",
+			script: "rm -rf $DIR/build\necho ok\ncp ${SRC} dst",
+			want: []lintIssue{
+				{line: 1, message: `$DIR isn't quoted, so its value is split at whitespace and expanded as a glob pattern; use "$DIR"`},
+				{line: 3, message: `$SRC isn't quoted, so its value is split at whitespace and expanded as a glob pattern; use "$SRC"`},
+			},
+		},
+		{
+			name:   "templates and special parameters",
+			script: "echo ${{ repository.name }} $1 $? $(pwd) $((1 + $n))",
+		},
+		{
+			name:   "assignments, comments and case",
+			script: "FOO=$BAR\n# echo $FOO\ncase $FOO in\n  *) echo \"$FOO\" ;;\nesac",
+		},
+		{
+			name:   "escaped dollar",
+			script: `echo \$HOME`,
+		},
+		{
+			name:   "here-document",
+			script: "cat <<EOF > out.txt\n$NOT_SPLIT\nEOF\necho $AFTER",
+			want: []lintIssue{
+				{line: 4, message: `$AFTER isn't quoted, so its value is split at whitespace and expanded as a glob pattern; use "$AFTER"`},
+			},
+		},
+		{
+			name:   "multi-line quotes",
+			script: "echo \"first\n$STILL_QUOTED\"",
+		},
+		{
+			name:   "shebang",
+			script: "#!/usr/bin/env python3\nprint('hello')",
+			want: []lintIssue{
+				{line: 1, message: "the shebang is ignored: run is executed with /bin/bash, or /bin/sh if the image doesn't contain bash"},
+			},
+		},
+		{
+			name:   "bash syntax",
+			script: "if [[ -f $FILE ]]; then\n  diff <(sort a) <(sort b)\nfi",
+			want: []lintIssue{
+				{line: 1, message: "[[ ]] is bash syntax, but run is executed with /bin/sh if the image doesn't contain bash"},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			have := lintScript(tc.script)
+			if diff := cmp.Diff(tc.want, have, cmp.AllowUnexported(lintIssue{})); diff != "" {
+				t.Errorf("wrong issues (-want +have):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLintSteps(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test doesn't work on Windows because the linter is run with sh")
+	}
+
+	ctx := context.Background()
+	steps := []batcheslib.Step{
+		{Run: `echo "$FOO"`},
+		{Command: []string{"echo", "$FOO"}},
+		{Run: "rm $FILE"},
+	}
+
+	t.Run("built-in checks", func(t *testing.T) {
+		findings, err := LintSteps(ctx, steps, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []LintFinding{
+			{StepIndex: 2, Line: 1, Message: `$FILE isn't quoted, so its value is split at whitespace and expanded as a glob pattern; use "$FILE"`},
+		}
+		if diff := cmp.Diff(want, findings); diff != "" {
+			t.Errorf("wrong findings (-want +have):\n%s", diff)
+		}
+		if have, want := findings[0].String(), "step 3, line 1: "+want[0].Message; have != want {
+			t.Errorf("wrong string. want=%q, have=%q", want, have)
+		}
+	})
+
+	t.Run("linter", func(t *testing.T) {
+		// The linter reports the scripts it's given, and exits non-zero to
+		// signal findings.
+		findings, err := LintSteps(ctx, steps[:1], `echo "SC0000: $(cat)"; exit 1`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []LintFinding{{StepIndex: 0, Message: `SC0000: echo "$FOO"`}}
+		if diff := cmp.Diff(want, findings); diff != "" {
+			t.Errorf("wrong findings (-want +have):\n%s", diff)
+		}
+	})
+
+	t.Run("linter without findings", func(t *testing.T) {
+		findings, err := LintSteps(ctx, steps[:1], `cat > /dev/null`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(findings) != 0 {
+			t.Errorf("unexpected findings: %v", findings)
+		}
+	})
+
+	t.Run("missing linter", func(t *testing.T) {
+		if _, err := LintSteps(ctx, steps[:1], "src-cli-missing-linter"); err == nil {
+			t.Fatal("expected an error, got none")
+		}
+	})
+}
@@ -0,0 +1,122 @@
+package executor
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+
+	"github.com/sourcegraph/go-diff/diff"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+)
+
+// normalizedContextLines is the number of lines of context hunks have at most
+// after normalizeDiff. It's the default of git diff.
+const normalizedContextLines = 3
+
+// normalizeDiff rewrites d so that diffs that make the same changes are equal
+// byte for byte: the files are sorted by path, the section headings of hunks
+// are removed, and hunks are trimmed to normalizedContextLines lines of
+// context, which splits hunks that were only joined by more context.
+func normalizeDiff(d []byte) ([]byte, error) {
+	fileDiffs, err := diff.ParseMultiFileDiff(d)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing diff")
+	}
+
+	slices.SortStableFunc(fileDiffs, func(a, b *diff.FileDiff) int {
+		return strings.Compare(fileDiffPath(a), fileDiffPath(b))
+	})
+	for _, fd := range fileDiffs {
+		var hunks []*diff.Hunk
+		for _, h := range fd.Hunks {
+			hunks = append(hunks, normalizeHunk(h)...)
+		}
+		fd.Hunks = hunks
+	}
+
+	return diff.PrintMultiFileDiff(fileDiffs)
+}
+
+// fileDiffPath returns the path of the file fd changes, which is its original
+// path if it's deleted.
+func fileDiffPath(fd *diff.FileDiff) string {
+	if fd.NewName == "/dev/null" {
+		return fd.OrigName
+	}
+	return fd.NewName
+}
+
+// normalizeHunk trims h to normalizedContextLines lines of context, splitting
+// it where unchanged lines separate its changes by more than twice that.
+// Hunks that end without a newline are only stripped of their section
+// heading.
+func normalizeHunk(h *diff.Hunk) []*diff.Hunk {
+	h.Section = ""
+	if h.OrigNoNewlineAt > 0 {
+		return []*diff.Hunk{h}
+	}
+
+	lines := bytes.SplitAfter(h.Body, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+
+	// The line numbers in the original and new file at which each line of
+	// the hunk starts.
+	origLine, newLine := make([]int32, len(lines)), make([]int32, len(lines))
+	var changed []int
+	o, n := h.OrigStartLine, h.NewStartLine
+	for i, line := range lines {
+		origLine[i], newLine[i] = o, n
+		switch {
+		case bytes.HasPrefix(line, []byte("-")):
+			o++
+			changed = append(changed, i)
+		case bytes.HasPrefix(line, []byte("+")):
+			n++
+			changed = append(changed, i)
+		default:
+			o++
+			n++
+		}
+	}
+	if len(changed) == 0 {
+		return []*diff.Hunk{h}
+	}
+
+	var hunks []*diff.Hunk
+	for start := 0; start < len(changed); {
+		end := start
+		for end+1 < len(changed) && changed[end+1]-changed[end]-1 <= 2*normalizedContextLines {
+			end++
+		}
+
+		from := max(changed[start]-normalizedContextLines, 0)
+		to := min(changed[end]+normalizedContextLines, len(lines)-1)
+		hunk := &diff.Hunk{
+			OrigStartLine: origLine[from],
+			NewStartLine:  newLine[from],
+			Body:          bytes.Join(lines[from:to+1], nil),
+		}
+		for _, line := range lines[from : to+1] {
+			if !bytes.HasPrefix(line, []byte("+")) {
+				hunk.OrigLines++
+			}
+			if !bytes.HasPrefix(line, []byte("-")) {
+				hunk.NewLines++
+			}
+		}
+		// A hunk that doesn't contain lines of a file starts at the line
+		// before the change, like in the original hunk.
+		if hunk.OrigLines == 0 {
+			hunk.OrigStartLine = h.OrigStartLine
+		}
+		if hunk.NewLines == 0 {
+			hunk.NewStartLine = h.NewStartLine
+		}
+		hunks = append(hunks, hunk)
+
+		start = end + 1
+	}
+	return hunks
+}
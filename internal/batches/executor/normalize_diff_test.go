@@ -0,0 +1,134 @@
+package executor
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	batcheslib "github.com/sourcegraph/sourcegraph/lib/batches"
+	"github.com/sourcegraph/sourcegraph/lib/batches/execution"
+	"github.com/sourcegraph/sourcegraph/lib/batches/git"
+	"github.com/sourcegraph/sourcegraph/lib/batches/template"
+)
+
+// normalizedDiff changes README.md and deletes old.txt. The hunks of README.md
+// are far enough apart to not be joined with 3 lines of context.
+const normalizedDiff = `diff --git README.md README.md
+index 1234567..89abcde 100644
+--- README.md
++++ README.md
+@@ -1,4 +1,4 @@
+-# README
++# Read me
+ a
+ b
+ c
+@@ -8,4 +8,4 @@
+ g
+ h
+ i
+-j
++J
+diff --git old.txt old.txt
+deleted file mode 100644
+index 1234567..0000000
+--- old.txt
++++ /dev/null
+@@ -1,1 +0,0 @@
+-old
+`
+
+func TestNormalizeDiff(t *testing.T) {
+	tests := map[string]string{
+		"normalized": normalizedDiff,
+		"reordered files and section headings": `diff --git old.txt old.txt
+deleted file mode 100644
+index 1234567..0000000
+--- old.txt
++++ /dev/null
+@@ -1 +0,0 @@
+-old
+diff --git README.md README.md
+index 1234567..89abcde 100644
+--- README.md
++++ README.md
+@@ -1,4 +1,4 @@ Title
+-# README
++# Read me
+ a
+ b
+ c
+@@ -8,4 +8,4 @@ Section
+ g
+ h
+ i
+-j
++J
+`,
+		"more context": `diff --git README.md README.md
+index 1234567..89abcde 100644
+--- README.md
++++ README.md
+@@ -1,11 +1,11 @@
+-# README
++# Read me
+ a
+ b
+ c
+ d
+ e
+ f
+ g
+ h
+ i
+-j
++J
+diff --git old.txt old.txt
+deleted file mode 100644
+index 1234567..0000000
+--- old.txt
++++ /dev/null
+@@ -1 +0,0 @@
+-old
+`,
+	}
+
+	for name, d := range tests {
+		t.Run(name, func(t *testing.T) {
+			have, err := normalizeDiff([]byte(d))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(normalizedDiff, string(have)); diff != "" {
+				t.Errorf("wrong normalized diff (-want +have):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("same changeset specs", func(t *testing.T) {
+		batchSpec := &batcheslib.BatchSpec{Name: "my-batch-change", ChangesetTemplate: testChangesetTemplate}
+		task := &Task{Repository: testRepo1, BatchChangeAttributes: &template.BatchChangeAttributes{Name: batchSpec.Name}}
+		c := &Coordinator{}
+
+		var specs [][]*batcheslib.ChangesetSpec
+		for _, d := range []string{tests["reordered files and section headings"], tests["more context"]} {
+			normalized, err := normalizeDiff([]byte(d))
+			if err != nil {
+				t.Fatal(err)
+			}
+			changes, err := git.ChangesInDiff(normalized)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, err := c.buildChangesetSpecs(context.Background(), task, batchSpec, execution.AfterStepResult{Diff: normalized, ChangedFiles: changes})
+			if err != nil {
+				t.Fatal(err)
+			}
+			specs = append(specs, s)
+		}
+		if diff := cmp.Diff(specs[0], specs[1]); diff != "" {
+			t.Errorf("changeset specs differ (-first +second):\n%s", diff)
+		}
+	})
+}
@@ -0,0 +1,61 @@
+package executor
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+)
+
+// patchMetadata describes what a patch written to ExecOpts.PatchOutputDir
+// applies to. It's written next to the patch.
+type patchMetadata struct {
+	Repository string `json:"repository"`
+	Path       string `json:"path,omitempty"`
+	BaseRef    string `json:"baseRef"`
+	BaseRev    string `json:"baseRev"`
+}
+
+// patchFileName returns the name of the patch of the Task in
+// ExecOpts.PatchOutputDir, without extension: the escaped name of the
+// repository, followed by the escaped path of the workspace if it has one.
+func patchFileName(task *Task) string {
+	name := task.Repository.Name
+	if task.Path != "" {
+		name += "/" + task.Path
+	}
+	return url.PathEscape(name)
+}
+
+// writePatch writes diff to ExecOpts.PatchOutputDir, if it's set, as
+// <name>.patch, and the patchMetadata of the Task as <name>.json.
+func (c *Coordinator) writePatch(task *Task, diff []byte) error {
+	dir := c.opts.ExecOpts.PatchOutputDir
+	if dir == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return errors.Wrap(err, "creating patch output directory")
+	}
+	name := filepath.Join(dir, patchFileName(task))
+	if err := os.WriteFile(name+".patch", diff, 0o644); err != nil {
+		return errors.Wrap(err, "writing patch")
+	}
+
+	metadata, err := json.MarshalIndent(patchMetadata{
+		Repository: task.Repository.Name,
+		Path:       task.Path,
+		BaseRef:    task.Repository.BaseRef(),
+		BaseRev:    task.BaseRev(),
+	}, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshalling patch metadata")
+	}
+	if err := os.WriteFile(name+".json", append(metadata, '\n'), 0o644); err != nil {
+		return errors.Wrap(err, "writing patch metadata")
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package executor
+
+import (
+	"bufio"
+	"io"
+	"strings"
+
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+)
+
+// ParseRepoList parses a list of repository names, one per line, such as
+// "github.com/sourcegraph/src-cli". Empty lines and comments, which start with
+// "#", are ignored. Names that are listed more than once are only returned
+// once.
+func ParseRepoList(r io.Reader) ([]string, error) {
+	var repos []string
+	seen := make(map[string]struct{})
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		if strings.ContainsAny(text, " \t") {
+			return nil, errors.Newf("line %d: %q is not a repository name", line, text)
+		}
+		if _, ok := seen[text]; !ok {
+			seen[text] = struct{}{}
+			repos = append(repos, text)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return repos, nil
+}
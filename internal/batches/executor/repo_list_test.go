@@ -0,0 +1,30 @@
+package executor
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseRepoList(t *testing.T) {
+	repos, err := ParseRepoList(strings.NewReader(`
+# Reviewed by the platform team.
+github.com/sourcegraph/src-cli
+  github.com/sourcegraph/sourcegraph   # the monorepo
+
+github.com/sourcegraph/src-cli
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"github.com/sourcegraph/src-cli", "github.com/sourcegraph/sourcegraph"}
+	if diff := cmp.Diff(want, repos); diff != "" {
+		t.Errorf("wrong repos (-want +have):\n%s", diff)
+	}
+
+	_, err = ParseRepoList(strings.NewReader("github.com/sourcegraph/src-cli\ngithub.com/sourcegraph/sourcegraph src-cli\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("wrong error for two names on a line: %v", err)
+	}
+}
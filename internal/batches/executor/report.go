@@ -0,0 +1,130 @@
+package executor
+
+import (
+	"maps"
+	"slices"
+	"sync"
+
+	batcheslib "github.com/sourcegraph/sourcegraph/lib/batches"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+)
+
+// RunReport groups the Tasks of a run of a Coordinator by their outcome. Every
+// Task is in exactly one group, which lists the names of the repositories of
+// the Tasks, followed by the path of the workspace in the repository if it has
+// one.
+type RunReport struct {
+	// Created are the Tasks that were executed and produced changeset specs.
+	Created []string `json:"created"`
+	// Cached are the Tasks that were completely served from the cache.
+	Cached []string `json:"cached"`
+	// Empty are the Tasks whose diff was empty, or below
+	// ExecOpts.MinChangedLines.
+	Empty []string `json:"empty"`
+	// Skipped are the Tasks that a step output said to create no changeset
+	// for.
+	Skipped []string `json:"skipped"`
+	// Failed are the Tasks that failed, except for the ones that TimedOut.
+	Failed []string `json:"failed"`
+	// TimedOut are the Tasks whose execution took longer than
+	// ExecOpts.Timeout.
+	TimedOut []string `json:"timedOut"`
+
+	// Labels are the labels NewCoordinatorOpts.FileLabels derived from the
+	// changed files of the Tasks that produced changeset specs, including
+	// cached ones, by Task.
+	Labels map[string][]string `json:"labels,omitempty"`
+
+	// Annotations are ExecOpts.Annotations. The run summary has them at its
+	// top level rather than among the workspaces.
+	Annotations map[string]string `json:"-"`
+}
+
+// Total returns the number of Tasks in r.
+func (r RunReport) Total() int {
+	return len(r.Created) + len(r.Cached) + len(r.Empty) + len(r.Skipped) + len(r.Failed) + len(r.TimedOut)
+}
+
+// runReporter collects the RunReport of a Coordinator. It's safe for
+// concurrent use.
+type runReporter struct {
+	mu     sync.Mutex
+	report RunReport
+
+	// tasks holds the Tasks in the report, and specs the ChangesetSpecs that
+	// were built for them, by name. They're only used by the HTML report.
+	tasks map[string]*Task
+	specs map[string][]*batcheslib.ChangesetSpec
+}
+
+// add adds the Task to group, which is one of the groups of r.report.
+func (r *runReporter) add(group *[]string, task *Task) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	*group = append(*group, reportName(task))
+	if r.tasks == nil {
+		r.tasks = make(map[string]*Task)
+	}
+	r.tasks[reportName(task)] = task
+}
+
+// built records the ChangesetSpecs that were built for the Task.
+func (r *runReporter) built(task *Task, specs []*batcheslib.ChangesetSpec) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.specs == nil {
+		r.specs = make(map[string][]*batcheslib.ChangesetSpec)
+	}
+	r.specs[reportName(task)] = specs
+}
+
+// label records the labels of the Task.
+func (r *runReporter) label(task *Task, labels []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.report.Labels == nil {
+		r.report.Labels = make(map[string][]string)
+	}
+	r.report.Labels[reportName(task)] = labels
+}
+
+// reportName is the name of the Task in the RunReport.
+func reportName(task *Task) string {
+	name := task.Repository.Name
+	if task.Path != "" {
+		name += ":" + task.Path
+	}
+	return name
+}
+
+// failed adds the Task to Failed or, if err is a timeout, TimedOut.
+func (r *runReporter) failed(task *Task, err error) {
+	var timeout *errTimeoutReached
+	var stepTimeout *errStepTimeoutReached
+	if errors.As(err, &timeout) || errors.As(err, &stepTimeout) {
+		r.add(&r.report.TimedOut, task)
+		return
+	}
+	r.add(&r.report.Failed, task)
+}
+
+// get returns a copy of the report with every group sorted.
+func (r *runReporter) get() RunReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sorted := func(names []string) []string {
+		names = append([]string{}, names...)
+		slices.Sort(names)
+		return names
+	}
+	return RunReport{
+		Created:  sorted(r.report.Created),
+		Cached:   sorted(r.report.Cached),
+		Empty:    sorted(r.report.Empty),
+		Skipped:  sorted(r.report.Skipped),
+		Failed:   sorted(r.report.Failed),
+		TimedOut: sorted(r.report.TimedOut),
+		Labels:   maps.Clone(r.report.Labels),
+	}
+}
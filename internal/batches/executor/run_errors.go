@@ -0,0 +1,168 @@
+package executor
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+)
+
+// TaskErrorKind is the reason a Task failed, as returned by
+// TaskExecutionErr.Kind.
+type TaskErrorKind string
+
+const (
+	TaskErrorStep      TaskErrorKind = "step failure"
+	TaskErrorTimeout   TaskErrorKind = "timeout"
+	TaskErrorWorkspace TaskErrorKind = "workspace error"
+	TaskErrorCancelled TaskErrorKind = "cancellation"
+	TaskErrorNoChanges TaskErrorKind = "run without changes"
+	TaskErrorOther     TaskErrorKind = "other error"
+)
+
+// taskErrorKindPlurals are the plural forms of the TaskErrorKinds.
+var taskErrorKindPlurals = map[TaskErrorKind]string{
+	TaskErrorStep:      "step failures",
+	TaskErrorTimeout:   "timeouts",
+	TaskErrorWorkspace: "workspace errors",
+	TaskErrorCancelled: "cancellations",
+	TaskErrorNoChanges: "runs without changes",
+	TaskErrorOther:     "other errors",
+}
+
+// Plural returns the plural form of the kind, as in "3 timeouts".
+func (k TaskErrorKind) Plural() string {
+	if plural, ok := taskErrorKindPlurals[k]; ok {
+		return plural
+	}
+	return string(k)
+}
+
+// Kind returns the reason the Task failed.
+func (e TaskExecutionErr) Kind() TaskErrorKind {
+	var timeout *errTimeoutReached
+	var stepTimeout *errStepTimeoutReached
+	switch {
+	case errors.Is(e.Err, ErrTaskCancelled):
+		return TaskErrorCancelled
+	case errors.As(e.Err, &timeout), errors.As(e.Err, &stepTimeout):
+		return TaskErrorTimeout
+	case errors.As(e.Err, &WorkspaceCreationErr{}):
+		return TaskErrorWorkspace
+	case errors.As(e.Err, &stepFailedErr{}):
+		return TaskErrorStep
+	case errors.Is(e.Err, ErrNoChanges):
+		return TaskErrorNoChanges
+	default:
+		return TaskErrorOther
+	}
+}
+
+// RunErrors is the error returned by Executor.Wait if any Task failed. It
+// implements errors.MultiError.
+type RunErrors struct {
+	// Tasks are the errors of the Tasks that failed.
+	Tasks []TaskExecutionErr
+	// Other are the errors that aren't the failure of a single Task, such as
+	// the cancellation of the run before all Tasks started.
+	Other []error
+}
+
+var _ errors.MultiError = &RunErrors{}
+
+// newRunErrors returns a *RunErrors of the non-nil errs, or nil if there are
+// none.
+func newRunErrors(errs ...error) error {
+	var e RunErrors
+	for _, err := range errs {
+		var taskErr TaskExecutionErr
+		switch {
+		case err == nil:
+		case errors.As(err, &taskErr):
+			e.Tasks = append(e.Tasks, taskErr)
+		default:
+			e.Other = append(e.Other, err)
+		}
+	}
+	if len(e.Tasks) == 0 && len(e.Other) == 0 {
+		return nil
+	}
+	return &e
+}
+
+// ByKind groups the errors of the Tasks by TaskExecutionErr.Kind.
+func (e *RunErrors) ByKind() map[TaskErrorKind][]TaskExecutionErr {
+	kinds := make(map[TaskErrorKind][]TaskExecutionErr)
+	for _, err := range e.Tasks {
+		kinds[err.Kind()] = append(kinds[err.Kind()], err)
+	}
+	return kinds
+}
+
+// Summary counts the errors of the Tasks by kind, most frequent first, as in
+// "18 timeouts, 9 step failures, 3 workspace errors".
+func (e *RunErrors) Summary() string {
+	return SummarizeTaskErrors(e.Tasks)
+}
+
+// SummarizeTaskErrors counts errs by kind like RunErrors.Summary.
+func SummarizeTaskErrors(errs []TaskExecutionErr) string {
+	counts := make(map[TaskErrorKind]int)
+	for _, err := range errs {
+		counts[err.Kind()]++
+	}
+	kinds := slices.SortedFunc(maps.Keys(counts), func(a, b TaskErrorKind) int {
+		return cmp.Or(cmp.Compare(counts[b], counts[a]), cmp.Compare(a, b))
+	})
+
+	parts := make([]string, len(kinds))
+	for i, kind := range kinds {
+		parts[i] = pluralize(counts[kind], string(kind), kind.Plural())
+	}
+	return strings.Join(parts, ", ")
+}
+
+// pluralize returns n followed by the singular form if n is 1 and by the
+// plural form otherwise, as in "1 task" and "2 tasks".
+func pluralize(n int, singular, plural string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, singular)
+	}
+	return fmt.Sprintf("%d %s", n, plural)
+}
+
+// Errors returns the errors of the Tasks followed by the other errors.
+func (e *RunErrors) Errors() []error {
+	errs := make([]error, 0, len(e.Tasks)+len(e.Other))
+	for _, err := range e.Tasks {
+		errs = append(errs, err)
+	}
+	return append(errs, e.Other...)
+}
+
+// Unwrap makes errors.Is and errors.As match any of the errors.
+func (e *RunErrors) Unwrap() []error {
+	return e.Errors()
+}
+
+func (e *RunErrors) Error() string {
+	errs := e.Errors()
+	if len(errs) == 1 {
+		return errs[0].Error()
+	}
+
+	var b strings.Builder
+	if len(e.Tasks) > 0 {
+		fmt.Fprintf(&b, "%s failed (%s)", pluralize(len(e.Tasks), "task", "tasks"), e.Summary())
+	} else {
+		fmt.Fprintf(&b, "%s occurred", pluralize(len(errs), "error", "errors"))
+	}
+	for _, err := range errs {
+		b.WriteString("\n\t* ")
+		b.WriteString(err.Error())
+	}
+	return b.String()
+}
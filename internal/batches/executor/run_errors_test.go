@@ -0,0 +1,85 @@
+package executor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+)
+
+func TestRunErrors(t *testing.T) {
+	taskErr := func(repo string, err error) TaskExecutionErr {
+		return TaskExecutionErr{Err: err, Repository: repo, Logfile: "/tmp/" + repo + ".log"}
+	}
+	timeout := &errTimeoutReached{timeout: time.Minute}
+
+	err := newRunErrors(
+		taskErr("a", timeout),
+		nil,
+		taskErr("b", stepFailedErr{Step: 1, Err: errors.New("exit 1")}),
+		taskErr("c", errors.Wrap(timeout, "running step")),
+		taskErr("d", WorkspaceCreationErr{Repository: "d", Err: errors.New("fetching repo")}),
+		context.Canceled,
+	)
+
+	var runErrs *RunErrors
+	require.True(t, errors.As(err, &runErrs))
+	require.Len(t, runErrs.Tasks, 4)
+	require.Equal(t, []error{context.Canceled}, runErrs.Other)
+	require.ErrorIs(t, err, context.Canceled)
+
+	kinds := map[TaskErrorKind][]string{}
+	for kind, errs := range runErrs.ByKind() {
+		for _, e := range errs {
+			kinds[kind] = append(kinds[kind], e.Repository)
+		}
+	}
+	want := map[TaskErrorKind][]string{
+		TaskErrorTimeout:   {"a", "c"},
+		TaskErrorStep:      {"b"},
+		TaskErrorWorkspace: {"d"},
+	}
+	if diff := cmp.Diff(want, kinds); diff != "" {
+		t.Errorf("wrong kinds (-want +have):\n%s", diff)
+	}
+
+	require.Equal(t, "2 timeouts, 1 step failure, 1 workspace error", runErrs.Summary())
+	require.Contains(t, err.Error(), "4 tasks failed (2 timeouts, 1 step failure, 1 workspace error)")
+	require.Contains(t, err.Error(), "execution in d failed: workspace creation failed: fetching repo")
+
+	t.Run("plural kinds", func(t *testing.T) {
+		errs := []TaskExecutionErr{
+			taskErr("a", ErrNoChanges),
+			taskErr("b", ErrNoChanges),
+			taskErr("c", ErrTaskCancelled),
+			taskErr("d", ErrTaskCancelled),
+			taskErr("e", errors.New("unknown")),
+			taskErr("f", errors.New("unknown")),
+		}
+		require.Equal(t, "2 cancellations, 2 other errors, 2 runs without changes", SummarizeTaskErrors(errs))
+		require.Equal(t, "1 run without changes", SummarizeTaskErrors(errs[:1]))
+	})
+
+	t.Run("single failed task", func(t *testing.T) {
+		err := newRunErrors(taskErr("a", timeout), context.Canceled)
+		require.Contains(t, err.Error(), "1 task failed (1 timeout)")
+	})
+
+	t.Run("other errors", func(t *testing.T) {
+		err := newRunErrors(context.Canceled, errors.New("uploading"))
+		require.Contains(t, err.Error(), "2 errors occurred")
+	})
+
+	t.Run("single error", func(t *testing.T) {
+		err := newRunErrors(taskErr("a", timeout))
+		require.Equal(t, taskErr("a", timeout).Error(), err.Error())
+	})
+
+	t.Run("no errors", func(t *testing.T) {
+		require.NoError(t, newRunErrors(nil, nil))
+	})
+}
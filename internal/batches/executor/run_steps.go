@@ -9,10 +9,16 @@ import (
 	"maps"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/dustin/go-humanize"
+	"github.com/kballard/go-shellquote"
+
 	batcheslib "github.com/sourcegraph/sourcegraph/lib/batches"
 	"github.com/sourcegraph/sourcegraph/lib/batches/execution"
 	"github.com/sourcegraph/sourcegraph/lib/batches/git"
@@ -52,11 +58,41 @@ type RunStepsOpts struct {
 	// GlobalEnv is the os.Environ() for the execution. We don't read from os.Environ()
 	// directly to allow injecting variables and hiding others.
 	GlobalEnv []string
+	// CorrelationID, if set, is passed to every step in envCorrelationID.
+	CorrelationID string
 	// ForceRoot forces Docker containers to be run as root:root, rather than
 	// whatever the image's default user and group are.
 	ForceRoot bool
+	// SecretResolver resolves the secrets referenced by the steps. It's called
+	// right before the container of a step is started, and the values it
+	// returns are only passed to the container.
+	SecretResolver func(name string) (string, error)
+	// KeepWorkspaces determines whether the workspace is kept after the steps
+	// have been executed. If it's kept, its directory is recorded in
+	// Task.KeptWorkspace.
+	KeepWorkspaces KeepWorkspaces
+	// DiffParallelism is the number of git processes that compute the diff
+	// of the workspace, see workspace.Diff.
+	DiffParallelism int
+	// DiffOptions configure the diffs that are taken of the workspace.
+	DiffOptions workspace.DiffOptions
+	// ReuseContainers determines whether consecutive steps with the same
+	// image and container settings are executed in one long-lived container,
+	// rather than a container per step.
+	ReuseContainers bool
 
 	BinaryDiffs bool
+
+	// diskBudget, if set, is reserved for the workspace before it's created.
+	diskBudget *diskBudget
+	// timer, if set, records the timings of the phases of the execution.
+	timer *phaseTimer
+}
+
+// cleanupFailed records err in Task.CleanupErr. It doesn't fail the Task.
+func (opts *RunStepsOpts) cleanupFailed(err error) {
+	opts.Logger.Logf("Cleanup failed: %s", err)
+	opts.Task.CleanupErr = errors.Append(opts.Task.CleanupErr, err)
 }
 
 func RunSteps(ctx context.Context, opts *RunStepsOpts) (stepResults []execution.AfterStepResult, err error) {
@@ -73,22 +109,95 @@ func RunSteps(ctx context.Context, opts *RunStepsOpts) (stepResults []execution.
 		}
 	}()
 
-	opts.UI.ArchiveDownloadStarted()
-	err = opts.RepoArchive.Ensure(ctx)
-	opts.UI.ArchiveDownloadFinished(err)
+	// The precondition is evaluated before the repository is fetched, so that
+	// skipping the Task is cheap.
+	met, err := opts.Task.preconditionMet()
 	if err != nil {
-		return nil, errors.Wrap(err, "fetching repo")
+		return nil, err
+	}
+	if !met {
+		opts.Logger.Logf("Skipping workspace: precondition %q is not true", opts.Task.Precondition)
+		return nil, nil
+	}
+
+	// A cloned repository doesn't need the archive.
+	if opts.Task.Checkout == nil {
+		opts.UI.ArchiveDownloadStarted()
+		done := opts.timer.start(PhaseArchiveDownload, "Archive download")
+		err = opts.RepoArchive.Ensure(repozip.WithFetchRetryFunc(ctx, func(attempt int, err error) {
+			opts.Logger.Logf("Retrying archive download (attempt %d) after error: %s", attempt, err)
+			opts.UI.ArchiveDownloadRetrying(attempt, err)
+		}))
+		done()
+		opts.UI.ArchiveDownloadFinished(err)
+		if err != nil {
+			return nil, WorkspaceCreationErr{Repository: opts.Task.Repository.Name, Err: errors.Wrap(err, "fetching repo")}
+		}
+		defer func() {
+			if err := opts.RepoArchive.Close(); err != nil {
+				opts.cleanupFailed(errors.Wrap(err, "deleting repository archive"))
+			}
+		}()
+	}
+
+	// The reservation is released after the workspace has been deleted. The
+	// size of a clone isn't known before it's cloned, so it isn't reserved.
+	if opts.diskBudget != nil && opts.Task.Checkout == nil {
+		size, err := estimateWorkspaceSize(opts.RepoArchive.Path())
+		if err != nil {
+			return nil, WorkspaceCreationErr{Repository: opts.Task.Repository.Name, Err: err}
+		}
+		release, err := opts.diskBudget.reserve(ctx, size, opts.UI.WaitingForDisk)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		opts.Logger.Logf("Reserved %s of disk for the workspace", humanize.IBytes(uint64(size)))
 	}
-	defer opts.RepoArchive.Close()
 
 	opts.UI.WorkspaceInitializationStarted()
-	ws, err := opts.WC.Create(ctx, opts.Task.Repository, opts.Task.Steps, opts.RepoArchive)
+	done := opts.timer.start(PhaseWorkspaceCreation, "Workspace creation")
+	var ws workspace.Workspace
+	if opts.Task.Checkout != nil {
+		ws, err = createClone(ctx, opts)
+	} else {
+		ws, err = opts.WC.Create(ctx, opts.Task.Repository, opts.Task.Steps, opts.RepoArchive)
+	}
+	done()
 	if err != nil {
-		return nil, errors.Wrap(err, "creating workspace")
+		return nil, WorkspaceCreationErr{Repository: opts.Task.Repository.Name, Err: err}
 	}
-	defer ws.Close(ctx)
+	defer func() {
+		// Only workspaces in a directory on the host can be inspected, so
+		// other workspaces are always deleted.
+		if dir := ws.WorkDir(); dir != nil && opts.KeepWorkspaces.keep(err) {
+			opts.Task.KeptWorkspace = *dir
+			opts.Logger.Logf("Keeping workspace at %s", *dir)
+			return
+		}
+
+		ctx, cancel := util.CleanupContext(ctx)
+		defer cancel()
+		if err := ws.Close(ctx); err != nil {
+			opts.cleanupFailed(errors.Wrap(err, "deleting workspace"))
+		}
+	}()
 	opts.UI.WorkspaceInitializationFinished()
 
+	// The shared containers are removed before the workspace, which they
+	// might have mounted.
+	var shared *sharedContainers
+	if opts.ReuseContainers && opts.Task.Runner != RunnerLocal {
+		shared = newSharedContainers()
+		defer func() {
+			ctx, cancel := util.CleanupContext(ctx)
+			defer cancel()
+			if err := shared.close(ctx); err != nil {
+				opts.cleanupFailed(errors.Wrap(err, "removing shared containers"))
+			}
+		}()
+	}
+
 	var (
 		// lastOutputs are the step.outputs from the previously run step.
 		// Outputs are additive, so we will only ever append to this map,
@@ -98,6 +207,10 @@ func RunSteps(ctx context.Context, opts *RunStepsOpts) (stepResults []execution.
 		// startStep is the index of the step we start executing with. Set when
 		// there's a partial cache result for the task.
 		startStep int
+		// commits are the commits made by steps that set a commit so far, and
+		// snapshot is the state of the workspace after the last of them.
+		commits  []execution.Commit
+		snapshot string
 	)
 
 	if opts.Task.CachedStepResultFound {
@@ -122,8 +235,14 @@ func RunSteps(ctx context.Context, opts *RunStepsOpts) (stepResults []execution.
 		}
 
 		// If the previous steps made any modifications to the workspace yet,
-		// apply them.
-		if len(opts.Task.CachedStepResult.Diff) > 0 {
+		// apply them. If they made commits, the commits are applied one by
+		// one, so that the next commit only contains the changes after them.
+		commits = opts.Task.CachedStepResult.Commits
+		if len(commits) > 0 {
+			if snapshot, err = replayCommits(ctx, ws, opts.Task.CachedStepResult); err != nil {
+				return nil, errors.Wrap(err, "applying commits of cache result")
+			}
+		} else if len(opts.Task.CachedStepResult.Diff) > 0 {
 			if err := ws.ApplyDiff(ctx, opts.Task.CachedStepResult.Diff); err != nil {
 				return nil, errors.Wrap(err, "applying diff of cache result")
 			}
@@ -137,6 +256,23 @@ func RunSteps(ctx context.Context, opts *RunStepsOpts) (stepResults []execution.
 		)
 	}
 
+	// The finally steps run after the diff of the last step was taken, so
+	// their changes aren't part of it. If a step failed, its error is the one
+	// that's reported.
+	if len(opts.Task.Finally) > 0 {
+		defer func() {
+			finallyErr := runFinallySteps(ctx, opts, ws, shared, lastOutputs, previousStepResult)
+			if finallyErr == nil {
+				return
+			}
+			if err != nil {
+				opts.Logger.Logf("Finally steps failed after a step failed: %s", finallyErr)
+				return
+			}
+			err = finallyErr
+		}()
+	}
+
 	for i := startStep; i < len(opts.Task.Steps); i++ {
 		step := opts.Task.Steps[i]
 
@@ -165,17 +301,32 @@ func RunSteps(ctx context.Context, opts *RunStepsOpts) (stepResults []execution.
 			continue
 		}
 
-		// We need to grab the digest for the exact image we're using.
-		img, err := opts.EnsureImage(ctx, step.Container)
-		if err != nil {
-			return nil, err
+		// We need to grab the digest for the exact image we're using. The
+		// local runner doesn't use images.
+		var digest string
+		if opts.Task.Runner != RunnerLocal {
+			img, err := opts.EnsureImage(ctx, step.Container)
+			if err != nil {
+				return nil, err
+			}
+			if digest, err = img.Digest(ctx); err != nil {
+				return nil, err
+			}
 		}
-		digest, err := img.Digest(ctx)
+
+		// Write the files of the step with relative paths into the
+		// workspace, before the step is executed.
+		files, err := renderWorkspaceFiles(step, opts.Task.Path, &stepContext)
 		if err != nil {
-			return nil, err
+			return stepResults, err
+		}
+		if err := writeWorkspaceFiles(ctx, ws, files); err != nil {
+			return stepResults, err
 		}
 
-		stdoutBuffer, stderrBuffer, err := executeSingleStep(ctx, opts, ws, i, step, digest, &stepContext)
+		done := opts.timer.start(PhaseSteps, fmt.Sprintf("Step %d", i+1))
+		stdoutBuffer, stderrBuffer, err := executeSingleStep(ctx, opts, ws, shared, i, step, digest, &stepContext)
+		done()
 		defer func() {
 			if err != nil {
 				exitCode := -1
@@ -191,11 +342,20 @@ func RunSteps(ctx context.Context, opts *RunStepsOpts) (stepResults []execution.
 		}
 
 		// Get the current diff and store that away as the per-step result.
-		stepDiff, err := ws.Diff(ctx)
+		done = opts.timer.start(PhaseDiff, fmt.Sprintf("Diff of step %d", i+1))
+		stepDiff, err := workspace.Diff(ctx, ws, opts.DiffOptions, opts.DiffParallelism)
+		done()
 		if err != nil {
 			return stepResults, errors.Wrap(err, "getting diff produced by step")
 		}
 
+		// Files written into the workspace are only part of the diff if the
+		// step changed them.
+		stepDiff, err = removeWorkspaceFiles(ctx, ws, opts.DiffOptions, stepDiff, files)
+		if err != nil {
+			return stepResults, err
+		}
+
 		// Next parse the diff to determine which files were changed.
 		changes, err := git.ChangesInDiff(stepDiff)
 		if err != nil {
@@ -224,6 +384,34 @@ func RunSteps(ctx context.Context, opts *RunStepsOpts) (stepResults []execution.
 			return stepResults, errors.Wrap(err, "setting step outputs")
 		}
 		maps.Copy(stepResult.Outputs, lastOutputs)
+
+		if step.Commit != nil {
+			commitDiff := stepDiff
+			if snapshot != "" {
+				if commitDiff, err = ws.DiffSince(ctx, snapshot, opts.DiffOptions); err != nil {
+					return stepResults, errors.Wrap(err, "getting diff of step commit")
+				}
+			}
+			// A step that didn't change anything since the last commit
+			// doesn't make a commit.
+			if len(commitDiff) > 0 {
+				commit, err := renderStepCommit(step.Commit, i, commitDiff, &stepContext)
+				if err != nil {
+					return stepResults, err
+				}
+				commits = append(slices.Clone(commits), commit)
+				if snapshot, err = ws.Snapshot(ctx); err != nil {
+					return stepResults, errors.Wrap(err, "recording step commit")
+				}
+			}
+		}
+		if len(commits) > 0 {
+			stepResult.Commits = commits
+			if stepResult.UncommittedDiff, err = ws.DiffSince(ctx, snapshot, opts.DiffOptions); err != nil {
+				return stepResults, errors.Wrap(err, "getting uncommitted diff")
+			}
+		}
+
 		stepResults = append(stepResults, stepResult)
 		previousStepResult = stepResult
 
@@ -241,12 +429,149 @@ func RunSteps(ctx context.Context, opts *RunStepsOpts) (stepResults []execution.
 	return stepResults, err
 }
 
+// createClone creates the workspace of the Task from a git clone of its
+// repository, for batch specs with a checkout.
+func createClone(ctx context.Context, opts *RunStepsOpts) (workspace.Workspace, error) {
+	creator, ok := opts.WC.(workspace.CloneCreator)
+	if !ok {
+		return nil, errors.New("cloning the repository requires the bind workspace")
+	}
+	cloneOpts, err := opts.Task.cloneOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	opts.Logger.Logf("Cloning %s at %s", cloneOpts.URL, cloneOpts.Rev)
+	return creator.CreateClone(ctx, opts.Task.Repository, opts.Task.Steps, cloneOpts)
+}
+
+// runFinallySteps executes the finally steps of the Task in ws. They're
+// numbered after the steps of the Task. If one fails, the others are still
+// executed, and the first error is returned.
+func runFinallySteps(ctx context.Context, opts *RunStepsOpts, ws workspace.Workspace, shared *sharedContainers, outputs map[string]any, previousStepResult execution.AfterStepResult) (errs error) {
+	// The finally steps also have to clean up after steps that were cancelled
+	// or timed out.
+	if ctx.Err() != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = util.CleanupContext(ctx)
+		defer cancel()
+	}
+
+	for j, step := range opts.Task.Finally {
+		i := len(opts.Task.Steps) + j
+		if err := runFinallyStep(ctx, opts, ws, shared, i, step, outputs, previousStepResult); err != nil {
+			if errs == nil {
+				errs = errors.Wrapf(err, "finally step %d", j+1)
+			}
+			exitCode := -1
+			sfe := &stepFailedErr{}
+			if errors.As(err, sfe) {
+				exitCode = sfe.ExitCode
+			}
+			opts.UI.StepFailed(i+1, err, exitCode)
+		}
+	}
+	return errs
+}
+
+// runFinallyStep executes step, whose index is i after the steps of the Task.
+func runFinallyStep(ctx context.Context, opts *RunStepsOpts, ws workspace.Workspace, shared *sharedContainers, i int, step batcheslib.Step, outputs map[string]any, previousStepResult execution.AfterStepResult) error {
+	stepContext := template.StepContext{
+		BatchChange: *opts.Task.BatchChangeAttributes,
+		Repository: util.NewTemplatingRepo(
+			opts.Task.Repository.Name,
+			opts.Task.Repository.Branch.Name,
+			opts.Task.Repository.FileMatches,
+		),
+		Outputs: outputs,
+		Steps: template.StepsContext{
+			Path:    opts.Task.Path,
+			Changes: previousStepResult.ChangedFiles,
+		},
+		PreviousStep: previousStepResult,
+	}
+
+	cond, err := template.EvalStepCondition(step.IfCondition(), &stepContext)
+	if err != nil {
+		return errors.Wrap(err, "evaluating step condition")
+	}
+	if !cond {
+		opts.UI.StepSkipped(i + 1)
+		return nil
+	}
+
+	var digest string
+	if opts.Task.Runner != RunnerLocal {
+		img, err := opts.EnsureImage(ctx, step.Container)
+		if err != nil {
+			return err
+		}
+		if digest, err = img.Digest(ctx); err != nil {
+			return err
+		}
+	}
+
+	files, err := renderWorkspaceFiles(step, opts.Task.Path, &stepContext)
+	if err != nil {
+		return err
+	}
+	if err := writeWorkspaceFiles(ctx, ws, files); err != nil {
+		return err
+	}
+
+	opts.Logger.Logf("[Step %d] executing finally step %d", i+1, i+1-len(opts.Task.Steps))
+	done := opts.timer.start(PhaseSteps, fmt.Sprintf("Finally step %d", i+1-len(opts.Task.Steps)))
+	_, _, err = executeSingleStep(ctx, opts, ws, shared, i, step, digest, &stepContext)
+	done()
+	if err != nil {
+		return err
+	}
+	opts.UI.StepFinished(i+1, nil, git.Changes{}, outputs)
+	return nil
+}
+
 const workDir = "/work"
 
+// The environment variables that every step gets in addition to Step.Env,
+// unless Step.Env sets them itself. They're a stable contract with the step
+// scripts, so they must not be renamed or removed. Since they're derived from
+// the Task, they aren't part of the cache keys: adding or changing one only
+// affects steps that are executed afterwards.
+const (
+	// envWorkspace is the absolute path of the repository root in the
+	// workspace, which is workDir in containers.
+	envWorkspace = "SRC_WORKSPACE"
+	// envRepoName is the name of the repository, such as
+	// github.com/sourcegraph/src-cli.
+	envRepoName = "SRC_REPO_NAME"
+	// envRepoRev is the commit the workspace was created from.
+	envRepoRev = "SRC_REPO_REV"
+	// envCorrelationID is NewExecutorOpts.CorrelationID. It's only set if
+	// the option is.
+	envCorrelationID = "SRC_CORRELATION_ID"
+)
+
+// withBuiltinEnv returns a copy of env with the built-in environment variables
+// of the Task added, where root is the path of the repository root in the
+// workspace.
+func withBuiltinEnv(env map[string]string, task *Task, root, correlationID string) map[string]string {
+	merged := map[string]string{
+		envWorkspace: root,
+		envRepoName:  task.Repository.Name,
+		envRepoRev:   task.BaseRev(),
+	}
+	if correlationID != "" {
+		merged[envCorrelationID] = correlationID
+	}
+	maps.Copy(merged, env)
+	return merged
+}
+
 func executeSingleStep(
 	ctx context.Context,
 	opts *RunStepsOpts,
 	workspace workspace.Workspace,
+	shared *sharedContainers,
 	stepIdx int,
 	step batcheslib.Step,
 	imageDigest string,
@@ -257,27 +582,91 @@ func executeSingleStep(
 	// ----------
 	opts.UI.StepPreparingStart(stepIdx + 1)
 
-	cidFile, cleanup, err := createCidFile(ctx, opts.TempDir, util.SlugForRepo(opts.Task.Repository.Name, opts.Task.Repository.Rev()))
-	if err != nil {
-		opts.UI.StepPreparingFailed(stepIdx+1, err)
-		return bytes.Buffer{}, bytes.Buffer{}, err
+	local := opts.Task.Runner == RunnerLocal
+	if local {
+		if err := checkLocalStep(step); err != nil {
+			opts.UI.StepPreparingFailed(stepIdx+1, err)
+			return bytes.Buffer{}, bytes.Buffer{}, err
+		}
 	}
-	defer cleanup()
 
-	// For now, we only support shell scripts provided via the Run field.
-	shell, containerTemp, err := probeImageForShell(ctx, imageDigest)
-	if err != nil {
-		err = errors.Wrapf(err, "probing image %q for shell", step.Container)
-		opts.UI.StepPreparingFailed(stepIdx+1, err)
-		return bytes.Buffer{}, bytes.Buffer{}, err
+	// In ReuseContainers mode, the step is executed in a container that's
+	// shared with other steps, if it can be.
+	var container *sharedContainer
+	if shared != nil && canShareContainer(step) {
+		container, err = shared.get(ctx, opts, workspace, step, imageDigest)
+		if err != nil {
+			opts.UI.StepPreparingFailed(stepIdx+1, err)
+			return bytes.Buffer{}, bytes.Buffer{}, err
+		}
 	}
 
-	runScriptFile, runScript, cleanup, err := createRunScriptFile(ctx, opts.TempDir, step.Run, stepContext)
-	if err != nil {
-		opts.UI.StepPreparingFailed(stepIdx+1, err)
-		return bytes.Buffer{}, bytes.Buffer{}, err
+	var c stepCmdOpts
+	if !local && container == nil {
+		var cleanup func()
+		c.cidFile, cleanup, err = createCidFile(ctx, opts.TempDir, util.SlugForRepo(opts.Task.Repository.Name, opts.Task.Repository.Rev()))
+		if err != nil {
+			opts.UI.StepPreparingFailed(stepIdx+1, err)
+			return bytes.Buffer{}, bytes.Buffer{}, err
+		}
+		defer cleanup()
+	}
+
+	// A step either runs the shell script in step.Run, which is written to a
+	// file that's mounted into the container, or the exact argv in
+	// step.Command.
+	var runScript string
+	if len(step.Command) > 0 {
+		argv, err := renderStepCommand(step.Command, stepContext)
+		if err != nil {
+			opts.UI.StepPreparingFailed(stepIdx+1, err)
+			return bytes.Buffer{}, bytes.Buffer{}, err
+		}
+		c.entrypoint, c.entryArgs = argv[0], argv[1:]
+		runScript = formatCommand(argv)
+	} else {
+		var shell string
+		if local {
+			shell, err = localShell()
+		} else if container != nil {
+			shell = container.shell
+		} else if shell, c.containerTemp, err = probeImageForShell(ctx, imageDigest); err != nil {
+			err = errors.Wrapf(err, "probing image %q for shell", step.Container)
+		}
+		if err != nil {
+			opts.UI.StepPreparingFailed(stepIdx+1, err)
+			return bytes.Buffer{}, bytes.Buffer{}, err
+		}
+
+		scriptsDir := opts.TempDir
+		if container != nil {
+			scriptsDir = container.scriptsDir
+		}
+		var cleanup func()
+		c.runScriptFile, runScript, cleanup, err = createRunScriptFile(ctx, scriptsDir, step.Run, stepContext)
+		if err != nil {
+			opts.UI.StepPreparingFailed(stepIdx+1, err)
+			return bytes.Buffer{}, bytes.Buffer{}, err
+		}
+		defer cleanup()
+
+		if container != nil {
+			c.containerTemp = container.scriptPath(c.runScriptFile)
+		}
+		c.entrypoint, c.entryArgs = shell, []string{c.containerTemp}
+		if local {
+			c.entryArgs = []string{c.runScriptFile}
+		}
+	}
+	// The entrypoint of the step replaces the shell that runs the script, or
+	// precedes the command.
+	if len(step.Entrypoint) > 0 && !local {
+		args := c.entryArgs
+		if len(step.Command) > 0 {
+			args = append([]string{c.entrypoint}, c.entryArgs...)
+		}
+		c.entrypoint, c.entryArgs = step.Entrypoint[0], append(slices.Clone(step.Entrypoint[1:]), args...)
 	}
-	defer cleanup()
 
 	// Parse and render the step.Files.
 	filesToMount, cleanup, err := createFilesToMount(opts.TempDir, step, stepContext)
@@ -286,6 +675,7 @@ func executeSingleStep(
 		return bytes.Buffer{}, bytes.Buffer{}, err
 	}
 	defer cleanup()
+	c.filesToMount = filesToMount
 
 	// Resolve step.Env given the current environment.
 	stepEnv, err := step.Env.Resolve(opts.GlobalEnv)
@@ -296,67 +686,70 @@ func executeSingleStep(
 	}
 
 	// Render the step.Env variables as templates.
-	env, err := template.RenderStepMap(stepEnv, stepContext)
+	c.env, err = template.RenderStepMap(stepEnv, stepContext)
 	if err != nil {
 		err = errors.Wrap(err, "parsing step environment")
 		opts.UI.StepPreparingFailed(stepIdx+1, err)
 		return bytes.Buffer{}, bytes.Buffer{}, err
 	}
 
+	timeout, err := step.ParsedTimeout()
+	if err != nil {
+		err = errors.Wrap(err, "parsing step timeout")
+		opts.UI.StepPreparingFailed(stepIdx+1, err)
+		return bytes.Buffer{}, bytes.Buffer{}, err
+	}
+
+	// Render the step.Stdin, which is fed to the container.
+	var stdin bytes.Buffer
+	if step.Stdin != "" {
+		if err := template.RenderStepTemplate("step-stdin", step.Stdin, &stdin, stepContext); err != nil {
+			err = errors.Wrap(err, "parsing step stdin")
+			opts.UI.StepPreparingFailed(stepIdx+1, err)
+			return bytes.Buffer{}, bytes.Buffer{}, err
+		}
+	}
+
 	opts.UI.StepPreparingSuccess(stepIdx + 1)
 
 	// ----------
 	// EXECUTION
 	// ----------
-	opts.UI.StepStarted(stepIdx+1, runScript, env)
+	opts.UI.StepStarted(stepIdx+1, runScript, c.env)
 
-	workspaceOpts, err := workspace.DockerRunOpts(ctx, workDir)
+	c.secrets, err = resolveSecrets(step, opts.SecretResolver)
 	if err != nil {
-		return bytes.Buffer{}, bytes.Buffer{}, errors.Wrap(err, "getting Docker options for workspace")
+		return bytes.Buffer{}, bytes.Buffer{}, err
 	}
 
-	// Where should we execute the steps.run script?
-	scriptWorkDir := workDir
-	if opts.Task.Path != "" {
-		scriptWorkDir = workDir + "/" + opts.Task.Path
+	root := workDir
+	if dir := workspace.WorkDir(); local && dir != nil {
+		root = *dir
 	}
-
-	args := append([]string{
-		"run",
-		"--rm",
-		"--init",
-		"--cidfile", cidFile,
-		"--workdir", scriptWorkDir,
-		"--mount", fmt.Sprintf("type=bind,source=%s,target=%s,ro", runScriptFile, containerTemp),
-	}, workspaceOpts...)
-
-	if opts.ForceRoot {
-		args = append(args, "--user", "0:0")
-	}
-
-	for target, source := range filesToMount {
-		args = append(args, "--mount", fmt.Sprintf("type=bind,source=%s,target=%s,ro", source.Name(), target))
+	c.env = withBuiltinEnv(c.env, opts.Task, root, opts.CorrelationID)
+
+	// The timeout of the step composes with the timeout of the Task in ctx:
+	// whichever is reached first stops the step.
+	cmdCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		cmdCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
 
-	// Mount any paths on the local system to the docker container. The paths have already been validated during parsing.
-	for _, mount := range step.Mount {
-		workspaceFilePath, err := getAbsoluteMountPath(opts.WorkingDirectory, mount.Path)
-		if err != nil {
-			return bytes.Buffer{}, bytes.Buffer{}, err
-		}
-		args = append(args, "--mount", fmt.Sprintf("type=bind,source=%s,target=%s,ro", workspaceFilePath, mount.Mountpoint))
+	var cmd *exec.Cmd
+	if local {
+		cmd, err = localStepCmd(cmdCtx, opts, workspace, step, c)
+	} else if container != nil {
+		cmd = container.execCmd(cmdCtx, opts, workspace, step, c)
+	} else {
+		cmd, err = dockerStepCmd(cmdCtx, opts, workspace, step, imageDigest, c)
 	}
-
-	for k, v := range env {
-		args = append(args, "-e", k+"="+v)
+	if err != nil {
+		return bytes.Buffer{}, bytes.Buffer{}, err
 	}
-
-	args = append(args, "--entrypoint", shell)
-
-	cmd := exec.CommandContext(ctx, "docker", args...)
-	cmd.Args = append(cmd.Args, "--", imageDigest, containerTemp)
-	if dir := workspace.WorkDir(); dir != nil {
-		cmd.Dir = *dir
+	if step.Stdin != "" {
+		cmd.Stdin = &stdin
 	}
 
 	writerCtx, writerCancel := context.WithCancel(ctx)
@@ -370,7 +763,7 @@ func executeSingleStep(
 	stderrWriter := io.MultiWriter(&stderr, outputWriter.StderrWriter(), opts.Logger.PrefixWriter("stderr"))
 
 	// Setup readers that pipe the output into the given buffers
-	wg, err := process.PipeOutput(ctx, cmd, stdoutWriter, stderrWriter)
+	wg, err := process.PipeOutput(cmdCtx, cmd, stdoutWriter, stderrWriter)
 	if err != nil {
 		return stdout, stderr, errors.Wrap(err, "piping process output")
 	}
@@ -383,23 +776,35 @@ func executeSingleStep(
 		}
 		return stepFailedErr{
 			Err:         wrappedErr,
+			Step:        stepIdx + 1,
+			NoNetwork:   step.Network == batcheslib.StepNetworkNone,
+			MemoryLimit: step.Memory,
 			ExitCode:    exitCode,
 			Args:        cmd.Args,
 			Run:         runScript,
 			Container:   step.Container,
-			TmpFilename: containerTemp,
+			TmpFilename: c.containerTemp,
 			Stdout:      strings.TrimSpace(stdout.String()),
 			Stderr:      strings.TrimSpace(stderr.String()),
 		}
 	}
 
-	opts.Logger.Logf("[Step %d] run: %q, container: %q", stepIdx+1, step.Run, step.Container)
-	opts.Logger.Logf("[Step %d] full command: %q", stepIdx+1, strings.Join(cmd.Args, " "))
+	if local {
+		opts.Logger.Logf("[Step %d] executing on the host, without a container", stepIdx+1)
+	} else if container != nil {
+		opts.Logger.Logf("[Step %d] executing in shared container %s", stepIdx+1, container.id)
+	}
+	if len(step.Command) > 0 {
+		opts.Logger.Logf("[Step %d] command: %q, container: %q", stepIdx+1, step.Command, step.Container)
+	} else {
+		opts.Logger.Logf("[Step %d] run: %q, container: %q", stepIdx+1, step.Run, step.Container)
+	}
+	opts.Logger.Logf("[Step %d] command to reproduce the step: %s", stepIdx+1, reproduceCommand(cmd, local, c.env, step.Secrets))
 
 	// Start the command.
 	t0 := time.Now()
 	if err := cmd.Start(); err != nil {
-		opts.Logger.Logf("[Step %d] error starting Docker container: %+v", stepIdx+1, err)
+		opts.Logger.Logf("[Step %d] error starting step: %+v", stepIdx+1, err)
 		return stdout, stderr, newStepFailedErr(err)
 	}
 
@@ -410,8 +815,16 @@ func executeSingleStep(
 	// Now wait for the command.
 	err = cmd.Wait()
 	elapsed := time.Since(t0).Round(time.Millisecond)
+	exitErr := &exec.ExitError{}
+	if errors.As(err, &exitErr) && exitErr.ExitCode() != 0 && step.IsSuccessExitCode(exitErr.ExitCode()) && cmdCtx.Err() == nil {
+		opts.Logger.Logf("[Step %d] exited with code %d, which counts as success", stepIdx+1, exitErr.ExitCode())
+		err = nil
+	}
 	if err != nil {
-		opts.Logger.Logf("[Step %d] took %s; error running Docker container: %+v", stepIdx+1, elapsed, err)
+		opts.Logger.Logf("[Step %d] took %s; error running step: %+v", stepIdx+1, elapsed, err)
+		if ctx.Err() == nil && cmdCtx.Err() == context.DeadlineExceeded {
+			return stdout, stderr, &errStepTimeoutReached{step: stepIdx + 1, timeout: timeout}
+		}
 		return stdout, stderr, newStepFailedErr(err)
 	}
 
@@ -419,6 +832,199 @@ func executeSingleStep(
 	return stdout, stderr, nil
 }
 
+// stepCmdOpts holds what's prepared by executeSingleStep to build the command
+// that executes a step.
+type stepCmdOpts struct {
+	entrypoint string
+	entryArgs  []string
+	env        map[string]string
+	// secrets are the resolved secrets of the step, as NAME=value entries.
+	secrets []string
+
+	// The following are only used by RunnerDocker.
+	cidFile       string
+	runScriptFile string
+	// containerTemp is the path the run script is mounted at in the
+	// container.
+	containerTemp string
+	filesToMount  map[string]*os.File
+}
+
+// dockerStepCmd returns the command that executes step in a Docker container
+// of the image with the given digest, for RunnerDocker.
+func dockerStepCmd(ctx context.Context, opts *RunStepsOpts, ws workspace.Workspace, step batcheslib.Step, imageDigest string, c stepCmdOpts) (*exec.Cmd, error) {
+	workspaceOpts, err := ws.DockerRunOpts(ctx, workDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting Docker options for workspace")
+	}
+
+	// Where should we execute the steps.run script? The workspace path and
+	// step.WorkingDir only change the directory the script runs in: the diff
+	// is always taken from the repository root, so the paths in the resulting
+	// changeset spec remain relative to the repository.
+	scriptWorkDir := path.Join(workDir, opts.Task.Path, step.WorkingDir)
+
+	args := append([]string{
+		"run",
+		"--rm",
+		"--init",
+		"--cidfile", c.cidFile,
+		"--workdir", scriptWorkDir,
+	}, workspaceOpts...)
+
+	if c.runScriptFile != "" {
+		args = append(args, "--mount", fmt.Sprintf("type=bind,source=%s,target=%s,ro", c.runScriptFile, c.containerTemp))
+	}
+
+	if opts.ForceRoot {
+		args = append(args, "--user", "0:0")
+	}
+
+	if step.Stdin != "" {
+		args = append(args, "--interactive")
+	}
+
+	if step.Network == batcheslib.StepNetworkNone {
+		args = append(args, "--network", "none")
+	}
+
+	if step.CPUs > 0 {
+		args = append(args, "--cpus", strconv.FormatFloat(step.CPUs, 'f', -1, 64))
+	}
+	if step.Memory != "" {
+		args = append(args, "--memory", step.Memory)
+	}
+
+	for target, source := range c.filesToMount {
+		args = append(args, "--mount", fmt.Sprintf("type=bind,source=%s,target=%s,ro", source.Name(), target))
+	}
+
+	// Mount any paths on the local system to the docker container. The paths have already been validated during parsing.
+	for _, mount := range step.Mount {
+		workspaceFilePath, err := getAbsoluteMountPath(opts.WorkingDirectory, mount.Path)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "--mount", fmt.Sprintf("type=bind,source=%s,target=%s,ro", workspaceFilePath, mount.Mountpoint))
+	}
+
+	for k, v := range c.env {
+		args = append(args, "-e", k+"="+v)
+	}
+
+	// Secrets are passed by name only, so that their values are read from the
+	// environment of the docker process and don't end up in its arguments,
+	// which are logged.
+	for _, name := range step.Secrets {
+		args = append(args, "-e", name)
+	}
+
+	args = append(args, "--entrypoint", c.entrypoint)
+
+	cmd := exec.CommandContext(ctx, "docker", args...)
+	cmd.Args = append(cmd.Args, "--", imageDigest)
+	cmd.Args = append(cmd.Args, c.entryArgs...)
+	if dir := ws.WorkDir(); dir != nil {
+		cmd.Dir = *dir
+	}
+	if len(c.secrets) > 0 {
+		cmd.Env = append(os.Environ(), c.secrets...)
+	}
+	return cmd, nil
+}
+
+// reproduceCommand returns a shell command line that executes cmd, the command
+// of a step, in the same directory and environment. The secrets are passed by
+// name, so that their values are read from the environment of the shell and
+// never logged.
+func reproduceCommand(cmd *exec.Cmd, local bool, env map[string]string, secrets []string) string {
+	var b strings.Builder
+	if cmd.Dir != "" {
+		b.WriteString("cd " + shellquote.Join(cmd.Dir) + " && ")
+	}
+	// The docker command line already contains the environment of the
+	// container.
+	if local && (len(env) > 0 || len(secrets) > 0) {
+		b.WriteString("env ")
+		for _, k := range slices.Sorted(maps.Keys(env)) {
+			b.WriteString(shellquote.Join(k+"="+env[k]) + " ")
+		}
+		for _, name := range secrets {
+			b.WriteString(name + `="$` + name + `" `)
+		}
+	}
+	b.WriteString(shellquote.Join(cmd.Args...))
+	return b.String()
+}
+
+// renderStepCommit renders the commit of the step with the given index, which
+// made the changes in diff.
+func renderStepCommit(c *batcheslib.StepCommit, stepIdx int, diff []byte, stepCtx *template.StepContext) (commit execution.Commit, err error) {
+	render := func(name, tmpl string) (string, error) {
+		var out bytes.Buffer
+		if err := template.RenderStepTemplate("step-commit-"+name, tmpl, &out, stepCtx); err != nil {
+			return "", errors.Wrapf(err, "parsing step commit %s", name)
+		}
+		return out.String(), nil
+	}
+
+	commit = execution.Commit{StepIndex: stepIdx, Diff: diff}
+	if commit.Message, err = render("message", c.Message); err != nil {
+		return commit, err
+	}
+	if c.Author != nil {
+		if commit.AuthorName, err = render("author.name", c.Author.Name); err != nil {
+			return commit, err
+		}
+		if commit.AuthorEmail, err = render("author.email", c.Author.Email); err != nil {
+			return commit, err
+		}
+	}
+	return commit, nil
+}
+
+// replayCommits applies the commits of a cached step result to ws one by one,
+// followed by its uncommitted changes, and returns the snapshot of ws after
+// the last commit.
+func replayCommits(ctx context.Context, ws workspace.Workspace, result execution.AfterStepResult) (string, error) {
+	for _, c := range result.Commits {
+		if err := ws.ApplyDiff(ctx, c.Diff); err != nil {
+			return "", err
+		}
+	}
+	snapshot, err := ws.Snapshot(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(result.UncommittedDiff) > 0 {
+		if err := ws.ApplyDiff(ctx, result.UncommittedDiff); err != nil {
+			return "", err
+		}
+	}
+	return snapshot, nil
+}
+
+// resolveSecrets resolves the secrets of step with resolver and returns them
+// in the form "NAME=value".
+func resolveSecrets(step batcheslib.Step, resolver func(name string) (string, error)) ([]string, error) {
+	if len(step.Secrets) == 0 {
+		return nil, nil
+	}
+	if resolver == nil {
+		return nil, errors.New("step references secrets, but no secret resolver is configured")
+	}
+
+	secrets := make([]string, 0, len(step.Secrets))
+	for _, name := range step.Secrets {
+		value, err := resolver(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "resolving secret %q", name)
+		}
+		secrets = append(secrets, name+"="+value)
+	}
+	return secrets, nil
+}
+
 func setOutputs(stepOutputs batcheslib.Outputs, global map[string]any, stepCtx *template.StepContext) error {
 	for name, output := range stepOutputs {
 		var value bytes.Buffer
@@ -494,10 +1100,18 @@ func probeImageForShell(ctx context.Context, image string) (shell, tempfile stri
 }
 
 // createFilesToMount creates temporary files with the contents of Step.Files
-// that are to be mounted into the container that executes the step.
+// that are to be mounted into the container that executes the step. Files with
+// relative paths are written into the workspace instead, by RunSteps.
 func createFilesToMount(tempDir string, step batcheslib.Step, stepContext *template.StepContext) (map[string]*os.File, func(), error) {
+	toMount := make(map[string]string, len(step.Files))
+	for name, content := range step.Files {
+		if path.IsAbs(name) {
+			toMount[name] = content
+		}
+	}
+
 	// Parse and render the step.Files.
-	files, err := template.RenderStepMap(step.Files, stepContext)
+	files, err := template.RenderStepMap(toMount, stepContext)
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "parsing step files")
 	}
@@ -573,6 +1187,35 @@ func createRunScriptFile(ctx context.Context, tempDir string, stepRun string, st
 	return runScriptFile.Name(), runScript.String(), cleanup, nil
 }
 
+// renderStepCommand renders each element of command as a template.
+func renderStepCommand(command []string, stepCtx *template.StepContext) ([]string, error) {
+	argv := make([]string, len(command))
+	for i, arg := range command {
+		var out bytes.Buffer
+		if err := template.RenderStepTemplate(fmt.Sprintf("step-command-%d", i), arg, &out, stepCtx); err != nil {
+			return nil, errors.Wrap(err, "parsing step command")
+		}
+		argv[i] = out.String()
+	}
+	if argv[0] == "" {
+		return nil, errors.New("step command renders to an empty executable")
+	}
+	return argv, nil
+}
+
+// formatCommand formats argv for display, quoting the arguments that would be
+// ambiguous otherwise.
+func formatCommand(argv []string) string {
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		if arg == "" || strings.ContainsAny(arg, " \t\n\"'\\") {
+			arg = strconv.Quote(arg)
+		}
+		quoted[i] = arg
+	}
+	return strings.Join(quoted, " ")
+}
+
 // createCidFile creates a temporary file that will contain the container ID
 // when executing steps.
 // It returns the location of the file and a function that cleans up the
@@ -600,7 +1243,9 @@ func createCidFile(ctx context.Context, tempDir string, repoSlug string) (string
 		cid, err := os.ReadFile(cidFile.Name())
 		_ = os.Remove(cidFile.Name())
 		if err == nil {
-			ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+			// The container is also removed if ctx was cancelled while it
+			// was running.
+			ctx, cancel := util.CleanupContext(ctx)
 			defer cancel()
 			_ = exec.CommandContext(ctx, "docker", "rm", "-f", "--", string(cid)).Run()
 		}
@@ -645,6 +1290,8 @@ func getAbsoluteMountPath(batchSpecDir string, mountPath string) (string, error)
 }
 
 type stepFailedErr struct {
+	// Step is the 1-indexed number of the step that failed.
+	Step      int
 	Run       string
 	Container string
 
@@ -657,6 +1304,21 @@ type stepFailedErr struct {
 	// ExitCode of the command, or -1 if a non-command error occured.
 	ExitCode int
 	Err      error
+
+	// NoNetwork is true if the step ran without network access.
+	NoNetwork bool
+	// MemoryLimit is the memory limit of the step's container, if any.
+	MemoryLimit string
+}
+
+// exitCodeKilled is the exit code of a container that was killed with
+// SIGKILL, which is what happens when it exceeds its memory limit.
+const exitCodeKilled = 137
+
+// ExceededMemoryLimit returns true if the step most likely failed because its
+// container was killed for exceeding its memory limit.
+func (e stepFailedErr) ExceededMemoryLimit() bool {
+	return e.MemoryLimit != "" && e.ExitCode == exitCodeKilled
 }
 
 func (e stepFailedErr) Cause() error { return e.Err }
@@ -699,10 +1361,22 @@ func (e stepFailedErr) Error() string {
 		fmt.Fprintf(&out, "\nCommand failed: %s", e.Err)
 	}
 
+	if e.ExceededMemoryLimit() {
+		fmt.Fprintf(&out, "\nThe step exceeded its memory limit of %s.", e.MemoryLimit)
+	}
+
+	if e.NoNetwork {
+		out.WriteString("\nThe step has no network access because of `network: none`. If it needs to download anything, remove that setting.")
+	}
+
 	return out.String()
 }
 
 func (e stepFailedErr) SingleLineError() string {
+	if e.ExceededMemoryLimit() {
+		return "step exceeded memory limit of " + e.MemoryLimit
+	}
+
 	out := e.Err.Error()
 	if len(e.Stderr) > 0 {
 		out = e.Stderr
@@ -711,12 +1385,31 @@ func (e stepFailedErr) SingleLineError() string {
 	return strings.Split(out, "\n")[0]
 }
 
+// Summary pinpoints the failed step, e.g. "step 4 (golang:1.19) exited 2".
+func (e stepFailedErr) Summary() string {
+	if e.ExitCode == -1 {
+		return fmt.Sprintf("step %d (%s) failed", e.Step, e.Container)
+	}
+	return fmt.Sprintf("step %d (%s) exited %d", e.Step, e.Container, e.ExitCode)
+}
+
 type errTimeoutReached struct{ timeout time.Duration }
 
 func (e *errTimeoutReached) Error() string {
 	return fmt.Sprintf("Timeout reached. Execution took longer than %s.", e.timeout)
 }
 
+// errStepTimeoutReached is returned if a step exceeded its own timeout before
+// the timeout of the Task was reached.
+type errStepTimeoutReached struct {
+	step    int
+	timeout time.Duration
+}
+
+func (e *errStepTimeoutReached) Error() string {
+	return fmt.Sprintf("step %d timed out after %s", e.step, e.timeout)
+}
+
 func reachedTimeout(cmdCtx context.Context, err error) bool {
 	if ee, ok := errors.Cause(err).(*exec.ExitError); ok {
 		if ee.String() == "signal: killed" && cmdCtx.Err() == context.DeadlineExceeded {
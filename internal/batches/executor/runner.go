@@ -0,0 +1,105 @@
+package executor
+
+import (
+	"context"
+	"maps"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+
+	batcheslib "github.com/sourcegraph/sourcegraph/lib/batches"
+
+	"github.com/sourcegraph/src-cli/internal/batches/workspace"
+)
+
+// Runner determines how the steps of a Task are executed.
+type Runner string
+
+const (
+	// RunnerDocker executes every step in a Docker container of the image
+	// in Step.Container. It's the default.
+	RunnerDocker Runner = "docker"
+	// RunnerLocal executes the steps directly on the host, in the directory
+	// of the workspace, with the environment of src. The step containers
+	// are ignored.
+	//
+	// Steps executed this way aren't isolated from the host in any way: they
+	// can read and change all files and use all credentials of the user
+	// running src, and they run with whatever versions of tools happen to be
+	// installed. It must only be used with batch specs that are trusted.
+	RunnerLocal Runner = "local"
+)
+
+// ParseRunner parses the value of a -runner flag. An empty string means
+// RunnerDocker.
+func ParseRunner(s string) (Runner, error) {
+	switch r := Runner(s); r {
+	case "", RunnerDocker:
+		return RunnerDocker, nil
+	case RunnerLocal:
+		return r, nil
+	default:
+		return "", errors.Newf("unknown runner %q, must be %q or %q", s, RunnerDocker, RunnerLocal)
+	}
+}
+
+// cacheKey returns the value of r in the cache keys of Tasks. It's empty for
+// RunnerDocker, so that the keys of Tasks executed in Docker are the same as
+// before runners existed.
+func (r Runner) cacheKey() string {
+	if r == RunnerLocal {
+		return string(r)
+	}
+	return ""
+}
+
+// checkLocalStep returns an error if step uses features that need a
+// container, and therefore can't be executed by RunnerLocal.
+func checkLocalStep(step batcheslib.Step) error {
+	for name := range step.Files {
+		if path.IsAbs(name) {
+			return errors.Newf("files with absolute paths, like %q, can't be used with the local runner", name)
+		}
+	}
+	switch {
+	case len(step.Mount) > 0:
+		return errors.New("mount can't be used with the local runner")
+	case step.Network == batcheslib.StepNetworkNone:
+		return errors.New("network: none can't be used with the local runner")
+	case step.CPUs > 0 || step.Memory != "":
+		return errors.New("cpus and memory can't be used with the local runner")
+	}
+	return nil
+}
+
+// localShell returns the shell that run scripts are executed with by
+// RunnerLocal. Like in containers, bash is preferred over sh.
+func localShell() (string, error) {
+	for _, shell := range []string{"bash", "sh"} {
+		if p, err := exec.LookPath(shell); err == nil {
+			return p, nil
+		}
+	}
+	return "", errors.New("neither bash nor sh found in PATH")
+}
+
+// localStepCmd returns the command that executes step directly on the host,
+// in the directory of the Task in ws, for RunnerLocal.
+func localStepCmd(ctx context.Context, opts *RunStepsOpts, ws workspace.Workspace, step batcheslib.Step, c stepCmdOpts) (*exec.Cmd, error) {
+	dir := ws.WorkDir()
+	if dir == nil {
+		return nil, errors.New("the local runner can only be used with workspaces on the host, use -workspace bind")
+	}
+
+	cmd := exec.CommandContext(ctx, c.entrypoint, c.entryArgs...)
+	cmd.Dir = filepath.Join(*dir, filepath.FromSlash(opts.Task.Path), filepath.FromSlash(step.WorkingDir))
+	cmd.Env = slices.Clone(opts.GlobalEnv)
+	for _, k := range slices.Sorted(maps.Keys(c.env)) {
+		cmd.Env = append(cmd.Env, k+"="+c.env[k])
+	}
+	cmd.Env = append(cmd.Env, c.secrets...)
+	return cmd, nil
+}
@@ -0,0 +1,178 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	batcheslib "github.com/sourcegraph/sourcegraph/lib/batches"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+
+	"github.com/sourcegraph/src-cli/internal/batches/util"
+	"github.com/sourcegraph/src-cli/internal/batches/workspace"
+)
+
+// sharedContainers are the long-lived containers of a Task in
+// RunStepsOpts.ReuseContainers mode. Steps with the same image and container
+// settings are executed in the same container with `docker exec`, instead of
+// a new container each, so that they can use what the previous steps left
+// outside of the workspace and don't pay for the start of a container.
+type sharedContainers struct {
+	containers map[sharedContainerKey]*sharedContainer
+}
+
+// sharedContainerKey are the settings of a step that are fixed when its
+// container is started.
+type sharedContainerKey struct {
+	image   string
+	network string
+	cpus    float64
+	memory  string
+}
+
+type sharedContainer struct {
+	id    string
+	shell string
+	// scriptsDir is the directory on the host the run scripts of the steps
+	// are written to. It's mounted at containerScriptsDir.
+	scriptsDir          string
+	containerScriptsDir string
+}
+
+func newSharedContainers() *sharedContainers {
+	return &sharedContainers{containers: make(map[sharedContainerKey]*sharedContainer)}
+}
+
+// canShareContainer returns whether step can be executed in a shared
+// container. The files and mounts of a step are mounted into its container,
+// so steps with them get their own.
+func canShareContainer(step batcheslib.Step) bool {
+	for name := range step.Files {
+		if path.IsAbs(name) {
+			return false
+		}
+	}
+	return len(step.Mount) == 0
+}
+
+// get returns the container that step is executed in, starting it if no
+// previous step has.
+func (s *sharedContainers) get(ctx context.Context, opts *RunStepsOpts, ws workspace.Workspace, step batcheslib.Step, imageDigest string) (*sharedContainer, error) {
+	key := sharedContainerKey{image: imageDigest, network: step.Network, cpus: step.CPUs, memory: step.Memory}
+	if c, ok := s.containers[key]; ok {
+		return c, nil
+	}
+
+	shell, containerTemp, err := probeImageForShell(ctx, imageDigest)
+	if err != nil {
+		return nil, errors.Wrapf(err, "probing image %q for shell", step.Container)
+	}
+	scriptsDir, err := os.MkdirTemp(opts.TempDir, util.SlugForRepo(opts.Task.Repository.Name, opts.Task.Repository.Rev())+"-scripts")
+	if err != nil {
+		return nil, errors.Wrap(err, "creating directory for step scripts")
+	}
+	c := &sharedContainer{shell: shell, scriptsDir: scriptsDir, containerScriptsDir: containerTemp}
+
+	workspaceOpts, err := ws.DockerRunOpts(ctx, workDir)
+	if err != nil {
+		os.RemoveAll(scriptsDir)
+		return nil, errors.Wrap(err, "getting Docker options for workspace")
+	}
+
+	args := append([]string{
+		"run",
+		"--detach",
+		// The shell of the container waits for its stdin to be closed, which
+		// only happens when the container is removed.
+		"--interactive",
+		"--rm",
+		"--init",
+		"--workdir", workDir,
+	}, workspaceOpts...)
+	args = append(args, "--mount", fmt.Sprintf("type=bind,source=%s,target=%s,ro", scriptsDir, containerTemp))
+	if opts.ForceRoot {
+		args = append(args, "--user", "0:0")
+	}
+	if step.Network == batcheslib.StepNetworkNone {
+		args = append(args, "--network", "none")
+	}
+	if step.CPUs > 0 {
+		args = append(args, "--cpus", strconv.FormatFloat(step.CPUs, 'f', -1, 64))
+	}
+	if step.Memory != "" {
+		args = append(args, "--memory", step.Memory)
+	}
+	args = append(args, "--entrypoint", shell, "--", imageDigest, "-c", "read _")
+
+	cmd := exec.CommandContext(ctx, "docker", args...)
+	if dir := ws.WorkDir(); dir != nil {
+		cmd.Dir = *dir
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		os.RemoveAll(scriptsDir)
+		return nil, errors.Wrapf(err, "starting container of image %q: %s", step.Container, strings.TrimSpace(stderr.String()))
+	}
+	c.id = strings.TrimSpace(stdout.String())
+
+	opts.Logger.Logf("Started container %s of image %q to share between steps", c.id, step.Container)
+	s.containers[key] = c
+	return c, nil
+}
+
+// execCmd returns the command that executes step in the container.
+func (c *sharedContainer) execCmd(ctx context.Context, opts *RunStepsOpts, ws workspace.Workspace, step batcheslib.Step, sc stepCmdOpts) *exec.Cmd {
+	args := []string{
+		"exec",
+		"--workdir", path.Join(workDir, opts.Task.Path, step.WorkingDir),
+	}
+	if step.Stdin != "" {
+		args = append(args, "--interactive")
+	}
+	for k, v := range sc.env {
+		args = append(args, "-e", k+"="+v)
+	}
+	// Like in dockerStepCmd, secrets are passed by name only.
+	for _, name := range step.Secrets {
+		args = append(args, "-e", name)
+	}
+	args = append(args, c.id, sc.entrypoint)
+	args = append(args, sc.entryArgs...)
+
+	cmd := exec.CommandContext(ctx, "docker", args...)
+	if dir := ws.WorkDir(); dir != nil {
+		cmd.Dir = *dir
+	}
+	if len(sc.secrets) > 0 {
+		cmd.Env = append(os.Environ(), sc.secrets...)
+	}
+	return cmd
+}
+
+// scriptPath returns the path of the run script file in the container.
+func (c *sharedContainer) scriptPath(runScriptFile string) string {
+	return path.Join(c.containerScriptsDir, filepath.Base(runScriptFile))
+}
+
+// close removes the containers. Processes that are still running in them,
+// because their step was cancelled or timed out, are killed.
+func (s *sharedContainers) close(ctx context.Context) error {
+	var errs error
+	for _, c := range s.containers {
+		if out, err := exec.CommandContext(ctx, "docker", "rm", "-f", "--", c.id).CombinedOutput(); err != nil {
+			errs = errors.Append(errs, errors.Wrapf(err, "removing container %s: %s", c.id, strings.TrimSpace(string(out))))
+		}
+		if err := os.RemoveAll(c.scriptsDir); err != nil {
+			errs = errors.Append(errs, errors.Wrap(err, "removing step scripts"))
+		}
+	}
+	s.containers = make(map[sharedContainerKey]*sharedContainer)
+	return errs
+}
@@ -0,0 +1,183 @@
+package executor
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+
+	"github.com/sourcegraph/src-cli/internal/batches/util"
+)
+
+// TaskStatus is the current state of a Task, as kept in a StatusStore. It's
+// updated with every Event of the Task.
+type TaskStatus struct {
+	Repository string `json:"repository"`
+	Rev        string `json:"rev"`
+	Path       string `json:"path,omitempty"`
+	// State is the type of the last Event of the Task.
+	State EventType `json:"state"`
+	// Step is the number of the last step an Event was emitted for, starting
+	// at 1.
+	Step int `json:"step,omitempty"`
+	// StartedAt is when the execution of the Task started. It's zero for
+	// Tasks that haven't been started, or were served from the cache.
+	StartedAt time.Time `json:"startedAt,omitzero"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	// Error is the error the Task or its last step failed with.
+	Error string `json:"error,omitempty"`
+	// TempDir is Task.TempDir of a Task that was started, if any.
+	TempDir string `json:"tempDir,omitempty"`
+}
+
+// after returns the status after e, which must be an Event of its Task.
+func (s TaskStatus) after(e Event) TaskStatus {
+	s.State = e.Type
+	s.UpdatedAt = e.Time
+	s.Error = e.Error
+	if e.Step > 0 {
+		s.Step = e.Step
+	}
+	if e.Type == EventTaskStarted {
+		s.StartedAt = e.Time
+		s.TempDir = e.TempDir
+	}
+	return s
+}
+
+// Key returns the key the status is stored under. It's unique for every
+// workspace and can be used as a file name.
+func (s TaskStatus) Key() string {
+	return util.SlugForPathInRepo(s.Repository, s.Rev, s.Path)
+}
+
+// StatusStore keeps the TaskStatus of every Task of a run. Implementations
+// must be safe for concurrent use. A store other than the in-memory one
+// makes the statuses available to other processes, such as a dashboard,
+// while the run is going on.
+type StatusStore interface {
+	// Store stores status under status.Key(), replacing the previous one.
+	Store(status TaskStatus) error
+	// Load returns the status stored under key, and whether one was found.
+	Load(key string) (TaskStatus, bool, error)
+	// Range calls fn for every stored status, in no particular order, until
+	// fn returns false.
+	Range(fn func(status TaskStatus) bool) error
+}
+
+// NewMemoryStatusStore returns a StatusStore that keeps the statuses in
+// memory.
+func NewMemoryStatusStore() StatusStore {
+	return &memoryStatusStore{}
+}
+
+type memoryStatusStore struct {
+	statuses sync.Map
+}
+
+func (s *memoryStatusStore) Store(status TaskStatus) error {
+	s.statuses.Store(status.Key(), status)
+	return nil
+}
+
+func (s *memoryStatusStore) Load(key string) (TaskStatus, bool, error) {
+	status, ok := s.statuses.Load(key)
+	if !ok {
+		return TaskStatus{}, false, nil
+	}
+	return status.(TaskStatus), true, nil
+}
+
+func (s *memoryStatusStore) Range(fn func(status TaskStatus) bool) error {
+	s.statuses.Range(func(_, status any) bool {
+		return fn(status.(TaskStatus))
+	})
+	return nil
+}
+
+// NewFileStatusStore returns a StatusStore that keeps every status as a JSON
+// file in dir, which is created if it doesn't exist. The files are replaced
+// atomically, so that other processes can read them at any time.
+func NewFileStatusStore(dir string) (StatusStore, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, errors.Wrap(err, "creating status directory")
+	}
+	return &fileStatusStore{dir: dir}, nil
+}
+
+type fileStatusStore struct {
+	dir string
+}
+
+const statusFileExt = ".json"
+
+func (s *fileStatusStore) Store(status TaskStatus) error {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(s.dir, ".status-*")
+	if err != nil {
+		return errors.Wrap(err, "creating status file")
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return errors.Wrap(err, "writing status file")
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, "writing status file")
+	}
+	if err := os.Rename(f.Name(), filepath.Join(s.dir, status.Key()+statusFileExt)); err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, "writing status file")
+	}
+	return nil
+}
+
+func (s *fileStatusStore) Load(key string) (TaskStatus, bool, error) {
+	return readStatusFile(filepath.Join(s.dir, key+statusFileExt))
+}
+
+func (s *fileStatusStore) Range(fn func(status TaskStatus) bool) error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return errors.Wrap(err, "reading status directory")
+	}
+	for _, entry := range entries {
+		// The temporary files of statuses that are being written start with
+		// a dot.
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || filepath.Ext(entry.Name()) != statusFileExt {
+			continue
+		}
+		status, ok, err := readStatusFile(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		if ok && !fn(status) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func readStatusFile(path string) (TaskStatus, bool, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return TaskStatus{}, false, nil
+	} else if err != nil {
+		return TaskStatus{}, false, errors.Wrap(err, "reading status file")
+	}
+
+	var status TaskStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return TaskStatus{}, false, errors.Wrapf(err, "reading status file %s", path)
+	}
+	return status, true, nil
+}
@@ -0,0 +1,61 @@
+package executor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusStores(t *testing.T) {
+	fileStore, err := NewFileStatusStore(filepath.Join(t.TempDir(), "statuses"))
+	require.NoError(t, err)
+
+	for name, store := range map[string]StatusStore{
+		"memory": NewMemoryStatusStore(),
+		"file":   fileStore,
+	} {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now().UTC().Truncate(time.Second)
+			started := TaskStatus{Repository: "github.com/sourcegraph/src-cli", Rev: "d34db33f", State: EventTaskStarted, StartedAt: now, UpdatedAt: now}
+			inPath := TaskStatus{Repository: "github.com/sourcegraph/src-cli", Rev: "d34db33f", Path: "a/b", State: EventTaskEnqueued, UpdatedAt: now}
+			require.NotEqual(t, started.Key(), inPath.Key())
+
+			_, ok, err := store.Load(started.Key())
+			require.NoError(t, err)
+			require.False(t, ok)
+
+			require.NoError(t, store.Store(started))
+			require.NoError(t, store.Store(inPath))
+			finished := started
+			finished.State, finished.Step, finished.Error = EventTaskFailed, 2, "exit 1"
+			require.NoError(t, store.Store(finished))
+
+			loaded, ok, err := store.Load(started.Key())
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, finished, loaded)
+
+			all := map[string]TaskStatus{}
+			require.NoError(t, store.Range(func(status TaskStatus) bool {
+				all[status.Key()] = status
+				return true
+			}))
+			require.Equal(t, map[string]TaskStatus{finished.Key(): finished, inPath.Key(): inPath}, all)
+
+			n := 0
+			require.NoError(t, store.Range(func(TaskStatus) bool {
+				n++
+				return false
+			}))
+			require.Equal(t, 1, n)
+		})
+	}
+
+	// Only the status files are left behind.
+	entries, err := os.ReadDir(fileStore.(*fileStatusStore).dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+}
@@ -1,8 +1,16 @@
 package executor
 
 import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 
 	batcheslib "github.com/sourcegraph/sourcegraph/lib/batches"
 	"github.com/sourcegraph/sourcegraph/lib/batches/execution"
@@ -11,6 +19,8 @@ import (
 	"github.com/sourcegraph/sourcegraph/lib/errors"
 
 	"github.com/sourcegraph/src-cli/internal/batches/graphql"
+	"github.com/sourcegraph/src-cli/internal/batches/util"
+	"github.com/sourcegraph/src-cli/internal/batches/workspace"
 )
 
 type Task struct {
@@ -22,13 +32,96 @@ type Task struct {
 	// the complete repository or just the files in Path (and additional files,
 	// see RepoFetcher).
 	// If Path is "" then this setting has no effect.
-	OnlyFetchWorkspace    bool
-	Steps                 []batcheslib.Step
+	OnlyFetchWorkspace bool
+	Steps              []batcheslib.Step
+	// Finally are executed after Steps, whether they succeeded or not. They
+	// aren't part of the cache keys, since their changes aren't part of the
+	// diff, and aren't executed if the result of the Task is cached.
+	Finally               []batcheslib.Step
 	BatchChangeAttributes *template.BatchChangeAttributes
 	// CachedStepResultFound is true when a partial execution result was found in the cache.
 	// When this field is true, CachedStepResult is also populated.
 	CachedStepResultFound bool
 	CachedStepResult      execution.AfterStepResult
+	// TempDir is the directory the executor picked from
+	// NewExecutorOpts.TempDirs for the workspace and temporary files of the
+	// Task. It's empty if TempDirs isn't used.
+	TempDir string
+	// Wave is the name of the wave AssignWaves assigned the Task to, if any.
+	Wave string
+	// KeptWorkspace is the directory of the workspace of the Task, if it was
+	// kept after execution because of NewExecutorOpts.KeepWorkspaces.
+	KeptWorkspace string
+	// CleanupErr is the error deleting the workspace or the repository
+	// archive of the Task failed with, if any. It doesn't fail the Task, but
+	// means that its files might be left on disk.
+	CleanupErr error
+	// Runner executes the steps of the Task. The zero value executes them in
+	// Docker containers, like RunnerDocker.
+	Runner Runner
+	// Precondition is the precondition of the batch spec. If it isn't "true"
+	// for the Task, the Task is skipped before its repository is fetched.
+	Precondition string
+	// Checkout is the checkout of the batch spec. If it's set, the workspace
+	// is a git clone of the repository instead of an unpacked archive.
+	Checkout *batcheslib.Checkout
+	// PinnedRev is the commit the executor pinned the Task to when it started
+	// it. The repository is fetched at this commit and it's the base revision
+	// of the changeset specs, even if Repository is changed while the Task is
+	// executed.
+	PinnedRev string
+}
+
+// BaseRev returns the commit the Task is executed on: PinnedRev, or the
+// revision of the Repository if the Task hasn't been started yet.
+func (t *Task) BaseRev() string {
+	return cmp.Or(t.PinnedRev, t.Repository.Rev())
+}
+
+// preconditionMet evaluates the Precondition of the Task.
+func (t *Task) preconditionMet() (bool, error) {
+	if t.Precondition == "" {
+		return true, nil
+	}
+	return template.EvalPrecondition(t.Precondition, t.repositoryStepContext())
+}
+
+// repositoryStepContext returns the templating context of the Task before any
+// step has been executed.
+func (t *Task) repositoryStepContext() *template.StepContext {
+	return &template.StepContext{
+		BatchChange: *t.BatchChangeAttributes,
+		Repository: util.NewTemplatingRepo(
+			t.Repository.Name,
+			t.Repository.Branch.Name,
+			t.Repository.FileMatches,
+		),
+		Steps: template.StepsContext{Path: t.Path},
+	}
+}
+
+// cloneOptions returns the options of the git clone the workspace of the Task
+// is created from. It must only be called if Checkout is set.
+func (t *Task) cloneOptions() (workspace.CloneOptions, error) {
+	var url strings.Builder
+	if err := template.RenderStepTemplate("checkout-url", cmp.Or(t.Checkout.URL, batcheslib.DefaultCheckoutURL), &url, t.repositoryStepContext()); err != nil {
+		return workspace.CloneOptions{}, errors.Wrap(err, "rendering checkout URL")
+	}
+	return workspace.CloneOptions{
+		URL:   url.String(),
+		Rev:   t.BaseRev(),
+		Depth: t.Checkout.Depth,
+	}, nil
+}
+
+// checkoutCacheKey returns the part of the cache keys that stands for
+// Checkout. It's empty if the repository isn't cloned, so that the cache keys
+// of archives don't change.
+func (t *Task) checkoutCacheKey() string {
+	if t.Checkout == nil {
+		return ""
+	}
+	return fmt.Sprintf("clone url=%s depth=%d", cmp.Or(t.Checkout.URL, batcheslib.DefaultCheckoutURL), t.Checkout.Depth)
 }
 
 func (t *Task) ArchivePathToFetch() string {
@@ -38,13 +131,33 @@ func (t *Task) ArchivePathToFetch() string {
 	return ""
 }
 
+// changesetSkippedBy returns the name of the first output with SkipChangeset
+// set whose value in outputs signals that no changeset should be created for
+// the Task, or "" if there is none.
+func (t *Task) changesetSkippedBy(outputs map[string]any) string {
+	for _, step := range t.Steps {
+		for _, name := range slices.Sorted(maps.Keys(step.Outputs)) {
+			if value, ok := outputs[name]; ok && step.Outputs[name].SkipsChangeset(value) {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// CacheKey returns the key of the cached result of the step with stepIndex,
+// for the default workspace.DiffOptions.
 func (t *Task) CacheKey(globalEnv []string, workingDir string, stepIndex int) cache.Keyer {
+	return t.cacheKey(globalEnv, workingDir, stepIndex, workspace.DiffOptions{})
+}
+
+func (t *Task) cacheKey(globalEnv []string, workingDir string, stepIndex int, diffOptions workspace.DiffOptions) *cache.CacheKey {
 	return &cache.CacheKey{
 		Repository: batcheslib.Repository{
 			ID:          t.Repository.ID,
 			Name:        t.Repository.Name,
 			BaseRef:     t.Repository.BaseRef(),
-			BaseRev:     t.Repository.Rev(),
+			BaseRev:     t.BaseRev(),
 			FileMatches: t.Repository.SortedFileMatches(),
 		},
 		Path:                  t.Path,
@@ -53,7 +166,10 @@ func (t *Task) CacheKey(globalEnv []string, workingDir string, stepIndex int) ca
 		BatchChangeAttributes: t.BatchChangeAttributes,
 		MetadataRetriever:     fileMetadataRetriever{workingDirectory: workingDir},
 
-		GlobalEnv: globalEnv,
+		GlobalEnv:   globalEnv,
+		Runner:      t.Runner.cacheKey(),
+		DiffOptions: diffOptions.CacheKey(),
+		Checkout:    t.checkoutCacheKey(),
 
 		StepIndex: stepIndex,
 	}
@@ -102,11 +218,30 @@ func (f fileMetadataRetriever) getMountMetadata(baseDir string, path string) ([]
 		if err != nil {
 			return nil, err
 		}
-		metadata = append(metadata, cache.MountMetadata{Path: relativePath, Size: info.Size(), Modified: info.ModTime().UTC()})
+		hash, err := hashFile(fullPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "hashing mounted file %s", path)
+		}
+		metadata = append(metadata, cache.MountMetadata{Path: relativePath, Hash: hash})
 	}
 	return metadata, nil
 }
 
+// hashFile returns the hex encoded SHA-256 of the contents of the file at path.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 // getDirectoryMountMetadata reads all the files in the directory with the given
 // path and returns the cache.MountMetadata for all of them.
 func (f fileMetadataRetriever) getDirectoryMountMetadata(path string) ([]cache.MountMetadata, error) {
@@ -0,0 +1,79 @@
+package executor
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+
+	"github.com/sourcegraph/src-cli/internal/batches/log"
+)
+
+// TaskCompletion describes a Task that completed. It's passed to
+// NewExecutorOpts.OnTaskComplete.
+type TaskCompletion struct {
+	Task *Task
+	// Cached is true if the result of the Task was served from the cache,
+	// without executing it.
+	Cached bool
+	// Err is the error the Task failed with, if any.
+	Err error
+	// Diff is the final diff of the Task. It's empty if the Task didn't
+	// change anything, or failed.
+	Diff []byte
+
+	// EnqueuedAt is when the Task was enqueued to be executed. StartedAt is
+	// when its execution started, after waiting for a free slot, and
+	// FinishedAt when it finished. All three are the same for cached Tasks.
+	EnqueuedAt time.Time
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
+
+// QueueTime returns how long the Task waited to be executed.
+func (c TaskCompletion) QueueTime() time.Duration {
+	return c.StartedAt.Sub(c.EnqueuedAt)
+}
+
+// ExecutionTime returns how long the execution of the Task took.
+func (c TaskCompletion) ExecutionTime() time.Duration {
+	return c.FinishedAt.Sub(c.StartedAt)
+}
+
+// taskCompleteHook serializes the calls to NewExecutorOpts.OnTaskComplete, so
+// that the hook doesn't need to be safe for concurrent use.
+type taskCompleteHook struct {
+	mu   sync.Mutex
+	fn   func(TaskCompletion) error
+	fail bool
+}
+
+func newTaskCompleteHook(opts NewExecutorOpts) *taskCompleteHook {
+	return &taskCompleteHook{fn: opts.OnTaskComplete, fail: opts.FailOnTaskCompleteErr}
+}
+
+func (h *taskCompleteHook) enabled() bool {
+	return h != nil && h.fn != nil
+}
+
+// call calls the hook with c. If the hook fails, the error is written to l and
+// only returned if FailOnTaskCompleteErr is set.
+func (h *taskCompleteHook) call(c TaskCompletion, l log.TaskLogger) error {
+	if !h.enabled() {
+		return nil
+	}
+
+	h.mu.Lock()
+	err := h.fn(c)
+	h.mu.Unlock()
+	if err == nil {
+		return nil
+	}
+
+	err = errors.Wrap(err, "task completion hook failed")
+	l.Log(err.Error())
+	if h.fail {
+		return err
+	}
+	return nil
+}
@@ -11,7 +11,11 @@ import (
 
 	"github.com/sourcegraph/sourcegraph/lib/batches"
 	"github.com/sourcegraph/sourcegraph/lib/batches/execution/cache"
+	"github.com/sourcegraph/sourcegraph/lib/batches/template"
 	"github.com/sourcegraph/sourcegraph/lib/errors"
+
+	"github.com/sourcegraph/src-cli/internal/batches/graphql"
+	"github.com/sourcegraph/src-cli/internal/batches/workspace"
 )
 
 func TestFileMetadataRetriever_Get(t *testing.T) {
@@ -39,6 +43,9 @@ func TestFileMetadataRetriever_Get(t *testing.T) {
 	err = os.Chtimes(anotherScriptPath, modDate, modDate)
 	require.NoError(t, err)
 
+	// The SHA-256 of the empty temp files.
+	const emptyFileHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
 	retriever := fileMetadataRetriever{
 		workingDirectory: tempDir,
 	}
@@ -61,7 +68,7 @@ func TestFileMetadataRetriever_Get(t *testing.T) {
 				},
 			},
 			expectedMetadata: []cache.MountMetadata{
-				{Path: "sample.sh", Size: 0, Modified: modDate},
+				{Path: "sample.sh", Hash: emptyFileHash},
 			},
 		},
 		{
@@ -82,8 +89,8 @@ func TestFileMetadataRetriever_Get(t *testing.T) {
 				},
 			},
 			expectedMetadata: []cache.MountMetadata{
-				{Path: "sample.sh", Size: 0, Modified: modDate},
-				{Path: "another.sh", Size: 0, Modified: modDate},
+				{Path: "sample.sh", Hash: emptyFileHash},
+				{Path: "another.sh", Hash: emptyFileHash},
 			},
 		},
 		{
@@ -98,8 +105,8 @@ func TestFileMetadataRetriever_Get(t *testing.T) {
 				},
 			},
 			expectedMetadata: []cache.MountMetadata{
-				{Path: "another.sh", Size: 0, Modified: modDate},
-				{Path: "sample.sh", Size: 0, Modified: modDate},
+				{Path: "another.sh", Hash: emptyFileHash},
+				{Path: "sample.sh", Hash: emptyFileHash},
 			},
 		},
 		{
@@ -134,8 +141,8 @@ func TestFileMetadataRetriever_Get(t *testing.T) {
 				},
 			},
 			expectedMetadata: []cache.MountMetadata{
-				{Path: "sample.sh", Size: 0, Modified: modDate},
-				{Path: "sample.sh", Size: 0, Modified: modDate},
+				{Path: "sample.sh", Hash: emptyFileHash},
+				{Path: "sample.sh", Hash: emptyFileHash},
 			},
 		},
 	}
@@ -151,3 +158,165 @@ func TestFileMetadataRetriever_Get(t *testing.T) {
 		})
 	}
 }
+
+func TestTask_CacheKey_Mount(t *testing.T) {
+	tempDir := t.TempDir()
+	lookupTable := filepath.Join(tempDir, "table.csv")
+	require.NoError(t, os.WriteFile(lookupTable, []byte("a,b\n"), 0644))
+
+	task := &Task{
+		Repository: testRepo1,
+		Steps: []batches.Step{{
+			Run:       "cat /tmp/table.csv",
+			Container: "alpine:3",
+			Mount:     []batches.Mount{{Path: "table.csv", Mountpoint: "/tmp/table.csv"}},
+		}},
+	}
+
+	before, err := task.CacheKey(nil, tempDir, 0).Key()
+	require.NoError(t, err)
+
+	// Changing the mounted file invalidates cached results.
+	require.NoError(t, os.WriteFile(lookupTable, []byte("a,b\nc,d\n"), 0644))
+
+	after, err := task.CacheKey(nil, tempDir, 0).Key()
+	require.NoError(t, err)
+	assert.NotEqual(t, before, after)
+
+	// So does changing it without changing its size or modification time.
+	info, err := os.Stat(lookupTable)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(lookupTable, []byte("a,b\ne,f\n"), 0644))
+	require.NoError(t, os.Chtimes(lookupTable, info.ModTime(), info.ModTime()))
+
+	rewritten, err := task.CacheKey(nil, tempDir, 0).Key()
+	require.NoError(t, err)
+	assert.NotEqual(t, after, rewritten)
+}
+
+func TestTask_CacheKey_Stable(t *testing.T) {
+	task := &Task{
+		Repository: testRepo1,
+		Path:       "sub/dir",
+		Steps: []batches.Step{
+			{Run: "echo hello > hello.txt", Container: "alpine:3"},
+			{Run: "gofmt -w ./", Container: "golang:1"},
+		},
+	}
+
+	// The key must only change when KeyVersion is bumped. If this test fails
+	// without a bump, cached results of earlier versions can't be reused.
+	key, err := task.CacheKey(nil, t.TempDir(), 1).Key()
+	require.NoError(t, err)
+	assert.Equal(t, "gD2Sq-TuN4snhXPJ6akv2A-step-1", key)
+}
+
+func TestTask_CacheKey_Branch(t *testing.T) {
+	steps := []batches.Step{{Run: "echo hello > hello.txt", Container: "alpine:3"}}
+	defaultBranchTask := &Task{Repository: testRepo1, Steps: steps}
+
+	// A workspace on a branch other than the default branch, as resolved
+	// from `on: [{repository: ..., branch: release/1.0}]`.
+	releaseRepo := *testRepo1
+	releaseRepo.Branch = graphql.Branch{Name: "release/1.0", Target: graphql.Target{OID: "f00b4r"}}
+	releaseBranchTask := &Task{Repository: &releaseRepo, Steps: steps}
+
+	assert.Equal(t, "refs/heads/release/1.0", releaseRepo.BaseRef())
+	assert.Equal(t, "f00b4r", releaseRepo.Rev())
+
+	defaultKey, err := defaultBranchTask.CacheKey(nil, t.TempDir(), 0).Key()
+	require.NoError(t, err)
+	releaseKey, err := releaseBranchTask.CacheKey(nil, t.TempDir(), 0).Key()
+	require.NoError(t, err)
+	assert.NotEqual(t, defaultKey, releaseKey)
+}
+
+func TestTask_CacheKey_Secrets(t *testing.T) {
+	tempDir := t.TempDir()
+	steps := []batches.Step{{Run: `curl -H "Authorization: $API_TOKEN" example.com`, Container: "alpine:3"}}
+	withoutSecrets := &Task{Repository: testRepo1, Steps: steps}
+
+	steps = []batches.Step{{Run: steps[0].Run, Container: steps[0].Container, Secrets: []string{"API_TOKEN"}}}
+	withSecrets := &Task{Repository: testRepo1, Steps: steps}
+
+	// The names of the secrets are part of the key, ...
+	key, err := withSecrets.CacheKey([]string{"API_TOKEN=old"}, tempDir, 0).Key()
+	require.NoError(t, err)
+	keyWithoutSecrets, err := withoutSecrets.CacheKey([]string{"API_TOKEN=old"}, tempDir, 0).Key()
+	require.NoError(t, err)
+	assert.NotEqual(t, key, keyWithoutSecrets)
+
+	// ... but their values aren't, so rotating a secret keeps cached results.
+	rotatedKey, err := withSecrets.CacheKey([]string{"API_TOKEN=new"}, tempDir, 0).Key()
+	require.NoError(t, err)
+	assert.Equal(t, key, rotatedKey)
+}
+
+func TestTask_CacheKey_Runner(t *testing.T) {
+	tempDir := t.TempDir()
+	steps := []batches.Step{{Run: `gofmt -w .`, Container: "golang:1"}}
+
+	key := func(runner Runner) string {
+		t.Helper()
+		k, err := (&Task{Repository: testRepo1, Steps: steps, Runner: runner}).CacheKey(nil, tempDir, 0).Key()
+		require.NoError(t, err)
+		return k
+	}
+
+	// Docker is the default, so it doesn't change the keys of existing
+	// cache entries, but steps executed on the host are cached separately.
+	assert.Equal(t, key(""), key(RunnerDocker))
+	assert.NotEqual(t, key(RunnerDocker), key(RunnerLocal))
+}
+
+func TestTask_CacheKey_SuccessExitCodes(t *testing.T) {
+	tempDir := t.TempDir()
+
+	key := func(codes []int) string {
+		t.Helper()
+		steps := []batches.Step{{Run: `golangci-lint run --fix`, Container: "golangci/golangci-lint", SuccessExitCodes: codes}}
+		k, err := (&Task{Repository: testRepo1, Steps: steps}).CacheKey(nil, tempDir, 0).Key()
+		require.NoError(t, err)
+		return k
+	}
+
+	// A step that fails with an exit code can succeed with it once it's
+	// allowed, so the allowed codes are cached separately.
+	assert.NotEqual(t, key(nil), key([]int{0, 1}))
+	assert.NotEqual(t, key([]int{0, 1}), key([]int{0, 2}))
+}
+
+func TestTask_CacheKey_Checkout(t *testing.T) {
+	tempDir := t.TempDir()
+	steps := []batches.Step{{Run: `git log --oneline > history.txt`, Container: "alpine/git"}}
+
+	key := func(checkout *batches.Checkout) string {
+		t.Helper()
+		k, err := (&Task{Repository: testRepo1, Steps: steps, Checkout: checkout}).CacheKey(nil, tempDir, 0).Key()
+		require.NoError(t, err)
+		return k
+	}
+
+	// Steps can see the history of a clone, so the results of clones are
+	// cached separately from the ones of archives, and of each other.
+	assert.NotEqual(t, key(nil), key(&batches.Checkout{}))
+	assert.NotEqual(t, key(&batches.Checkout{}), key(&batches.Checkout{Depth: 1}))
+	assert.Equal(t, key(&batches.Checkout{}), key(&batches.Checkout{URL: batches.DefaultCheckoutURL}))
+}
+
+func TestTask_CloneOptions(t *testing.T) {
+	task := &Task{
+		Repository:            testRepo1,
+		BatchChangeAttributes: &template.BatchChangeAttributes{Name: "clone"},
+		Checkout:              &batches.Checkout{Depth: 10},
+	}
+
+	opts, err := task.cloneOptions()
+	require.NoError(t, err)
+	assert.Equal(t, workspace.CloneOptions{URL: "https://github.com/sourcegraph/src-cli.git", Rev: testRepo1.Rev(), Depth: 10}, opts)
+
+	task.Checkout.URL = "git@${{ repository.name }}.git"
+	opts, err = task.cloneOptions()
+	require.NoError(t, err)
+	assert.Equal(t, "git@github.com/sourcegraph/src-cli.git", opts.URL)
+}
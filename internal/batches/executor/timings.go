@@ -0,0 +1,93 @@
+package executor
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sourcegraph/src-cli/internal/batches/log"
+)
+
+// Phase is a phase of the execution of a Task, whose timings are recorded in
+// NewExecutorOpts.VerboseTimings mode.
+type Phase string
+
+const (
+	PhaseArchiveDownload   Phase = "archive download"
+	PhaseWorkspaceCreation Phase = "workspace creation"
+	PhaseSteps             Phase = "steps"
+	PhaseDiff              Phase = "diff"
+	PhaseCache             Phase = "cache"
+)
+
+// phases are all phases in the order they happen in.
+var phases = []Phase{PhaseArchiveDownload, PhaseWorkspaceCreation, PhaseSteps, PhaseDiff, PhaseCache}
+
+// PhaseDuration is the total time a Task spent in a Phase.
+type PhaseDuration struct {
+	Phase    Phase
+	Duration time.Duration
+}
+
+// phaseTimer logs when the phases of a Task start and end, relative to the
+// start of the Task, and sums up their durations. All methods of a nil
+// *phaseTimer do nothing, so that it only has to be created in
+// NewExecutorOpts.VerboseTimings mode.
+type phaseTimer struct {
+	logger    log.TaskLogger
+	startedAt time.Time
+
+	mu        sync.Mutex
+	durations map[Phase]time.Duration
+}
+
+func newPhaseTimer(logger log.TaskLogger, startedAt time.Time) *phaseTimer {
+	return &phaseTimer{logger: logger, startedAt: startedAt, durations: make(map[Phase]time.Duration)}
+}
+
+// start logs the start of what, which is part of phase, and returns a func
+// that logs its end and records its duration.
+func (t *phaseTimer) start(phase Phase, what string) (done func()) {
+	if t == nil {
+		return func() {}
+	}
+
+	// time.Since uses the monotonic clock, so the offsets aren't affected by
+	// changes of the wall clock.
+	started := time.Since(t.startedAt)
+	t.logger.Logf("[Timing +%s] %s started", started.Truncate(time.Millisecond), what)
+	return func() {
+		finished := time.Since(t.startedAt)
+		t.logger.Logf("[Timing +%s] %s finished after %s", finished.Truncate(time.Millisecond), what, (finished - started).Truncate(time.Millisecond))
+		t.record(phase, finished-started)
+	}
+}
+
+// record adds d to the duration of phase without logging it, for phases that
+// happen after the log of the Task has been closed.
+func (t *phaseTimer) record(phase Phase, d time.Duration) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.durations[phase] += d
+}
+
+// phaseDurations returns the durations of the phases the Task went through,
+// in the order they happen in.
+func (t *phaseTimer) phaseDurations() []PhaseDuration {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var durations []PhaseDuration
+	for _, phase := range phases {
+		if d, ok := t.durations[phase]; ok {
+			durations = append(durations, PhaseDuration{Phase: phase, Duration: d})
+		}
+	}
+	return durations
+}
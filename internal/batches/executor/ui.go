@@ -17,6 +17,12 @@ type TaskExecutionUI interface {
 	TaskFinished(*Task, error)
 
 	TaskChangesetSpecsBuilt(*Task, []*batcheslib.ChangesetSpec)
+	TaskChangesetSpecsUploadFailed(*Task, error)
+	TaskChangesetSpecsFiltered(task *Task, changedLines int)
+	TaskChangesetSpecsSkipped(task *Task, output string)
+	// TaskPhaseTimings is called with the total duration of each Phase of
+	// the execution of the Task in NewExecutorOpts.VerboseTimings mode.
+	TaskPhaseTimings(task *Task, durations []PhaseDuration)
 
 	StepsExecutionUI(*Task) StepsExecutionUI
 }
@@ -29,8 +35,16 @@ type StepOutputWriter interface {
 
 type StepsExecutionUI interface {
 	ArchiveDownloadStarted()
+	// ArchiveDownloadRetrying is called before the download of the archive
+	// is retried after a transient error, with the number of the next
+	// attempt, starting at 2.
+	ArchiveDownloadRetrying(attempt int, err error)
 	ArchiveDownloadFinished(error)
 
+	// WaitingForDisk is called when the workspace has to wait for other
+	// workspaces to free up the given number of bytes of the disk budget.
+	WaitingForDisk(size int64)
+
 	WorkspaceInitializationStarted()
 	WorkspaceInitializationFinished()
 
@@ -53,7 +67,9 @@ type StepsExecutionUI interface {
 type NoopStepsExecUI struct{}
 
 func (noop NoopStepsExecUI) ArchiveDownloadStarted()                                       {}
+func (noop NoopStepsExecUI) ArchiveDownloadRetrying(attempt int, err error)                {}
 func (noop NoopStepsExecUI) ArchiveDownloadFinished(error)                                 {}
+func (noop NoopStepsExecUI) WaitingForDisk(size int64)                                     {}
 func (noop NoopStepsExecUI) WorkspaceInitializationStarted()                               {}
 func (noop NoopStepsExecUI) WorkspaceInitializationFinished()                              {}
 func (noop NoopStepsExecUI) SkippingStepsUpto(startStep int)                               {}
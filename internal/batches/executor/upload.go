@@ -0,0 +1,149 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+
+	batcheslib "github.com/sourcegraph/sourcegraph/lib/batches"
+
+	"github.com/sourcegraph/src-cli/internal/api"
+	"github.com/sourcegraph/src-cli/internal/batches/graphql"
+)
+
+// SpecUploader uploads a ChangesetSpec to the Sourcegraph instance and returns
+// its ID. (*service.Service).CreateChangesetSpec is the implementation used
+// outside of tests.
+type SpecUploader func(ctx context.Context, spec *batcheslib.ChangesetSpec) (graphql.ChangesetSpecID, error)
+
+const maxUploadAttempts = 3
+
+const defaultUploadRetryInterval = time.Second
+
+// uploadRetryInterval is the time to wait before the first retry of a failed
+// upload. It doubles with every further attempt.
+var uploadRetryInterval = defaultUploadRetryInterval
+
+// ChangesetSpecUploadErr is returned when the ChangesetSpecs of a Task that
+// was executed successfully couldn't be uploaded.
+type ChangesetSpecUploadErr struct {
+	Err        error
+	Repository string
+}
+
+func (e ChangesetSpecUploadErr) Cause() error {
+	return e.Err
+}
+
+func (e ChangesetSpecUploadErr) Unwrap() error {
+	return e.Err
+}
+
+func (e ChangesetSpecUploadErr) Error() string {
+	return fmt.Sprintf("uploading changeset specs for %s failed: %s", e.Repository, e.Err)
+}
+
+func (e ChangesetSpecUploadErr) StatusText() string {
+	return "Upload failed: " + e.Err.Error()
+}
+
+// UploadChangesetSpec uploads spec with upload and retries transient failures,
+// such as network errors, rate limiting or server errors, with an exponential
+// backoff.
+//
+// If an attempt fails after the server created the spec, the retry creates a
+// second one. That's harmless: changeset specs that are never attached to a
+// batch spec are deleted by the server after a while.
+func UploadChangesetSpec(ctx context.Context, upload SpecUploader, spec *batcheslib.ChangesetSpec) (graphql.ChangesetSpecID, error) {
+	interval := uploadRetryInterval
+	for attempt := 1; ; attempt++ {
+		id, err := upload(ctx, spec)
+		if err == nil {
+			return id, nil
+		}
+		if !isTransientUploadErr(err) {
+			return "", err
+		}
+		if attempt == maxUploadAttempts {
+			return "", errors.Wrapf(err, "giving up after %d attempts", attempt)
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", err
+		case <-time.After(interval):
+		}
+		interval *= 2
+	}
+}
+
+// PaceUploads returns a SpecUploader that calls upload at most once per
+// interval, including retries, so that a large number of changeset specs
+// doesn't overwhelm the server. It's safe for concurrent use: concurrent
+// uploads are started one interval apart. If interval isn't positive, upload
+// is returned.
+func PaceUploads(upload SpecUploader, interval time.Duration) SpecUploader {
+	if interval <= 0 {
+		return upload
+	}
+	p := &uploadPacer{interval: interval}
+	return func(ctx context.Context, spec *batcheslib.ChangesetSpec) (graphql.ChangesetSpecID, error) {
+		if err := p.wait(ctx); err != nil {
+			return "", err
+		}
+		return upload(ctx, spec)
+	}
+}
+
+type uploadPacer struct {
+	mu       sync.Mutex
+	interval time.Duration
+	// next is the earliest time the next upload can start.
+	next time.Time
+}
+
+// wait reserves the next free slot and waits for it.
+func (p *uploadPacer) wait(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	now := time.Now()
+	start := now
+	if p.next.After(now) {
+		start = p.next
+	}
+	p.next = start.Add(p.interval)
+	p.mu.Unlock()
+
+	if start.Equal(now) {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(start.Sub(now)):
+		return nil
+	}
+}
+
+func isTransientUploadErr(err error) bool {
+	if errors.IsAny(err, context.Canceled, context.DeadlineExceeded) {
+		return false
+	}
+
+	var httpErr *api.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.Temporary()
+	}
+
+	// Errors returned by the HTTP client itself, such as a refused or reset
+	// connection.
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
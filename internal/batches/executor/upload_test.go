@@ -0,0 +1,126 @@
+package executor
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+
+	batcheslib "github.com/sourcegraph/sourcegraph/lib/batches"
+
+	"github.com/sourcegraph/src-cli/internal/api"
+	"github.com/sourcegraph/src-cli/internal/batches/graphql"
+)
+
+func TestUploadChangesetSpec(t *testing.T) {
+	uploadRetryInterval = 0
+	t.Cleanup(func() { uploadRetryInterval = defaultUploadRetryInterval })
+
+	serverErr := &api.HTTPError{StatusCode: http.StatusBadGateway, Status: "502 Bad Gateway"}
+	badRequest := &api.HTTPError{StatusCode: http.StatusBadRequest, Status: "400 Bad Request"}
+	otherErr := errors.New("invalid changeset spec")
+
+	for name, tc := range map[string]struct {
+		errs         []error
+		wantAttempts int
+		wantErr      error
+	}{
+		"success": {
+			wantAttempts: 1,
+		},
+		"transient error": {
+			errs:         []error{serverErr, serverErr},
+			wantAttempts: 3,
+		},
+		"persistent transient error": {
+			errs:         []error{serverErr, serverErr, serverErr, serverErr},
+			wantAttempts: 3,
+			wantErr:      serverErr,
+		},
+		"client error": {
+			errs:         []error{badRequest},
+			wantAttempts: 1,
+			wantErr:      badRequest,
+		},
+		"other error": {
+			errs:         []error{otherErr},
+			wantAttempts: 1,
+			wantErr:      otherErr,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			attempts := 0
+			upload := func(ctx context.Context, spec *batcheslib.ChangesetSpec) (graphql.ChangesetSpecID, error) {
+				attempts++
+				if attempts <= len(tc.errs) {
+					return "", tc.errs[attempts-1]
+				}
+				return "spec-id", nil
+			}
+
+			id, err := UploadChangesetSpec(context.Background(), upload, &batcheslib.ChangesetSpec{})
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("wrong error. want=%v, have=%v", tc.wantErr, err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			} else if id != "spec-id" {
+				t.Errorf("wrong ID. want=%q, have=%q", "spec-id", id)
+			}
+
+			if attempts != tc.wantAttempts {
+				t.Errorf("wrong number of attempts. want=%d, have=%d", tc.wantAttempts, attempts)
+			}
+		})
+	}
+}
+
+func TestPaceUploads(t *testing.T) {
+	const interval = 20 * time.Millisecond
+
+	var (
+		mu      sync.Mutex
+		started []time.Time
+	)
+	upload := PaceUploads(func(ctx context.Context, spec *batcheslib.ChangesetSpec) (graphql.ChangesetSpecID, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		started = append(started, time.Now())
+		return "id", nil
+	}, interval)
+
+	begin := time.Now()
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := upload(context.Background(), &batcheslib.ChangesetSpec{}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	slices.SortFunc(started, time.Time.Compare)
+	for i, s := range started {
+		if earliest := begin.Add(time.Duration(i) * interval); s.Before(earliest) {
+			t.Errorf("upload %d started %s after the first, before %s", i+1, s.Sub(begin), earliest.Sub(begin))
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := upload(ctx, &batcheslib.ChangesetSpec{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("wrong error for cancelled context: %v", err)
+	}
+
+	if have := PaceUploads(nil, 0); have != nil {
+		t.Error("uploads without an interval were paced")
+	}
+}
@@ -0,0 +1,96 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sourcegraph/conc/pool"
+
+	batcheslib "github.com/sourcegraph/sourcegraph/lib/batches"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+
+	"github.com/sourcegraph/src-cli/internal/batches/graphql"
+	"github.com/sourcegraph/src-cli/internal/batches/repozip"
+	"github.com/sourcegraph/src-cli/internal/batches/util"
+)
+
+// SpecApplyErr is reported by Coordinator.VerifySpecs for a ChangesetSpec whose
+// commits don't apply to the revision it's based on.
+type SpecApplyErr struct {
+	Repository string
+	BaseRev    string
+	HeadRef    string
+	Err        error
+}
+
+func (e SpecApplyErr) Error() string {
+	return fmt.Sprintf("changeset %s in %s doesn't apply to %s: %s", e.HeadRef, e.Repository, e.BaseRev, e.Err)
+}
+
+func (e SpecApplyErr) Unwrap() error { return e.Err }
+
+// VerifySpecs checks that the commits of every ChangesetSpec built for tasks
+// apply cleanly to the base revision of the spec, by applying them one after
+// the other to a new workspace of that revision. This catches diffs that
+// can't be applied, like ones that were cached for a revision that has
+// changed since, before they're rejected by Sourcegraph.
+//
+// It returns an error with a SpecApplyErr for every ChangesetSpec that
+// doesn't apply, in the order of specs. Specs of existing changesets, and
+// specs of repositories that aren't in tasks, are skipped.
+func (c *Coordinator) VerifySpecs(ctx context.Context, tasks []*Task, specs []*batcheslib.ChangesetSpec) error {
+	repos := make(map[string]*graphql.Repository, len(tasks))
+	for _, task := range tasks {
+		repos[task.Repository.ID] = task.Repository
+	}
+
+	errs := make([]error, len(specs))
+	p := pool.New().WithMaxGoroutines(max(c.opts.ExecOpts.Parallelism, 1))
+	for i, spec := range specs {
+		repo, ok := repos[spec.BaseRepository]
+		if !ok || len(spec.Commits) == 0 {
+			continue
+		}
+		p.Go(func() {
+			if err := c.verifySpec(ctx, repo, spec); err != nil {
+				errs[i] = SpecApplyErr{Repository: repo.Name, BaseRev: spec.BaseRev, HeadRef: spec.HeadRef, Err: err}
+			}
+		})
+	}
+	p.Wait()
+
+	return errors.Append(nil, errs...)
+}
+
+func (c *Coordinator) verifySpec(ctx context.Context, repo *graphql.Repository, spec *batcheslib.ChangesetSpec) error {
+	spec, err := c.LoadChangesetSpec(spec)
+	if err != nil {
+		return err
+	}
+
+	archive := c.opts.ExecOpts.RepoArchiveRegistry.Checkout(repozip.RepoRevision{RepoName: repo.Name, Commit: spec.BaseRev}, "")
+	if err := archive.Ensure(ctx); err != nil {
+		return errors.Wrap(err, "fetching repo")
+	}
+	defer archive.Close()
+
+	ws, err := c.opts.ExecOpts.Creator.Create(ctx, repo, nil, archive)
+	if err != nil {
+		return errors.Wrap(err, "creating workspace")
+	}
+	defer func() {
+		ctx, cancel := util.CleanupContext(ctx)
+		defer cancel()
+		_ = ws.Close(ctx)
+	}()
+
+	for i, commit := range spec.Commits {
+		if err := ws.ApplyDiff(ctx, commit.Diff); err != nil {
+			if len(spec.Commits) > 1 {
+				return errors.Wrapf(err, "commit %d", i+1)
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	batcheslib "github.com/sourcegraph/sourcegraph/lib/batches"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+
+	"github.com/sourcegraph/src-cli/internal/api"
+	"github.com/sourcegraph/src-cli/internal/batches/docker"
+	"github.com/sourcegraph/src-cli/internal/batches/mock"
+	"github.com/sourcegraph/src-cli/internal/batches/repozip"
+	"github.com/sourcegraph/src-cli/internal/batches/workspace"
+)
+
+func TestCoordinator_VerifySpecs(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test doesn't work on Windows because the bind workspace needs git")
+	}
+
+	archives := []mock.RepoArchive{
+		{RepoName: testRepo1.Name, Commit: testRepo1.Rev(), Files: map[string]string{"README.md": "# Welcome to the README\n"}},
+		{RepoName: testRepo2.Name, Commit: testRepo2.Rev(), Files: map[string]string{"README.md": "# Sourcegraph README\n"}},
+	}
+	ts := httptest.NewServer(mock.NewZipArchivesMux(t, nil, archives...))
+	defer ts.Close()
+
+	var clientBuffer bytes.Buffer
+	u, _ := url.ParseRequestURI(ts.URL)
+	client := api.NewClient(api.ClientOpts{EndpointURL: u, Out: &clientBuffer})
+
+	testTempDir := t.TempDir()
+	ctx := context.Background()
+	cr, _ := workspace.NewCreator(ctx, "bind", testTempDir, testTempDir, map[string]docker.Image{})
+
+	coord := NewCoordinator(NewCoordinatorOpts{ExecOpts: NewExecutorOpts{
+		Creator:             cr,
+		RepoArchiveRegistry: repozip.NewArchiveRegistry(client, testTempDir, false),
+		Parallelism:         2,
+	}})
+
+	const (
+		appendFoobar = `diff --git README.md README.md
+--- README.md
++++ README.md
+@@ -1 +1,2 @@
+ # Welcome to the README
++foobar
+`
+		appendBarfoo = `diff --git README.md README.md
+--- README.md
++++ README.md
+@@ -1,2 +1,3 @@
+ # Welcome to the README
+ foobar
++barfoo
+`
+	)
+	spec := func(repo string, headRef string, diffs ...string) *batcheslib.ChangesetSpec {
+		s := &batcheslib.ChangesetSpec{BaseRepository: repo, BaseRev: testRepo1.Rev(), HeadRef: headRef}
+		if repo == testRepo2.ID {
+			s.BaseRev = testRepo2.Rev()
+		}
+		for _, d := range diffs {
+			s.Commits = append(s.Commits, batcheslib.GitCommitDescription{Diff: []byte(d)})
+		}
+		return s
+	}
+
+	specs := []*batcheslib.ChangesetSpec{
+		spec(testRepo1.ID, "refs/heads/applies", appendFoobar),
+		spec(testRepo1.ID, "refs/heads/commits-apply", appendFoobar, appendBarfoo),
+		spec(testRepo1.ID, "refs/heads/drifted", appendBarfoo),
+		spec(testRepo2.ID, "refs/heads/other-repo", appendFoobar),
+		spec(testRepo1.ID, "refs/heads/commit-drifted", appendFoobar, appendFoobar),
+		// Specs of existing changesets and unknown repositories are skipped.
+		{BaseRepository: testRepo1.ID, ExternalID: "123"},
+		spec("unknown", "refs/heads/unknown", appendBarfoo),
+	}
+
+	err := coord.VerifySpecs(ctx, []*Task{{Repository: testRepo1}, {Repository: testRepo2}}, specs)
+
+	var multiErr errors.MultiError
+	require.True(t, errors.As(err, &multiErr))
+	var failed []string
+	for _, err := range multiErr.Errors() {
+		var applyErr SpecApplyErr
+		require.True(t, errors.As(err, &applyErr))
+		failed = append(failed, applyErr.Repository+"@"+applyErr.HeadRef)
+	}
+	require.Equal(t, []string{
+		testRepo1.Name + "@refs/heads/drifted",
+		testRepo2.Name + "@refs/heads/other-repo",
+		testRepo1.Name + "@refs/heads/commit-drifted",
+	}, failed)
+	require.ErrorContains(t, err, "changeset refs/heads/commit-drifted in github.com/sourcegraph/src-cli doesn't apply to d34db33f: commit 2: applying cached diff")
+
+	require.NoError(t, coord.VerifySpecs(ctx, []*Task{{Repository: testRepo1}}, specs[:2]))
+}
@@ -0,0 +1,80 @@
+package executor
+
+import (
+	"cmp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+)
+
+// Wave is a named group of Tasks that are executed together, separately from
+// the other Tasks, for example to try a batch change on a few repositories
+// before executing it everywhere.
+type Wave struct {
+	Name string
+	// Size is the number of Tasks in the wave. If it's 0, the wave contains
+	// all Tasks that aren't in an earlier wave.
+	Size int
+}
+
+// ParseWaves parses a comma-separated list of waves, such as
+// "canary=10,early=100,rest". Every wave but the last needs a size.
+func ParseWaves(s string) ([]Wave, error) {
+	var waves []Wave
+	for value := range strings.SplitSeq(s, ",") {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+		if n := len(waves); n > 0 && waves[n-1].Size == 0 {
+			return nil, errors.Newf("wave %q contains all remaining workspaces, so it must be the last wave", waves[n-1].Name)
+		}
+
+		var wave Wave
+		name, size, hasSize := strings.Cut(value, "=")
+		wave.Name = strings.TrimSpace(name)
+		if wave.Name == "" {
+			return nil, errors.Newf("wave %q has no name", value)
+		}
+		if hasSize {
+			var err error
+			if wave.Size, err = strconv.Atoi(strings.TrimSpace(size)); err != nil || wave.Size < 1 {
+				return nil, errors.Newf("size of wave %q must be a positive number", wave.Name)
+			}
+		}
+		if slices.ContainsFunc(waves, func(w Wave) bool { return w.Name == wave.Name }) {
+			return nil, errors.Newf("wave %q is defined more than once", wave.Name)
+		}
+		waves = append(waves, wave)
+	}
+	return waves, nil
+}
+
+// AssignWaves sets the Wave of the given Tasks. The Tasks are assigned in the
+// order of their repository names and paths, so that the same Tasks end up in
+// the same waves every time. Tasks that don't fit into any wave aren't
+// assigned to one.
+func AssignWaves(tasks []*Task, waves []Wave) {
+	sorted := slices.Clone(tasks)
+	slices.SortStableFunc(sorted, func(a, b *Task) int {
+		return cmp.Or(
+			strings.Compare(a.Repository.Name, b.Repository.Name),
+			strings.Compare(a.Path, b.Path),
+		)
+	})
+
+	for _, wave := range waves {
+		n := len(sorted)
+		if wave.Size > 0 {
+			n = min(n, wave.Size)
+		}
+		for _, t := range sorted[:n] {
+			t.Wave = wave.Name
+		}
+		sorted = sorted[n:]
+	}
+	for _, t := range sorted {
+		t.Wave = ""
+	}
+}
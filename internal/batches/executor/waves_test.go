@@ -0,0 +1,62 @@
+package executor
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseWaves(t *testing.T) {
+	tests := map[string]struct {
+		in      string
+		want    []Wave
+		wantErr string
+	}{
+		"empty":              {in: ""},
+		"sizes":              {in: "canary=10, early = 100", want: []Wave{{Name: "canary", Size: 10}, {Name: "early", Size: 100}}},
+		"remaining":          {in: "canary=10,rest", want: []Wave{{Name: "canary", Size: 10}, {Name: "rest"}}},
+		"remaining not last": {in: "rest,canary=10", wantErr: `wave "rest" contains all remaining workspaces, so it must be the last wave`},
+		"invalid size":       {in: "canary=ten", wantErr: `size of wave "canary" must be a positive number`},
+		"zero size":          {in: "canary=0", wantErr: `size of wave "canary" must be a positive number`},
+		"no name":            {in: "=10", wantErr: `wave "=10" has no name`},
+		"duplicate":          {in: "canary=1,canary=2", wantErr: `wave "canary" is defined more than once`},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			have, err := ParseWaves(tc.in)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("wrong error. want=%q, have=%v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.want, have); diff != "" {
+				t.Errorf("wrong waves (-want +have):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestAssignWaves(t *testing.T) {
+	tasks := []*Task{
+		{Repository: testRepo1, Path: "b"},
+		{Repository: testRepo1, Path: "a"},
+		{Repository: testRepo2},
+		{Repository: testRepo1},
+	}
+
+	AssignWaves(tasks, []Wave{{Name: "canary", Size: 1}, {Name: "early", Size: 2}})
+
+	want := []string{"", "early", "canary", "early"}
+	var have []string
+	for _, task := range tasks {
+		have = append(have, task.Wave)
+	}
+	if diff := cmp.Diff(want, have); diff != "" {
+		t.Errorf("wrong waves (-want +have):\n%s", diff)
+	}
+}
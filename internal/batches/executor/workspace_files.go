@@ -0,0 +1,153 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/sourcegraph/go-diff/diff"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+
+	batcheslib "github.com/sourcegraph/sourcegraph/lib/batches"
+	"github.com/sourcegraph/sourcegraph/lib/batches/template"
+
+	"github.com/sourcegraph/src-cli/internal/batches/workspace"
+)
+
+// workspaceFile is an entry of Step.Files with a relative path, which is
+// written into the workspace instead of being mounted into the container.
+type workspaceFile struct {
+	// path is relative to the root of the repository.
+	path    string
+	content string
+}
+
+// renderWorkspaceFiles renders the entries of Step.Files with relative paths.
+// The paths are relative to the workspace at workspacePath.
+func renderWorkspaceFiles(step batcheslib.Step, workspacePath string, stepContext *template.StepContext) ([]workspaceFile, error) {
+	relative := make(map[string]string)
+	for name, content := range step.Files {
+		if !path.IsAbs(name) {
+			relative[name] = content
+		}
+	}
+	if len(relative) == 0 {
+		return nil, nil
+	}
+
+	rendered, err := template.RenderStepMap(relative, stepContext)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing step files")
+	}
+
+	files := make([]workspaceFile, 0, len(rendered))
+	for name, content := range rendered {
+		files = append(files, workspaceFile{path: path.Join(workspacePath, name), content: content})
+	}
+	slices.SortFunc(files, func(a, b workspaceFile) int { return strings.Compare(a.path, b.path) })
+	return files, nil
+}
+
+// writeWorkspaceFiles creates files in ws. The files must not exist yet.
+func writeWorkspaceFiles(ctx context.Context, ws workspace.Workspace, files []workspaceFile) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	var d bytes.Buffer
+	for _, f := range files {
+		d.Write(workspaceFileDiff(f, false))
+	}
+	if err := ws.ApplyDiff(ctx, d.Bytes()); err != nil {
+		return errors.Wrap(err, "writing step files into the workspace")
+	}
+	return nil
+}
+
+// removeWorkspaceFiles removes the files from ws that the step didn't change,
+// so that they aren't part of the diff, and returns the diff of ws without
+// them. stepDiff is the diff of ws after the step, computed with opts.
+func removeWorkspaceFiles(ctx context.Context, ws workspace.Workspace, opts workspace.DiffOptions, stepDiff []byte, files []workspaceFile) ([]byte, error) {
+	if len(files) == 0 {
+		return stepDiff, nil
+	}
+
+	fileDiffs, err := diff.ParseMultiFileDiff(stepDiff)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing diff produced by step")
+	}
+
+	var d bytes.Buffer
+	for _, f := range files {
+		idx := slices.IndexFunc(fileDiffs, func(fd *diff.FileDiff) bool {
+			return fd.OrigName == "/dev/null" && fd.NewName == f.path
+		})
+		if idx >= 0 && unchangedWorkspaceFile(fileDiffs[idx], f) {
+			d.Write(workspaceFileDiff(f, true))
+		}
+	}
+	if d.Len() == 0 {
+		return stepDiff, nil
+	}
+
+	if err := ws.ApplyDiff(ctx, d.Bytes()); err != nil {
+		return nil, errors.Wrap(err, "removing step files from the workspace")
+	}
+	return ws.Diff(ctx, opts)
+}
+
+// unchangedWorkspaceFile returns whether fd, which creates the file at f.path,
+// creates it with f.content.
+func unchangedWorkspaceFile(fd *diff.FileDiff, f workspaceFile) bool {
+	want, err := diff.ParseFileDiff(workspaceFileDiff(f, false))
+	if err != nil {
+		return false
+	}
+	have, err := diff.PrintHunks(fd.Hunks)
+	if err != nil {
+		return false
+	}
+	wantHunks, err := diff.PrintHunks(want.Hunks)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(have, wantHunks)
+}
+
+// workspaceFileDiff returns a diff that creates f, or deletes it if deleted is
+// true, in the format produced by Workspace.Diff.
+func workspaceFileDiff(f workspaceFile, deleted bool) []byte {
+	var d bytes.Buffer
+	fmt.Fprintf(&d, "diff --git %s %s\n", f.path, f.path)
+	if deleted {
+		d.WriteString("deleted file mode 100644\n")
+	} else {
+		d.WriteString("new file mode 100644\n")
+	}
+	if f.content == "" {
+		return d.Bytes()
+	}
+
+	lines := strings.SplitAfter(f.content, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	prefix := "+"
+	if deleted {
+		fmt.Fprintf(&d, "--- %s\n+++ /dev/null\n@@ -1,%d +0,0 @@\n", f.path, len(lines))
+		prefix = "-"
+	} else {
+		fmt.Fprintf(&d, "--- /dev/null\n+++ %s\n@@ -0,0 +1,%d @@\n", f.path, len(lines))
+	}
+	for _, line := range lines {
+		d.WriteString(prefix + line)
+	}
+	if !strings.HasSuffix(f.content, "\n") {
+		d.WriteString("\n\\ No newline at end of file\n")
+	}
+	return d.Bytes()
+}
@@ -63,6 +63,8 @@ func (r *Repository) BaseRef() string {
 	return util.EnsureRefPrefix(r.DefaultBranch.Name)
 }
 
+// Rev returns the commit the branch pointed at when the repository was
+// resolved. It doesn't change if the branch advances later on.
 func (r *Repository) Rev() string {
 	if r.Branch.Target.OID != "" {
 		return r.Branch.Target.OID
@@ -11,7 +11,8 @@ import (
 )
 
 type FileTaskLogger struct {
-	f *os.File
+	f      *os.File
+	format Formatter
 
 	errored bool
 	keep    bool
@@ -26,11 +27,22 @@ func newTaskLogger(slug string, keep bool, dir string) (*FileTaskLogger, error)
 	}
 
 	return &FileTaskLogger{
-		f:    f,
-		keep: keep,
+		f:      f,
+		format: TextFormatter{},
+		keep:   keep,
 	}, nil
 }
 
+var _ FormattableTaskLogger = &FileTaskLogger{}
+
+func (tl *FileTaskLogger) Format(f Formatter, h Header) error {
+	tl.format = f
+	if _, err := tl.f.Write(f.FormatHeader(h)); err != nil {
+		return errors.Wrap(err, "writing log header")
+	}
+	return nil
+}
+
 func (tl *FileTaskLogger) Close() error {
 	if err := tl.f.Close(); err != nil {
 		return err
@@ -48,11 +60,15 @@ func (tl *FileTaskLogger) Close() error {
 }
 
 func (tl *FileTaskLogger) Log(s string) {
-	fmt.Fprintf(tl.f, "%s %s\n", time.Now().Format(time.RFC3339Nano), s)
+	tl.write("", s)
 }
 
 func (tl *FileTaskLogger) Logf(format string, a ...any) {
-	fmt.Fprintf(tl.f, "%s "+format+"\n", append([]any{time.Now().Format(time.RFC3339Nano)}, a...)...)
+	tl.write("", fmt.Sprintf(format, a...))
+}
+
+func (tl *FileTaskLogger) write(prefix, line string) {
+	tl.f.Write(tl.format.FormatLine(time.Now(), prefix, line))
 }
 
 func (tl *FileTaskLogger) MarkErrored() {
@@ -86,7 +102,7 @@ func (pw *prefixWriter) Write(p []byte) (int, error) {
 	//
 	t := bytes.TrimSuffix(p, []byte("\n"))
 	for line := range bytes.SplitSeq(t, []byte("\n")) {
-		pw.logger.Logf("%s | %s", pw.prefix, string(line))
+		pw.logger.write(pw.prefix, string(line))
 	}
 	return len(p), nil
 }
@@ -0,0 +1,80 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Header describes a Task at the start of its log file.
+type Header struct {
+	Repository string    `json:"repository"`
+	Rev        string    `json:"rev"`
+	Path       string    `json:"path,omitempty"`
+	Steps      []string  `json:"steps"`
+	StartedAt  time.Time `json:"startedAt"`
+	// Annotations are the metadata of the run the Task is part of.
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// CorrelationID ties the run the Task is part of to the system that
+	// started it.
+	CorrelationID string `json:"correlationID,omitempty"`
+}
+
+// Formatter formats the log file of a Task.
+type Formatter interface {
+	// FormatHeader returns the start of the log file.
+	FormatHeader(h Header) []byte
+	// FormatLine returns a line logged at t. prefix is the output the line
+	// was written to, such as "stdout", or empty for messages of src itself.
+	FormatLine(t time.Time, prefix, line string) []byte
+}
+
+// FormattableTaskLogger is a TaskLogger whose log file can be formatted with
+// a Formatter.
+type FormattableTaskLogger interface {
+	TaskLogger
+	// Format writes the header h to the log file and formats everything
+	// that's logged afterwards with f.
+	Format(f Formatter, h Header) error
+}
+
+// TextFormatter is the default Formatter. It writes every line with the time
+// it was logged in front, and no header.
+type TextFormatter struct{}
+
+var _ Formatter = TextFormatter{}
+
+func (TextFormatter) FormatHeader(Header) []byte { return nil }
+
+func (TextFormatter) FormatLine(t time.Time, prefix, line string) []byte {
+	if prefix != "" {
+		return fmt.Appendf(nil, "%s %s | %s\n", t.Format(time.RFC3339Nano), prefix, line)
+	}
+	return fmt.Appendf(nil, "%s %s\n", t.Format(time.RFC3339Nano), line)
+}
+
+// JSONFormatter writes the header and every line as a JSON object on a line
+// of its own, for machines to parse.
+type JSONFormatter struct{}
+
+var _ Formatter = JSONFormatter{}
+
+func (JSONFormatter) FormatHeader(h Header) []byte {
+	return marshalLine(struct {
+		Header Header `json:"header"`
+	}{h})
+}
+
+func (JSONFormatter) FormatLine(t time.Time, prefix, line string) []byte {
+	return marshalLine(struct {
+		Time    time.Time `json:"time"`
+		Prefix  string    `json:"prefix,omitempty"`
+		Message string    `json:"message"`
+	}{t, prefix, line})
+}
+
+func marshalLine(v any) []byte {
+	// The values only consist of strings and times, which always marshal.
+	data, _ := json.Marshal(v)
+	return append(data, '\n')
+}
@@ -0,0 +1,71 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Stream writes the log output of many tasks to a single writer, prefixing
+// every line with the name of the task it belongs to. Lines of tasks running
+// in parallel are interleaved, but never torn apart.
+type Stream struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewStream(w io.Writer) *Stream {
+	return &Stream{w: w}
+}
+
+// Tee returns a TaskLogger that writes everything that's logged to tl to the
+// Stream too, with each line prefixed by name.
+func (s *Stream) Tee(tl TaskLogger, name string) TaskLogger {
+	return &streamingTaskLogger{TaskLogger: tl, stream: s, name: name}
+}
+
+func (s *Stream) writeLines(name, prefix string, p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := bytes.TrimSuffix(p, []byte("\n"))
+	for line := range bytes.SplitSeq(t, []byte("\n")) {
+		if prefix != "" {
+			fmt.Fprintf(s.w, "[%s] %s | %s\n", name, prefix, line)
+		} else {
+			fmt.Fprintf(s.w, "[%s] %s\n", name, line)
+		}
+	}
+}
+
+type streamingTaskLogger struct {
+	TaskLogger
+
+	stream *Stream
+	name   string
+}
+
+func (tl *streamingTaskLogger) Log(s string) {
+	tl.TaskLogger.Log(s)
+	tl.stream.writeLines(tl.name, "", []byte(s))
+}
+
+func (tl *streamingTaskLogger) Logf(format string, a ...any) {
+	tl.TaskLogger.Logf(format, a...)
+	tl.stream.writeLines(tl.name, "", fmt.Appendf(nil, format, a...))
+}
+
+func (tl *streamingTaskLogger) PrefixWriter(prefix string) io.Writer {
+	return io.MultiWriter(tl.TaskLogger.PrefixWriter(prefix), &streamPrefixWriter{tl, prefix})
+}
+
+type streamPrefixWriter struct {
+	logger *streamingTaskLogger
+	prefix string
+}
+
+func (pw *streamPrefixWriter) Write(p []byte) (int, error) {
+	pw.logger.stream.writeLines(pw.logger.name, pw.prefix, p)
+	return len(p), nil
+}
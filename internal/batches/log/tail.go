@@ -0,0 +1,175 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// tailBacklog is the number of recent lines a Tail keeps for new
+	// subscribers.
+	tailBacklog = 500
+	// subscriptionBuffer is the number of lines a Subscription buffers on
+	// top of the backlog before it drops lines.
+	subscriptionBuffer = 500
+)
+
+// Line is a line of the log of a task.
+type Line struct {
+	Time time.Time
+	// Prefix is the output the line was written to, such as "stdout", or
+	// empty for messages of src itself.
+	Prefix string
+	Text   string
+}
+
+// Tail broadcasts the lines logged to a TaskLogger to live subscribers, such
+// as a UI that shows the output of a running task. It's safe for concurrent
+// use.
+type Tail struct {
+	mu      sync.Mutex
+	backlog []Line
+	subs    map[*Subscription]struct{}
+	closed  bool
+}
+
+func NewTail() *Tail {
+	return &Tail{subs: make(map[*Subscription]struct{})}
+}
+
+// Tee returns a TaskLogger that writes everything that's logged to tl to the
+// Tail too. Writing to tl never waits for the subscribers.
+func (t *Tail) Tee(tl TaskLogger) TaskLogger {
+	return &tailingTaskLogger{TaskLogger: tl, tail: t}
+}
+
+// Subscribe returns a Subscription that receives the recent lines of the log
+// and then every line as it's logged. If the Tail is already closed, it only
+// receives the recent lines.
+func (t *Tail) Subscribe() *Subscription {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := &Subscription{tail: t, lines: make(chan Line, len(t.backlog)+subscriptionBuffer)}
+	for _, l := range t.backlog {
+		s.lines <- l
+	}
+	if t.closed {
+		close(s.lines)
+		return s
+	}
+	t.subs[s] = struct{}{}
+	return s
+}
+
+// Close closes the Subscriptions once they received all lines. Lines that are
+// logged afterwards are dropped.
+func (t *Tail) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return
+	}
+	t.closed = true
+	for s := range t.subs {
+		close(s.lines)
+		delete(t.subs, s)
+	}
+}
+
+func (t *Tail) writeLines(prefix string, p []byte) {
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return
+	}
+	p = bytes.TrimSuffix(p, []byte("\n"))
+	for text := range bytes.SplitSeq(p, []byte("\n")) {
+		l := Line{Time: now, Prefix: prefix, Text: string(text)}
+		if len(t.backlog) == tailBacklog {
+			t.backlog = append(t.backlog[:0], t.backlog[1:]...)
+		}
+		t.backlog = append(t.backlog, l)
+
+		// Subscribers that don't keep up miss lines, instead of holding up
+		// the task.
+		for s := range t.subs {
+			select {
+			case s.lines <- l:
+			default:
+				s.dropped++
+			}
+		}
+	}
+}
+
+// Subscription receives the lines of the log of a task from a Tail.
+type Subscription struct {
+	tail  *Tail
+	lines chan Line
+	// dropped is guarded by tail.mu.
+	dropped int
+}
+
+// Lines returns the channel the lines are sent on. It's closed when the task
+// is done or the Subscription is closed.
+func (s *Subscription) Lines() <-chan Line {
+	return s.lines
+}
+
+// Dropped returns the number of lines that weren't sent, because the
+// subscriber didn't receive them fast enough.
+func (s *Subscription) Dropped() int {
+	s.tail.mu.Lock()
+	defer s.tail.mu.Unlock()
+	return s.dropped
+}
+
+// Close stops the Subscription. It doesn't affect the log of the task or the
+// other Subscriptions.
+func (s *Subscription) Close() {
+	s.tail.mu.Lock()
+	defer s.tail.mu.Unlock()
+
+	if _, ok := s.tail.subs[s]; ok {
+		delete(s.tail.subs, s)
+		close(s.lines)
+	}
+}
+
+type tailingTaskLogger struct {
+	TaskLogger
+
+	tail *Tail
+}
+
+func (tl *tailingTaskLogger) Log(s string) {
+	tl.TaskLogger.Log(s)
+	tl.tail.writeLines("", []byte(s))
+}
+
+func (tl *tailingTaskLogger) Logf(format string, a ...any) {
+	tl.TaskLogger.Logf(format, a...)
+	tl.tail.writeLines("", fmt.Appendf(nil, format, a...))
+}
+
+func (tl *tailingTaskLogger) PrefixWriter(prefix string) io.Writer {
+	return io.MultiWriter(tl.TaskLogger.PrefixWriter(prefix), &tailPrefixWriter{tl.tail, prefix})
+}
+
+type tailPrefixWriter struct {
+	tail   *Tail
+	prefix string
+}
+
+func (pw *tailPrefixWriter) Write(p []byte) (int, error) {
+	pw.tail.writeLines(pw.prefix, p)
+	return len(p), nil
+}
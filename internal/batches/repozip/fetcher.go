@@ -1,21 +1,45 @@
 package repozip
 
 import (
+	"archive/zip"
+	"bytes"
+	"cmp"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"io"
+	"math/rand/v2"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/sourcegraph/sourcegraph/lib/errors"
 
 	"github.com/sourcegraph/src-cli/internal/batches/util"
 )
 
+// DefaultFetchAttempts is the number of times a file of a repository is
+// downloaded before giving up, if the downloads fail with a transient error.
+const DefaultFetchAttempts = 3
+
+const defaultFetchRetryInterval = time.Second
+
+// fetchRetryInterval is the average time to wait before the first retry of a
+// failed download. It doubles with every further attempt.
+var fetchRetryInterval = defaultFetchRetryInterval
+
+// errIncompleteDownload is returned when a downloaded file doesn't match the
+// length or checksum advertised by the server, or, for ZIP archives, isn't a
+// valid archive, which means that it was truncated or corrupted on the way.
+var errIncompleteDownload = errors.New("incomplete download")
+
 type RepoRevision struct {
 	RepoName string
 	Commit   string
@@ -62,8 +86,33 @@ type HTTPClient interface {
 	Do(req *http.Request) (*http.Response, error)
 }
 
+// NewArchiveRegistry returns an ArchiveRegistry that downloads archives into
+// dir with client. An api.Client sends the downloads with the same
+// http.Client as its GraphQL requests, including one set in
+// api.ClientOpts.HTTPClient.
 func NewArchiveRegistry(client HTTPClient, dir string, deleteZips bool) ArchiveRegistry {
-	return &archiveRegistry{client: client, dir: dir, deleteZips: deleteZips}
+	return NewArchiveRegistryWithAttempts(client, dir, deleteZips, DefaultFetchAttempts)
+}
+
+// NewArchiveRegistryWithAttempts is like NewArchiveRegistry, but makes up to
+// fetchAttempts attempts to download a file before giving up. Only transient
+// errors, like network errors, server errors and incomplete downloads, are
+// retried, with an exponential backoff.
+func NewArchiveRegistryWithAttempts(client HTTPClient, dir string, deleteZips bool, fetchAttempts int) ArchiveRegistry {
+	return &archiveRegistry{client: client, dir: dir, deleteZips: deleteZips, fetchAttempts: fetchAttempts}
+}
+
+// FetchRetryFunc is called before a download of a repository archive is
+// retried, with the number of the next attempt, starting at 2, and the error
+// of the failed one.
+type FetchRetryFunc func(attempt int, err error)
+
+type fetchRetryFuncKey struct{}
+
+// WithFetchRetryFunc returns a context that makes Archive.Ensure call fn
+// before it retries a failed download.
+func WithFetchRetryFunc(ctx context.Context, fn FetchRetryFunc) context.Context {
+	return context.WithValue(ctx, fetchRetryFuncKey{}, fn)
 }
 
 // archiveRegistry is the concrete implementation of the ArchiveRegistry interface used
@@ -72,6 +121,9 @@ type archiveRegistry struct {
 	client     HTTPClient
 	dir        string
 	deleteZips bool
+	// fetchAttempts is the maximum number of attempts to download a file. If
+	// it's 0, DefaultFetchAttempts are made.
+	fetchAttempts int
 
 	zipsMu sync.Mutex
 	zips   map[string]*repoArchive
@@ -115,6 +167,7 @@ func (rf *archiveRegistry) zipFor(repo RepoRevision, workspacePath string) *repo
 			zipPath:       zipPath,
 			repo:          repo,
 			client:        rf.client,
+			fetchAttempts: cmp.Or(rf.fetchAttempts, DefaultFetchAttempts),
 			deleteOnClose: rf.deleteZips,
 			pathInRepo:    workspacePath,
 		}
@@ -173,7 +226,8 @@ type repoArchive struct {
 	repo       RepoRevision
 	pathInRepo string
 
-	client HTTPClient
+	client        HTTPClient
+	fetchAttempts int
 
 	// zipPath is the path of the downloaded ZIP archive on the local filesystem.
 	zipPath string
@@ -276,7 +330,7 @@ func (rz *repoArchive) fetchArchiveAndFiles(ctx context.Context) (err error) {
 			return err
 		}
 
-		ok, err := fetchRepositoryFile(ctx, rz.client, rz.repo, rz.pathInRepo, rz.zipPath)
+		ok, err := rz.fetchWithRetries(ctx, rz.pathInRepo, rz.zipPath)
 		if err != nil {
 			return errors.Wrap(err, "fetching ZIP archive")
 		}
@@ -296,7 +350,7 @@ func (rz *repoArchive) fetchArchiveAndFiles(ctx context.Context) (err error) {
 			continue
 		}
 
-		ok, err := fetchRepositoryFile(ctx, rz.client, rz.repo, addFile.filename, addFile.localPath)
+		ok, err := rz.fetchWithRetries(ctx, addFile.filename, addFile.localPath)
 		if err != nil {
 			return errors.Wrapf(err, "fetching %s for repository archive", addFile.filename)
 		}
@@ -308,6 +362,82 @@ func (rz *repoArchive) fetchArchiveAndFiles(ctx context.Context) (err error) {
 	return nil
 }
 
+// fetchWithRetries calls fetchRepositoryFile and retries it with an
+// exponential backoff, with jitter, as long as it fails with a transient
+// error, up to rz.fetchAttempts times.
+func (rz *repoArchive) fetchWithRetries(ctx context.Context, pathInRepo, dest string) (bool, error) {
+	onRetry, _ := ctx.Value(fetchRetryFuncKey{}).(FetchRetryFunc)
+
+	interval := fetchRetryInterval
+	for attempt := 1; ; attempt++ {
+		ok, err := fetchRepositoryFile(ctx, rz.client, rz.repo, pathInRepo, dest)
+		if err == nil || !isTransientFetchErr(err) || ctx.Err() != nil {
+			return ok, err
+		}
+		if attempt >= rz.fetchAttempts {
+			if attempt > 1 {
+				err = errors.Wrapf(err, "giving up after %d attempts", attempt)
+			}
+			return false, err
+		}
+
+		if onRetry != nil {
+			onRetry(attempt+1, err)
+		}
+		// The jitter keeps the workspaces that failed at the same time, for
+		// example because the instance was restarted, from retrying in lockstep.
+		select {
+		case <-ctx.Done():
+			return false, err
+		case <-time.After(interval/2 + rand.N(interval+1)):
+		}
+		interval *= 2
+	}
+}
+
+// FetchStatusErr is returned when the Sourcegraph instance responds to the
+// download of a file with an unexpected HTTP status.
+type FetchStatusErr struct {
+	StatusCode int
+	URL        string
+}
+
+func (e *FetchStatusErr) Error() string {
+	msg := fmt.Sprintf("unable to fetch archive (HTTP %d from %s)", e.StatusCode, e.URL)
+	if e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden {
+		msg += ": check that the access token is valid and can read the repository"
+	}
+	return msg
+}
+
+// Temporary returns whether the download can succeed when it's retried.
+func (e *FetchStatusErr) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusRequestTimeout
+}
+
+// isTransientFetchErr returns whether err, returned by fetchRepositoryFile, is
+// likely to go away when the download is retried.
+func isTransientFetchErr(err error) bool {
+	if errors.IsAny(err, context.Canceled, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, errIncompleteDownload) {
+		return true
+	}
+
+	var statusErr *FetchStatusErr
+	if errors.As(err, &statusErr) {
+		return statusErr.Temporary()
+	}
+
+	// Errors returned by the HTTP client itself, such as a refused
+	// connection, and errors reading the response body, such as a reset
+	// connection.
+	var urlErr *url.Error
+	var netErr net.Error
+	return errors.As(err, &urlErr) || errors.As(err, &netErr)
+}
+
 // fetchRepositoryInFile fetches the given `pathInRepo` using the Sourcegraph's
 // raw endpoint and writes it to `dest`.
 // If `pathInRepo` is empty and `dest` ends in `.zip` a ZIP archive of the
@@ -333,7 +463,7 @@ func fetchRepositoryFile(ctx context.Context, client HTTPClient, repo RepoRevisi
 		if resp.StatusCode == http.StatusNotFound {
 			return false, nil
 		}
-		return false, fmt.Errorf("unable to fetch archive (HTTP %d from %s)", resp.StatusCode, req.URL.String())
+		return false, &FetchStatusErr{StatusCode: resp.StatusCode, URL: req.URL.String()}
 	}
 
 	f, err := os.CreateTemp(filepath.Dir(dest), fmt.Sprintf("%s-*.tmp", filepath.Base(dest)))
@@ -343,15 +473,31 @@ func fetchRepositoryFile(ctx context.Context, client HTTPClient, repo RepoRevisi
 	// Make sure we clean up the temp file in case something fails.
 	defer func(path string) { _ = os.Remove(path) }(f.Name())
 
-	if _, err := io.Copy(f, resp.Body); err != nil {
+	h := sha256.New()
+	written, err := io.Copy(io.MultiWriter(f, h), resp.Body)
+	if err != nil {
 		// Be a good citizen, attempt to close the file.
 		_ = f.Close()
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, errors.Wrapf(errIncompleteDownload, "connection closed while downloading %s", req.URL.String())
+		}
 		return false, err
 	}
 	if err := f.Close(); err != nil {
 		return false, errors.Wrap(err, "closing temp file")
 	}
 
+	if err := verifyDownload(resp, written, h.Sum(nil)); err != nil {
+		return false, errors.Wrapf(err, "downloading %s", req.URL.String())
+	}
+	if strings.HasSuffix(dest, ".zip") {
+		r, err := zip.OpenReader(f.Name())
+		if err != nil {
+			return false, errors.Wrapf(errIncompleteDownload, "downloading %s: not a valid ZIP archive: %s", req.URL.String(), err)
+		}
+		r.Close()
+	}
+
 	// Atomically create the actual file, so that there are no artifacts left behind
 	// when this process is aborted, network errors occur, or some witchcraft goes on.
 	if err := os.Rename(f.Name(), dest); err != nil {
@@ -361,6 +507,40 @@ func fetchRepositoryFile(ctx context.Context, client HTTPClient, repo RepoRevisi
 	return true, nil
 }
 
+// verifyDownload checks the length and the SHA-256 checksum of a downloaded
+// response body against the Content-Length and the Content-Digest or Digest
+// headers of resp, if the server sent them.
+func verifyDownload(resp *http.Response, written int64, sum []byte) error {
+	if resp.ContentLength >= 0 && written != resp.ContentLength {
+		return errors.Wrapf(errIncompleteDownload, "received %d of %d bytes", written, resp.ContentLength)
+	}
+
+	want, ok := sha256Digest(resp.Header)
+	if ok && !bytes.Equal(want, sum) {
+		return errors.Wrap(errIncompleteDownload, "SHA-256 checksum doesn't match the one sent by the server")
+	}
+	return nil
+}
+
+// sha256Digest returns the SHA-256 checksum in the Content-Digest header
+// (RFC 9530), or in the older Digest header (RFC 3230).
+func sha256Digest(header http.Header) ([]byte, bool) {
+	for _, name := range []string{"Content-Digest", "Digest"} {
+		for value := range strings.SplitSeq(header.Get(name), ",") {
+			algorithm, encoded, ok := strings.Cut(strings.TrimSpace(value), "=")
+			if !ok || !strings.EqualFold(algorithm, "sha-256") {
+				continue
+			}
+			// Content-Digest wraps the value in colons.
+			encoded = strings.Trim(encoded, ":")
+			if sum, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+				return sum, true
+			}
+		}
+	}
+	return nil, false
+}
+
 func repositoryRawFileEndpoint(repo RepoRevision, pathInRepo string) string {
 	p := path.Join(repo.RepoName+"@"+repo.Commit, "-", "raw")
 	if pathInRepo != "" {
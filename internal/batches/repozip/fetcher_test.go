@@ -3,6 +3,8 @@ package repozip
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -15,6 +17,7 @@ import (
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
 
 	"github.com/sourcegraph/src-cli/internal/api"
 	"github.com/sourcegraph/src-cli/internal/batches/mock"
@@ -222,6 +225,171 @@ func TestArchive_Ensure(t *testing.T) {
 		}
 	})
 
+	fetchRetryInterval = 0
+	t.Cleanup(func() { fetchRetryInterval = defaultFetchRetryInterval })
+
+	t.Run("incomplete download", func(t *testing.T) {
+		mux := mock.NewZipArchivesMux(t, nil, archive)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", "/"+repo.RepoName+"@"+repo.Commit+"/-/raw", nil))
+		zipData := rec.Body.Bytes()
+		sum := sha256.Sum256(zipData)
+		digest := "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+
+		tests := map[string]struct {
+			// serve writes the response to the request with the given
+			// number, starting at 1.
+			serve        func(w http.ResponseWriter, n int)
+			wantErr      bool
+			wantRequests int
+		}{
+			"matching digest": {
+				serve: func(w http.ResponseWriter, n int) {
+					w.Header().Set("Content-Digest", digest)
+					w.Write(zipData)
+				},
+				wantRequests: 1,
+			},
+			"retried after wrong digest": {
+				serve: func(w http.ResponseWriter, n int) {
+					if n == 1 {
+						w.Header().Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString([]byte("wrong")))
+					}
+					w.Write(zipData)
+				},
+				wantRequests: 2,
+			},
+			"truncated archive": {
+				serve: func(w http.ResponseWriter, n int) {
+					w.Write(zipData[:len(zipData)/2])
+				},
+				wantErr:      true,
+				wantRequests: DefaultFetchAttempts,
+			},
+		}
+
+		for name, tc := range tests {
+			t.Run(name, func(t *testing.T) {
+				requests := 0
+				ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					requests++
+					tc.serve(w, requests)
+				}))
+				defer ts.Close()
+
+				var clientBuffer bytes.Buffer
+				u, _ := url.ParseRequestURI(ts.URL)
+				client := api.NewClient(api.ClientOpts{EndpointURL: u, Out: &clientBuffer})
+
+				rf := &archiveRegistry{
+					client: client,
+					dir:    t.TempDir(),
+				}
+				zip := rf.Checkout(repo, "")
+				err := zip.Ensure(context.Background())
+				if tc.wantErr {
+					if !errors.Is(err, errIncompleteDownload) {
+						t.Errorf("wrong error: %v", err)
+					}
+					ok, err := dirContains(rf.dir, filepath.Base(zip.Path()))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if ok {
+						t.Errorf("incomplete zip file was not cleaned up")
+					}
+				} else if err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+				if requests != tc.wantRequests {
+					t.Errorf("wrong number of requests. want=%d, have=%d", tc.wantRequests, requests)
+				}
+			})
+		}
+	})
+
+	t.Run("transient errors", func(t *testing.T) {
+		mux := mock.NewZipArchivesMux(t, nil, archive)
+
+		tests := map[string]struct {
+			// status is the HTTP status of the responses to the requests with
+			// the given numbers, starting at 1. Other requests are served by
+			// mux.
+			status        map[int]int
+			fetchAttempts int
+			wantErr       string
+			wantRequests  int
+			wantRetries   []int
+		}{
+			"retried after server error": {
+				status:       map[int]int{1: http.StatusBadGateway, 2: http.StatusTooManyRequests},
+				wantRequests: 3,
+				wantRetries:  []int{2, 3},
+			},
+			"giving up": {
+				status:       map[int]int{1: http.StatusServiceUnavailable, 2: http.StatusServiceUnavailable, 3: http.StatusServiceUnavailable},
+				wantErr:      "giving up after 3 attempts: unable to fetch archive (HTTP 503",
+				wantRequests: 3,
+				wantRetries:  []int{2, 3},
+			},
+			"configured attempts": {
+				status:        map[int]int{1: http.StatusInternalServerError},
+				fetchAttempts: 1,
+				wantErr:       "unable to fetch archive (HTTP 500",
+				wantRequests:  1,
+			},
+			"not found": {
+				status:       map[int]int{1: http.StatusNotFound},
+				wantErr:      "failed to download repository archive: not found",
+				wantRequests: 1,
+			},
+			"unauthorized": {
+				status:       map[int]int{1: http.StatusUnauthorized},
+				wantErr:      "check that the access token is valid",
+				wantRequests: 1,
+			},
+		}
+
+		for name, tc := range tests {
+			t.Run(name, func(t *testing.T) {
+				requests := 0
+				ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					requests++
+					if status, ok := tc.status[requests]; ok {
+						w.WriteHeader(status)
+						return
+					}
+					mux.ServeHTTP(w, r)
+				}))
+				defer ts.Close()
+
+				var clientBuffer bytes.Buffer
+				u, _ := url.ParseRequestURI(ts.URL)
+				client := api.NewClient(api.ClientOpts{EndpointURL: u, Out: &clientBuffer})
+
+				rf := NewArchiveRegistryWithAttempts(client, t.TempDir(), false, tc.fetchAttempts)
+				var retries []int
+				ctx := WithFetchRetryFunc(context.Background(), func(attempt int, err error) {
+					retries = append(retries, attempt)
+				})
+				err := rf.Checkout(repo, "").Ensure(ctx)
+				if tc.wantErr == "" {
+					if err != nil {
+						t.Errorf("unexpected error: %s", err)
+					}
+				} else if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("wrong error. want=%q, have=%v", tc.wantErr, err)
+				}
+				if requests != tc.wantRequests {
+					t.Errorf("wrong number of requests. want=%d, have=%d", tc.wantRequests, requests)
+				}
+				if diff := cmp.Diff(tc.wantRetries, retries); diff != "" {
+					t.Errorf("wrong retries (-want +got):\n%s", diff)
+				}
+			})
+		}
+	})
+
 	t.Run("path in repository", func(t *testing.T) {
 		additionalFiles := mock.MockRepoAdditionalFiles{
 			RepoName: repo.RepoName,
@@ -0,0 +1,58 @@
+package service
+
+import (
+	"regexp"
+	"strings"
+
+	batcheslib "github.com/sourcegraph/sourcegraph/lib/batches"
+	"github.com/sourcegraph/sourcegraph/lib/batches/git"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+)
+
+// envVarPattern matches the references to environment variables in a
+// changeset template, such as ${env:CI_PIPELINE_ID}. The syntax is distinct
+// from the ${{ }} templating, which is rendered for every workspace, since
+// the variables are expanded once, from the environment of src.
+var envVarPattern = regexp.MustCompile(`\$\{env:([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ExpandChangesetTemplateEnv replaces the references to environment variables
+// in the title, body, branch and commit message of tmpl with their values
+// returned by lookup. Variables that aren't set are validation errors, so that
+// a typo doesn't end up in the changesets of every repository.
+//
+// ParseBatchSpec doesn't validate branches with references to environment
+// variables, so the expanded branch is validated here instead, unless it's
+// still templated.
+func ExpandChangesetTemplateEnv(tmpl *batcheslib.ChangesetTemplate, lookup func(string) (string, bool)) error {
+	if tmpl == nil {
+		return nil
+	}
+
+	var errs errors.MultiError
+	expand := func(field string, value *string) {
+		*value = envVarPattern.ReplaceAllStringFunc(*value, func(ref string) string {
+			name := envVarPattern.FindStringSubmatch(ref)[1]
+			v, ok := lookup(name)
+			if !ok {
+				errs = errors.Append(errs, batcheslib.NewValidationError(errors.Newf("changesetTemplate.%s: environment variable %s is not set", field, name)))
+			}
+			return v
+		})
+	}
+	expand("title", &tmpl.Title)
+	expand("body", &tmpl.Body)
+	if envVarPattern.MatchString(tmpl.Branch) {
+		expand("branch", &tmpl.Branch)
+		if !strings.Contains(tmpl.Branch, "${{") {
+			if err := git.ValidateBranchName(tmpl.Branch); err != nil {
+				errs = errors.Append(errs, batcheslib.NewValidationError(errors.Wrap(err, "changesetTemplate.branch")))
+			}
+		}
+	}
+	expand("commit.message", &tmpl.Commit.Message)
+
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -20,6 +21,7 @@ import (
 	"github.com/sourcegraph/src-cli/internal/batches/docker"
 	"github.com/sourcegraph/src-cli/internal/batches/executor"
 	"github.com/sourcegraph/src-cli/internal/batches/graphql"
+	"github.com/sourcegraph/src-cli/internal/batches/util"
 )
 
 type Service struct {
@@ -474,6 +476,71 @@ func (e *duplicateBranchesErr) Error() string {
 	return out.String()
 }
 
+// CheckChangesetTitles returns a *DuplicateTitlesErr if changeset specs in
+// different repositories, or on different branches, have the same title,
+// which usually means that the title template of the batch spec is too
+// generic to tell the changesets apart. Imported changesets are ignored.
+func (svc *Service) CheckChangesetTitles(repos []*graphql.Repository, specs []*batcheslib.ChangesetSpec) error {
+	repoByID := make(map[string]*graphql.Repository, len(repos))
+	for _, repo := range repos {
+		repoByID[repo.ID] = repo
+	}
+
+	var titles []string
+	reposByTitle := make(map[string][]string)
+	for _, spec := range specs {
+		if spec.Type() == batcheslib.ChangesetSpecDescriptionTypeExisting {
+			continue
+		}
+		name := spec.HeadRepository
+		if repo, ok := repoByID[spec.HeadRepository]; ok {
+			name = repo.Name
+		}
+		if _, ok := reposByTitle[spec.Title]; !ok {
+			titles = append(titles, spec.Title)
+		}
+		reposByTitle[spec.Title] = append(reposByTitle[spec.Title], name)
+	}
+
+	var duplicates []DuplicateTitle
+	for _, title := range titles {
+		if repos := reposByTitle[title]; len(repos) > 1 {
+			duplicates = append(duplicates, DuplicateTitle{Title: title, Repositories: repos})
+		}
+	}
+	if len(duplicates) > 0 {
+		return &DuplicateTitlesErr{Duplicates: duplicates}
+	}
+	return nil
+}
+
+// DuplicateTitle is a title that's shared by the changeset specs of the given
+// repositories. A repository is listed once per changeset spec.
+type DuplicateTitle struct {
+	Title        string
+	Repositories []string
+}
+
+// DuplicateTitlesErr is returned by CheckChangesetTitles, with the titles in
+// the order of the changeset specs.
+type DuplicateTitlesErr struct {
+	Duplicates []DuplicateTitle
+}
+
+func (e *DuplicateTitlesErr) Error() string {
+	var out strings.Builder
+
+	fmt.Fprintf(&out, "Multiple changeset specs have the same title:\n\n")
+
+	for _, d := range e.Duplicates {
+		fmt.Fprintf(&out, "\t* %q: %s\n", d.Title, strings.Join(d.Repositories, ", "))
+	}
+
+	fmt.Fprint(&out, "\nMake sure that the changesetTemplate.title field in the batch spec produces a unique title for each changeset and rerun this command.")
+
+	return out.String()
+}
+
 func (svc *Service) ParseBatchSpec(dir string, data []byte) (*batcheslib.BatchSpec, error) {
 	spec, err := batcheslib.ParseBatchSpec(data)
 	if err != nil {
@@ -485,6 +552,19 @@ func (svc *Service) ParseBatchSpec(dir string, data []byte) (*batcheslib.BatchSp
 	return spec, nil
 }
 
+// ParseSteps parses and validates steps given separately from a batch spec, see
+// batcheslib.ParseSteps. The mounts of the steps are relative to dir.
+func (svc *Service) ParseSteps(dir string, r io.Reader) ([]batcheslib.Step, *batcheslib.ChangesetTemplate, error) {
+	steps, changesetTemplate, err := batcheslib.ParseSteps(r)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "parsing steps")
+	}
+	if err = validateMount(dir, &batcheslib.BatchSpec{Steps: steps}); err != nil {
+		return nil, nil, errors.Wrap(err, "handling mount")
+	}
+	return steps, changesetTemplate, nil
+}
+
 func validateMount(batchSpecDir string, spec *batcheslib.BatchSpec) error {
 	// Check if any step has mounts before opening the root directory.
 	hasMounts := false
@@ -688,6 +768,12 @@ query Repository($name: String!, $queryCommit: Boolean!, $rev: String!) {
 }
 ` + graphql.RepositoryFieldsFragment
 
+// ResolveRepository resolves the name of a repository on the Sourcegraph
+// instance, and returns an error if it doesn't exist.
+func (svc *Service) ResolveRepository(ctx context.Context, name string) (*graphql.Repository, error) {
+	return svc.resolveRepositoryName(ctx, name)
+}
+
 func (svc *Service) resolveRepositoryName(ctx context.Context, name string) (*graphql.Repository, error) {
 	var result struct{ Repository *graphql.Repository }
 	if ok, err := svc.client.NewRequest(repositoryNameQuery, map[string]any{
@@ -703,6 +789,56 @@ func (svc *Service) resolveRepositoryName(ctx context.Context, name string) (*gr
 	return result.Repository, nil
 }
 
+// ResolveHeadBranches makes the tasks run on the existing head branch of their
+// changeset, if the branch exists on the Sourcegraph instance, so that the
+// changes are committed on top of it. Tasks whose branch doesn't exist yet keep
+// running on their base branch. It's used if the changeset template has
+// updateBranch set.
+func (svc *Service) ResolveHeadBranches(ctx context.Context, tmpl *batcheslib.ChangesetTemplate, tasks []*executor.Task) error {
+	// Tasks in the same repository often share the head branch.
+	heads := make(map[[2]string]graphql.Target)
+	for _, task := range tasks {
+		repo := task.Repository
+		branch, err := batcheslib.RenderHeadBranch(tmpl, task.BatchChangeAttributes, batcheslib.Repository{
+			Name:        repo.Name,
+			BaseRef:     repo.BaseRef(),
+			FileMatches: repo.SortedFileMatches(),
+		})
+		if err != nil {
+			return errors.Wrapf(err, "rendering head branch for %s", repo.Name)
+		}
+
+		key := [2]string{repo.Name, branch}
+		head, ok := heads[key]
+		if !ok {
+			var result struct{ Repository *graphql.Repository }
+			if ok, err := svc.client.NewRequest(repositoryNameQuery, map[string]any{
+				"name":        repo.Name,
+				"queryCommit": true,
+				"rev":         util.EnsureRefPrefix(branch),
+			}).Do(ctx, &result); err != nil {
+				return errors.Wrapf(err, "resolving head branch %s of %s", branch, repo.Name)
+			} else if !ok {
+				return nil
+			}
+			if result.Repository != nil {
+				head = result.Repository.Commit
+			}
+			heads[key] = head
+		}
+		if head.OID == "" {
+			continue
+		}
+
+		// The base ref stays the same, only the revision the steps run on
+		// and the changes are committed on top of changes.
+		headRepo := *repo
+		headRepo.Branch = graphql.Branch{Name: strings.TrimPrefix(repo.BaseRef(), "refs/heads/"), Target: head}
+		task.Repository = &headRepo
+	}
+	return nil
+}
+
 func getGitConfig(attribute string) (string, error) {
 	cmd := exec.Command("git", "config", "--get", attribute)
 	out, err := cmd.CombinedOutput()
@@ -10,13 +10,17 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	testifymock "github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 
 	"github.com/sourcegraph/sourcegraph/lib/errors"
 
 	batcheslib "github.com/sourcegraph/sourcegraph/lib/batches"
+	templatelib "github.com/sourcegraph/sourcegraph/lib/batches/template"
 
+	mockclient "github.com/sourcegraph/src-cli/internal/api/mock"
 	"github.com/sourcegraph/src-cli/internal/batches/docker"
+	"github.com/sourcegraph/src-cli/internal/batches/executor"
 	"github.com/sourcegraph/src-cli/internal/batches/graphql"
 	"github.com/sourcegraph/src-cli/internal/batches/mock"
 )
@@ -265,6 +269,28 @@ some-new-field: Foo bar
 `,
 			expectedErr: errors.New("parsing batch spec: Additional property some-new-field is not allowed"),
 		},
+		{
+			name: "update branch with groups",
+			rawSpec: `
+name: test-spec
+description: A test spec
+steps:
+  - run: echo "hello"
+    container: alpine:3
+changesetTemplate:
+  title: Test
+  body: Test
+  branch: test
+  commit:
+    message: Test
+  updateBranch: true
+transformChanges:
+  group:
+    - directory: sub
+      branch: test-sub
+`,
+			expectedErr: errors.New("parsing batch spec: changesetTemplate.updateBranch can't be combined with transformChanges.group"),
+		},
 		{
 			name: "supported version",
 			rawSpec: `
@@ -284,6 +310,128 @@ description: A test spec
 `,
 			expectedErr: errors.New("parsing batch spec: version: version must be one of the following: 1, 2, 3"),
 		},
+		{
+			name: "unsupported step network",
+			rawSpec: `
+name: test-spec
+description: A test spec
+steps:
+  - run: echo "hello"
+    container: alpine:3
+    network: host
+`,
+			expectedErr: errors.New("parsing batch spec: steps.0.network: steps.0.network must be one of the following: \"default\", \"none\""),
+		},
+		{
+			name: "step with command",
+			rawSpec: `
+name: test-spec
+description: A test spec
+steps:
+  - command: ["comby", "-in-place", "foo", "bar", ".go"]
+    container: comby/comby
+changesetTemplate:
+  title: Test Command
+  body: Test a step with a command
+  branch: test
+  commit:
+    message: Test
+`,
+			expectedSpec: &batcheslib.BatchSpec{
+				Name:        "test-spec",
+				Description: "A test spec",
+				Steps: []batcheslib.Step{
+					{
+						Command:   []string{"comby", "-in-place", "foo", "bar", ".go"},
+						Container: "comby/comby",
+					},
+				},
+				ChangesetTemplate: &batcheslib.ChangesetTemplate{
+					Title:  "Test Command",
+					Body:   "Test a step with a command",
+					Branch: "test",
+					Commit: batcheslib.ExpandedGitCommitDescription{
+						Message: "Test",
+					},
+				},
+			},
+		},
+		{
+			name: "step with run and command",
+			rawSpec: `
+name: test-spec
+description: A test spec
+steps:
+  - run: echo "hello"
+    command: ["echo", "hello"]
+    container: alpine:3
+`,
+			expectedErr: errors.New("parsing batch spec: steps.0: Must validate one and only one schema (oneOf)"),
+		},
+		{
+			name: "step without run or command",
+			rawSpec: `
+name: test-spec
+description: A test spec
+steps:
+  - container: alpine:3
+`,
+			expectedErr: errors.New("parsing batch spec: 2 errors occurred:\n\t* steps.0: Must validate one and only one schema (oneOf)\n\t* steps.0: run is required"),
+		},
+		{
+			name: "invalid step memory limit",
+			rawSpec: `
+name: test-spec
+description: A test spec
+steps:
+  - run: echo "hello"
+    container: alpine:3
+    memory: 512 megabytes
+`,
+			expectedErr: errors.New("parsing batch spec: steps.0.memory: Does not match pattern '^[0-9]+[bkmgBKMG]?$'"),
+		},
+		{
+			name: "step file outside of the workspace",
+			rawSpec: `
+name: test-spec
+description: A test spec
+steps:
+  - run: cat ../config.json
+    container: alpine:3
+    files:
+      ../config.json: "{}"
+changesetTemplate:
+  title: Test Files
+  body: Test a file outside of the workspace
+  branch: test
+  commit:
+    message: Test
+`,
+			expectedErr: errors.New("parsing batch spec: step 1 files path \"../config.json\" must be absolute, or a relative path inside the workspace"),
+		},
+		{
+			name: "step commit with transformChanges",
+			rawSpec: `
+name: test-spec
+description: A test spec
+steps:
+  - run: gofmt -w .
+    container: golang:1
+    commit:
+      message: Format code
+transformChanges:
+  group:
+    - directory: docs
+      branch: docs
+changesetTemplate:
+  title: Test Commits
+  body: Test a step commit
+  branch: test
+  commit:
+    message: Test
+`,
+			expectedErr: errors.New("parsing batch spec: transformChanges can't be used with steps that set a commit"),
+		},
 		{
 			name:         "mount absolute file",
 			batchSpecDir: tempDir,
@@ -614,6 +762,25 @@ changesetTemplate:
 `,
 			expectedErr: errors.New("parsing batch spec: step 1 files target path contains invalid characters"),
 		},
+		{
+			name:         "invalid step timeout",
+			batchSpecDir: tempDir,
+			rawSpec: `
+name: test-spec
+description: A test spec
+steps:
+  - run: echo "hello"
+    container: alpine:3
+    timeout: -5m
+changesetTemplate:
+  title: Test Timeout
+  body: Test an invalid step timeout
+  branch: test
+  commit:
+    message: Test
+`,
+			expectedErr: errors.New(`parsing batch spec: step 1 has an invalid timeout: timeout "-5m" must be positive`),
+		},
 		{
 			name:         "mount path dot-dot traversal",
 			batchSpecDir: tempDir,
@@ -635,6 +802,26 @@ changesetTemplate:
 `,
 			expectedErr: errors.New("handling mount: step 1 mount path is not in the same directory or subdirectory as the batch spec"),
 		},
+		{
+			name: "invalid changesetTemplate",
+			rawSpec: `
+name: test-spec
+description: A test spec
+steps:
+  - run: echo "hello"
+    container: alpine:3
+changesetTemplate:
+  title: ${{ repository.nam }
+  body: ${{ unknown_variable }}
+  branch: feature..branch
+  commit:
+    message: Test
+`,
+			expectedErr: errors.New("parsing batch spec: 3 errors occurred:\n" +
+				"\t* parsing changeset template field \"body\": template: body:1: function \"unknown_variable\" not defined\n" +
+				"\t* parsing changeset template field \"title\": template: title:1: unexpected \"}\" in operand\n" +
+				"\t* changesetTemplate.branch: branch name \"feature..branch\" cannot contain \"..\", \"//\" or \"@{\""),
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -648,3 +835,254 @@ changesetTemplate:
 		})
 	}
 }
+
+func TestService_ResolveHeadBranches(t *testing.T) {
+	client := new(mockclient.Client)
+	svc := &Service{client: client}
+
+	existing := &mockclient.Request{Response: `{"repository":{"commit":{"oid":"h34db33f"}}}`}
+	existing.On("Do", testifymock.Anything, testifymock.Anything).Return(true, nil).Once()
+	client.On("NewRequest", testifymock.Anything, map[string]any{
+		"name":        "github.com/sourcegraph/src-cli",
+		"queryCommit": true,
+		"rev":         "refs/heads/update-my-batch-change",
+	}).Return(existing).Once()
+
+	missing := &mockclient.Request{Response: `{"repository":{"commit":null}}`}
+	missing.On("Do", testifymock.Anything, testifymock.Anything).Return(true, nil).Once()
+	client.On("NewRequest", testifymock.Anything, map[string]any{
+		"name":        "github.com/sourcegraph/sourcegraph",
+		"queryCommit": true,
+		"rev":         "refs/heads/update-my-batch-change",
+	}).Return(missing).Once()
+
+	attrs := &templatelib.BatchChangeAttributes{Name: "my-batch-change"}
+	srcCLI := &graphql.Repository{
+		Name:          "github.com/sourcegraph/src-cli",
+		DefaultBranch: &graphql.Branch{Name: "main", Target: graphql.Target{OID: "d34db33f"}},
+	}
+	sourcegraph := &graphql.Repository{
+		Name:          "github.com/sourcegraph/sourcegraph",
+		DefaultBranch: &graphql.Branch{Name: "main", Target: graphql.Target{OID: "f00b4r3r"}},
+	}
+	tasks := []*executor.Task{
+		{Repository: srcCLI, BatchChangeAttributes: attrs},
+		// The head branch is only resolved once per repository.
+		{Repository: srcCLI, Path: "sub", BatchChangeAttributes: attrs},
+		{Repository: sourcegraph, BatchChangeAttributes: attrs},
+	}
+
+	tmpl := &batcheslib.ChangesetTemplate{Branch: "update-${{ batch_change.name }}", UpdateBranch: true}
+	require.NoError(t, svc.ResolveHeadBranches(context.Background(), tmpl, tasks))
+
+	for _, task := range tasks[:2] {
+		assert.Equal(t, "refs/heads/main", task.Repository.BaseRef())
+		assert.Equal(t, "h34db33f", task.Repository.Rev())
+	}
+	assert.Same(t, sourcegraph, tasks[2].Repository)
+	assert.Equal(t, "d34db33f", srcCLI.Rev(), "repository shared with other tasks was modified")
+	client.AssertExpectations(t)
+}
+
+func TestService_ParseSteps(t *testing.T) {
+	svc := &Service{}
+
+	tests := []struct {
+		name                      string
+		rawSteps                  string
+		expectedSteps             []batcheslib.Step
+		expectedChangesetTemplate *batcheslib.ChangesetTemplate
+		expectedErr               error
+	}{
+		{
+			name: "list of steps",
+			rawSteps: `
+- run: echo foo
+  container: alpine:3
+`,
+			expectedSteps: []batcheslib.Step{{Run: "echo foo", Container: "alpine:3"}},
+		},
+		{
+			name:          "JSON",
+			rawSteps:      `[{"run": "echo foo", "container": "alpine:3"}]`,
+			expectedSteps: []batcheslib.Step{{Run: "echo foo", Container: "alpine:3"}},
+		},
+		{
+			name: "steps and changeset template",
+			rawSteps: `
+steps:
+  - run: echo foo
+    container: alpine:3
+changesetTemplate:
+  title: Test
+  branch: test
+  commit:
+    message: Test
+`,
+			expectedSteps: []batcheslib.Step{{Run: "echo foo", Container: "alpine:3"}},
+			expectedChangesetTemplate: &batcheslib.ChangesetTemplate{
+				Title:  "Test",
+				Branch: "test",
+				Commit: batcheslib.ExpandedGitCommitDescription{Message: "Test"},
+			},
+		},
+		{
+			name:        "unknown field",
+			rawSteps:    "name: test\nsteps: []\n",
+			expectedErr: errors.New("parsing steps: unknown field \"name\": only steps and changesetTemplate can be given"),
+		},
+		{
+			name:        "invalid YAML",
+			rawSteps:    "- run: echo foo\n\tcontainer: alpine:3\n",
+			expectedErr: errors.New("parsing steps: yaml: line 2: found a tab character that violates indentation"),
+		},
+		{
+			name:        "invalid step",
+			rawSteps:    "- run: echo foo\n",
+			expectedErr: errors.New("parsing steps: steps.0: container is required"),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			steps, changesetTemplate, err := svc.ParseSteps(t.TempDir(), strings.NewReader(test.rawSteps))
+			if test.expectedErr != nil {
+				assert.Equal(t, test.expectedErr.Error(), err.Error())
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, test.expectedSteps, steps)
+				assert.Equal(t, test.expectedChangesetTemplate, changesetTemplate)
+			}
+		})
+	}
+}
+
+func TestExpandChangesetTemplateEnv(t *testing.T) {
+	env := map[string]string{"CI_PIPELINE_ID": "1234", "TEAM": "search"}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	t.Run("set variables", func(t *testing.T) {
+		tmpl := &batcheslib.ChangesetTemplate{
+			Title:  "Pipeline ${env:CI_PIPELINE_ID}: update ${{ repository.name }}",
+			Body:   "Owned by ${env:TEAM}, see ${HOME} and ${{ batch_change_link }}",
+			Branch: "${env:TEAM}/update",
+			Commit: batcheslib.ExpandedGitCommitDescription{Message: "Update (${env:CI_PIPELINE_ID})"},
+		}
+		require.NoError(t, ExpandChangesetTemplateEnv(tmpl, lookup))
+		assert.Equal(t, &batcheslib.ChangesetTemplate{
+			Title:  "Pipeline 1234: update ${{ repository.name }}",
+			Body:   "Owned by search, see ${HOME} and ${{ batch_change_link }}",
+			Branch: "search/update",
+			Commit: batcheslib.ExpandedGitCommitDescription{Message: "Update (1234)"},
+		}, tmpl)
+	})
+
+	t.Run("unset variables", func(t *testing.T) {
+		tmpl := &batcheslib.ChangesetTemplate{
+			Title: "Pipeline ${env:CI_PIPELNE_ID}",
+			Body:  "Owned by ${env:TEAM} and ${env:OWNER}",
+		}
+		err := ExpandChangesetTemplateEnv(tmpl, lookup)
+		var multiErr errors.MultiError
+		require.True(t, errors.As(err, &multiErr))
+		require.Len(t, multiErr.Errors(), 2)
+		assert.ErrorContains(t, multiErr.Errors()[0], "changesetTemplate.title: environment variable CI_PIPELNE_ID is not set")
+		assert.ErrorContains(t, multiErr.Errors()[1], "changesetTemplate.body: environment variable OWNER is not set")
+	})
+
+	t.Run("no changeset template", func(t *testing.T) {
+		require.NoError(t, ExpandChangesetTemplateEnv(nil, lookup))
+	})
+
+	t.Run("parsed branch", func(t *testing.T) {
+		parse := func(branch string) *batcheslib.BatchSpec {
+			spec, err := batcheslib.ParseBatchSpec([]byte(fmt.Sprintf(`
+name: test
+on:
+  - repository: github.com/sourcegraph/src-cli
+steps:
+  - run: echo
+    container: alpine:3
+changesetTemplate:
+  title: Test
+  body: Test
+  branch: %q
+  commit:
+    message: Test
+`, branch)))
+			require.NoError(t, err)
+			return spec
+		}
+
+		spec := parse("fix-${env:CI_PIPELINE_ID}")
+		require.NoError(t, ExpandChangesetTemplateEnv(spec.ChangesetTemplate, lookup))
+		assert.Equal(t, "fix-1234", spec.ChangesetTemplate.Branch)
+
+		spec = parse("${env:TEAM}/${{ repository.name }}")
+		require.NoError(t, ExpandChangesetTemplateEnv(spec.ChangesetTemplate, lookup))
+		assert.Equal(t, "search/${{ repository.name }}", spec.ChangesetTemplate.Branch)
+
+		// The expanded branch is still validated.
+		env["TEAM"] = "search team"
+		defer func() { env["TEAM"] = "search" }()
+		spec = parse("${env:TEAM}/update")
+		err := ExpandChangesetTemplateEnv(spec.ChangesetTemplate, lookup)
+		assert.ErrorContains(t, err, "changesetTemplate.branch")
+	})
+}
+
+func TestValidateStepImages(t *testing.T) {
+	spec := &batcheslib.BatchSpec{
+		Steps: []batcheslib.Step{
+			{Container: "alpine:3"},
+			{Container: "sourcegraph/Comby"},
+			{Container: "ghcr.io/sourcegraph/comby:1.8.1"},
+			{Container: ""},
+		},
+		Finally: []batcheslib.Step{{Container: "alpine 3"}},
+	}
+	err := ValidateStepImages(spec)
+	var multiErr errors.MultiError
+	require.True(t, errors.As(err, &multiErr))
+	require.Len(t, multiErr.Errors(), 3)
+	assert.ErrorContains(t, multiErr.Errors()[0], `step 2 has an invalid container: invalid image reference "sourcegraph/Comby": repository names must be lowercase`)
+	assert.ErrorContains(t, multiErr.Errors()[1], "step 4 has an invalid container: no image given")
+	assert.ErrorContains(t, multiErr.Errors()[2], `finally step 1 has an invalid container: invalid image reference "alpine 3"`)
+
+	require.NoError(t, ValidateStepImages(&batcheslib.BatchSpec{Steps: spec.Steps[:1]}))
+}
+
+func TestService_CheckChangesetTitles(t *testing.T) {
+	repo1 := &graphql.Repository{ID: "repo-graphql-id-1", Name: "github.com/sourcegraph/src-cli"}
+	repo2 := &graphql.Repository{ID: "repo-graphql-id-2", Name: "github.com/sourcegraph/sourcegraph"}
+	repo3 := &graphql.Repository{ID: "repo-graphql-id-3", Name: "github.com/sourcegraph/conc"}
+	repos := []*graphql.Repository{repo1, repo2, repo3}
+
+	svc := &Service{}
+
+	t.Run("unique titles", func(t *testing.T) {
+		err := svc.CheckChangesetTitles(repos, []*batcheslib.ChangesetSpec{
+			{HeadRepository: repo1.ID, HeadRef: "refs/heads/branch-1", Title: "Bump src-cli"},
+			{HeadRepository: repo2.ID, HeadRef: "refs/heads/branch-1", Title: "Bump sourcegraph"},
+			// Imported changesets don't have a title.
+			{BaseRepository: repo1.ID, ExternalID: "123"},
+			{BaseRepository: repo2.ID, ExternalID: "456"},
+		})
+		assert.NoError(t, err)
+	})
+
+	t.Run("duplicate titles", func(t *testing.T) {
+		err := svc.CheckChangesetTitles(repos, []*batcheslib.ChangesetSpec{
+			{HeadRepository: repo1.ID, HeadRef: "refs/heads/branch-1", Title: "Bump lib"},
+			{HeadRepository: repo2.ID, HeadRef: "refs/heads/branch-1", Title: "Bump sourcegraph"},
+			{HeadRepository: repo3.ID, HeadRef: "refs/heads/branch-1", Title: "Bump lib"},
+			{HeadRepository: repo1.ID, HeadRef: "refs/heads/branch-2", Title: "Bump lib"},
+		})
+		var dupErr *DuplicateTitlesErr
+		require.True(t, errors.As(err, &dupErr), "wrong error: %v", err)
+		assert.Equal(t, []DuplicateTitle{{Title: "Bump lib", Repositories: []string{repo1.Name, repo3.Name, repo1.Name}}}, dupErr.Duplicates)
+		assert.Contains(t, err.Error(), `"Bump lib": github.com/sourcegraph/src-cli, github.com/sourcegraph/conc, github.com/sourcegraph/src-cli`)
+	})
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"context"
+
+	batcheslib "github.com/sourcegraph/sourcegraph/lib/batches"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+
+	"github.com/sourcegraph/src-cli/internal/batches/docker"
+)
+
+// ValidateStepImages checks that the container of every step and finally step
+// of spec is a well-formed image reference. Invalid ones are validation
+// errors, so that a typo is reported before any image is pulled, rather than
+// as a pull failure in the middle of the run.
+func ValidateStepImages(spec *batcheslib.BatchSpec) error {
+	var errs errors.MultiError
+	validate := func(kind string, steps []batcheslib.Step) {
+		for i, step := range steps {
+			if err := docker.ValidateReference(step.Container); err != nil {
+				errs = errors.Append(errs, batcheslib.NewValidationError(errors.Wrapf(err, "%s %d has an invalid container", kind, i+1)))
+			}
+		}
+	}
+	validate("step", spec.Steps)
+	validate("finally step", spec.Finally)
+
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
+// PinnedImage is an image of the steps of a batch spec, and the reference it
+// was pinned to by PinStepImages.
+type PinnedImage struct {
+	// Reference is the image as the batch spec references it.
+	Reference string `json:"reference"`
+	// Pinned is the reference by digest the steps use instead. It's empty if
+	// the image couldn't be pinned, because it wasn't pulled from a registry.
+	Pinned string `json:"pinned,omitempty"`
+}
+
+// PinStepImages replaces the container of every step and finally step of spec
+// with a reference by digest to the image it refers to locally, so that all
+// steps of the run use the same image even if its tag is moved to another one
+// during the run. Since the steps are part of the cache keys, results that
+// were cached for another image aren't used either.
+//
+// The images have to be pulled already, by EnsureDockerImages. The pinned
+// images are returned in the order they're first used in.
+func PinStepImages(ctx context.Context, spec *batcheslib.BatchSpec) ([]PinnedImage, error) {
+	var pinned []PinnedImage
+	refs := map[string]string{}
+	pin := func(steps []batcheslib.Step) error {
+		for i := range steps {
+			ref := steps[i].Container
+			p, ok := refs[ref]
+			if !ok {
+				var err error
+				if p, err = docker.PinnedReference(ctx, ref); err != nil {
+					return errors.Wrap(err, "pinning image")
+				}
+				refs[ref] = p
+				pinned = append(pinned, PinnedImage{Reference: ref, Pinned: p})
+			}
+			if p != "" {
+				steps[i].Container = p
+			}
+		}
+		return nil
+	}
+	if err := pin(spec.Steps); err != nil {
+		return nil, err
+	}
+	if err := pin(spec.Finally); err != nil {
+		return nil, err
+	}
+	return pinned, nil
+}
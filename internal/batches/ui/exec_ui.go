@@ -1,16 +1,23 @@
 package ui
 
 import (
+	"io"
+
 	"github.com/sourcegraph/src-cli/internal/batches"
 	"github.com/sourcegraph/src-cli/internal/batches/executor"
 	"github.com/sourcegraph/src-cli/internal/batches/graphql"
+	"github.com/sourcegraph/src-cli/internal/batches/service"
 	"github.com/sourcegraph/src-cli/internal/batches/workspace"
 )
 
 type ExecUI interface {
+	FeatureFlags(ffs *batches.FeatureFlags)
+	CacheDirectory(dir string)
+
 	ParsingBatchSpec()
 	ParsingBatchSpecSuccess()
 	ParsingBatchSpecFailure(error)
+	StepLintFindings(findings []executor.LintFinding)
 
 	ResolvingNamespace()
 	ResolvingNamespaceSuccess(namespace string)
@@ -19,19 +26,49 @@ type ExecUI interface {
 	PreparingContainerImagesProgress(done, total int)
 	PreparingContainerImagesSuccess()
 
+	LocalRunnerWarning()
+
 	DeterminingWorkspaceCreatorType()
 	DeterminingWorkspaceCreatorTypeSuccess(wt workspace.CreatorType)
 
 	DeterminingWorkspaces()
 	DeterminingWorkspacesSuccess(workspacesCount, reposCount int, unsupported batches.UnsupportedRepoSet, ignored batches.IgnoredRepoSet)
 
+	FilteringTasksSuccess(tasksCount, skippedCount int)
+	// ListedReposNotFound is called with the repositories listed in
+	// -only-repos or in the -repo-list file that have no workspaces.
+	ListedReposNotFound(repos []string)
+	TasksLimited(maxTasks, droppedCount int)
+
 	CheckingCache()
+	// TaskCached is called for every Task that's completely served from the
+	// cache while checking it, with the number of changeset specs found.
+	TaskCached(task *executor.Task, specs int)
 	CheckingCacheSuccess(cachedSpecsFound int, tasksToExecute int)
+	CacheStats(stats executor.CacheStats)
+	// CacheMisses explains why Tasks weren't served from the cache, compared
+	// to an earlier run.
+	CacheMisses(misses []executor.CacheMiss)
 
 	ExecutingTasks(verbose bool, parallelism int) executor.TaskExecutionUI
+	ParallelismWarning(err error)
 	ExecutingTasksSkippingErrors(err error)
+	TasksBelowMinChangedLines(filteredCount, minChangedLines int)
+	RunReport(report executor.RunReport)
+	// HTMLReportWritten is called with the path of the -html-report file.
+	HTMLReportWritten(path string)
 
 	LogFilesKept(files []string)
+	WorkspacesKept(tasks []*executor.Task)
+	WorkspaceCleanupFailed(tasks []*executor.Task)
+
+	// DuplicateChangesetTitles warns about changeset specs that share a
+	// title.
+	DuplicateChangesetTitles(duplicates []service.DuplicateTitle)
+
+	VerifyingChangesetSpecs(num int)
+	VerifyingChangesetSpecsSuccess()
+	VerifyingChangesetSpecsFailure(err error)
 
 	NoChangesetSpecs()
 	UploadingChangesetSpecs(num int)
@@ -55,3 +92,10 @@ type ExecUI interface {
 
 	DockerWatchDogWarning(error)
 }
+
+// StatusDumper is implemented by TaskExecutionUIs that can render a snapshot
+// of the tasks that are currently being executed, as returned by
+// executor.Coordinator.InFlight.
+type StatusDumper interface {
+	DumpStatus(w io.Writer, inFlight []executor.TaskStatus)
+}
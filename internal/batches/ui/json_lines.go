@@ -14,6 +14,7 @@ import (
 	"github.com/sourcegraph/src-cli/internal/batches"
 	"github.com/sourcegraph/src-cli/internal/batches/executor"
 	"github.com/sourcegraph/src-cli/internal/batches/graphql"
+	"github.com/sourcegraph/src-cli/internal/batches/service"
 	"github.com/sourcegraph/src-cli/internal/batches/workspace"
 
 	batcheslib "github.com/sourcegraph/sourcegraph/lib/batches"
@@ -27,16 +28,31 @@ type JSONLines struct {
 	BinaryDiffs bool
 }
 
+func (ui *JSONLines) CacheDirectory(dir string) {
+	// The cache isn't used in server-side execution, so there's no log event
+	// for it.
+}
+
 func (ui *JSONLines) ParsingBatchSpec() {
 	logOperationStart(batcheslib.LogEventOperationParsingBatchSpec, &batcheslib.ParsingBatchSpecMetadata{})
 }
 func (ui *JSONLines) ParsingBatchSpecSuccess() {
 	logOperationSuccess(batcheslib.LogEventOperationParsingBatchSpec, &batcheslib.ParsingBatchSpecMetadata{})
 }
+func (ui *JSONLines) FeatureFlags(ffs *batches.FeatureFlags) {
+	// In executor mode, the features are determined by the server that
+	// scheduled the execution, so there's no log event for them.
+}
+
 func (ui *JSONLines) ParsingBatchSpecFailure(err error) {
 	logOperationFailure(batcheslib.LogEventOperationParsingBatchSpec, &batcheslib.ParsingBatchSpecMetadata{Error: err.Error()})
 }
 
+func (ui *JSONLines) StepLintFindings(findings []executor.LintFinding) {
+	// Linting steps is a local aid and not used in server-side execution, so
+	// there's no log event for it.
+}
+
 func (ui *JSONLines) ResolvingNamespace() {
 	logOperationStart(batcheslib.LogEventOperationResolvingNamespace, &batcheslib.ResolvingNamespaceMetadata{})
 }
@@ -54,6 +70,10 @@ func (ui *JSONLines) PreparingContainerImagesSuccess() {
 	logOperationSuccess(batcheslib.LogEventOperationPreparingDockerImages, &batcheslib.PreparingDockerImagesMetadata{})
 }
 
+func (ui *JSONLines) LocalRunnerWarning() {
+	// The local runner isn't used in server-side execution.
+}
+
 func (ui *JSONLines) DeterminingWorkspaceCreatorType() {
 	logOperationStart(batcheslib.LogEventOperationDeterminingWorkspaceType, &batcheslib.DeterminingWorkspaceTypeMetadata{})
 }
@@ -80,9 +100,29 @@ func (ui *JSONLines) DeterminingWorkspacesSuccess(workspacesCount, reposCount in
 	})
 }
 
+func (ui *JSONLines) FilteringTasksSuccess(tasksCount, skippedCount int) {
+	// -only-repos is a local debugging aid and not used in server-side
+	// execution, so there's no log event for it.
+}
+
+func (ui *JSONLines) ListedReposNotFound(repos []string) {
+	// -repo-list is a local option like -only-repos, so there's no log event
+	// for it.
+}
+
+func (ui *JSONLines) TasksLimited(maxTasks, droppedCount int) {
+	// -max-workspaces is meant for trying out batch specs locally, so there's
+	// no log event for it.
+}
+
 func (ui *JSONLines) CheckingCache() {
 	logOperationStart(batcheslib.LogEventOperationCheckingCache, &batcheslib.CheckingCacheMetadata{})
 }
+func (ui *JSONLines) TaskCached(task *executor.Task, specs int) {
+	// The cache is checked before the execution events of the tasks, and the
+	// number of cached specs is part of the CheckingCacheSuccess event.
+}
+
 func (ui *JSONLines) CheckingCacheSuccess(cachedSpecsFound int, tasksToExecute int) {
 	logOperationSuccess(batcheslib.LogEventOperationCheckingCache, &batcheslib.CheckingCacheMetadata{
 		CachedSpecsFound: cachedSpecsFound,
@@ -90,6 +130,23 @@ func (ui *JSONLines) CheckingCacheSuccess(cachedSpecsFound int, tasksToExecute i
 	})
 }
 
+func (ui *JSONLines) CacheStats(stats executor.CacheStats) {
+	// The numbers are already part of the CheckingCacheSuccess event.
+}
+
+func (ui *JSONLines) CacheMisses(misses []executor.CacheMiss) {
+	// Cache keys are only recorded when running locally.
+}
+
+func (ui *JSONLines) RunReport(report executor.RunReport) {
+	// The outcomes are already part of the task events.
+}
+
+func (ui *JSONLines) TasksBelowMinChangedLines(filteredCount, minChangedLines int) {
+	// -min-changed-lines isn't used in server-side execution, so there's no
+	// log event for it.
+}
+
 func (ui *JSONLines) ExecutingTasks(_ bool, _ int) executor.TaskExecutionUI {
 	return &taskExecutionJSONLines{
 		binaryDiffs: ui.BinaryDiffs,
@@ -103,12 +160,40 @@ func (ui *JSONLines) ExecutingTasksSkippingErrors(err error) {
 	})
 }
 
+func (ui *JSONLines) HTMLReportWritten(path string) {
+	// The HTML report is meant for reviewing local runs by hand, so there's
+	// no log event for it.
+}
+
 func (ui *JSONLines) LogFilesKept(files []string) {
 	for _, path := range files {
 		logOperationSuccess(batcheslib.LogEventOperationLogFileKept, &batcheslib.LogFileKeptMetadata{Path: path})
 	}
 }
 
+func (ui *JSONLines) WorkspacesKept(tasks []*executor.Task) {
+	// -keep-workspaces isn't used in server-side execution, so there's no
+	// log event for it.
+}
+
+func (ui *JSONLines) WorkspaceCleanupFailed(tasks []*executor.Task) {
+	// The executor cleans up after server-side execution itself, and the
+	// errors are in the log files of the tasks.
+}
+
+func (ui *JSONLines) DuplicateChangesetTitles(duplicates []service.DuplicateTitle) {
+	// The titles are only checked when running locally.
+}
+
+func (ui *JSONLines) VerifyingChangesetSpecs(num int) {
+	// There's no log event for verifying the specs, and failures are part of
+	// the error the command fails with.
+}
+
+func (ui *JSONLines) VerifyingChangesetSpecsSuccess() {}
+
+func (ui *JSONLines) VerifyingChangesetSpecsFailure(err error) {}
+
 func (ui *JSONLines) NoChangesetSpecs() {
 	ui.UploadingChangesetSpecsSuccess([]graphql.ChangesetSpecID{})
 }
@@ -177,6 +262,11 @@ func (ui *JSONLines) WriteAfterStepResult(key string, value execution.AfterStepR
 	})
 }
 
+func (ui *JSONLines) ParallelismWarning(err error) {
+	// Parallelism is controlled by the executor when running server-side, so
+	// there's nothing to warn about.
+}
+
 func (ui *JSONLines) DockerWatchDogWarning(err error) {
 	message := fmt.Sprintf(`It seems your Docker engine might be frozen.
 If there's no progress in the next couple minutes, you may want to try restarting Docker and running the command again.
@@ -259,6 +349,23 @@ func (ui *taskExecutionJSONLines) TaskChangesetSpecsBuilt(task *executor.Task, s
 	logOperationSuccess(batcheslib.LogEventOperationTaskBuildChangesetSpecs, &batcheslib.TaskBuildChangesetSpecsMetadata{TaskID: lt.ID})
 }
 
+func (ui *taskExecutionJSONLines) TaskChangesetSpecsUploadFailed(task *executor.Task, err error) {
+	// Changeset specs aren't uploaded in executor mode.
+}
+
+func (ui *taskExecutionJSONLines) TaskChangesetSpecsFiltered(task *executor.Task, changedLines int) {
+	// MinChangedLines isn't used in executor mode.
+}
+
+func (ui *taskExecutionJSONLines) TaskChangesetSpecsSkipped(task *executor.Task, output string) {
+	// No changeset specs are built for the task, which the server learns
+	// from the step outputs.
+}
+
+func (ui *taskExecutionJSONLines) TaskPhaseTimings(task *executor.Task, durations []executor.PhaseDuration) {
+	// The timings are only logged to the log file of the task.
+}
+
 func (ui *taskExecutionJSONLines) StepsExecutionUI(task *executor.Task) executor.StepsExecutionUI {
 	lt, ok := ui.linesTasks[task]
 	if !ok {
@@ -278,10 +385,17 @@ const stepFlushDuration = 500 * time.Millisecond
 func (ui *stepsExecutionJSONLines) ArchiveDownloadStarted() {
 	// We don't fetch archives in executor mode.
 }
+func (ui *stepsExecutionJSONLines) ArchiveDownloadRetrying(attempt int, err error) {
+	// We don't fetch archives in executor mode.
+}
 func (ui *stepsExecutionJSONLines) ArchiveDownloadFinished(err error) {
 	// We don't fetch archives in executor mode.
 }
 
+func (ui *stepsExecutionJSONLines) WaitingForDisk(size int64) {
+	// The disk usage isn't limited in executor mode.
+}
+
 func (ui *stepsExecutionJSONLines) WorkspaceInitializationStarted() {
 	// No workspace initialization required for executor mode.
 }
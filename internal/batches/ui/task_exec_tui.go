@@ -3,11 +3,15 @@ package ui
 import (
 	"context"
 	"fmt"
+	"io"
 	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/dustin/go-humanize"
+	"github.com/jedib0t/go-pretty/v6/table"
 	"github.com/sourcegraph/go-diff/diff"
 
 	"github.com/sourcegraph/src-cli/internal/batches/executor"
@@ -23,9 +27,84 @@ type taskStatus struct {
 	startedAt          time.Time
 	finishedAt         time.Time
 	currentlyExecuting string
+	// tempDir is the directory the executor picked for the Task, if any.
+	tempDir string
+	// cached is true if execution started from a cached step result.
+	cached bool
+
+	// stepTimings holds the timings of the steps that were executed. Steps
+	// that were skipped, or whose results were cached, aren't included.
+	stepTimings []stepTiming
+	// phaseDurations holds the total duration of each phase of the
+	// execution, if the executor recorded them.
+	phaseDurations []executor.PhaseDuration
 
 	// err is set if executing the Task lead to an error.
 	err error
+	// uploadErr is set if the Task was executed successfully, but uploading
+	// its changeset specs failed.
+	uploadErr error
+	// cleanupErr is set if deleting the workspace of the Task failed, which
+	// doesn't fail the Task.
+	cleanupErr error
+	// filtered is true if no changeset specs were built for the Task because
+	// its diff is below the MinChangedLines threshold.
+	filtered bool
+	// skippedBy is the name of the step output that signalled that no
+	// changeset should be created for the Task, if any.
+	skippedBy string
+
+	// diff is the diff of all commits in the changeset specs built for the
+	// Task.
+	diff []byte
+
+	// pendingMessage is the latest message passed to updateStatus, which
+	// hasn't necessarily been applied to currentlyExecuting yet. queued is
+	// true while the taskStatus is waiting in taskExecTUI.updates.
+	pendingMessage atomic.Pointer[string]
+	queued         atomic.Bool
+}
+
+// Diff returns the diff of all commits in the changeset specs that were built
+// for the Task, or an empty string if none were built yet.
+func (ts *taskStatus) Diff() string {
+	return string(ts.diff)
+}
+
+// changesetSpecsDiff concatenates the diffs of all commits in specs.
+func changesetSpecsDiff(specs []*batcheslib.ChangesetSpec) []byte {
+	var d []byte
+	for _, spec := range specs {
+		for _, commit := range spec.Commits {
+			d = append(d, commit.Diff...)
+		}
+	}
+	return d
+}
+
+type stepTiming struct {
+	step       int
+	container  string
+	startedAt  time.Time
+	finishedAt time.Time
+}
+
+func (st stepTiming) Duration() time.Duration {
+	return st.finishedAt.Sub(st.startedAt).Truncate(time.Millisecond)
+}
+
+// slowestStep returns the timing of the finished step that took the longest,
+// and false if no step has finished.
+func (ts *taskStatus) slowestStep() (slowest stepTiming, found bool) {
+	for _, st := range ts.stepTimings {
+		if st.finishedAt.IsZero() {
+			continue
+		}
+		if !found || st.Duration() > slowest.Duration() {
+			slowest, found = st, true
+		}
+	}
+	return slowest, found
 }
 
 func (ts *taskStatus) FinishedExecution() bool {
@@ -40,12 +119,20 @@ func (ts *taskStatus) String() string {
 	var statusText string
 
 	if ts.FinishedExecution() {
-		if ts.err != nil {
-			if texter, ok := ts.err.(statusTexter); ok {
+		err := ts.err
+		if err == nil {
+			err = ts.uploadErr
+		}
+		if err != nil {
+			if texter, ok := err.(statusTexter); ok {
 				statusText = texter.StatusText()
 			} else {
-				statusText = ts.err.Error()
+				statusText = err.Error()
 			}
+		} else if ts.filtered {
+			statusText = "Filtered (below threshold)"
+		} else if ts.skippedBy != "" {
+			statusText = fmt.Sprintf("Skipped by step (output %s)", ts.skippedBy)
 		} else {
 			statusText = "Done!"
 		}
@@ -105,9 +192,26 @@ type taskExecTUI struct {
 
 	finished int
 	errored  int
+
+	// updates carries the taskStatuses whose message changed to the goroutine
+	// started in Start, which applies them and renders the status bars, so
+	// that executing Tasks don't wait for the lock or for rendering.
+	updates         chan statusUpdate
+	stopUpdates     chan struct{}
+	stopUpdatesOnce sync.Once
+	// updatesStopped is closed when the goroutine started in Start returns.
+	updatesStopped chan struct{}
+}
+
+// statusUpdate is either a taskStatus whose message changed, or a request to
+// close flushed once all updates before it are applied.
+type statusUpdate struct {
+	ts      *taskStatus
+	flushed chan struct{}
 }
 
 var _ executor.TaskExecutionUI = &taskExecTUI{}
+var _ StatusDumper = &taskExecTUI{}
 
 func (ui *taskExecTUI) Start(tasks []*executor.Task) {
 	for _, t := range tasks {
@@ -118,6 +222,8 @@ func (ui *taskExecTUI) Start(tasks []*executor.Task) {
 			status.displayName = t.Repository.Name
 		}
 
+		status.cached = t.CachedStepResultFound
+
 		if len(status.displayName) > ui.maxRepoName {
 			ui.maxRepoName = len(status.displayName)
 		}
@@ -141,13 +247,21 @@ func (ui *taskExecTUI) Start(tasks []*executor.Task) {
 
 	opts := output.DefaultProgressTTYOpts.WithNoSpinner(ui.forceNoSpinner)
 	ui.progress = ui.out.ProgressWithStatusBars(progressBars, statusBars, opts)
+
+	// Every Task is queued at most once at a time, so the buffer never fills
+	// up with updates, and updateStatus never blocks.
+	ui.updates = make(chan statusUpdate, len(tasks))
+	ui.stopUpdates = make(chan struct{})
+	ui.updatesStopped = make(chan struct{})
+	go ui.applyStatusUpdates()
 }
 
 func (ui *taskExecTUI) Success() {
+	ui.stopStatusUpdates()
 	ui.progress.Complete()
 }
 func (ui *taskExecTUI) Failed(err error) {
-	// noop right now
+	ui.stopStatusUpdates()
 }
 
 func (ui *taskExecTUI) useFreeStatusBar(ts *taskStatus) (bar int, found bool) {
@@ -187,6 +301,7 @@ func (ui *taskExecTUI) TaskStarted(task *executor.Task) {
 	}
 
 	ts.startedAt = ui.clock()
+	ts.tempDir = task.TempDir
 
 	// Find free slot
 	bar, found := ui.useFreeStatusBar(ts)
@@ -199,16 +314,65 @@ func (ui *taskExecTUI) TaskStarted(task *executor.Task) {
 }
 
 func (ui *taskExecTUI) TaskCurrentlyExecuting(task *executor.Task, message string) {
-	ui.mu.Lock()
-	defer ui.mu.Unlock()
-
+	// statuses is only written to in Start, so it can be read without the
+	// lock.
 	ts, ok := ui.statuses[task]
 	if !ok {
 		ui.out.Verbose("warning: task not found in internal 'statuses'")
 		return
 	}
 
-	ts.currentlyExecuting = message
+	ui.updateStatus(ts, message)
+}
+
+// updateStatus sets the message of ts and queues it to be rendered. It never
+// blocks: if ts is already queued, the queued update picks up the new message
+// instead.
+func (ui *taskExecTUI) updateStatus(ts *taskStatus, message string) {
+	ts.pendingMessage.Store(&message)
+	if !ts.queued.CompareAndSwap(false, true) {
+		return
+	}
+
+	if ui.statusUpdatesStopped() {
+		ui.applyStatusUpdate(ts)
+		return
+	}
+	select {
+	case ui.updates <- statusUpdate{ts: ts}:
+	default:
+		// Start wasn't called yet, or the buffer is taken up by flush
+		// requests.
+		ui.applyStatusUpdate(ts)
+	}
+}
+
+func (ui *taskExecTUI) applyStatusUpdates() {
+	defer close(ui.updatesStopped)
+	for {
+		select {
+		case u := <-ui.updates:
+			if u.flushed != nil {
+				close(u.flushed)
+			} else {
+				ui.applyStatusUpdate(u.ts)
+			}
+		case <-ui.stopUpdates:
+			return
+		}
+	}
+}
+
+func (ui *taskExecTUI) applyStatusUpdate(ts *taskStatus) {
+	// queued is reset before the message is loaded, so that a message that's
+	// stored after this queues ts again.
+	ts.queued.Store(false)
+	message := ts.pendingMessage.Load()
+
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+
+	ts.currentlyExecuting = *message
 
 	bar, found := ui.findStatusBar(ts)
 	if !found {
@@ -219,6 +383,60 @@ func (ui *taskExecTUI) TaskCurrentlyExecuting(task *executor.Task, message strin
 	ui.progress.StatusBarUpdatef(bar, ts.String())
 }
 
+// flushStatusUpdates waits until all status updates queued so far are
+// applied. The updates can be stopped concurrently, in which case
+// stopStatusUpdates applies them instead.
+func (ui *taskExecTUI) flushStatusUpdates() {
+	if ui.updates == nil {
+		return
+	}
+	flushed := make(chan struct{})
+	select {
+	case ui.updates <- statusUpdate{flushed: flushed}:
+	case <-ui.stopUpdates:
+		return
+	}
+	select {
+	case <-flushed:
+	case <-ui.stopUpdates:
+	}
+}
+
+// stopStatusUpdates applies all queued status updates and stops the goroutine
+// started in Start. Later updates are applied synchronously.
+func (ui *taskExecTUI) stopStatusUpdates() {
+	ui.flushStatusUpdates()
+	ui.stopUpdatesOnce.Do(func() {
+		if ui.stopUpdates == nil {
+			return
+		}
+		close(ui.stopUpdates)
+		<-ui.updatesStopped
+		// Updates queued after the flush would otherwise never be applied.
+		for {
+			select {
+			case u := <-ui.updates:
+				if u.flushed != nil {
+					close(u.flushed)
+				} else {
+					ui.applyStatusUpdate(u.ts)
+				}
+			default:
+				return
+			}
+		}
+	})
+}
+
+func (ui *taskExecTUI) statusUpdatesStopped() bool {
+	select {
+	case <-ui.stopUpdates:
+		return true
+	default:
+		return false
+	}
+}
+
 func (ui *taskExecTUI) StepsExecutionUI(task *executor.Task) executor.StepsExecutionUI {
 	ui.mu.Lock()
 	defer ui.mu.Unlock()
@@ -229,8 +447,7 @@ func (ui *taskExecTUI) StepsExecutionUI(task *executor.Task) executor.StepsExecu
 		return executor.NoopStepsExecUI{}
 	}
 
-	bar, found := ui.findStatusBar(ts)
-	if !found {
+	if _, found := ui.findStatusBar(ts); !found {
 		ui.out.Verbose("warning: no free status bar found to display task status")
 		return executor.NoopStepsExecUI{}
 	}
@@ -239,8 +456,27 @@ func (ui *taskExecTUI) StepsExecutionUI(task *executor.Task) executor.StepsExecu
 		out:  ui.out,
 		task: task,
 		updateStatusBar: func(message string) {
-			ts.currentlyExecuting = message
-			ui.progress.StatusBarUpdatef(bar, ts.String())
+			ui.updateStatus(ts, message)
+		},
+		startStepTiming: func(step int) {
+			ui.mu.Lock()
+			defer ui.mu.Unlock()
+
+			var container string
+			if step > 0 && step <= len(task.Steps) {
+				container = task.Steps[step-1].Container
+			} else if finally := step - len(task.Steps); finally > 0 && finally <= len(task.Finally) {
+				container = task.Finally[finally-1].Container
+			}
+			ts.stepTimings = append(ts.stepTimings, stepTiming{step: step, container: container, startedAt: ui.clock()})
+		},
+		finishStepTiming: func(step int) {
+			ui.mu.Lock()
+			defer ui.mu.Unlock()
+
+			if n := len(ts.stepTimings); n > 0 && ts.stepTimings[n-1].step == step {
+				ts.stepTimings[n-1].finishedAt = ui.clock()
+			}
 		},
 	}
 }
@@ -257,6 +493,10 @@ func (ui *taskExecTUI) TaskFinished(task *executor.Task, err error) {
 
 	ts.finishedAt = ui.clock()
 	ts.err = err
+	ts.cleanupErr = task.CleanupErr
+	if ts.cleanupErr != nil {
+		ui.progress.WriteLine(output.Linef(output.EmojiWarning, output.StyleWarning, "%s: cleanup failed: %s", ts.displayName, ts.cleanupErr))
+	}
 
 	ui.finished += 1
 	if ts.err != nil {
@@ -280,10 +520,6 @@ func (ui *taskExecTUI) TaskFinished(task *executor.Task, err error) {
 }
 
 func (ui *taskExecTUI) TaskChangesetSpecsBuilt(task *executor.Task, specs []*batcheslib.ChangesetSpec) {
-	if !ui.verbose {
-		return
-	}
-
 	ui.mu.Lock()
 	defer ui.mu.Unlock()
 
@@ -292,15 +528,16 @@ func (ui *taskExecTUI) TaskChangesetSpecsBuilt(task *executor.Task, specs []*bat
 		ui.out.Verbose("warning: task not found in internal 'statuses'")
 		return
 	}
+	ts.diff = changesetSpecsDiff(specs)
 
-	var fileDiffs []*diff.FileDiff
-	for _, spec := range specs {
-		fd, err := diff.ParseMultiFileDiff(spec.Commits[0].Diff)
-		if err != nil {
-			ui.progress.Verbosef("%-*s failed to display status: %s", ui.maxRepoName, ts.displayName, err)
-			return
-		}
-		fileDiffs = append(fileDiffs, fd...)
+	if !ui.verbose {
+		return
+	}
+
+	fileDiffs, err := diff.ParseMultiFileDiff(ts.diff)
+	if err != nil {
+		ui.progress.Verbosef("%-*s failed to display status: %s", ui.maxRepoName, ts.displayName, err)
+		return
 	}
 
 	ui.progress.VerboseLine(output.Linef("", output.StylePending, "%s", ts.displayName))
@@ -323,16 +560,179 @@ func (ui *taskExecTUI) TaskChangesetSpecsBuilt(task *executor.Task, specs []*bat
 		ui.progress.Verbosef("  %d changeset specs generated", len(specs))
 	}
 	ui.progress.Verbosef("  Execution took %s", ts.ExecutionTime())
+	if slowest, ok := ts.slowestStep(); ok && len(ts.stepTimings) > 1 {
+		ui.progress.Verbosef("  Step %d (%s) took %s of the %s total", slowest.step, slowest.container, slowest.Duration(), ts.ExecutionTime())
+	}
 	ui.progress.Verbose("")
 }
 
+func (ui *taskExecTUI) TaskChangesetSpecsUploadFailed(task *executor.Task, err error) {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+
+	ts, ok := ui.statuses[task]
+	if !ok {
+		ui.out.Verbose("warning: task not found in internal 'statuses'")
+		return
+	}
+
+	ts.uploadErr = err
+	ui.progress.WriteLine(output.Linef(output.EmojiFailure, output.StyleWarning, "%s: %s", ts.displayName, ts.String()))
+}
+
+func (ui *taskExecTUI) TaskChangesetSpecsFiltered(task *executor.Task, changedLines int) {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+
+	ts, ok := ui.statuses[task]
+	if !ok {
+		ui.out.Verbose("warning: task not found in internal 'statuses'")
+		return
+	}
+
+	ts.filtered = true
+	ui.progress.Verbosef("%-*s %s: only %d changed lines", ui.maxRepoName, ts.displayName, ts.String(), changedLines)
+}
+
+func (ui *taskExecTUI) TaskChangesetSpecsSkipped(task *executor.Task, output string) {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+
+	ts, ok := ui.statuses[task]
+	if !ok {
+		ui.out.Verbose("warning: task not found in internal 'statuses'")
+		return
+	}
+
+	ts.skippedBy = output
+	ui.progress.Verbosef("%-*s %s", ui.maxRepoName, ts.displayName, ts.String())
+}
+
+func (ui *taskExecTUI) TaskPhaseTimings(task *executor.Task, durations []executor.PhaseDuration) {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+
+	ts, ok := ui.statuses[task]
+	if !ok {
+		ui.out.Verbose("warning: task not found in internal 'statuses'")
+		return
+	}
+
+	ts.phaseDurations = durations
+	parts := make([]string, len(durations))
+	for i, d := range durations {
+		parts[i] = fmt.Sprintf("%s %s", d.Phase, d.Duration.Truncate(time.Millisecond))
+	}
+	ui.progress.WriteLine(output.Linef("", output.StylePending, "%-*s %s", ui.maxRepoName, ts.displayName, strings.Join(parts, ", ")))
+}
+
+// DumpStatus writes a table of the tasks in inFlight, including the step
+// they're executing and how long they've been running, to w. It's meant to be
+// used to diagnose runs that appear to be stuck.
+func (ui *taskExecTUI) DumpStatus(w io.Writer, inFlight []executor.TaskStatus) {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+
+	now := ui.clock()
+
+	// Only show the temporary directories if they were spread.
+	withTempDir := slices.ContainsFunc(inFlight, func(s executor.TaskStatus) bool { return s.TempDir != "" })
+
+	t := table.NewWriter()
+	t.SetOutputMirror(w)
+	header := table.Row{"Repository", "Currently executing", "Execution time"}
+	footer := table.Row{fmt.Sprintf("%d in flight", len(inFlight)), fmt.Sprintf("%d/%d finished, %d errored", ui.finished, len(ui.statuses), ui.errored), ""}
+	if withTempDir {
+		header = append(header, "Temporary directory")
+		footer = append(footer, "")
+	}
+	t.AppendHeader(header)
+	for _, s := range inFlight {
+		name := s.Repository
+		if s.Path != "" {
+			name += ":" + s.Path
+		}
+		row := table.Row{name, describeInFlight(s), now.Sub(s.StartedAt).Truncate(time.Second)}
+		if withTempDir {
+			row = append(row, s.TempDir)
+		}
+		t.AppendRow(row)
+	}
+	t.AppendFooter(footer)
+	t.SetStyle(table.StyleRounded)
+	t.Render()
+}
+
+// describeInFlight describes what the Task of s is currently doing, based on
+// its last event.
+func describeInFlight(s executor.TaskStatus) string {
+	switch s.State {
+	case executor.EventStepStarted:
+		return fmt.Sprintf("Running step %d", s.Step)
+	case executor.EventStepFinished:
+		return fmt.Sprintf("Finished step %d", s.Step)
+	case executor.EventStepSkipped:
+		return fmt.Sprintf("Skipped step %d", s.Step)
+	case executor.EventStepFailed:
+		return fmt.Sprintf("Step %d failed", s.Step)
+	default:
+		return "Preparing workspace"
+	}
+}
+
 func (ui *taskExecTUI) updateProgressBar(completed, errored, total int) {
 	ui.progress.SetValue(0, float64(completed))
 
 	label := fmt.Sprintf("Executing... (%d/%d, %d errored)", completed, total, errored)
+	if remaining, ok := ui.estimatedTimeRemaining(); ok {
+		label = fmt.Sprintf("Executing... (%d/%d, %d errored, ~%s left)", completed, total, errored, formatTimeRemaining(remaining))
+	}
 	ui.progress.SetLabelAndRecalc(0, label)
 }
 
+// estimatedTimeRemaining estimates how long it takes until all Tasks are
+// finished, based on the average execution time of the finished Tasks. Tasks
+// that started from a cached result are left out of the average, since they
+// only ran a part of their steps. It returns false if there isn't enough data
+// for an estimate, or if all Tasks are finished.
+func (ui *taskExecTUI) estimatedTimeRemaining() (time.Duration, bool) {
+	var (
+		total    time.Duration
+		finished int
+		pending  int
+	)
+	for _, ts := range ui.statuses {
+		if !ts.FinishedExecution() {
+			pending++
+			continue
+		}
+		if ts.cached {
+			continue
+		}
+		total += ts.ExecutionTime()
+		finished++
+	}
+	if finished == 0 || pending == 0 {
+		return 0, false
+	}
+
+	average := total / time.Duration(finished)
+	parallelism := max(1, min(ui.numParallelism, pending))
+	return average * time.Duration(pending) / time.Duration(parallelism), true
+}
+
+// formatTimeRemaining formats d coarsely, for example as "40s", "12m" or
+// "1h05m", since the estimate isn't any more precise than that.
+func formatTimeRemaining(d time.Duration) string {
+	if d = d.Round(time.Second); d < time.Minute {
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	}
+	if d = d.Round(time.Minute); d < time.Hour {
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	}
+	return fmt.Sprintf("%dh%02dm", int(d.Hours()), int(d.Minutes())%60)
+}
+
 type statusTexter interface {
 	StatusText() string
 }
@@ -431,6 +831,9 @@ type stepsExecTUI struct {
 	out             *output.Output
 	task            *executor.Task
 	updateStatusBar func(string)
+
+	startStepTiming  func(step int)
+	finishStepTiming func(step int)
 }
 
 func (ui stepsExecTUI) ArchiveDownloadStarted() {
@@ -438,6 +841,11 @@ func (ui stepsExecTUI) ArchiveDownloadStarted() {
 	ui.out.Verbosef("[%s] Downloading repository archive...", ui.task.Repository.Name)
 }
 
+func (ui stepsExecTUI) ArchiveDownloadRetrying(attempt int, err error) {
+	ui.updateStatusBar(fmt.Sprintf("Downloading archive (attempt %d)", attempt))
+	ui.out.Verbosef("[%s] Archive download failed, retrying (attempt %d): %v", ui.task.Repository.Name, attempt, err)
+}
+
 func (ui stepsExecTUI) ArchiveDownloadFinished(err error) {
 	if err != nil {
 		ui.out.Verbosef("[%s] Archive download failed: %v", ui.task.Repository.Name, err)
@@ -446,6 +854,11 @@ func (ui stepsExecTUI) ArchiveDownloadFinished(err error) {
 	}
 }
 
+func (ui stepsExecTUI) WaitingForDisk(size int64) {
+	ui.updateStatusBar("Waiting for disk")
+	ui.out.Verbosef("[%s] Waiting for other workspaces to free up %s of disk...", ui.task.Repository.Name, humanize.IBytes(uint64(size)))
+}
+
 func (ui stepsExecTUI) WorkspaceInitializationStarted() {
 	ui.updateStatusBar("Initializing workspace")
 	ui.out.Verbosef("[%s] Initializing workspace...", ui.task.Repository.Name)
@@ -485,6 +898,7 @@ func (ui stepsExecTUI) StepPreparingFailed(step int, err error) {
 }
 
 func (ui stepsExecTUI) StepStarted(step int, runScript string, env map[string]string) {
+	ui.startStepTiming(step)
 	ui.updateStatusBar(runScript)
 	ui.out.Verbosef("[%s] Step %d started: %s", ui.task.Repository.Name, step, truncateScript(runScript, 100))
 	if len(env) > 0 {
@@ -497,6 +911,7 @@ func (ui stepsExecTUI) StepOutputWriter(ctx context.Context, task *executor.Task
 }
 
 func (ui stepsExecTUI) StepFinished(idx int, diff []byte, changes git.Changes, outputs map[string]any) {
+	ui.finishStepTiming(idx)
 	ui.out.Verbosef("[%s] Step %d finished successfully", ui.task.Repository.Name, idx)
 	if len(diff) > 0 {
 		ui.out.Verbosef("[%s] Step %d produced %d bytes of diff", ui.task.Repository.Name, idx, len(diff))
@@ -512,6 +927,7 @@ func (ui stepsExecTUI) StepFinished(idx int, diff []byte, changes git.Changes, o
 }
 
 func (ui stepsExecTUI) StepFailed(idx int, err error, exitCode int) {
+	ui.finishStepTiming(idx)
 	ui.out.Verbosef("[%s] Step %d failed (exit code %d): %v", ui.task.Repository.Name, idx, exitCode, err)
 }
 
@@ -1,13 +1,19 @@
 package ui
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
 	batcheslib "github.com/sourcegraph/sourcegraph/lib/batches"
+	"github.com/sourcegraph/sourcegraph/lib/batches/git"
 	"github.com/sourcegraph/sourcegraph/lib/output"
 
 	"github.com/sourcegraph/src-cli/internal/batches/executor"
@@ -91,6 +97,7 @@ func TestTaskExecTUI_Integration(t *testing.T) {
 	printer.TaskCurrentlyExecuting(tasks[0], "echo Hello World > README.md")
 	printer.TaskCurrentlyExecuting(tasks[1], "Downloading archive")
 	printer.TaskCurrentlyExecuting(tasks[2], "echo Hello World > README.md")
+	printer.flushStatusUpdates()
 
 	expectOutput(t, buf, []string{
 		"⠋  Executing... (0/4, 0 errored)                                              0%",
@@ -105,6 +112,7 @@ func TestTaskExecTUI_Integration(t *testing.T) {
 	printer.TaskCurrentlyExecuting(tasks[0], "gofmt")
 	printer.TaskCurrentlyExecuting(tasks[1], "echo Hello World > README.md")
 	printer.TaskCurrentlyExecuting(tasks[2], "echo Hello World > README.md")
+	printer.flushStatusUpdates()
 
 	expectOutput(t, buf, []string{
 		"⠋  Executing... (0/4, 0 errored)                                              0%",
@@ -120,7 +128,7 @@ func TestTaskExecTUI_Integration(t *testing.T) {
 	printer.TaskFinished(tasks[2], nil)
 
 	expectOutput(t, buf, []string{
-		"⠋  Executing... (1/4, 0 errored)  ██████████▎                                25%",
+		"⠋  Executing... (1/4, 0 errored, ~1...  ████████▊                            25%",
 		"│                                                                               ",
 		"├── github.com/sourcegraph/sourcegraph  gofmt                                 0s",
 		"├── github.com/sourcegraph/src-cli      echo Hello World > README.md          0s",
@@ -133,7 +141,7 @@ func TestTaskExecTUI_Integration(t *testing.T) {
 	printer.TaskFinished(tasks[0], nil)
 
 	expectOutput(t, buf, []string{
-		"⠋  Executing... (2/4, 0 errored)  ████████████████████▌                      50%",
+		"⠋  Executing... (2/4, 0 errored, ~1...  █████████████████▌                   50%",
 		"│                                                                               ",
 		"├── github.com/sourcegraph/sourcegraph  Done!                                 0s",
 		"├── github.com/sourcegraph/src-cli      echo Hello World > README.md          0s",
@@ -171,7 +179,7 @@ func TestTaskExecTUI_Integration(t *testing.T) {
 		"  3 files changed, 4 insertions, 2 deletions",
 		"  Execution took 10s",
 		"",
-		"⠋  Executing... (2/4, 0 errored)  ████████████████████▌                      50%",
+		"⠋  Executing... (2/4, 0 errored, ~1...  █████████████████▌                   50%",
 		"│                                                                               ",
 		"├── github.com/sourcegraph/sourcegraph  Done!                                 0s",
 		"├── github.com/sourcegraph/src-cli      echo Hello World > README.md          0s",
@@ -182,6 +190,7 @@ func TestTaskExecTUI_Integration(t *testing.T) {
 	// Now we start the 4th task
 	printer.TaskStarted(tasks[3])
 	printer.TaskCurrentlyExecuting(tasks[3], "rm -rf ~/.horse-ascii-art")
+	printer.flushStatusUpdates()
 
 	expectOutput(t, buf, []string{
 		"github.com/sourcegraph/automation-testing",
@@ -191,7 +200,7 @@ func TestTaskExecTUI_Integration(t *testing.T) {
 		"  3 files changed, 4 insertions, 2 deletions",
 		"  Execution took 10s",
 		"",
-		"⠋  Executing... (2/4, 0 errored)  ████████████████████▌                      50%",
+		"⠋  Executing... (2/4, 0 errored, ~1...  █████████████████▌                   50%",
 		"│                                                                               ",
 		"├── github.com/sourcegraph/tiny-go-...  rm -rf ~/.horse-ascii-art             0s",
 		"├── github.com/sourcegraph/src-cli      echo Hello World > README.md          0s",
@@ -238,6 +247,7 @@ func TestProgressUpdateAfterComplete(t *testing.T) {
 	// Update the tasks into a useful state.
 	printer.TaskCurrentlyExecuting(tasks[0], "echo Hello World > README.md")
 	printer.TaskCurrentlyExecuting(tasks[1], "Downloading archive")
+	printer.flushStatusUpdates()
 
 	expectOutput(t, buf, []string{
 		"⠋  Executing... (0/2, 0 errored)                                              0%",
@@ -253,6 +263,7 @@ func TestProgressUpdateAfterComplete(t *testing.T) {
 	// Now send another update. This would panic before the relevant fix was
 	// merged in #666.
 	printer.TaskCurrentlyExecuting(tasks[0], "exit 42")
+	printer.flushStatusUpdates()
 
 	// The actual output is slightly less important at this point, but let's
 	// check it anyway.
@@ -265,6 +276,311 @@ func TestProgressUpdateAfterComplete(t *testing.T) {
 	})
 }
 
+func TestTaskExecTUI_DumpStatus(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	clock := func() time.Time { return now }
+
+	out := output.NewOutput(&bytes.Buffer{}, output.OutputOpts{})
+
+	tasks := []*executor.Task{
+		{Repository: &graphql.Repository{Name: "github.com/sourcegraph/sourcegraph"}},
+		{Repository: &graphql.Repository{Name: "github.com/sourcegraph/src-cli"}},
+		{Repository: &graphql.Repository{Name: "github.com/sourcegraph/tiny-go-repo"}},
+	}
+
+	printer := newTaskExecTUI(out, false, 3)
+	printer.forceNoSpinner = true
+	printer.clock = clock
+	printer.Start(tasks)
+
+	// The statuses are passed in as returned by Coordinator.InFlight, without
+	// waiting for the TUI to catch up with the updates.
+	inFlight := []executor.TaskStatus{
+		{Repository: "github.com/sourcegraph/sourcegraph", State: executor.EventStepStarted, Step: 2, StartedAt: now.Add(-15 * time.Second)},
+		{Repository: "github.com/sourcegraph/src-cli", Path: "cmd/src", State: executor.EventTaskStarted, StartedAt: now.Add(-10 * time.Second)},
+	}
+
+	var buf bytes.Buffer
+	printer.DumpStatus(&buf, inFlight)
+	dump := buf.String()
+
+	for _, want := range []string{
+		"github.com/sourcegraph/sourcegraph",
+		"Running step 2",
+		"15s",
+		"github.com/sourcegraph/src-cli:cmd/src",
+		"Preparing workspace",
+		"10s",
+		"2 IN FLIGHT",
+	} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("status dump does not contain %q:\n%s", want, dump)
+		}
+	}
+	if strings.Contains(dump, "tiny-go-repo") {
+		t.Errorf("status dump contains task that isn't in flight:\n%s", dump)
+	}
+	if strings.Contains(dump, "Temporary directory") {
+		t.Errorf("status dump contains temporary directories that weren't spread:\n%s", dump)
+	}
+}
+
+func TestTaskExecTUI_StepTimings(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now.UTC().Truncate(time.Millisecond) }
+	advanceClock := func(d time.Duration) { now = now.Add(d) }
+
+	var buf bytes.Buffer
+	out := output.NewOutput(&buf, output.OutputOpts{Verbose: true})
+
+	task := &executor.Task{
+		Repository: &graphql.Repository{Name: "github.com/sourcegraph/src-cli"},
+		Steps: []batcheslib.Step{
+			{Container: "alpine:3"},
+			{Container: "comby/comby"},
+		},
+	}
+
+	printer := newTaskExecTUI(out, true, 1)
+	printer.forceNoSpinner = true
+	printer.clock = clock
+
+	printer.Start([]*executor.Task{task})
+	printer.TaskStarted(task)
+	stepsUI := printer.StepsExecutionUI(task)
+	stepsUI.StepStarted(1, "echo", nil)
+	advanceClock(1 * time.Second)
+	stepsUI.StepFinished(1, nil, git.Changes{}, nil)
+	stepsUI.StepStarted(2, "comby", nil)
+	advanceClock(4 * time.Minute)
+	stepsUI.StepFinished(2, nil, git.Changes{}, nil)
+	printer.TaskFinished(task, nil)
+	printer.TaskChangesetSpecsBuilt(task, []*batcheslib.ChangesetSpec{
+		{Commits: []batcheslib.GitCommitDescription{{Diff: progressPrinterDiff}}},
+	})
+
+	if want := "Step 2 (comby/comby) took 4m0s of the 4m1s total"; !strings.Contains(buf.String(), want) {
+		t.Errorf("output does not contain %q:\n%s", want, buf.String())
+	}
+}
+
+func TestTaskExecTUI_Diff(t *testing.T) {
+	var buf bytes.Buffer
+	out := output.NewOutput(&buf, output.OutputOpts{})
+
+	task := &executor.Task{Repository: &graphql.Repository{Name: "github.com/sourcegraph/src-cli"}}
+
+	printer := newTaskExecTUI(out, false, 1)
+	printer.forceNoSpinner = true
+
+	printer.Start([]*executor.Task{task})
+	printer.TaskStarted(task)
+	printer.TaskFinished(task, nil)
+
+	if have := printer.statuses[task].Diff(); have != "" {
+		t.Fatalf("diff before specs were built: want empty, have %q", have)
+	}
+
+	const diffA = "diff --git a/a b/a\n--- a/a\n+++ b/a\n@@ -1 +1 @@\n-a\n+A\n"
+	const diffB = "diff --git a/b b/b\n--- a/b\n+++ b/b\n@@ -1 +1 @@\n-b\n+B\n"
+	printer.TaskChangesetSpecsBuilt(task, []*batcheslib.ChangesetSpec{
+		{Commits: []batcheslib.GitCommitDescription{{Diff: []byte(diffA)}, {Diff: []byte(diffB)}}},
+	})
+
+	if have, want := printer.statuses[task].Diff(), diffA+diffB; have != want {
+		t.Errorf("wrong diff: want=%q, have=%q", want, have)
+	}
+}
+
+func TestTaskExecTUI_EstimatedTimeRemaining(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now.UTC().Truncate(time.Millisecond) }
+	advanceClock := func(d time.Duration) { now = now.Add(d) }
+
+	out := output.NewOutput(&bytes.Buffer{}, output.OutputOpts{})
+
+	var tasks []*executor.Task
+	for _, name := range []string{"a", "b", "cached", "d", "e"} {
+		tasks = append(tasks, &executor.Task{
+			Repository:            &graphql.Repository{Name: "github.com/sourcegraph/" + name},
+			CachedStepResultFound: name == "cached",
+		})
+	}
+
+	printer := newTaskExecTUI(out, false, 2)
+	printer.forceNoSpinner = true
+	printer.clock = clock
+	printer.Start(tasks)
+
+	if _, ok := printer.estimatedTimeRemaining(); ok {
+		t.Fatal("expected no estimate before any task finished")
+	}
+
+	printer.TaskStarted(tasks[2])
+	advanceClock(1 * time.Second)
+	printer.TaskFinished(tasks[2], nil)
+
+	if _, ok := printer.estimatedTimeRemaining(); ok {
+		t.Fatal("expected no estimate when only cached tasks finished")
+	}
+
+	printer.TaskStarted(tasks[0])
+	printer.TaskStarted(tasks[1])
+	advanceClock(10 * time.Second)
+	printer.TaskFinished(tasks[0], nil)
+	advanceClock(10 * time.Second)
+	printer.TaskFinished(tasks[1], nil)
+
+	// Two tasks took 15s on average, and the remaining two run in parallel.
+	remaining, ok := printer.estimatedTimeRemaining()
+	if !ok {
+		t.Fatal("expected an estimate")
+	}
+	if want := 15 * time.Second; remaining != want {
+		t.Errorf("wrong estimate. want=%s, have=%s", want, remaining)
+	}
+}
+
+func TestTaskExecTUI_StatusUpdates(t *testing.T) {
+	const numTasks, numUpdates = 32, 100
+
+	tasks, printer := newStatusUpdatesTUI(io.Discard, numTasks)
+
+	var wg sync.WaitGroup
+	for i, task := range tasks {
+		wg.Go(func() {
+			for j := range numUpdates {
+				printer.TaskCurrentlyExecuting(task, fmt.Sprintf("task %d, update %d", i, j))
+			}
+		})
+	}
+	wg.Wait()
+	printer.Success()
+
+	// Updates may be coalesced, but the last one must never be lost.
+	for i, task := range tasks {
+		want := fmt.Sprintf("task %d, update %d", i, numUpdates-1)
+		if have := printer.statuses[task].currentlyExecuting; have != want {
+			t.Errorf("wrong status for task %d. want=%q, have=%q", i, want, have)
+		}
+	}
+
+	// Updates after Success are applied synchronously.
+	printer.TaskCurrentlyExecuting(tasks[0], "late")
+	if have := printer.statuses[tasks[0]].currentlyExecuting; have != "late" {
+		t.Errorf("wrong status after Success. want=%q, have=%q", "late", have)
+	}
+}
+
+func TestTaskExecTUI_FlushWhileStopping(t *testing.T) {
+	for range 100 {
+		tasks, printer := newStatusUpdatesTUI(io.Discard, 4)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			var wg sync.WaitGroup
+			for _, task := range tasks {
+				wg.Go(func() {
+					printer.TaskCurrentlyExecuting(task, "running")
+					printer.flushStatusUpdates()
+				})
+			}
+			wg.Go(printer.Success)
+			wg.Wait()
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatal("flushing the status updates while they're stopped hangs")
+		}
+		for i, task := range tasks {
+			if have := printer.statuses[task].currentlyExecuting; have != "running" {
+				t.Errorf("wrong status for task %d. want=%q, have=%q", i, "running", have)
+			}
+		}
+	}
+}
+
+// BenchmarkTaskExecTUI_StatusUpdates compares updating the status bars
+// directly from the executing Tasks, holding the lock while rendering, with
+// queueing the updates for the goroutine started in Start. It measures how
+// long the Tasks are held up, not how long rendering takes.
+func BenchmarkTaskExecTUI_StatusUpdates(b *testing.B) {
+	const parallelism = 256
+
+	for _, bc := range []struct {
+		name   string
+		update func(ui *taskExecTUI, ts *taskStatus, message string)
+	}{
+		{
+			name: "lock",
+			update: func(ui *taskExecTUI, ts *taskStatus, message string) {
+				ts.pendingMessage.Store(&message)
+				ui.applyStatusUpdate(ts)
+			},
+		},
+		{
+			name:   "channel",
+			update: (*taskExecTUI).updateStatus,
+		},
+	} {
+		b.Run(fmt.Sprintf("%s/j=%d", bc.name, parallelism), func(b *testing.B) {
+			tasks, printer := newStatusUpdatesTUI(io.Discard, parallelism)
+			for _, task := range tasks {
+				printer.TaskStarted(task)
+			}
+
+			b.ResetTimer()
+			var wg sync.WaitGroup
+			for _, task := range tasks {
+				ts := printer.statuses[task]
+				wg.Go(func() {
+					for j := range b.N / parallelism {
+						bc.update(printer, ts, "step "+strconv.Itoa(j))
+					}
+				})
+			}
+			wg.Wait()
+			b.StopTimer()
+
+			printer.Success()
+		})
+	}
+}
+
+func newStatusUpdatesTUI(w io.Writer, numTasks int) ([]*executor.Task, *taskExecTUI) {
+	true_ := true
+	out := output.NewOutput(w, output.OutputOpts{
+		ForceTTY:    &true_,
+		ForceHeight: numTasks + 10,
+		ForceWidth:  80,
+	})
+
+	tasks := make([]*executor.Task, numTasks)
+	for i := range tasks {
+		tasks[i] = &executor.Task{Repository: &graphql.Repository{Name: fmt.Sprintf("github.com/sourcegraph/repo-%d", i)}}
+	}
+
+	printer := newTaskExecTUI(out, false, numTasks)
+	printer.Start(tasks)
+	return tasks, printer
+}
+
+func TestFormatTimeRemaining(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		12 * time.Second:                      "12s",
+		59*time.Second + 600*time.Millisecond: "1m",
+		12*time.Minute + 20*time.Second:       "12m",
+		65 * time.Minute:                      "1h05m",
+	} {
+		if have := formatTimeRemaining(d); have != want {
+			t.Errorf("formatTimeRemaining(%s): want=%q, have=%q", d, want, have)
+		}
+	}
+}
+
 type ttyBuf struct {
 	lines [][]byte
 
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math"
 	"os/exec"
+	"strings"
 
 	"github.com/neelance/parallel"
 
@@ -15,6 +16,7 @@ import (
 	"github.com/sourcegraph/src-cli/internal/batches"
 	"github.com/sourcegraph/src-cli/internal/batches/executor"
 	"github.com/sourcegraph/src-cli/internal/batches/graphql"
+	"github.com/sourcegraph/src-cli/internal/batches/service"
 	"github.com/sourcegraph/src-cli/internal/batches/workspace"
 	"github.com/sourcegraph/src-cli/internal/cmderrors"
 )
@@ -36,6 +38,21 @@ type TUI struct {
 	progress output.Progress
 
 	progressPrinter *taskExecTUI
+
+	// cachedTasks is the number of Tasks served from the cache so far.
+	cachedTasks int
+}
+
+func (ui *TUI) FeatureFlags(ffs *batches.FeatureFlags) {
+	enabled := "none"
+	if names := ffs.Enabled(); len(names) > 0 {
+		enabled = strings.Join(names, ", ")
+	}
+	ui.Out.Verbosef("Sourcegraph features: %s", enabled)
+}
+
+func (ui *TUI) CacheDirectory(dir string) {
+	ui.Out.WriteLine(output.Linef(output.EmojiInfo, output.StyleSuggestion, "Using cache directory %s", dir))
 }
 
 func (ui *TUI) ParsingBatchSpec() {
@@ -59,6 +76,15 @@ func (ui *TUI) ParsingBatchSpecFailure(err error) {
 	}
 }
 
+func (ui *TUI) StepLintFindings(findings []executor.LintFinding) {
+	block := ui.Out.Block(output.Linef(output.EmojiWarning, output.StyleWarning, "Found %d possible mistakes in the steps of the batch spec:", len(findings)))
+	defer block.Close()
+
+	for _, f := range findings {
+		block.Write(f.String())
+	}
+}
+
 func (ui *TUI) ResolvingNamespace() {
 	ui.pending = batchCreatePending(ui.Out, "Resolving namespace")
 }
@@ -149,10 +175,43 @@ func (ui *TUI) maybeWorkspaceCountWarning(count, limit int) {
 	}
 }
 
+func (ui *TUI) FilteringTasksSuccess(tasksCount, skippedCount int) {
+	ui.Out.WriteLine(output.Linef(
+		batchSuccessEmoji, batchSuccessColor,
+		"Limited execution to %d workspaces; skipped %d workspaces that aren't selected by -only-repos, -repo-list or -wave",
+		tasksCount, skippedCount,
+	))
+}
+
+func (ui *TUI) ListedReposNotFound(repos []string) {
+	block := ui.Out.Block(output.Linef(output.EmojiWarning, output.StyleWarning, "%d repositories in -only-repos or -repo-list have no workspaces:", len(repos)))
+	for _, repo := range repos {
+		block.Writef("%s", repo)
+	}
+	block.WriteLine(output.Line("", output.StyleWarning, "Check their spelling, and whether the batch spec's on section includes them."))
+	block.Write("")
+	block.Close()
+}
+
+func (ui *TUI) TasksLimited(maxTasks, droppedCount int) {
+	block := ui.Out.Block(output.Linef(output.EmojiWarning, output.StyleWarning, "Execution is limited to %d workspaces by -max-workspaces: %d workspaces are not executed.", maxTasks, droppedCount))
+	block.WriteLine(output.Line("", output.StyleWarning, "The batch spec doesn't cover all of its repositories, and applying it closes the changesets in the repositories that weren't executed."))
+	block.Write("")
+	block.Close()
+}
+
 func (ui *TUI) CheckingCache() {
 	ui.pending = batchCreatePending(ui.Out, "Checking cache for changeset specs")
 }
 
+func (ui *TUI) TaskCached(task *executor.Task, specs int) {
+	ui.cachedTasks++
+	if ui.pending != nil {
+		ui.pending.Updatef("Checking cache for changeset specs (%d cached)", ui.cachedTasks)
+	}
+	ui.Out.Verbosef("Served from cache: %s (%d changeset specs)", task.Repository.Name, specs)
+}
+
 func (ui *TUI) CheckingCacheSuccess(cachedSpecsFound int, uncachedTasks int) {
 	var specsFoundMessage string
 	if cachedSpecsFound == 1 {
@@ -171,6 +230,60 @@ func (ui *TUI) CheckingCacheSuccess(cachedSpecsFound int, uncachedTasks int) {
 	ui.Out.Verbosef("Cache check: %d cached specs found, %d tasks to execute", cachedSpecsFound, uncachedTasks)
 }
 
+func (ui *TUI) CacheStats(stats executor.CacheStats) {
+	if stats.ReadErrors > 0 {
+		ui.Out.WriteLine(output.Linef(
+			output.EmojiWarning, output.StyleWarning,
+			"Ignored %d cached results that couldn't be read; their steps are executed again",
+			stats.ReadErrors,
+		))
+	}
+	if stats.Clears > 0 {
+		ui.Out.Verbosef("Cache: cleared %d tasks", stats.Clears)
+		return
+	}
+	ui.Out.Verbosef("Cache: %d/%d tasks served from cache", stats.Hits, stats.Hits+stats.Misses)
+}
+
+// maxCacheMissExamples is the number of workspaces CacheMisses lists for
+// every reason.
+const maxCacheMissExamples = 3
+
+func (ui *TUI) CacheMisses(misses []executor.CacheMiss) {
+	if len(misses) == 0 {
+		return
+	}
+
+	// Usually the same inputs changed for many workspaces, so the workspaces
+	// are grouped by the reason they weren't served from the cache.
+	var reasons []string
+	tasks := map[string][]string{}
+	for _, miss := range misses {
+		reason := "no inputs changed, but the cached result is missing"
+		if miss.New {
+			reason = "not part of the previous run"
+		} else if len(miss.Changed) > 0 {
+			reason = "changed: " + strings.Join(miss.Changed, ", ")
+		}
+		if _, ok := tasks[reason]; !ok {
+			reasons = append(reasons, reason)
+		}
+		tasks[reason] = append(tasks[reason], miss.Task)
+	}
+
+	block := ui.Out.Block(output.Linef(output.EmojiInfo, output.StyleReset, "%d workspaces weren't served from the cache:", len(misses)))
+	for _, reason := range reasons {
+		names := tasks[reason]
+		examples := strings.Join(names[:min(len(names), maxCacheMissExamples)], ", ")
+		if len(names) > maxCacheMissExamples {
+			examples += fmt.Sprintf(" and %d more", len(names)-maxCacheMissExamples)
+		}
+		block.WriteLine(output.Linef("", output.StyleReset, "%s: %s", reason, examples))
+	}
+	block.Write("")
+	block.Close()
+}
+
 func (ui *TUI) ExecutingTasks(verbose bool, parallelism int) executor.TaskExecutionUI {
 	ui.progressPrinter = newTaskExecTUI(ui.Out, verbose, parallelism)
 	return ui.progressPrinter
@@ -181,6 +294,49 @@ func (ui *TUI) ExecutingTasksSkippingErrors(err error) {
 	ui.Out.WriteLine(output.Line(output.EmojiWarning, output.StyleWarning, "Skipping errors because -skip-errors was used."))
 }
 
+func (ui *TUI) TasksBelowMinChangedLines(filteredCount, minChangedLines int) {
+	ui.Out.WriteLine(output.Linef(
+		output.EmojiInfo, output.StyleSuggestion,
+		"Filtered %d workspaces whose changes are below the threshold of %d changed lines set with -min-changed-lines",
+		filteredCount, minChangedLines,
+	))
+}
+
+func (ui *TUI) RunReport(report executor.RunReport) {
+	groups := []struct {
+		name  string
+		names []string
+	}{
+		{"created", report.Created},
+		{"cached", report.Cached},
+		{"empty", report.Empty},
+		{"skipped", report.Skipped},
+		{"failed", report.Failed},
+		{"timed out", report.TimedOut},
+	}
+
+	var counts []string
+	for _, g := range groups {
+		if len(g.names) > 0 {
+			counts = append(counts, fmt.Sprintf("%d %s", len(g.names), g.name))
+		}
+	}
+	if len(counts) == 0 {
+		return
+	}
+	ui.Out.WriteLine(output.Linef("", output.StyleReset, "Workspaces: %s", strings.Join(counts, ", ")))
+
+	for _, g := range groups {
+		if len(g.names) > 0 {
+			ui.Out.Verbosef("Workspaces %s: %s", g.name, strings.Join(g.names, ", "))
+		}
+	}
+}
+
+func (ui *TUI) HTMLReportWritten(path string) {
+	ui.Out.WriteLine(output.Linef(output.EmojiInfo, output.StyleSuggestion, "Wrote HTML report to %s", path))
+}
+
 func (ui *TUI) LogFilesKept(files []string) {
 	block := ui.Out.Block(output.Line("", batchSuccessColor, "Preserving log files:"))
 	defer block.Close()
@@ -190,10 +346,73 @@ func (ui *TUI) LogFilesKept(files []string) {
 	}
 }
 
+func (ui *TUI) WorkspacesKept(tasks []*executor.Task) {
+	block := ui.Out.Block(output.Line("", batchSuccessColor, "Preserving workspaces for inspection:"))
+	defer block.Close()
+
+	for _, task := range tasks {
+		name := task.Repository.Name
+		if task.Path != "" {
+			name += ":" + task.Path
+		}
+		block.Writef("%s: %s", name, task.KeptWorkspace)
+	}
+}
+
+func (ui *TUI) WorkspaceCleanupFailed(tasks []*executor.Task) {
+	block := ui.Out.Block(output.Linef(output.EmojiWarning, output.StyleWarning, "Failed to clean up %d workspaces, their files might still take up disk space:", len(tasks)))
+	defer block.Close()
+
+	for _, task := range tasks {
+		name := task.Repository.Name
+		if task.Path != "" {
+			name += ":" + task.Path
+		}
+		block.Writef("%s: %s", name, task.CleanupErr)
+	}
+}
+
 func (ui *TUI) NoChangesetSpecs() {
 	ui.Out.WriteLine(output.Linef(output.EmojiWarning, output.StyleWarning, `No changeset specs created`))
 }
 
+func (ui *TUI) DuplicateChangesetTitles(duplicates []service.DuplicateTitle) {
+	block := ui.Out.Block(output.Line(output.EmojiWarning, output.StyleWarning, "Multiple changeset specs have the same title:"))
+	for _, d := range duplicates {
+		block.WriteLine(output.Linef("", output.StyleWarning, "%q: %s", d.Title, strings.Join(d.Repositories, ", ")))
+	}
+	block.WriteLine(output.Line("", output.StyleWarning, "Consider making the changesetTemplate.title field in the batch spec depend on the repository."))
+	block.Write("")
+	block.Close()
+}
+
+func (ui *TUI) VerifyingChangesetSpecs(num int) {
+	if num == 1 {
+		ui.pending = batchCreatePending(ui.Out, "Verifying that 1 changeset spec applies")
+	} else {
+		ui.pending = batchCreatePending(ui.Out, fmt.Sprintf("Verifying that %d changeset specs apply", num))
+	}
+}
+
+func (ui *TUI) VerifyingChangesetSpecsSuccess() {
+	batchCompletePending(ui.pending, "Verified that the changeset specs apply")
+}
+
+func (ui *TUI) VerifyingChangesetSpecsFailure(err error) {
+	ui.pending.Destroy()
+	block := ui.Out.Block(output.Line("\u274c", output.StyleWarning, "Changeset specs don't apply to their base revisions."))
+	defer block.Close()
+
+	var multiErr errors.MultiError
+	if errors.As(err, &multiErr) {
+		for i, err := range multiErr.Errors() {
+			block.Writef("%d. %s", i+1, err)
+		}
+	} else {
+		block.Writef("1. %s", err)
+	}
+}
+
 func (ui *TUI) UploadingChangesetSpecs(num int) {
 	var label string
 	if num == 1 {
@@ -227,6 +446,22 @@ func (ui *TUI) CreatingBatchSpecError(maxUnlicensedCS int, err error) error {
 	return prettyPrintBatchUnlicensedError(ui.Out, maxUnlicensedCS, err)
 }
 
+func (ui *TUI) ParallelismWarning(err error) {
+	block := ui.Out.Block(output.Line(output.EmojiWarning, output.StyleWarning, "The requested parallelism is likely too high for this machine."))
+	block.WriteLine(output.Linef("", output.StyleWarning, "%s", err.Error()))
+	block.WriteLine(output.Line("", output.StyleWarning, "Consider lowering it with -j, or omit -j to use the number of CPUs available to Docker."))
+	block.Write("")
+	block.Close()
+}
+
+func (ui *TUI) LocalRunnerWarning() {
+	block := ui.Out.Block(output.Line(output.EmojiWarning, output.StyleWarning, "Steps are executed directly on this machine, without containers."))
+	block.WriteLine(output.Line("", output.StyleWarning, "They can read and change all files and use all credentials of your user, and their containers are ignored."))
+	block.WriteLine(output.Line("", output.StyleWarning, "Only use -runner local with batch specs you trust."))
+	block.Write("")
+	block.Close()
+}
+
 func (ui *TUI) DockerWatchDogWarning(err error) {
 	dockerWatchDogWarning(ui.Out, err)
 }
@@ -366,15 +601,28 @@ func printExecutionError(out *output.Output, err error) {
 	writeErrs := func(errs []error) {
 		var block *output.Block
 
-		if len(errs) > 1 {
+		var taskErrs []executor.TaskExecutionErr
+		for _, e := range errs {
+			if taskErr, ok := e.(executor.TaskExecutionErr); ok {
+				taskErrs = append(taskErrs, taskErr)
+			}
+		}
+
+		if len(errs) > 1 && len(taskErrs) > 0 {
+			block = out.Block(output.Linef(output.EmojiFailure, output.StyleWarning, "%d errors (%s):", len(errs), executor.SummarizeTaskErrors(taskErrs)))
+		} else if len(errs) > 1 {
 			block = out.Block(output.Linef(output.EmojiFailure, output.StyleWarning, "%d errors:", len(errs)))
 		} else {
 			block = out.Block(output.Line(output.EmojiFailure, output.StyleWarning, "Error:"))
 		}
 
+		var workspaceErrs int
 		for _, e := range errs {
 			if taskErr, ok := e.(executor.TaskExecutionErr); ok {
 				block.Write(formatTaskExecutionErr(taskErr))
+				if errors.As(taskErr, &executor.WorkspaceCreationErr{}) {
+					workspaceErrs++
+				}
 			} else {
 				if err == context.Canceled {
 					block.Writef("%sAborting", output.StyleBold)
@@ -387,6 +635,14 @@ func printExecutionError(out *output.Output, err error) {
 		if block != nil {
 			block.Close()
 		}
+
+		if workspaceErrs > 0 {
+			out.Write("")
+			out.WriteLine(output.Linef(output.EmojiWarning, output.StyleWarning,
+				"%d of the errors occurred while creating workspaces, before any step was run. They're likely caused by unreachable repositories or a lack of disk space, not by the batch spec.",
+				workspaceErrs,
+			))
+		}
 	}
 
 	switch err := err.(type) {
@@ -0,0 +1,16 @@
+package util
+
+import (
+	"context"
+	"time"
+)
+
+const cleanupTimeout = 30 * time.Second
+
+// CleanupContext returns a context for cleaning up resources, such as
+// workspaces and containers, that were used with ctx. It isn't cancelled along
+// with ctx, so that the cleanup also happens when execution was interrupted,
+// but it times out so that a hanging cleanup doesn't block forever.
+func CleanupContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+}
@@ -22,7 +22,14 @@ type dockerBindWorkspaceCreator struct {
 	Dir string
 }
 
-var _ Creator = &dockerBindWorkspaceCreator{}
+var (
+	_ DirCreator   = &dockerBindWorkspaceCreator{}
+	_ CloneCreator = &dockerBindWorkspaceCreator{}
+)
+
+func (wc *dockerBindWorkspaceCreator) InDir(dir string) Creator {
+	return &dockerBindWorkspaceCreator{Dir: dir}
+}
 
 func (wc *dockerBindWorkspaceCreator) Create(ctx context.Context, repo *graphql.Repository, steps []batcheslib.Step, archive repozip.Archive) (Workspace, error) {
 	w, err := wc.unzipToWorkspace(ctx, repo, archive.Path())
@@ -31,10 +38,31 @@ func (wc *dockerBindWorkspaceCreator) Create(ctx context.Context, repo *graphql.
 	}
 
 	if err := wc.copyToWorkspace(ctx, w, archive.AdditionalFilePaths()); err != nil {
+		w.Close(ctx)
 		return nil, errors.Wrap(err, "copying additional files into workspace")
 	}
 
-	return w, errors.Wrap(wc.prepareGitRepo(ctx, w), "preparing local git repo")
+	if err := wc.prepareGitRepo(ctx, w); err != nil {
+		w.Close(ctx)
+		return nil, errors.Wrap(err, "preparing local git repo")
+	}
+
+	return w, nil
+}
+
+func (wc *dockerBindWorkspaceCreator) CreateClone(ctx context.Context, repo *graphql.Repository, steps []batcheslib.Step, opts CloneOptions) (Workspace, error) {
+	dir, err := os.MkdirTemp(wc.Dir, "workspace-"+util.SlugForRepo(repo.Name, repo.Rev()))
+	if err != nil {
+		return nil, errors.Wrap(err, "creating workspace directory")
+	}
+	w := &dockerBindWorkspace{tempDir: wc.Dir, dir: dir}
+
+	if err := cloneRepo(ctx, dir, opts); err != nil {
+		w.Close(ctx)
+		return nil, errors.Wrap(err, "cloning the repository")
+	}
+
+	return w, nil
 }
 
 func (*dockerBindWorkspaceCreator) prepareGitRepo(ctx context.Context, w *dockerBindWorkspace) error {
@@ -128,20 +156,34 @@ func (w *dockerBindWorkspace) DockerRunOpts(ctx context.Context, target string)
 
 func (w *dockerBindWorkspace) WorkDir() *string { return &w.dir }
 
-func (w *dockerBindWorkspace) Diff(ctx context.Context) ([]byte, error) {
+func (w *dockerBindWorkspace) Diff(ctx context.Context, opts DiffOptions) ([]byte, error) {
+	if _, err := runGitCmd(ctx, w.dir, "add", "--all"); err != nil {
+		return nil, errors.Wrap(err, "git add failed")
+	}
+
+	return runGitCmd(ctx, w.dir, append([]string{"diff", "--cached"}, opts.args()...)...)
+}
+
+func (w *dockerBindWorkspace) Snapshot(ctx context.Context) (string, error) {
+	if _, err := runGitCmd(ctx, w.dir, "add", "--all"); err != nil {
+		return "", errors.Wrap(err, "git add failed")
+	}
+
+	// The snapshot is the tree of the index, so it doesn't need a commit.
+	tree, err := runGitCmd(ctx, w.dir, "write-tree")
+	if err != nil {
+		return "", errors.Wrap(err, "git write-tree failed")
+	}
+	return strings.TrimSpace(string(tree)), nil
+}
+
+func (w *dockerBindWorkspace) DiffSince(ctx context.Context, snapshot string, opts DiffOptions) ([]byte, error) {
 	if _, err := runGitCmd(ctx, w.dir, "add", "--all"); err != nil {
 		return nil, errors.Wrap(err, "git add failed")
 	}
 
-	// As of Sourcegraph 3.14 we only support unified diff format.
-	// That means we need to strip away the `a/` and `/b` prefixes with `--no-prefix`.
-	// See: https://github.com/sourcegraph/sourcegraph/blob/82d5e7e1562fef6be5c0b17f18631040fd330835/enterprise/internal/campaigns/service.go#L324-L329
-	//
-	// Also, we need to add --binary so binary file changes are inlined in the patch.
-	//
-	// ATTENTION: When you change the options here, be sure to also update the
-	// ApplyDiff method accordingly.
-	return runGitCmd(ctx, w.dir, "diff", "--cached", "--no-prefix", "--binary")
+	args := append([]string{"diff", "--cached"}, opts.args()...)
+	return runGitCmd(ctx, w.dir, append(args, snapshot)...)
 }
 
 func (w *dockerBindWorkspace) ApplyDiff(ctx context.Context, diff []byte) error {
@@ -177,10 +219,16 @@ func unzipToTempDir(ctx context.Context, zipFile, tempDir, tempFilePrefix string
 	}
 
 	if err := os.Chmod(volumeDir, 0777); err != nil {
+		os.RemoveAll(volumeDir)
+		return "", err
+	}
+
+	if err := unzip(ctx, zipFile, volumeDir); err != nil {
+		os.RemoveAll(volumeDir)
 		return "", err
 	}
 
-	return volumeDir, unzip(ctx, zipFile, volumeDir)
+	return volumeDir, nil
 }
 
 func unzip(ctx context.Context, zipFile, dest string) error {
@@ -3,9 +3,11 @@ package workspace
 import (
 	"archive/zip"
 	"context"
+	"fmt"
 	"maps"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -21,7 +23,7 @@ var repo = &graphql.Repository{
 	DefaultBranch: &graphql.Branch{Name: "main", Target: graphql.Target{OID: "d34db33f"}},
 }
 
-func zipUpFiles(t *testing.T, dir string, files map[string]string) string {
+func zipUpFiles(t testing.TB, dir string, files map[string]string) string {
 	f, err := os.CreateTemp(dir, "repo-zip-*")
 	if err != nil {
 		t.Fatal(err)
@@ -217,6 +219,144 @@ index 0000000..7bb2542
 	})
 }
 
+func TestDockerBindWorkspace_DiffSince(t *testing.T) {
+	ctx := context.Background()
+	archivePath := zipUpFiles(t, t.TempDir(), map[string]string{
+		"README.md": "# Welcome to the README\n",
+	})
+
+	creator := &dockerBindWorkspaceCreator{Dir: t.TempDir()}
+	workspace, err := creator.Create(ctx, repo, nil, &fakeRepoArchive{mockPath: archivePath})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	dir := *workspace.WorkDir()
+
+	if err := os.WriteFile(filepath.Join(dir, "first.txt"), []byte("first\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := workspace.Snapshot(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "second.txt"), []byte("second\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the changes after the snapshot are in the diff.
+	have, err := workspace.DiffSince(ctx, snapshot, DiffOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := `diff --git second.txt second.txt
+new file mode 100644
+index 0000000..e019be0
+--- /dev/null
++++ second.txt
+@@ -0,0 +1 @@
++second
+`
+	if diff := cmp.Diff(want, string(have)); diff != "" {
+		t.Errorf("wrong diff (-want +have):\n%s", diff)
+	}
+
+	// The diff of the workspace is still relative to the repository.
+	have, err = workspace.Diff(ctx, DiffOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.Contains(string(have), "+++ first.txt") || !strings.Contains(string(have), "+++ second.txt") {
+		t.Errorf("diff doesn't contain both files:\n%s", have)
+	}
+}
+
+func TestDockerBindWorkspaceCreator_CreateClone(t *testing.T) {
+	ctx := context.Background()
+
+	// The cloned revision has a parent and a child, so that we can tell how
+	// much history was fetched and that the right commit is checked out.
+	origin := t.TempDir()
+	var revs []string
+	for _, content := range []string{"first\n", "second\n", "third\n"} {
+		if err := os.WriteFile(filepath.Join(origin, "README.md"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		for _, args := range [][]string{{"init", "--quiet"}, {"add", "--all"}, {"commit", "--quiet", "-m", content}} {
+			if _, err := runGitCmd(ctx, origin, args...); err != nil {
+				t.Fatal(err)
+			}
+		}
+		rev, err := runGitCmd(ctx, origin, "rev-parse", "HEAD")
+		if err != nil {
+			t.Fatal(err)
+		}
+		revs = append(revs, strings.TrimSpace(string(rev)))
+	}
+
+	for _, tc := range []struct {
+		depth       int
+		wantCommits int
+	}{
+		{depth: 0, wantCommits: 2},
+		{depth: 1, wantCommits: 1},
+	} {
+		t.Run(fmt.Sprintf("depth %d", tc.depth), func(t *testing.T) {
+			creator := &dockerBindWorkspaceCreator{Dir: t.TempDir()}
+			workspace, err := creator.CreateClone(ctx, repo, nil, CloneOptions{URL: "file://" + origin, Rev: revs[1], Depth: tc.depth})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			dir := *workspace.WorkDir()
+
+			files, err := readWorkspaceFiles(workspace)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(map[string]string{"README.md": "second\n"}, files); diff != "" {
+				t.Errorf("wrong files in workspace (-want +have):\n%s", diff)
+			}
+			count, err := runGitCmd(ctx, dir, "rev-list", "--count", "HEAD")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have := strings.TrimSpace(string(count)); have != strconv.Itoa(tc.wantCommits) {
+				t.Errorf("wrong number of commits in history. want=%d, have=%s", tc.wantCommits, have)
+			}
+
+			// The diff is relative to the cloned revision, like the one of a
+			// workspace created from an archive.
+			if err := os.WriteFile(filepath.Join(dir, "README.md"), []byte("changed\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			have, err := workspace.Diff(ctx, DiffOptions{})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !strings.Contains(string(have), "-second\n+changed\n") {
+				t.Errorf("wrong diff:\n%s", have)
+			}
+
+			if err := workspace.Close(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(dir); !os.IsNotExist(err) {
+				t.Errorf("workspace not removed: %v", err)
+			}
+		})
+	}
+
+	t.Run("failure", func(t *testing.T) {
+		dir := t.TempDir()
+		creator := &dockerBindWorkspaceCreator{Dir: dir}
+		if _, err := creator.CreateClone(ctx, repo, nil, CloneOptions{URL: "file://" + filepath.Join(origin, "missing"), Rev: revs[1]}); err == nil {
+			t.Error("unexpected nil error")
+		}
+		if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+			t.Errorf("workspace not removed: %v", entries)
+		}
+	})
+}
+
 func TestMkdirAll(t *testing.T) {
 	// TestEnsureAll does most of the heavy lifting here; we're just testing the
 	// MkdirAll scenarios here around whether the directory exists.
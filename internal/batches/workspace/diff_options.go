@@ -0,0 +1,73 @@
+package workspace
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultDiffContextLines is the number of lines of context around the
+// changes in a diff, unless DiffOptions.ContextLines is set.
+const DefaultDiffContextLines = 3
+
+// DiffOptions configure how the diff of a Workspace is computed. The zero
+// value produces the diff Sourcegraph expects: a unified diff without the a/
+// and b/ prefixes, with three lines of context, renames detected and binary
+// changes inlined.
+type DiffOptions struct {
+	// ContextLines is the number of lines of context around the changes. If
+	// it's 0, DefaultDiffContextLines are used.
+	ContextLines int
+	// NoRenames disables the rename detection, so that a renamed file is
+	// diffed as a deleted and an added file.
+	NoRenames bool
+	// NoBinary leaves the contents of changed binary files out of the diff,
+	// which then only says that they differ. Such a diff can't be applied to
+	// a workspace again.
+	NoBinary bool
+}
+
+// args returns the options of git diff that produce the diff.
+//
+// ATTENTION: When you change the options here, be sure to also update the
+// ApplyDiff methods accordingly.
+func (o DiffOptions) args() []string {
+	// As of Sourcegraph 3.14 we only support unified diff format.
+	// That means we need to strip away the `a/` and `/b` prefixes with `--no-prefix`.
+	// See: https://github.com/sourcegraph/sourcegraph/blob/82d5e7e1562fef6be5c0b17f18631040fd330835/enterprise/internal/campaigns/service.go#L324-L329
+	args := []string{"--no-prefix"}
+	// We need to add --binary so binary file changes are inlined in the patch.
+	if !o.NoBinary {
+		args = append(args, "--binary")
+	}
+	if o.contextLines() != DefaultDiffContextLines {
+		args = append(args, fmt.Sprintf("--unified=%d", o.ContextLines))
+	}
+	if o.NoRenames {
+		args = append(args, "--no-renames")
+	}
+	return args
+}
+
+func (o DiffOptions) contextLines() int {
+	if o.ContextLines == 0 {
+		return DefaultDiffContextLines
+	}
+	return o.ContextLines
+}
+
+// CacheKey returns the part of a cache key that stands for the options, so
+// that results with different diffs aren't mixed up. It's empty for the
+// default options, which don't change the cache keys of existing results.
+func (o DiffOptions) CacheKey() string {
+	var parts []string
+	if o.contextLines() != DefaultDiffContextLines {
+		parts = append(parts, fmt.Sprintf("unified=%d", o.ContextLines))
+	}
+	if o.NoRenames {
+		parts = append(parts, "no-renames")
+	}
+	if o.NoBinary {
+		parts = append(parts, "no-binary")
+	}
+	return strings.Join(parts, " ")
+}
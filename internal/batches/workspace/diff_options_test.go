@@ -0,0 +1,20 @@
+package workspace
+
+import "testing"
+
+func TestDiffOptions_CacheKey(t *testing.T) {
+	for _, tc := range []struct {
+		opts DiffOptions
+		want string
+	}{
+		{opts: DiffOptions{}, want: ""},
+		{opts: DiffOptions{ContextLines: DefaultDiffContextLines}, want: ""},
+		{opts: DiffOptions{ContextLines: 10}, want: "unified=10"},
+		{opts: DiffOptions{ContextLines: 1, NoRenames: true, NoBinary: true}, want: "unified=1 no-renames no-binary"},
+		{opts: DiffOptions{NoBinary: true}, want: "no-binary"},
+	} {
+		if have := tc.opts.CacheKey(); have != tc.want {
+			t.Errorf("%+v: wrong cache key. want=%q, have=%q", tc.opts, tc.want, have)
+		}
+	}
+}
@@ -2,7 +2,9 @@ package workspace
 
 import (
 	"context"
+	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 
 	"github.com/sourcegraph/sourcegraph/lib/errors"
@@ -36,3 +38,33 @@ func runGitCmd(ctx context.Context, dir string, args ...string) ([]byte, error)
 	}
 	return out, nil
 }
+
+// cloneRepo fetches opts.Rev from opts.URL into a new repository in dir and
+// checks it out. The HEAD of the repository is opts.Rev, like the commit
+// prepareGitRepo makes of an archive, so that the diffs are computed the same
+// way.
+func cloneRepo(ctx context.Context, dir string, opts CloneOptions) error {
+	if _, err := runGitCmd(ctx, dir, "init", "--quiet"); err != nil {
+		return errors.Wrap(err, "git init failed")
+	}
+
+	// Unlike the other git commands, the fetch uses the environment and git
+	// configuration of the user, so that their credentials and proxy
+	// settings are used.
+	args := []string{"fetch", "--quiet", "--no-tags"}
+	if opts.Depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(opts.Depth))
+	}
+	args = append(args, "--", opts.URL, opts.Rev)
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "'git %s' failed: %s", strings.Join(args, " "), strings.TrimSpace(string(out)))
+	}
+
+	if _, err := runGitCmd(ctx, dir, "checkout", "--quiet", "--detach", "FETCH_HEAD"); err != nil {
+		return errors.Wrap(err, "git checkout failed")
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package workspace
+
+import (
+	"bytes"
+	"context"
+	"strings"
+
+	"github.com/sourcegraph/conc/pool"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+)
+
+// ParallelDiffer is implemented by Workspaces that can split the computation
+// of their diff across several git processes, which is faster for diffs that
+// change many files.
+type ParallelDiffer interface {
+	// ParallelDiff returns the same diff as Diff, byte for byte, computed by
+	// up to parallelism git processes at once.
+	ParallelDiff(ctx context.Context, opts DiffOptions, parallelism int) ([]byte, error)
+}
+
+// Diff returns the diff of ws, computed with opts. If parallelism is above 1
+// and ws is a ParallelDiffer, the diff is computed by up to parallelism git
+// processes.
+func Diff(ctx context.Context, ws Workspace, opts DiffOptions, parallelism int) ([]byte, error) {
+	if pd, ok := ws.(ParallelDiffer); ok && parallelism > 1 {
+		return pd.ParallelDiff(ctx, opts, parallelism)
+	}
+	return ws.Diff(ctx, opts)
+}
+
+// minParallelDiffFiles is the smallest number of changed files for which a
+// separate git process is started.
+const minParallelDiffFiles = 64
+
+var _ ParallelDiffer = &dockerBindWorkspace{}
+
+// ParallelDiff splits the changed files by directory into contiguous chunks
+// in the order of the diff, computes the diff of every chunk in a separate git
+// process and concatenates them. Since git diffs every file on its own, the
+// result is the same as the one of Diff, with one exception: renames pair
+// files that may end up in different chunks. If there are any, the diff is
+// computed by a single process, and otherwise the chunks are diffed without
+// rename detection, so that a chunk can't detect a rename that the complete
+// diff didn't.
+func (w *dockerBindWorkspace) ParallelDiff(ctx context.Context, opts DiffOptions, parallelism int) ([]byte, error) {
+	if _, err := runGitCmd(ctx, w.dir, "add", "--all"); err != nil {
+		return nil, errors.Wrap(err, "git add failed")
+	}
+
+	// The rename detection needs to match the one of Diff.
+	nameStatusArgs := []string{"diff", "--cached", "--name-status", "-z"}
+	if opts.NoRenames {
+		nameStatusArgs = append(nameStatusArgs, "--no-renames")
+	}
+	out, err := runGitCmd(ctx, w.dir, nameStatusArgs...)
+	if err != nil {
+		return nil, err
+	}
+	paths, renamed := parseNameStatus(out)
+	chunks := splitPaths(paths, parallelism)
+	if renamed || len(chunks) < 2 {
+		return runGitCmd(ctx, w.dir, append([]string{"diff", "--cached"}, opts.args()...)...)
+	}
+
+	diffs := make([][]byte, len(chunks))
+	p := pool.New().WithErrors().WithContext(ctx)
+	for i, chunk := range chunks {
+		p.Go(func(ctx context.Context) (err error) {
+			args := append([]string{"--literal-pathspecs", "diff", "--cached"}, opts.args()...)
+			args = append(args, "--no-renames", "--")
+			args = append(args, chunk...)
+			diffs[i], err = runGitCmd(ctx, w.dir, args...)
+			return err
+		})
+	}
+	if err := p.Wait(); err != nil {
+		return nil, err
+	}
+	return bytes.Join(diffs, nil), nil
+}
+
+// parseNameStatus returns the paths in the output of git diff --name-status
+// -z, and whether it contains renames or copies.
+func parseNameStatus(out []byte) (paths []string, renamed bool) {
+	fields := bytes.Split(bytes.TrimSuffix(out, []byte{0}), []byte{0})
+	for i := 0; i+1 < len(fields); i += 2 {
+		if status := fields[i]; len(status) > 0 && (status[0] == 'R' || status[0] == 'C') {
+			return nil, true
+		}
+		paths = append(paths, string(fields[i+1]))
+	}
+	return paths, false
+}
+
+// pathGroup is a set of changed files that are diffed together: either a
+// single file, or all changed files below a directory.
+type pathGroup struct {
+	// pathspec is the path of the file or directory.
+	pathspec string
+	files    int
+}
+
+// groupPaths groups paths, which are sorted like in the diff and start with
+// prefix, by their next path component. Directories with more than max
+// changed files are split up further.
+func groupPaths(paths []string, prefix string, max int) (groups []pathGroup) {
+	for len(paths) > 0 {
+		component, _, isDir := strings.Cut(strings.TrimPrefix(paths[0], prefix), "/")
+		// The paths below a directory are contiguous, since they share a
+		// prefix.
+		n := 1
+		if isDir {
+			dir := prefix + component + "/"
+			for n < len(paths) && strings.HasPrefix(paths[n], dir) {
+				n++
+			}
+			if n > max {
+				groups = append(groups, groupPaths(paths[:n], dir, max)...)
+				paths = paths[n:]
+				continue
+			}
+		}
+		groups = append(groups, pathGroup{pathspec: prefix + component, files: n})
+		paths = paths[n:]
+	}
+	return groups
+}
+
+// splitPaths splits paths, which are sorted like in the diff, into at most n
+// contiguous chunks of similar size, each with at least minParallelDiffFiles
+// paths if possible. The chunks are returned as pathspecs that match the
+// paths in them, which are far fewer than the paths if the changes are
+// concentrated in a few directories.
+func splitPaths(paths []string, n int) [][]string {
+	n = min(n, len(paths)/minParallelDiffFiles)
+	if n < 2 {
+		return nil
+	}
+
+	size := (len(paths) + n - 1) / n
+	var (
+		chunks [][]string
+		chunk  []string
+		files  int
+	)
+	for _, g := range groupPaths(paths, "", size) {
+		chunk = append(chunk, g.pathspec)
+		if files += g.files; files >= size {
+			chunks = append(chunks, chunk)
+			chunk, files = nil, 0
+		}
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
@@ -0,0 +1,204 @@
+package workspace
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// createLargeWorkspace creates a bind workspace of a repository with the given
+// number of files, spread across directories.
+func createLargeWorkspace(tb testing.TB, files int) *dockerBindWorkspace {
+	tb.Helper()
+
+	contents := make(map[string]string, files)
+	for i := range files {
+		contents[fmt.Sprintf("dir-%02d/file-%05d.txt", i%16, i)] = strings.Repeat(fmt.Sprintf("line of file %d\n", i), 50)
+	}
+	dir := tb.TempDir()
+	archivePath := zipUpFiles(tb, dir, contents)
+
+	creator := &dockerBindWorkspaceCreator{Dir: dir}
+	ws, err := creator.Create(context.Background(), repo, nil, &fakeRepoArchive{mockPath: archivePath})
+	if err != nil {
+		tb.Fatalf("unexpected error: %s", err)
+	}
+	return ws.(*dockerBindWorkspace)
+}
+
+// changeFiles appends a line to every nth file in ws.
+func changeFiles(tb testing.TB, ws *dockerBindWorkspace, files, nth int) {
+	tb.Helper()
+
+	for i := 0; i < files; i += nth {
+		p := filepath.Join(ws.dir, fmt.Sprintf("dir-%02d", i%16), fmt.Sprintf("file-%05d.txt", i))
+		f, err := os.OpenFile(p, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if _, err := f.WriteString("changed\n"); err != nil {
+			tb.Fatal(err)
+		}
+		f.Close()
+	}
+}
+
+func TestDockerBindWorkspace_ParallelDiff(t *testing.T) {
+	ctx := context.Background()
+	const files = 512
+
+	t.Run("changed, added and deleted files", func(t *testing.T) {
+		ws := createLargeWorkspace(t, files)
+		changeFiles(t, ws, files, 2)
+		if err := os.Remove(filepath.Join(ws.dir, "dir-01", "file-00001.txt")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(ws.dir, "dir-01", "new.bin"), []byte{0, 1, 2}, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		want, err := ws.Diff(ctx, DiffOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		have, err := ws.ParallelDiff(ctx, DiffOptions{}, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(string(want), string(have)); diff != "" {
+			t.Errorf("parallel diff differs (-serial +parallel):\n%s", diff)
+		}
+	})
+
+	t.Run("renamed file", func(t *testing.T) {
+		ws := createLargeWorkspace(t, files)
+		changeFiles(t, ws, files, 2)
+		// The rename pairs files at both ends of the diff.
+		if err := os.Rename(filepath.Join(ws.dir, "dir-01", "file-00001.txt"), filepath.Join(ws.dir, "zzz.txt")); err != nil {
+			t.Fatal(err)
+		}
+
+		want, err := ws.Diff(ctx, DiffOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(want), "rename to zzz.txt") {
+			t.Fatalf("diff doesn't contain the rename:\n%s", want)
+		}
+		have, err := ws.ParallelDiff(ctx, DiffOptions{}, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(string(want), string(have)); diff != "" {
+			t.Errorf("parallel diff differs (-serial +parallel):\n%s", diff)
+		}
+	})
+
+	t.Run("diff options", func(t *testing.T) {
+		ws := createLargeWorkspace(t, files)
+		changeFiles(t, ws, files, 2)
+		if err := os.Rename(filepath.Join(ws.dir, "dir-01", "file-00001.txt"), filepath.Join(ws.dir, "zzz.txt")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(ws.dir, "dir-01", "new.bin"), []byte{0, 1, 2}, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		opts := DiffOptions{ContextLines: 1, NoRenames: true, NoBinary: true}
+		want, err := ws.Diff(ctx, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, unwanted := range []string{"rename to zzz.txt", "GIT binary patch", "@@ -48,3 +48,4 @@"} {
+			if strings.Contains(string(want), unwanted) {
+				t.Errorf("diff contains %q", unwanted)
+			}
+		}
+		for _, wanted := range []string{"+++ zzz.txt", "Binary files /dev/null and dir-01/new.bin differ", "@@ -50 +50,2 @@"} {
+			if !strings.Contains(string(want), wanted) {
+				t.Errorf("diff doesn't contain %q", wanted)
+			}
+		}
+		have, err := ws.ParallelDiff(ctx, opts, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(string(want), string(have)); diff != "" {
+			t.Errorf("parallel diff differs (-serial +parallel):\n%s", diff)
+		}
+	})
+}
+
+func TestSplitPaths(t *testing.T) {
+	// The paths are sorted like in a diff.
+	var paths []string
+	for i := range 100 {
+		paths = append(paths, fmt.Sprintf("a/%03d", i))
+	}
+	for i := range 20 {
+		paths = append(paths, fmt.Sprintf("b/%03d", i))
+	}
+	paths = append(paths, "c.txt")
+	for i := range 80 {
+		paths = append(paths, fmt.Sprintf("d/e/%03d", i))
+	}
+
+	if chunks := splitPaths(paths[:2*minParallelDiffFiles-1], 2); chunks != nil {
+		t.Errorf("too few paths split into chunks: %v", chunks)
+	}
+
+	chunks := splitPaths(paths, 3)
+	var matched []string
+	var sizes []int
+	for _, chunk := range chunks {
+		n := 0
+		for _, p := range paths {
+			for _, spec := range chunk {
+				if p == spec || strings.HasPrefix(p, spec+"/") {
+					matched = append(matched, p)
+					n++
+				}
+			}
+		}
+		sizes = append(sizes, n)
+	}
+	if diff := cmp.Diff([]int{67, 67, 67}, sizes); diff != "" {
+		t.Errorf("wrong chunk sizes (-want +have):\n%s", diff)
+	}
+	if diff := cmp.Diff(paths, matched); diff != "" {
+		t.Errorf("chunks don't match the paths in order (-want +have):\n%s", diff)
+	}
+	// The directories that aren't split are matched as a whole.
+	if !slices.Contains(chunks[1], "b") || !slices.Contains(chunks[1], "c.txt") {
+		t.Errorf("b and c.txt not in the second chunk: %v", chunks[1])
+	}
+}
+
+func BenchmarkDockerBindWorkspace_Diff(b *testing.B) {
+	ctx := context.Background()
+	const files = 20000
+
+	ws := createLargeWorkspace(b, files)
+	changeFiles(b, ws, files, 2)
+	// Stage the changes once, so that the first benchmark doesn't include
+	// hashing the changed files.
+	if _, err := ws.Diff(ctx, DiffOptions{}); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, parallelism := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("parallelism=%d", parallelism), func(b *testing.B) {
+			for b.Loop() {
+				if _, err := Diff(ctx, ws, DiffOptions{}, parallelism); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -17,6 +17,7 @@ import (
 	"github.com/sourcegraph/src-cli/internal/batches/docker"
 	"github.com/sourcegraph/src-cli/internal/batches/graphql"
 	"github.com/sourcegraph/src-cli/internal/batches/repozip"
+	"github.com/sourcegraph/src-cli/internal/batches/util"
 	"github.com/sourcegraph/src-cli/internal/exec"
 	"github.com/sourcegraph/src-cli/internal/version"
 )
@@ -28,7 +29,11 @@ type dockerVolumeWorkspaceCreator struct {
 	EnsureImage imageEnsurer
 }
 
-var _ Creator = &dockerVolumeWorkspaceCreator{}
+var _ DirCreator = &dockerVolumeWorkspaceCreator{}
+
+func (wc *dockerVolumeWorkspaceCreator) InDir(dir string) Creator {
+	return &dockerVolumeWorkspaceCreator{tempDir: dir, EnsureImage: wc.EnsureImage}
+}
 
 func (wc *dockerVolumeWorkspaceCreator) Create(ctx context.Context, repo *graphql.Repository,
 	steps []batcheslib.Step, archive repozip.Archive) (ws Workspace, err error) {
@@ -39,6 +44,8 @@ func (wc *dockerVolumeWorkspaceCreator) Create(ctx context.Context, repo *graphq
 
 	defer func() {
 		if err != nil {
+			ctx, cancel := util.CleanupContext(ctx)
+			defer cancel()
 			deleteVolume(ctx, volume)
 		}
 	}()
@@ -238,23 +245,16 @@ func (w *dockerVolumeWorkspace) DockerRunOpts(ctx context.Context, target string
 
 func (w *dockerVolumeWorkspace) WorkDir() *string { return nil }
 
-func (w *dockerVolumeWorkspace) Diff(ctx context.Context) ([]byte, error) {
-	// As of Sourcegraph 3.14 we only support unified diff format.
-	// That means we need to strip away the `a/` and `/b` prefixes with `--no-prefix`.
-	// See: https://github.com/sourcegraph/sourcegraph/blob/82d5e7e1562fef6be5c0b17f18631040fd330835/enterprise/internal/campaigns/service.go#L324-L329
-	//
-	// Also, we need to add --binary so binary file changes are inlined in the patch.
-	//
-	// ATTENTION: When you change the options here, be sure to also update the
-	// ApplyDiff method accordingly.
-	script := `#!/bin/sh
+func (w *dockerVolumeWorkspace) Diff(ctx context.Context, opts DiffOptions) ([]byte, error) {
+	// The options are plain flags, so they don't need to be quoted.
+	script := fmt.Sprintf(`#!/bin/sh
 
 set -e
 # No set -x here, since we're going to parse the git status output.
 
 git add --all > /dev/null
-exec git diff --cached --no-prefix --binary
-`
+exec git diff --cached %s
+`, strings.Join(opts.args(), " "))
 
 	out, err := w.runScript(ctx, "/work", script)
 	if err != nil {
@@ -284,6 +284,41 @@ git add --all > /dev/null
 	return nil
 }
 
+func (w *dockerVolumeWorkspace) Snapshot(ctx context.Context) (string, error) {
+	// The snapshot is the tree of the index, so it doesn't need a commit.
+	script := `#!/bin/sh
+
+set -e
+
+git add --all > /dev/null
+exec git write-tree
+`
+
+	out, err := w.runScript(ctx, "/work", script)
+	if err != nil {
+		return "", errors.Wrapf(err, "git write-tree:\n\n%s", string(out))
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (w *dockerVolumeWorkspace) DiffSince(ctx context.Context, snapshot string, opts DiffOptions) ([]byte, error) {
+	script := fmt.Sprintf(`#!/bin/sh
+
+set -e
+
+git add --all > /dev/null
+exec git diff --cached %s %s
+`, strings.Join(opts.args(), " "), snapshot)
+
+	out, err := w.runScript(ctx, "/work", script)
+	if err != nil {
+		return nil, errors.Wrapf(err, "git diff:\n\n%s", string(out))
+	}
+
+	return out, nil
+}
+
 // DockerVolumeWorkspaceImage is the Docker image we'll run our unzip and git
 // commands in. This needs to match the name defined in
 // .github/workflows/docker.yml.
@@ -482,7 +482,7 @@ index 06471f4..5f9d3fa 100644
 					),
 				)
 
-				have, err := w.Diff(ctx)
+				have, err := w.Diff(ctx, DiffOptions{})
 				if err != nil {
 					t.Errorf("unexpected error: %v", err)
 				}
@@ -509,7 +509,7 @@ index 06471f4..5f9d3fa 100644
 			),
 		)
 
-		if _, err := w.Diff(ctx); err == nil {
+		if _, err := w.Diff(ctx, DiffOptions{}); err == nil {
 			t.Error("unexpected nil error")
 		}
 	})
@@ -20,6 +20,37 @@ type Creator interface {
 	Create(ctx context.Context, repo *graphql.Repository, steps []batcheslib.Step, archive repozip.Archive) (Workspace, error)
 }
 
+// DirCreator is implemented by Creators that keep the files of their
+// workspaces in a directory on the host.
+type DirCreator interface {
+	Creator
+	// InDir returns a copy of the Creator that keeps the files of its
+	// workspaces in dir.
+	InDir(dir string) Creator
+}
+
+// CloneOptions configure the git clone CloneCreator.CreateClone creates a
+// workspace from.
+type CloneOptions struct {
+	// URL is the URL the repository is cloned from.
+	URL string
+	// Rev is the commit that's checked out.
+	Rev string
+	// Depth is the number of commits of history that are fetched, starting
+	// at Rev. 0 fetches the full history.
+	Depth int
+}
+
+// CloneCreator is implemented by Creators that can create workspaces from a
+// git clone of the repository instead of an archive, so that the history of
+// the repository is available to the steps.
+type CloneCreator interface {
+	Creator
+	// CreateClone creates a new workspace for the given repository by
+	// cloning it.
+	CreateClone(ctx context.Context, repo *graphql.Repository, steps []batcheslib.Step, opts CloneOptions) (Workspace, error)
+}
+
 // Workspace implementations manage per-changeset storage when executing batch
 // change steps.
 type Workspace interface {
@@ -38,13 +69,22 @@ type Workspace interface {
 	// delete the workspace when Close is called.
 	Close(ctx context.Context) error
 
-	// Diff should return the total diff for the workspace. This may be called
-	// multiple times in the life of a workspace.
-	Diff(ctx context.Context) ([]byte, error)
+	// Diff should return the total diff for the workspace, computed with the
+	// given options. This may be called multiple times in the life of a
+	// workspace.
+	Diff(ctx context.Context, opts DiffOptions) ([]byte, error)
 
 	// ApplyDiff applies the given diff to the current workspace. Used when replaying
 	// a cache entry onto the workspace.
 	ApplyDiff(ctx context.Context, diff []byte) error
+
+	// Snapshot records the current state of the workspace and returns an ID
+	// that can be passed to DiffSince.
+	Snapshot(ctx context.Context) (string, error)
+
+	// DiffSince returns the diff between the state recorded by Snapshot and
+	// the current state of the workspace, in the format of Diff.
+	DiffSince(ctx context.Context, snapshot string, opts DiffOptions) ([]byte, error)
 }
 
 type CreatorType int
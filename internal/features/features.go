@@ -16,12 +16,15 @@ type FeatureFlags struct {
 	Sourcegraph70 bool
 }
 
-func (ff *FeatureFlags) SetFromVersion(version string, skipErrors bool) error {
-	for _, feature := range []struct {
-		flag       *bool
-		constraint string
-		minDate    string
-	}{
+type featureFlag struct {
+	name       string
+	flag       *bool
+	constraint string
+	minDate    string
+}
+
+func (ff *FeatureFlags) flags() []featureFlag {
+	return []featureFlag{
 		// NOTE: It's necessary to include a "-0" prerelease suffix on each constraint so that
 		// prereleases of future versions are still considered to satisfy the constraint.
 		//
@@ -30,11 +33,15 @@ func (ff *FeatureFlags) SetFromVersion(version string, skipErrors bool) error {
 		// "3.23.0-0". See
 		// https://github.com/Masterminds/semver#working-with-prerelease-versions for more.
 		// Example usage:
-		// {&ff.FlagName, ">= 3.23.0-0", "2020-11-24"},
-		{&ff.Sourcegraph40, ">= 4.0.0-0", "2022-08-24"},
-		{&ff.BinaryDiffs, ">= 4.3.0-0", "2022-11-29"},
-		{&ff.Sourcegraph70, ">= 7.0.0-0", "2026-02-25"},
-	} {
+		// {"FlagName", &ff.FlagName, ">= 3.23.0-0", "2020-11-24"},
+		{"Sourcegraph40", &ff.Sourcegraph40, ">= 4.0.0-0", "2022-08-24"},
+		{"BinaryDiffs", &ff.BinaryDiffs, ">= 4.3.0-0", "2022-11-29"},
+		{"Sourcegraph70", &ff.Sourcegraph70, ">= 7.0.0-0", "2026-02-25"},
+	}
+}
+
+func (ff *FeatureFlags) SetFromVersion(version string, skipErrors bool) error {
+	for _, feature := range ff.flags() {
 		value, err := api.CheckSourcegraphVersion(version, feature.constraint, feature.minDate)
 		if err != nil {
 			if skipErrors {
@@ -48,3 +55,15 @@ func (ff *FeatureFlags) SetFromVersion(version string, skipErrors bool) error {
 
 	return nil
 }
+
+// Enabled returns the names of the enabled feature flags, so that a run can
+// report which behaviour it used.
+func (ff *FeatureFlags) Enabled() []string {
+	var enabled []string
+	for _, feature := range ff.flags() {
+		if *feature.flag {
+			enabled = append(enabled, feature.name)
+		}
+	}
+	return enabled
+}
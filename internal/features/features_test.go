@@ -0,0 +1,23 @@
+package features
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFeatureFlags_Enabled(t *testing.T) {
+	for version, want := range map[string][]string{
+		"3.43.0": nil,
+		"4.3.0":  {"Sourcegraph40", "BinaryDiffs"},
+		"7.0.1":  {"Sourcegraph40", "BinaryDiffs", "Sourcegraph70"},
+	} {
+		var ffs FeatureFlags
+		if err := ffs.SetFromVersion(version, false); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, ffs.Enabled()); diff != "" {
+			t.Errorf("version %s: wrong enabled flags (-want +have):\n%s", version, diff)
+		}
+	}
+}
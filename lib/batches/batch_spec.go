@@ -1,15 +1,25 @@
 package batches
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"maps"
+	"path"
+	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/sourcegraph/sourcegraph/lib/batches/env"
+	"github.com/sourcegraph/sourcegraph/lib/batches/git"
 	"github.com/sourcegraph/sourcegraph/lib/batches/overridable"
 	"github.com/sourcegraph/sourcegraph/lib/batches/schema"
 	"github.com/sourcegraph/sourcegraph/lib/batches/template"
 	"github.com/sourcegraph/sourcegraph/lib/batches/yaml"
 	"github.com/sourcegraph/sourcegraph/lib/errors"
+
+	yamlv3 "gopkg.in/yaml.v3"
 )
 
 // Some general notes about the struct definitions below.
@@ -29,15 +39,45 @@ import (
 //    pointers, which is ugly and inefficient.
 
 type BatchSpec struct {
-	Version           int                      `json:"version,omitempty" yaml:"version"`
-	Name              string                   `json:"name,omitempty" yaml:"name"`
-	Description       string                   `json:"description,omitempty" yaml:"description"`
-	On                []OnQueryOrRepository    `json:"on,omitempty" yaml:"on"`
-	Workspaces        []WorkspaceConfiguration `json:"workspaces,omitempty"  yaml:"workspaces"`
-	Steps             []Step                   `json:"steps,omitempty" yaml:"steps"`
-	TransformChanges  *TransformChanges        `json:"transformChanges,omitempty" yaml:"transformChanges,omitempty"`
-	ImportChangesets  []ImportChangeset        `json:"importChangesets,omitempty" yaml:"importChangesets"`
-	ChangesetTemplate *ChangesetTemplate       `json:"changesetTemplate,omitempty" yaml:"changesetTemplate"`
+	Version     int                      `json:"version,omitempty" yaml:"version"`
+	Name        string                   `json:"name,omitempty" yaml:"name"`
+	Description string                   `json:"description,omitempty" yaml:"description"`
+	On          []OnQueryOrRepository    `json:"on,omitempty" yaml:"on"`
+	Workspaces  []WorkspaceConfiguration `json:"workspaces,omitempty"  yaml:"workspaces"`
+	// Precondition is evaluated for every workspace before its repository is
+	// fetched. Workspaces for which it isn't "true" are skipped.
+	Precondition string `json:"precondition,omitempty" yaml:"precondition,omitempty"`
+	Steps        []Step `json:"steps,omitempty" yaml:"steps"`
+	// Finally are executed after Steps in every workspace, whether Steps
+	// succeeded or not, to clean up after them. Their changes aren't part of
+	// the diff, and they can't mount paths or make commits.
+	Finally []Step `json:"finally,omitempty" yaml:"finally,omitempty"`
+	// Checkout, if set, makes the workspaces git clones of their repository
+	// instead of unpacked archives without history.
+	Checkout          *Checkout          `json:"checkout,omitempty" yaml:"checkout,omitempty"`
+	TransformChanges  *TransformChanges  `json:"transformChanges,omitempty" yaml:"transformChanges,omitempty"`
+	ImportChangesets  []ImportChangeset  `json:"importChangesets,omitempty" yaml:"importChangesets"`
+	ChangesetTemplate *ChangesetTemplate `json:"changesetTemplate,omitempty" yaml:"changesetTemplate"`
+}
+
+// DefaultCheckoutURL is the URL repositories are cloned from if Checkout.URL
+// isn't set. Repository names on Sourcegraph usually start with the host of
+// the code host, which makes it a valid clone URL for many of them.
+const DefaultCheckoutURL = "https://${{ repository.name }}.git"
+
+// Checkout makes the workspaces git clones of their repository, checked out
+// at the revision the archive would have been fetched at, so that steps can
+// use the history of the repository, such as with git log or git blame.
+// Cloning is slower and takes more disk space than unpacking an archive,
+// especially with the full history, so it should only be used by batch
+// changes that need the history.
+type Checkout struct {
+	// URL is the URL the repository is cloned from. It's rendered as a
+	// template with the repository, and defaults to DefaultCheckoutURL.
+	URL string `json:"url,omitempty" yaml:"url,omitempty"`
+	// Depth is the number of commits of history that are fetched, starting
+	// at the revision. 0 fetches the full history.
+	Depth int `json:"depth,omitempty" yaml:"depth,omitempty"`
 }
 
 type ChangesetTemplate struct {
@@ -47,6 +87,10 @@ type ChangesetTemplate struct {
 	Fork      *bool                        `json:"fork,omitempty" yaml:"fork"`
 	Commit    ExpandedGitCommitDescription `json:"commit" yaml:"commit"`
 	Published *overridable.BoolOrString    `json:"published" yaml:"published"`
+	// UpdateBranch makes the steps run on, and the changes be committed on
+	// top of, the existing head branch of the changeset if it exists,
+	// instead of the base branch.
+	UpdateBranch bool `json:"updateBranch,omitempty" yaml:"updateBranch"`
 }
 
 type GitCommitAuthor struct {
@@ -90,13 +134,86 @@ func (oqor *OnQueryOrRepository) GetBranches() ([]string, error) {
 }
 
 type Step struct {
-	Run       string            `json:"run,omitempty" yaml:"run"`
-	Container string            `json:"container,omitempty" yaml:"container"`
-	Env       env.Environment   `json:"env" yaml:"env"`
-	Files     map[string]string `json:"files,omitempty" yaml:"files,omitempty"`
-	Outputs   Outputs           `json:"outputs,omitempty" yaml:"outputs,omitempty"`
-	Mount     []Mount           `json:"mount,omitempty" yaml:"mount,omitempty"`
-	If        any               `json:"if,omitempty" yaml:"if,omitempty"`
+	// Run is a shell script that is run with /bin/bash, or /bin/sh if the
+	// image doesn't contain bash. Exactly one of Run and Command is set.
+	Run string `json:"run,omitempty" yaml:"run"`
+	// Command is run as is, without a shell: the first element is the
+	// executable and the rest are its arguments. Each element is rendered as
+	// a template.
+	Command []string `json:"command,omitempty" yaml:"command,omitempty"`
+	// Entrypoint, if set, is the executable and leading arguments the step is
+	// run with in the container. The path of the script of Run is passed to it
+	// instead of to the shell, and all elements of Command are appended to it.
+	// It's ignored by the local runner, like Container.
+	Entrypoint []string          `json:"entrypoint,omitempty" yaml:"entrypoint,omitempty"`
+	Container  string            `json:"container,omitempty" yaml:"container"`
+	Env        env.Environment   `json:"env" yaml:"env"`
+	Files      map[string]string `json:"files,omitempty" yaml:"files,omitempty"`
+	Outputs    Outputs           `json:"outputs,omitempty" yaml:"outputs,omitempty"`
+	Mount      []Mount           `json:"mount,omitempty" yaml:"mount,omitempty"`
+	If         any               `json:"if,omitempty" yaml:"if,omitempty"`
+	// WorkingDir is the directory, relative to the workspace, in which Run is
+	// executed. The diff produced by the step is still relative to the
+	// repository root.
+	WorkingDir string `json:"workingDir,omitempty" yaml:"workingDir,omitempty"`
+	// Stdin is rendered as a template and fed to the standard input of Run.
+	Stdin string `json:"stdin,omitempty" yaml:"stdin,omitempty"`
+	// Network is the network mode of the container: "default" or "none".
+	Network string `json:"network,omitempty" yaml:"network,omitempty"`
+	// CPUs and Memory limit the resources the container can use. Memory uses
+	// the format of `docker run --memory`, e.g. "512m".
+	CPUs   float64 `json:"cpus,omitempty" yaml:"cpus,omitempty"`
+	Memory string  `json:"memory,omitempty" yaml:"memory,omitempty"`
+	// Timeout is the maximum duration of the step, in the format of
+	// time.ParseDuration. It applies in addition to the timeout of the
+	// workspace.
+	Timeout string `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	// SuccessExitCodes are the exit codes of Run or Command that count as
+	// success. If it's empty, only 0 does.
+	SuccessExitCodes []int `json:"successExitCodes,omitempty" yaml:"successExitCodes,omitempty"`
+	// Secrets are the names of secrets that are set as environment variables
+	// in the container. Their values are resolved when the step is executed
+	// and aren't part of the batch spec or the cache.
+	Secrets []string `json:"secrets,omitempty" yaml:"secrets,omitempty"`
+	// Commit, if set, makes the changes of the step, and of the steps before
+	// it since the last step with a Commit, a separate commit.
+	Commit *StepCommit `json:"commit,omitempty" yaml:"commit,omitempty"`
+}
+
+// StepCommit is the commit a step makes of its changes. Message and the
+// fields of Author are rendered as step templates.
+type StepCommit struct {
+	Message string `json:"message" yaml:"message"`
+	// Author defaults to the author of the changesetTemplate. Its Date isn't
+	// supported.
+	Author *GitCommitAuthor `json:"author,omitempty" yaml:"author,omitempty"`
+}
+
+// StepNetworkNone is the Step.Network mode in which the container has no
+// network access.
+const StepNetworkNone = "none"
+
+// IsSuccessExitCode returns whether the step succeeded if it exited with code.
+func (s *Step) IsSuccessExitCode(code int) bool {
+	if len(s.SuccessExitCodes) == 0 {
+		return code == 0
+	}
+	return slices.Contains(s.SuccessExitCodes, code)
+}
+
+// ParsedTimeout returns the Timeout of the step, or 0 if it has none.
+func (s *Step) ParsedTimeout() (time.Duration, error) {
+	if s.Timeout == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s.Timeout)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, errors.Newf("timeout %q must be positive", s.Timeout)
+	}
+	return d, nil
 }
 
 func (s *Step) IfCondition() string {
@@ -118,6 +235,30 @@ type Outputs map[string]Output
 type Output struct {
 	Value  string `json:"value,omitempty" yaml:"value,omitempty"`
 	Format string `json:"format,omitempty" yaml:"format,omitempty"`
+	// SkipChangeset makes the output decide whether a changeset is created
+	// for the workspace: if its value is "skip" or "true" after all steps
+	// have been executed, no changeset is created, even if the steps changed
+	// the workspace.
+	SkipChangeset bool `json:"skipChangeset,omitempty" yaml:"skipChangeset,omitempty"`
+	// Changesets makes the output declare additional changesets, in other
+	// repositories than the one of the workspace: its value, in the json or
+	// yaml format, is a list of objects with the repository, branch, title,
+	// body, commit message and diff of every changeset.
+	Changesets bool `json:"changesets,omitempty" yaml:"changesets,omitempty"`
+}
+
+// SkipsChangeset returns whether value, the value of an Output with
+// SkipChangeset set, signals that no changeset should be created.
+func (o Output) SkipsChangeset(value any) bool {
+	if !o.SkipChangeset {
+		return false
+	}
+	switch v := strings.TrimSpace(fmt.Sprint(value)); v {
+	case "skip", "true":
+		return true
+	default:
+		return false
+	}
 }
 
 type TransformChanges struct {
@@ -167,7 +308,106 @@ func parseBatchSpec(schema string, data []byte) (*BatchSpec, error) {
 		errs = errors.Append(errs, NewValidationError(errors.New("batch spec includes steps but no changesetTemplate")))
 	}
 
-	for i, step := range spec.Steps {
+	if spec.ChangesetTemplate != nil {
+		errs = errors.Append(errs, validateChangesetTemplate(spec.ChangesetTemplate))
+		// Only the changeset on the branch of the template has its head
+		// branch resolved before execution.
+		if spec.ChangesetTemplate.UpdateBranch && spec.TransformChanges != nil && len(spec.TransformChanges.Group) > 0 {
+			errs = errors.Append(errs, NewValidationError(errors.New("changesetTemplate.updateBranch can't be combined with transformChanges.group")))
+		}
+	}
+
+	errs = errors.Append(errs, validateSteps(spec.Steps))
+	errs = errors.Append(errs, validateFinallySteps(spec.Finally))
+
+	if spec.TransformChanges != nil && len(spec.TransformChanges.Group) > 0 && slices.ContainsFunc(spec.Steps, func(s Step) bool { return s.Commit != nil }) {
+		errs = errors.Append(errs, NewValidationError(errors.New("transformChanges can't be used with steps that set a commit")))
+	}
+
+	return &spec, errs
+}
+
+// ParseSteps parses steps from r, so that they can be generated by other
+// programs instead of being part of a batch spec. r contains YAML or JSON
+// that's either a list of steps, or an object with the steps and the
+// changesetTemplate fields of a batch spec. The changeset template is nil if
+// it isn't given. The steps are validated like the ones in a batch spec.
+func ParseSteps(r io.Reader) ([]Step, *ChangesetTemplate, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "reading steps")
+	}
+
+	// Errors of the YAML parser contain the line number.
+	var doc any
+	if err := yamlv3.Unmarshal(data, &doc); err != nil {
+		return nil, nil, err
+	}
+
+	// The steps are validated with the batch spec schema, as part of a
+	// batch spec with a placeholder name.
+	spec := map[string]any{"name": "steps"}
+	switch doc := doc.(type) {
+	case nil:
+	case []any:
+		spec["steps"] = doc
+	case map[string]any:
+		for key, value := range doc {
+			if key != "steps" && key != "changesetTemplate" {
+				return nil, nil, NewValidationError(errors.Newf("unknown field %q: only steps and changesetTemplate can be given", key))
+			}
+			spec[key] = value
+		}
+	default:
+		return nil, nil, NewValidationError(errors.New("steps must be a list of steps, or an object with steps and changesetTemplate"))
+	}
+	normalized, err := json.Marshal(spec)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "normalizing steps")
+	}
+
+	var parsed BatchSpec
+	if err := yaml.UnmarshalValidate(schema.BatchSpecJSON, normalized, &parsed); err != nil {
+		var multiErr errors.MultiError
+		if errors.As(err, &multiErr) {
+			var errs error
+			for _, e := range multiErr.Errors() {
+				errs = errors.Append(errs, NewValidationError(e))
+			}
+			return nil, nil, errs
+		}
+		return nil, nil, err
+	}
+
+	var errs error
+	if parsed.ChangesetTemplate != nil {
+		errs = errors.Append(errs, validateChangesetTemplate(parsed.ChangesetTemplate))
+	}
+	errs = errors.Append(errs, validateSteps(parsed.Steps))
+	return parsed.Steps, parsed.ChangesetTemplate, errs
+}
+
+// validateFinallySteps checks the finally steps of a batch spec. They're
+// validated like steps, but their changes are discarded, so they can't make
+// commits, and they can't mount paths, which are only uploaded for steps.
+func validateFinallySteps(steps []Step) (errs error) {
+	for i, step := range steps {
+		if step.Commit != nil {
+			errs = errors.Append(errs, NewValidationError(errors.Newf("finally step %d can't set a commit", i+1)))
+		}
+		if len(step.Mount) > 0 {
+			errs = errors.Append(errs, NewValidationError(errors.Newf("finally step %d can't mount paths", i+1)))
+		}
+	}
+	if err := validateSteps(steps); err != nil {
+		errs = errors.Append(errs, errors.Wrap(err, "finally"))
+	}
+	return errs
+}
+
+// validateSteps checks the fields of steps that the schema can't check.
+func validateSteps(steps []Step) (errs error) {
+	for i, step := range steps {
 		for _, mount := range step.Mount {
 			if strings.ContainsAny(mount.Path, invalidMountCharacters) {
 				errs = errors.Append(errs, NewValidationError(errors.Newf("step %d mount path contains invalid characters", i+1)))
@@ -176,14 +416,55 @@ func parseBatchSpec(schema string, data []byte) (*BatchSpec, error) {
 				errs = errors.Append(errs, NewValidationError(errors.Newf("step %d mount mountpoint contains invalid characters", i+1)))
 			}
 		}
+		if _, err := step.ParsedTimeout(); err != nil {
+			errs = errors.Append(errs, NewValidationError(errors.Wrapf(err, "step %d has an invalid timeout", i+1)))
+		}
+		if step.WorkingDir != "" {
+			if path.IsAbs(step.WorkingDir) || !filepath.IsLocal(filepath.FromSlash(step.WorkingDir)) {
+				errs = errors.Append(errs, NewValidationError(errors.Newf("step %d workingDir must be a relative path inside the workspace", i+1)))
+			}
+		}
 		for name := range step.Files {
 			if strings.ContainsAny(name, invalidMountCharacters) {
 				errs = errors.Append(errs, NewValidationError(errors.Newf("step %d files target path contains invalid characters", i+1)))
 			}
+			if !path.IsAbs(name) && !filepath.IsLocal(filepath.FromSlash(name)) {
+				errs = errors.Append(errs, NewValidationError(errors.Newf("step %d files path %q must be absolute, or a relative path inside the workspace", i+1, name)))
+			}
 		}
 	}
+	return errs
+}
 
-	return &spec, errs
+// validateChangesetTemplate checks the fields of the changesetTemplate that
+// would otherwise only fail after execution, when the changeset specs are
+// built.
+func validateChangesetTemplate(ct *ChangesetTemplate) (errs error) {
+	fields := map[string]string{
+		"title":          ct.Title,
+		"body":           ct.Body,
+		"branch":         ct.Branch,
+		"commit.message": ct.Commit.Message,
+	}
+	if ct.Commit.Author != nil {
+		fields["commit.author.name"] = ct.Commit.Author.Name
+		fields["commit.author.email"] = ct.Commit.Author.Email
+	}
+	for _, name := range slices.Sorted(maps.Keys(fields)) {
+		if err := template.ValidateChangesetTemplateField(name, fields[name]); err != nil {
+			errs = errors.Append(errs, NewValidationError(err))
+		}
+	}
+
+	// Templated branch names can only be checked once they're rendered, and
+	// references to environment variables once they're expanded.
+	if !strings.Contains(ct.Branch, "${{") && !strings.Contains(ct.Branch, "${env:") {
+		if err := git.ValidateBranchName(ct.Branch); err != nil {
+			errs = errors.Append(errs, NewValidationError(errors.Wrap(err, "changesetTemplate.branch")))
+		}
+	}
+
+	return errs
 }
 
 // docker uses Golang's `encoding/csv` library to parse arguments passed to `--mount`
@@ -1,6 +1,8 @@
 package batches
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"reflect"
 	"strconv"
@@ -122,6 +124,55 @@ func (c *ChangesetSpec) MarshalJSON() ([]byte, error) {
 	return json.Marshal(&v)
 }
 
+// ContentHashVersion is hashed as the first byte of every content hash. Bump
+// it whenever the representation hashed by ContentHash changes, which changes
+// the hashes of all changeset specs.
+const ContentHashVersion byte = 1
+
+// contentHashInput is the canonical representation of a ChangesetSpec that
+// is hashed by ContentHash. encoding/json serializes struct fields in the
+// order they are declared here, so the representation is deterministic.
+type contentHashInput struct {
+	Repository string
+	ExternalID string
+	Branch     string
+	Title      string
+	Body       string
+	Commits    []contentHashCommit
+}
+
+type contentHashCommit struct {
+	Message string
+	Diff    []byte
+}
+
+// ContentHash returns a hash of the effective content of the changeset spec:
+// its repository, branch, title, body, and the messages and diffs of its
+// commits. It doesn't depend on the machine or the version of src that
+// computed it, so that changeset specs with the same content can be
+// recognized across runs. The diffs of the commits must be loaded.
+func (c *ChangesetSpec) ContentHash() (string, error) {
+	input := contentHashInput{
+		Repository: c.BaseRepository,
+		ExternalID: c.ExternalID,
+		Branch:     c.HeadRef,
+		Title:      c.Title,
+		Body:       c.Body,
+	}
+	for _, commit := range c.Commits {
+		input.Commits = append(input.Commits, contentHashCommit{Message: commit.Message, Diff: commit.Diff})
+	}
+	raw, err := json.Marshal(input)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write([]byte{ContentHashVersion})
+	h.Write(raw)
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
 type GitCommitDescription struct {
 	Version     int    `json:"version,omitempty"`
 	Message     string `json:"message,omitempty"`
@@ -32,6 +32,10 @@ type ChangesetSpecInput struct {
 	TransformChanges      *TransformChanges               `json:"-"`
 	Path                  string
 
+	// BodyFooter is a changeset template that's rendered and appended to the
+	// body of every changeset, unless the body already contains it.
+	BodyFooter string `json:"-"`
+
 	Result execution.AfterStepResult
 }
 
@@ -53,6 +57,7 @@ func BuildChangesetSpecs(input *ChangesetSpecInput, binaryDiffs bool, fallbackAu
 			Branch:      strings.TrimPrefix(input.Repository.BaseRef, "refs/heads/"),
 			FileMatches: input.Repository.FileMatches,
 		},
+		Diff: input.Result.Diff,
 	}
 
 	var author ChangesetSpecAuthor
@@ -69,11 +74,11 @@ func BuildChangesetSpecs(input *ChangesetSpecInput, binaryDiffs bool, fallbackAu
 		}
 	} else {
 		var err error
-		author.Name, err = template.RenderChangesetTemplateField("authorName", input.Template.Commit.Author.Name, tmplCtx)
+		author.Name, err = template.RenderChangesetTemplateField("commit.author.name", input.Template.Commit.Author.Name, tmplCtx)
 		if err != nil {
 			return nil, err
 		}
-		author.Email, err = template.RenderChangesetTemplateField("authorEmail", input.Template.Commit.Author.Email, tmplCtx)
+		author.Email, err = template.RenderChangesetTemplateField("commit.author.email", input.Template.Commit.Author.Email, tmplCtx)
 		if err != nil {
 			return nil, err
 		}
@@ -89,7 +94,15 @@ func BuildChangesetSpecs(input *ChangesetSpecInput, binaryDiffs bool, fallbackAu
 		return nil, err
 	}
 
-	message, err := template.RenderChangesetTemplateField("message", input.Template.Commit.Message, tmplCtx)
+	if input.BodyFooter != "" {
+		footer, err := template.RenderChangesetTemplateField("body footer", input.BodyFooter, tmplCtx)
+		if err != nil {
+			return nil, err
+		}
+		body = appendBodyFooter(body, footer)
+	}
+
+	message, err := template.RenderChangesetTemplateField("commit.message", input.Template.Commit.Message, tmplCtx)
 	if err != nil {
 		return nil, err
 	}
@@ -102,7 +115,34 @@ func BuildChangesetSpecs(input *ChangesetSpecInput, binaryDiffs bool, fallbackAu
 		return nil, err
 	}
 
-	newSpec := func(branch string, diff []byte) *ChangesetSpec {
+	// The head branch was resolved before the steps were executed, so the
+	// changes are only committed on top of it if it's still the same branch.
+	if input.Template.UpdateBranch {
+		headBranch, err := RenderHeadBranch(input.Template, input.BatchChangeAttributes, input.Repository)
+		if err != nil {
+			return nil, err
+		}
+		if headBranch != defaultBranch {
+			return nil, errors.Newf("changesetTemplate.branch can only depend on the batch change and the repository if changesetTemplate.updateBranch is set, but it's %q before and %q after executing the steps", headBranch, defaultBranch)
+		}
+	}
+
+	version := 1
+	if binaryDiffs {
+		version = 2
+	}
+
+	newCommit := func(message string, author ChangesetSpecAuthor, diff []byte) GitCommitDescription {
+		return GitCommitDescription{
+			Version:     version,
+			Message:     message,
+			AuthorName:  author.Name,
+			AuthorEmail: author.Email,
+			Diff:        diff,
+		}
+	}
+
+	newSpec := func(branch string, commits []GitCommitDescription) *ChangesetSpec {
 		var published any = nil
 		if input.Template.Published != nil {
 			published = input.Template.Published.ValueWithSuffix(input.Repository.Name, branch)
@@ -110,30 +150,17 @@ func BuildChangesetSpecs(input *ChangesetSpecInput, binaryDiffs bool, fallbackAu
 
 		fork := input.Template.Fork
 
-		version := 1
-		if binaryDiffs {
-			version = 2
-		}
-
 		return &ChangesetSpec{
 			BaseRepository: input.Repository.ID,
 			HeadRepository: input.Repository.ID,
 			BaseRef:        input.Repository.BaseRef,
 			BaseRev:        input.Repository.BaseRev,
 
-			HeadRef: git.EnsureRefPrefix(branch),
-			Title:   title,
-			Body:    body,
-			Fork:    fork,
-			Commits: []GitCommitDescription{
-				{
-					Version:     version,
-					Message:     message,
-					AuthorName:  author.Name,
-					AuthorEmail: author.Email,
-					Diff:        diff,
-				},
-			},
+			HeadRef:   git.EnsureRefPrefix(branch),
+			Title:     title,
+			Body:      body,
+			Fork:      fork,
+			Commits:   commits,
 			Published: PublishedValue{Val: published},
 		}
 	}
@@ -141,6 +168,28 @@ func BuildChangesetSpecs(input *ChangesetSpecInput, binaryDiffs bool, fallbackAu
 	var specs []*ChangesetSpec
 
 	groups := groupsForRepository(input.Repository.Name, input.TransformChanges)
+
+	// Steps that set a commit made their own commits. The changes after the
+	// last of them are committed with the commit of the template.
+	if len(input.Result.Commits) > 0 {
+		if len(groups) != 0 {
+			return specs, errors.New("transformChanges can't be used with steps that set a commit")
+		}
+
+		commits := make([]GitCommitDescription, 0, len(input.Result.Commits)+1)
+		for _, c := range input.Result.Commits {
+			commitAuthor := author
+			if c.AuthorName != "" || c.AuthorEmail != "" {
+				commitAuthor = ChangesetSpecAuthor{Name: c.AuthorName, Email: c.AuthorEmail}
+			}
+			commits = append(commits, newCommit(c.Message, commitAuthor, c.Diff))
+		}
+		if len(input.Result.UncommittedDiff) > 0 {
+			commits = append(commits, newCommit(message, author, input.Result.UncommittedDiff))
+		}
+		return append(specs, newSpec(defaultBranch, commits)), nil
+	}
+
 	if len(groups) != 0 {
 		err := validateGroups(input.Repository.Name, input.Template.Branch, groups)
 		if err != nil {
@@ -154,17 +203,35 @@ func BuildChangesetSpecs(input *ChangesetSpecInput, binaryDiffs bool, fallbackAu
 		}
 
 		for branch, diff := range diffsByBranch {
-			spec := newSpec(branch, diff)
+			spec := newSpec(branch, []GitCommitDescription{newCommit(message, author, diff)})
 			specs = append(specs, spec)
 		}
 	} else {
-		spec := newSpec(defaultBranch, input.Result.Diff)
+		spec := newSpec(defaultBranch, []GitCommitDescription{newCommit(message, author, input.Result.Diff)})
 		specs = append(specs, spec)
 	}
 
 	return specs, nil
 }
 
+// RenderHeadBranch renders the branch of the changeset template for the given
+// repository with only the batch change and repository in the template
+// context, as it is before the steps are executed.
+func RenderHeadBranch(tmpl *ChangesetTemplate, attrs *template.BatchChangeAttributes, repo Repository) (string, error) {
+	branch, err := template.RenderChangesetTemplateField("branch", tmpl.Branch, &template.ChangesetTemplateContext{
+		BatchChangeAttributes: *attrs,
+		Repository: template.Repository{
+			Name:        repo.Name,
+			Branch:      strings.TrimPrefix(repo.BaseRef, "refs/heads/"),
+			FileMatches: repo.FileMatches,
+		},
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "changesetTemplate.branch can only depend on the batch change and the repository if changesetTemplate.updateBranch is set")
+	}
+	return branch, nil
+}
+
 type RepoFetcher func(context.Context, []string) (map[string]string, error)
 
 func BuildImportChangesetSpecs(ctx context.Context, importChangesets []ImportChangeset, repoFetcher RepoFetcher) (specs []*ChangesetSpec, errs error) {
@@ -308,3 +375,15 @@ func groupFileDiffs(completeDiff []byte, defaultBranch string, groups []Group) (
 	}
 	return finalDiffsByBranch, nil
 }
+
+// appendBodyFooter appends footer to body, separated by an empty line. If body
+// already contains footer, it's returned as is.
+func appendBodyFooter(body, footer string) string {
+	if footer == "" || strings.Contains(body, footer) {
+		return body
+	}
+	if body == "" {
+		return footer
+	}
+	return body + "\n\n" + footer
+}
@@ -6,10 +6,11 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"slices"
 	"sort"
-	"time"
 
 	"github.com/sourcegraph/sourcegraph/lib/batches"
+	"github.com/sourcegraph/sourcegraph/lib/batches/env"
 	"github.com/sourcegraph/sourcegraph/lib/batches/execution"
 	"github.com/sourcegraph/sourcegraph/lib/batches/template"
 	"github.com/sourcegraph/sourcegraph/lib/errors"
@@ -20,11 +21,17 @@ type Cache interface {
 	Set(ctx context.Context, key Keyer, result execution.AfterStepResult) error
 
 	Clear(ctx context.Context, key Keyer) error
+	// ClearScope clears all entries whose Keyer has the given scope, and
+	// keeps the entries of other scopes.
+	ClearScope(ctx context.Context, scope string) error
 }
 
 type Keyer interface {
 	Key() (string, error)
 	Slug() string
+	// Scope is the name of the batch change the key belongs to, if any, so
+	// that the entries of a batch change can be cleared together.
+	Scope() string
 }
 
 // MetadataRetriever retrieves mount metadata.
@@ -35,9 +42,10 @@ type MetadataRetriever interface {
 
 // MountMetadata is the metadata of a file that is mounted by a Step.
 type MountMetadata struct {
-	Path     string
-	Size     int64
-	Modified time.Time
+	Path string
+	// Hash is the hex encoded SHA-256 of the contents of the file. Unlike its
+	// size and modification time, it changes whenever the contents change.
+	Hash string
 }
 
 func (key CacheKey) mountsMetadata() ([]MountMetadata, error) {
@@ -69,23 +77,61 @@ func resolveStepsEnvironment(globalEnv []string, steps []batches.Step) ([]map[st
 	return envs, nil
 }
 
+// KeyVersion is hashed as the first byte of every cache key. Bump it whenever
+// the representation hashed by marshalAndHash changes in a way that isn't
+// backwards compatible, which invalidates all existing cache entries.
+const KeyVersion byte = 1
+
+// keyInput is the canonical representation of a CacheKey that is hashed. Only
+// the fields that can affect the result of executing the steps are included.
+// encoding/json serializes struct fields in the order they are declared here
+// and sorts map keys, so the representation is deterministic.
+type keyInput struct {
+	Repository            batches.Repository
+	Path                  string
+	OnlyFetchWorkspace    bool
+	Steps                 []batches.Step
+	BatchChangeAttributes *template.BatchChangeAttributes
+	StepIndex             int
+
+	// Environments are the resolved environments of the steps, so that
+	// changes to unrelated environment variables don't affect the key.
+	Environments []map[string]string
+	// MountsMetadata is sorted by path.
+	MountsMetadata []MountMetadata `json:"MountsMetadata,omitempty"`
+	Runner         string          `json:"Runner,omitempty"`
+	DiffOptions    string          `json:"DiffOptions,omitempty"`
+	Checkout       string          `json:"Checkout,omitempty"`
+}
+
+// marshalAndHash computes the SHA256 of KeyVersion followed by the JSON
+// encoding of the keyInput of key, and returns the first 16 bytes of it,
+// base64 encoded.
 func marshalAndHash(key *CacheKey, envs []map[string]string, metadata []MountMetadata) (string, error) {
-	raw, err := json.Marshal(struct {
-		*CacheKey
-		Environments []map[string]string
-		// Omit if empty to be backwards compatible.
-		MountsMetadata []MountMetadata `json:"MountsMetadata,omitempty"`
-	}{
-		CacheKey:       key,
-		Environments:   envs,
-		MountsMetadata: metadata,
+	metadata = slices.Clone(metadata)
+	sort.SliceStable(metadata, func(i, j int) bool { return metadata[i].Path < metadata[j].Path })
+
+	raw, err := json.Marshal(keyInput{
+		Repository:            key.Repository,
+		Path:                  key.Path,
+		OnlyFetchWorkspace:    key.OnlyFetchWorkspace,
+		Steps:                 key.Steps,
+		BatchChangeAttributes: key.BatchChangeAttributes,
+		StepIndex:             key.StepIndex,
+		Environments:          envs,
+		MountsMetadata:        metadata,
+		Runner:                key.Runner,
+		DiffOptions:           key.DiffOptions,
+		Checkout:              key.Checkout,
 	})
 	if err != nil {
 		return "", err
 	}
 
-	hash := sha256.Sum256(raw)
-	return base64.RawURLEncoding.EncodeToString(hash[:16]), nil
+	h := sha256.New()
+	h.Write([]byte{KeyVersion})
+	h.Write(raw)
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:16]), nil
 }
 
 // CacheKey implements the Keyer interface for a batch spec execution in a
@@ -102,12 +148,24 @@ type CacheKey struct {
 	MetadataRetriever MetadataRetriever `json:"-"`
 	// Ignore from serialization.
 	GlobalEnv []string `json:"-"`
+	// Runner is the way the steps are executed, if it's not the default of
+	// executing them in containers. Steps executed on the host can have
+	// different results.
+	Runner string
+	// DiffOptions are the options the diffs are computed with, if they're
+	// not the defaults.
+	DiffOptions string
+	// Checkout is how the repository is checked out, if it's cloned instead
+	// of unpacked from an archive. Steps can see the history of clones.
+	Checkout string
 
 	StepIndex int
 }
 
 // Key converts the key into a string form that can be used to uniquely identify
-// the cache key in a more concise form than the entire Task.
+// the cache key in a more concise form than the entire Task. The key only
+// changes if the inputs of the steps up to StepIndex change, or if KeyVersion
+// is bumped.
 func (key CacheKey) Key() (string, error) {
 	// Setup a copy of the cache key that only includes the Steps up to and
 	// including key.StepIndex.
@@ -119,7 +177,9 @@ func (key CacheKey) Key() (string, error) {
 	if err != nil {
 		return "", err
 	}
-	metadata, err := key.mountsMetadata()
+	// Only the mounts of the subset of Steps can affect the result, so that
+	// appending a step with a mount doesn't invalidate the previous steps.
+	metadata, err := clone.mountsMetadata()
 	if err != nil {
 		return "", err
 	}
@@ -131,10 +191,75 @@ func (key CacheKey) Key() (string, error) {
 	return fmt.Sprintf("%s-step-%d", hash, key.StepIndex), err
 }
 
+// Components returns a hash of each of the inputs of Key, by name, so that
+// the inputs that changed can be told apart when a key changes, such as
+// "revision" or "step 2 run". Every step up to StepIndex has the components
+// "step N container", "step N run" and "step N env", counting from 1, and
+// "step N" for its other fields. The hashes are only comparable to the ones
+// of the same KeyVersion.
+func (key CacheKey) Components() (map[string]string, error) {
+	steps := key.Steps[0 : key.StepIndex+1]
+	envs, err := resolveStepsEnvironment(key.GlobalEnv, steps)
+	if err != nil {
+		return nil, err
+	}
+	clone := key
+	clone.Steps = steps
+	metadata, err := clone.mountsMetadata()
+	if err != nil {
+		return nil, err
+	}
+	metadata = slices.Clone(metadata)
+	sort.SliceStable(metadata, func(i, j int) bool { return metadata[i].Path < metadata[j].Path })
+
+	repo := key.Repository
+	repo.BaseRev = ""
+	inputs := map[string]any{
+		"revision":             key.Repository.BaseRev,
+		"repository":           repo,
+		"path":                 key.Path,
+		"only fetch workspace": key.OnlyFetchWorkspace,
+		"batch change":         key.BatchChangeAttributes,
+		"mounts":               metadata,
+		"runner":               key.Runner,
+		"diff options":         key.DiffOptions,
+		"checkout":             key.Checkout,
+	}
+	for i, step := range steps {
+		name := fmt.Sprintf("step %d", i+1)
+		inputs[name+" container"] = step.Container
+		inputs[name+" run"] = step.Run
+		inputs[name+" env"] = envs[i]
+		step.Container, step.Run, step.Env = "", "", env.Environment{}
+		inputs[name] = step
+	}
+
+	components := make(map[string]string, len(inputs))
+	for name, input := range inputs {
+		raw, err := json.Marshal(input)
+		if err != nil {
+			return nil, errors.Wrapf(err, "hashing %s", name)
+		}
+		h := sha256.New()
+		h.Write([]byte{KeyVersion})
+		h.Write(raw)
+		components[name] = base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:8])
+	}
+	return components, nil
+}
+
 func (key CacheKey) Slug() string {
 	return SlugForRepo(key.Repository.Name, key.Repository.BaseRev)
 }
 
+// Scope returns the name of the batch change, which is also part of Key.
+func (key CacheKey) Scope() string {
+	if key.BatchChangeAttributes == nil {
+		return ""
+	}
+	return key.BatchChangeAttributes.Name
+}
+
 func KeyForWorkspace(batchChangeAttributes *template.BatchChangeAttributes, r batches.Repository, path string, globalEnv []string, onlyFetchWorkspace bool, steps []batches.Step, stepIndex int, retriever MetadataRetriever) Keyer {
 	sort.Strings(r.FileMatches)
 
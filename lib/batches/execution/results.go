@@ -24,6 +24,22 @@ type AfterStepResult struct {
 	Outputs map[string]any `json:"outputs"`
 	// Skipped determines whether the step was skipped.
 	Skipped bool `json:"skipped"`
+	// Commits are the commits made by the steps up to and including the
+	// Step, in order. Only steps that set a commit make commits.
+	Commits []Commit `json:"commits,omitempty"`
+	// UncommittedDiff is the diff of the changes made after the last of the
+	// Commits. It's only set if there are Commits.
+	UncommittedDiff []byte `json:"uncommittedDiff,omitempty"`
+}
+
+// Commit is a commit made by a step of the changes since the previous commit.
+type Commit struct {
+	// StepIndex is the index of the step that made the commit.
+	StepIndex   int    `json:"stepIndex"`
+	Message     string `json:"message"`
+	AuthorName  string `json:"authorName,omitempty"`
+	AuthorEmail string `json:"authorEmail,omitempty"`
+	Diff        []byte `json:"diff"`
 }
 
 func (a AfterStepResult) MarshalJSON() ([]byte, error) {
@@ -37,6 +53,9 @@ func (a AfterStepResult) MarshalJSON() ([]byte, error) {
 		StepIndex:    a.StepIndex,
 		Diff:         string(a.Diff),
 		Outputs:      a.Outputs,
+
+		Commits:         a.Commits,
+		UncommittedDiff: a.UncommittedDiff,
 	})
 }
 
@@ -58,6 +77,8 @@ func (a *AfterStepResult) UnmarshalJSON(data []byte) error {
 		a.Diff = v2.Diff
 		a.Outputs = v2.Outputs
 		a.Skipped = v2.Skipped
+		a.Commits = v2.Commits
+		a.UncommittedDiff = v2.UncommittedDiff
 		return nil
 	}
 	var v1 v1AfterStepResult
@@ -70,6 +91,8 @@ func (a *AfterStepResult) UnmarshalJSON(data []byte) error {
 	a.StepIndex = v1.StepIndex
 	a.Diff = []byte(v1.Diff)
 	a.Outputs = v1.Outputs
+	a.Commits = v1.Commits
+	a.UncommittedDiff = v1.UncommittedDiff
 	return nil
 }
 
@@ -86,6 +109,9 @@ type v2AfterStepResult struct {
 	Diff         []byte         `json:"diff"`
 	Outputs      map[string]any `json:"outputs"`
 	Skipped      bool           `json:"skipped"`
+
+	Commits         []Commit `json:"commits,omitempty"`
+	UncommittedDiff []byte   `json:"uncommittedDiff,omitempty"`
 }
 
 type v1AfterStepResult struct {
@@ -95,4 +121,7 @@ type v1AfterStepResult struct {
 	StepIndex    int            `json:"stepIndex"`
 	Diff         string         `json:"diff"`
 	Outputs      map[string]any `json:"outputs"`
+
+	Commits         []Commit `json:"commits,omitempty"`
+	UncommittedDiff []byte   `json:"uncommittedDiff,omitempty"`
 }
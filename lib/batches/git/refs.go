@@ -1,6 +1,10 @@
 package git
 
-import "strings"
+import (
+	"strings"
+
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+)
 
 func EnsureRefPrefix(ref string) string {
 	if strings.HasPrefix(ref, "refs/heads/") {
@@ -8,3 +12,36 @@ func EnsureRefPrefix(ref string) string {
 	}
 	return "refs/heads/" + ref
 }
+
+// ValidateBranchName returns an error if name isn't a valid branch name
+// according to the rules of git check-ref-format.
+func ValidateBranchName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("branch name is empty")
+	case name == "@":
+		return errors.New("branch name cannot be \"@\"")
+	case strings.HasPrefix(name, "-"):
+		return errors.Newf("branch name %q cannot start with \"-\"", name)
+	case strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/"):
+		return errors.Newf("branch name %q cannot start or end with \"/\"", name)
+	case strings.HasSuffix(name, "."):
+		return errors.Newf("branch name %q cannot end with \".\"", name)
+	case strings.Contains(name, "..") || strings.Contains(name, "//") || strings.Contains(name, "@{"):
+		return errors.Newf("branch name %q cannot contain \"..\", \"//\" or \"@{\"", name)
+	}
+
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(" ~^:?*[\\", r) {
+			return errors.Newf("branch name %q contains invalid character %q", name, r)
+		}
+	}
+
+	for component := range strings.SplitSeq(name, "/") {
+		if strings.HasPrefix(component, ".") || strings.HasSuffix(component, ".lock") {
+			return errors.Newf("branch name %q cannot have components starting with \".\" or ending with \".lock\"", name)
+		}
+	}
+
+	return nil
+}
@@ -35,7 +35,10 @@ type rule struct {
 	patternSuffix string
 
 	compiled glob.Glob
-	value    any
+	// compiledSuffix is the patternSuffix compiled as a glob pattern, or nil
+	// if there is no suffix.
+	compiledSuffix glob.Glob
+	value          any
 }
 
 // newRule builds a new rule instance, ensuring that the glob pattern
@@ -53,16 +56,33 @@ func newRule(pattern string, value any) (*rule, error) {
 		return nil, err
 	}
 
+	var compiledSuffix glob.Glob
+	if suffix != "" {
+		if compiledSuffix, err = glob.Compile(suffix); err != nil {
+			return nil, err
+		}
+	}
+
 	return &rule{
-		pattern:       pattern,
-		patternSuffix: suffix,
-		compiled:      compiled,
-		value:         value,
+		pattern:        pattern,
+		patternSuffix:  suffix,
+		compiled:       compiled,
+		compiledSuffix: compiledSuffix,
+		value:          value,
 	}, nil
 }
 
 func (a rule) Equal(b rule) bool {
-	return a.pattern == b.pattern && a.value == b.value
+	return a.pattern == b.pattern && a.patternSuffix == b.patternSuffix && a.value == b.value
+}
+
+// fullPattern returns the pattern the rule was built from, including the
+// pattern suffix.
+func (a rule) fullPattern() string {
+	if a.patternSuffix == "" {
+		return a.pattern
+	}
+	return a.pattern + "@" + a.patternSuffix
 }
 
 type rules []*rule
@@ -79,18 +99,24 @@ func (r rules) Match(name string) any {
 }
 
 // MatchWithSuffix matches the given repository name against all rules and the
-// suffix against provided pattern suffix, returning the rule value that matches
-// at last, or nil if none match.
+// suffix, such as a branch name, against the pattern suffix of the rules,
+// returning the rule value that matches at last, or nil if none match. Rules
+// without a pattern suffix match every suffix. A pattern suffix matches if
+// it's equal to the suffix, or if it's a glob pattern that matches it.
 func (r rules) MatchWithSuffix(name, suffix string) any {
 	// We want the last match to win, so we'll iterate in reverse order.
 	for i := len(r) - 1; i >= 0; i-- {
-		if r[i].compiled.Match(name) && (r[i].patternSuffix == "" || r[i].patternSuffix == suffix) {
+		if r[i].compiled.Match(name) && r[i].matchSuffix(suffix) {
 			return r[i].value
 		}
 	}
 	return nil
 }
 
+func (r *rule) matchSuffix(suffix string) bool {
+	return r.patternSuffix == "" || r.patternSuffix == suffix || r.compiledSuffix.Match(suffix)
+}
+
 // MarshalJSON marshalls the bool into its JSON representation, which will
 // either be a literal or an array of objects.
 func (r rules) MarshalJSON() ([]byte, error) {
@@ -101,7 +127,7 @@ func (r rules) MarshalJSON() ([]byte, error) {
 	rules := []map[string]any{}
 	for _, rule := range r {
 		rules = append(rules, map[string]any{
-			rule.pattern: rule.value,
+			rule.fullPattern(): rule.value,
 		})
 	}
 	return json.Marshal(rules)
@@ -1,4 +1,8 @@
 // Code generated by stringdata. DO NOT EDIT.
+//
+// This copy has local changes that aren't in the upstream schema yet. They are
+// listed in dev/lib-schema-changes.md, so they can be reapplied when it's
+// regenerated.
 
 package schema
 
@@ -120,6 +124,11 @@ const BatchSpecJSON = `{
         }
       }
     },
+    "precondition": {
+      "type": "string",
+      "description": "A condition that is evaluated for every workspace before its repository is fetched. Workspaces for which it doesn't evaluate to 'true' are skipped. Supports the templating variables repository.name, repository.branch, repository.search_result_paths, steps.path and batch_change.",
+      "examples": ["${{ matches repository.name \"github.com/my-org/*\" }}"]
+    },
     "steps": {
       "type": ["array", "null"],
       "description": "The sequence of commands to run (for each repository branch matched in the ` + "`" + `on` + "`" + ` property) to produce the workspace changes that will be included in the batch change.",
@@ -128,11 +137,26 @@ const BatchSpecJSON = `{
         "type": "object",
         "description": "A command to run (as part of a sequence) in a repository branch to produce the required changes.",
         "additionalProperties": false,
-        "required": ["run", "container"],
+        "required": ["container"],
+        "oneOf": [{ "required": ["run"] }, { "required": ["command"] }],
         "properties": {
           "run": {
             "type": "string",
-            "description": "The shell command to run in the container. It can also be a multi-line shell script. The working directory is the root directory of the repository checkout."
+            "description": "The shell command to run in the container. It can also be a multi-line shell script. It is run with /bin/bash, or /bin/sh if the image doesn't contain bash. The working directory is the root directory of the repository checkout. Exactly one of run and command is required."
+          },
+          "command": {
+            "type": "array",
+            "description": "The command to run in the container, without a shell: the first element is the executable and the rest are its arguments, passed exactly as given. Each element is rendered as a template. Exactly one of run and command is required.",
+            "items": { "type": "string" },
+            "minItems": 1,
+            "examples": [["comby", "-in-place", "fmt.Sprintf(\"%d\", :[v])", "strconv.Itoa(:[v])", ".go"]]
+          },
+          "entrypoint": {
+            "type": "array",
+            "description": "The executable and leading arguments the step is run with in the container. The path of the run script is passed to it instead of to the shell, and all elements of command are appended to it, so that the image's own entrypoint can wrap them, or the script can be run with another interpreter. Ignored by the local runner.",
+            "items": { "type": "string" },
+            "minItems": 1,
+            "examples": [["/docker-entrypoint.sh", "bash"], ["python3"]]
           },
           "container": {
             "type": "string",
@@ -156,6 +180,16 @@ const BatchSpecJSON = `{
                   "type": "string",
                   "description": "The expected format of the output. If set, the output is being parsed in that format before being stored in the var. If not set, 'text' is assumed to the format.",
                   "enum": ["json", "yaml", "text"]
+                },
+                "skipChangeset": {
+                  "type": "boolean",
+                  "description": "If true, no changeset is created for the workspace if the value of the output is 'skip' or 'true' after all steps have been executed, even if the steps changed files.",
+                  "default": false
+                },
+                "changesets": {
+                  "type": "boolean",
+                  "description": "If true, the value of the output, in the json or yaml format, is a list of additional changesets to create in other repositories, such as a shared configuration repository. Every item has a repository, branch, title, body, message and diff.",
+                  "default": false
                 }
               }
             }
@@ -195,9 +229,46 @@ const BatchSpecJSON = `{
               }
             ]
           },
+          "commit": {
+            "type": "object",
+            "description": "Makes the changes of this step, and of the steps before it since the last step with a commit, a separate Git commit of the changeset. Changes of the steps after the last step with a commit are committed with the commit of the changesetTemplate.",
+            "additionalProperties": false,
+            "required": ["message"],
+            "properties": {
+              "message": {
+                "type": "string",
+                "description": "The Git commit message. It's rendered as a template, like run."
+              },
+              "author": {
+                "type": "object",
+                "description": "The author of the Git commit. If omitted, the author of the changesetTemplate is used.",
+                "additionalProperties": false,
+                "required": ["name", "email"],
+                "properties": {
+                  "name": {
+                    "type": "string",
+                    "description": "The Git commit author name."
+                  },
+                  "email": {
+                    "type": "string",
+                    "format": "email",
+                    "description": "The Git commit author email."
+                  }
+                }
+              }
+            }
+          },
+          "secrets": {
+            "type": "array",
+            "description": "The names of secrets that are set as environment variables in the container. Their values are resolved when the step is executed, and aren't part of the cache key, so changing them doesn't invalidate cached results.",
+            "items": {
+              "type": "string",
+              "pattern": "^[A-Za-z_][A-Za-z0-9_]*$"
+            }
+          },
           "files": {
             "type": ["object", "null"],
-            "description": "Files that should be mounted into or be created inside the Docker container.",
+            "description": "Files that should be mounted into or be created inside the Docker container. Files with relative paths are created in the workspace before the step is executed, and are only part of the diff if the step changes them.",
             "additionalProperties": {
               "type": "string"
             }
@@ -222,6 +293,50 @@ const BatchSpecJSON = `{
               "${{ eq previous_step.stdout \"success\" }}"
             ]
           },
+          "workingDir": {
+            "type": "string",
+            "description": "The directory, relative to the workspace, in which the shell command is run. The resulting diff is still relative to the repository root.",
+            "examples": ["cmd/server", "client/web"]
+          },
+          "stdin": {
+            "type": "string",
+            "description": "The standard input of the shell command. Can use templating variables, like the shell command itself.",
+            "examples": ["${{ outputs.patch }}", "${{ repository.name }}"]
+          },
+          "network": {
+            "type": "string",
+            "description": "The network access of the Docker container. With 'none', the container has no network access, so the shell command can't download dependencies. Defaults to 'default'.",
+            "enum": ["default", "none"]
+          },
+          "cpus": {
+            "type": "number",
+            "description": "The number of CPUs the Docker container can use at most.",
+            "exclusiveMinimum": 0,
+            "examples": [0.5, 2]
+          },
+          "memory": {
+            "type": "string",
+            "description": "The memory the Docker container can use at most, as a number with an optional unit of b, k, m or g. The step fails if it exceeds the limit.",
+            "pattern": "^[0-9]+[bkmgBKMG]?$",
+            "examples": ["512m", "4g"]
+          },
+          "timeout": {
+            "type": "string",
+            "description": "The maximum duration of the step, such as 2m or 1h30m. The step fails if it takes longer, even if the timeout of the whole workspace hasn't been reached yet.",
+            "examples": ["2m", "30m"]
+          },
+          "successExitCodes": {
+            "type": "array",
+            "description": "The exit codes of the step that count as success, for tools that exit with a non-zero code to signal that they found something. Defaults to [0].",
+            "items": {
+              "type": "integer",
+              "minimum": 0,
+              "maximum": 255
+            },
+            "minItems": 1,
+            "uniqueItems": true,
+            "examples": [[0, 1]]
+          },
           "mount": {
             "description": "Files that are mounted to the Docker container.",
             "type": ["array", "null"],
@@ -246,6 +361,29 @@ const BatchSpecJSON = `{
         }
       }
     },
+    "finally": {
+      "type": ["array", "null"],
+      "description": "Steps that are executed in every workspace after the steps, whether they succeeded or failed, to clean up after them, for example to stop a service or to remove a credential. Their changes aren't part of the batch change, and they can't mount paths or set a commit. If a finally step fails, the workspace fails, but the error of a failed step takes precedence.",
+      "items": { "$ref": "#/properties/steps/items" }
+    },
+    "checkout": {
+      "type": ["object", "null"],
+      "description": "If set, every workspace is a git clone of its repository at the revision, instead of the files of the repository without history, so that steps can use the history, for example with git log or git blame. Cloning is slower and takes more disk space than fetching the files, especially with the full history. The repositories are cloned with the git configuration and credentials of the user running src.",
+      "additionalProperties": false,
+      "properties": {
+        "url": {
+          "type": "string",
+          "description": "The URL the repository is cloned from. Supports the templating variable repository.name. Defaults to https://${{ repository.name }}.git.",
+          "examples": ["git@${{ repository.name }}.git"]
+        },
+        "depth": {
+          "type": "integer",
+          "description": "The number of commits of history to fetch, starting at the revision. 0 fetches the full history.",
+          "minimum": 0,
+          "default": 0
+        }
+      }
+    },
     "transformChanges": {
       "type": ["object", "null"],
       "description": "Optional transformations to apply to the changes produced in each repository.",
@@ -333,6 +471,10 @@ const BatchSpecJSON = `{
           "type": "boolean",
           "description": "Whether to publish the changeset to a fork of the target repository. If omitted, the changeset will be published to a branch directly on the target repository, unless the global ` + "`" + `batches.enforceFork` + "`" + ` setting is enabled. If set, this property will override any global setting."
         },
+        "updateBranch": {
+          "type": "boolean",
+          "description": "Whether to run the steps on the existing head branch of the changeset and commit the changes on top of it, instead of recreating the branch from the base branch. If the branch doesn't exist yet, it's created from the base branch. The branch may only depend on the batch change and the repository, so that it's the same in every run."
+        },
         "commit": {
           "title": "ExpandedGitCommitDescription",
           "type": "object",
@@ -387,7 +529,7 @@ const BatchSpecJSON = `{
               "description": "A list of glob patterns to match repository names. In the event multiple patterns match, the last matching pattern in the list will be used.",
               "items": {
                 "type": "object",
-                "description": "An object with one field: the key is the glob pattern to match against repository names; the value will be used as the published flag for matching repositories.",
+                "description": "An object with one field: the key is the glob pattern to match against repository names, optionally followed by @ and a glob pattern to match against the branch of the changeset, such as github.com/my-org/*@experimental-*; the value will be used as the published flag for matching changesets.",
                 "additionalProperties": {
                   "oneOf": [
                     {
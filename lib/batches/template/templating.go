@@ -11,6 +11,8 @@ import (
 	"github.com/gobwas/glob"
 	"github.com/grafana/regexp"
 
+	godiff "github.com/sourcegraph/go-diff/diff"
+
 	"github.com/sourcegraph/sourcegraph/lib/batches/execution"
 	"github.com/sourcegraph/sourcegraph/lib/batches/git"
 	"github.com/sourcegraph/sourcegraph/lib/errors"
@@ -118,6 +120,22 @@ func EvalStepCondition(condition string, stepCtx *StepContext) (bool, error) {
 	return isTrueOutput(&out), nil
 }
 
+// EvalPrecondition evaluates the precondition of a batch spec. Since no step
+// has been executed yet, only the repository, the path of the workspace and the
+// batch change are set in stepCtx.
+func EvalPrecondition(condition string, stepCtx *StepContext) (bool, error) {
+	if condition == "" {
+		return true, nil
+	}
+
+	var out bytes.Buffer
+	if err := RenderStepTemplate("precondition", condition, &out, stepCtx); err != nil {
+		return false, errors.Wrap(err, "evaluating precondition")
+	}
+
+	return isTrueOutput(&out), nil
+}
+
 func RenderStepTemplate(name, tmpl string, out io.Writer, stepCtx *StepContext) error {
 	// By default, text/template will continue even if it encounters a key that is not
 	// indexed in any of the provided `FuncMap`s, replacing the variable with "<no
@@ -272,12 +290,59 @@ type ChangesetTemplateContext struct {
 
 	// Repository is the repository in which the steps were executed.
 	Repository Repository
+
+	// Diff is the cumulative diff produced by all steps. It's used to compute
+	// the diff_stat variable.
+	Diff []byte
+}
+
+// DiffStat summarizes the size of a diff.
+type DiffStat struct {
+	FilesChanged int
+	Insertions   int
+	Deletions    int
+}
+
+// computeDiffStat parses the given diff and sums up the changed lines the
+// same way `git diff --stat` does.
+func computeDiffStat(rawDiff []byte) (DiffStat, error) {
+	var stat DiffStat
+	if len(rawDiff) == 0 {
+		return stat, nil
+	}
+
+	fileDiffs, err := godiff.ParseMultiFileDiff(rawDiff)
+	if err != nil {
+		return stat, errors.Wrap(err, "parsing diff")
+	}
+
+	stat.FilesChanged = len(fileDiffs)
+	for _, fd := range fileDiffs {
+		s := fd.Stat()
+		stat.Insertions += int(s.Added + s.Changed)
+		stat.Deletions += int(s.Deleted + s.Changed)
+	}
+
+	return stat, nil
 }
 
 // ToFuncMap returns a template.FuncMap to access fields on the StepContext in a
 // text/template.
 func (tmplCtx *ChangesetTemplateContext) ToFuncMap() template.FuncMap {
 	return template.FuncMap{
+		// diff_stat is computed lazily, since most templates don't use it and
+		// parsing large diffs isn't free.
+		"diff_stat": func() (map[string]any, error) {
+			stat, err := computeDiffStat(tmplCtx.Diff)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]any{
+				"files_changed": stat.FilesChanged,
+				"insertions":    stat.Insertions,
+				"deletions":     stat.Deletions,
+			}, nil
+		},
 		"repository": func() map[string]any {
 			return map[string]any{
 				"search_result_paths": tmplCtx.Repository.SearchResultPaths(),
@@ -310,6 +375,15 @@ func (tmplCtx *ChangesetTemplateContext) ToFuncMap() template.FuncMap {
 	}
 }
 
+// ValidateChangesetTemplateField checks that the given changeset template
+// field parses, and only uses known templating variables, without rendering it.
+func ValidateChangesetTemplateField(name, tmpl string) error {
+	if _, err := New(name, tmpl, "missingkey=error", (&ChangesetTemplateContext{}).ToFuncMap()); err != nil {
+		return errors.Wrapf(err, "parsing changeset template field %q", name)
+	}
+	return nil
+}
+
 func RenderChangesetTemplateField(name, tmpl string, tmplCtx *ChangesetTemplateContext) (string, error) {
 	var out bytes.Buffer
 
@@ -323,11 +397,11 @@ func RenderChangesetTemplateField(name, tmpl string, tmplCtx *ChangesetTemplateC
 	// "missingkey=error". See https://pkg.go.dev/text/template#Template.Option for more.
 	t, err := New(name, tmpl, "missingkey=error", tmplCtx.ToFuncMap())
 	if err != nil {
-		return "", err
+		return "", errors.Wrapf(err, "parsing changeset template field %q", name)
 	}
 
 	if err := t.Execute(&out, tmplCtx); err != nil {
-		return "", err
+		return "", errors.Wrapf(err, "rendering changeset template field %q", name)
 	}
 
 	return strings.TrimSpace(out.String()), nil